@@ -0,0 +1,72 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptedTypes returns the quality of each media type an Accept header
+// names, leaving out those it rules out with q=0.
+func acceptedTypes(accept string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > 0 {
+			accepted[mediaType] = q
+		}
+	}
+	return accepted
+}
+
+// acceptsJSON reports whether an Accept header allows an application/json
+// response. A missing header accepts anything.
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for mediaType := range acceptedTypes(accept) {
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// prefersBinaryList reports whether an Accept header asks for the list as
+// binaryListContentType: it must name the type, wildcards don't count, with
+// at least the quality of application/json.
+func prefersBinaryList(accept string) bool {
+	accepted := acceptedTypes(accept)
+	q, ok := accepted[binaryListContentType]
+	return ok && q >= accepted["application/json"]
+}
+
+// requireAcceptableType answers 406 to requests whose Accept header rules out
+// JSON, the only type the external endpoints produce besides the binary
+// list. It is a no-op unless --strict-accept is set, in which case clients
+// sending e.g. only "Accept: application/xml" are told so instead of
+// silently receiving JSON.
+func requireAcceptableType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		if r.URL.Path == "/" && prefersBinaryList(accept) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cf.StrictAccept && !acceptsJSON(accept) {
+			writeJSONError(w, http.StatusNotAcceptable, "not_acceptable", "only application/json responses are available")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                 true,
+		"application/json":                 true,
+		"application/json; charset=utf-8":  true,
+		"application/*":                    true,
+		"*/*":                              true,
+		"text/html, */*;q=0.1":             true,
+		"application/xml":                  false,
+		"text/html, application/xhtml+xml": false,
+		"application/json;q=0":             false,
+		"not a media type":                 false,
+	} {
+		if got := acceptsJSON(accept); got != want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+// serveWithAccept sends a GET for worker with the given Accept header
+// through the external handler chain's content negotiation.
+func serveWithAccept(accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/worker?ttl=1m", nil)
+	r.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	requireAcceptableType(externalRouter()).ServeHTTP(w, r)
+	return w
+}
+
+func TestStrictAccept(t *testing.T) {
+	setupTest(t, "--strict-accept")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectError(t, serveWithAccept("application/xml"), http.StatusNotAcceptable, "not_acceptable")
+	expectStatus(t, serveWithAccept("application/xml, application/json"), http.StatusOK)
+}
+
+func TestLenientAccept(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	w := serveWithAccept("application/xml")
+	expectStatus(t, w, http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON to be returned anyway, got %q", ct)
+	}
+}
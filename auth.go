@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// apiKey is an --api-key entry: a bearer token that may only write the
+// heartbeats whose path starts with prefix.
+type apiKey struct {
+	token  string
+	prefix string
+}
+
+// apiKeys holds the parsed --api-key entries.
+var apiKeys []apiKey
+
+// parseAPIKeys parses entries of the form "token=prefix". The prefix follows
+// the last =, so base64 padding can stay in the token. Errors leave the
+// token out so it doesn't end up in logs.
+func parseAPIKeys(values []string) ([]apiKey, error) {
+	var parsed []apiKey
+	for i, v := range values {
+		sep := strings.LastIndex(v, "=")
+		if sep <= 0 || sep == len(v)-1 {
+			return nil, fmt.Errorf("invalid --api-key entry %d, expected token=prefix", i+1)
+		}
+		parsed = append(parsed, apiKey{token: v[:sep], prefix: v[sep+1:]})
+	}
+	return parsed, nil
+}
+
+// apiKeyScopeKey is the context key of the prefix a request authenticated
+// with an --api-key is scoped to.
+type apiKeyScopeKey struct{}
+
+// findAPIKey returns the --api-key entry of token, comparing against every
+// entry so the time taken doesn't tell which one matched.
+func findAPIKey(token string) (apiKey, bool) {
+	var (
+		found apiKey
+		ok    bool
+	)
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.token)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// requireInternalToken rejects requests without an "Authorization: Bearer"
+// header carrying --internal-token or one of the --api-key tokens, the
+// latter scoped to their prefix. It lets every request through while no
+// token is configured, and GETs of the probePaths always.
+func requireInternalToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (cf.InternalToken == "" && len(apiKeys) == 0) || (r.Method == http.MethodGet && probePaths[r.URL.Path]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && cf.InternalToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cf.InternalToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if key, found := findAPIKey(token); ok && found {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyScopeKey{}, key.prefix)))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="internal"`)
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid bearer token")
+	})
+}
+
+// apiKeyRoutes are the internal routes an --api-key may use, those writing
+// or deleting a single heartbeat or a batch. Their handlers check each id
+// with inAPIKeyScope.
+var apiKeyRoutes = map[string]bool{
+	"/{id}":                    true,
+	"/{namespace}/{id}":        true,
+	"DELETE /{id}":             true,
+	"DELETE /{namespace}/{id}": true,
+	"POST /batch":              true,
+}
+
+// restrictAPIKeys answers 403 to requests authenticated with an --api-key
+// for any route but the apiKeyRoutes.
+func restrictAPIKeys(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, scoped := r.Context().Value(apiKeyScopeKey{}).(string); scoped {
+			if _, pattern := mux.Handler(r); !apiKeyRoutes[pattern] {
+				writeJSONError(w, http.StatusForbidden, "out_of_scope", "this API key may only write heartbeats")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// inAPIKeyScope reports whether the request may write key: always, unless
+// it was authenticated with an --api-key. Then the path of key, its id in
+// the default namespace or namespace/id in another, must start with the
+// prefix of the key. A prefix with a / names the namespace in full, and ids
+// are compared under the configured collation.
+func inAPIKeyScope(r *http.Request, key heartbeatKey) bool {
+	prefix, scoped := r.Context().Value(apiKeyScopeKey{}).(string)
+	if !scoped {
+		return true
+	}
+	namespace, idPrefix, ok := strings.Cut(prefix, "/")
+	if !ok {
+		namespace, idPrefix = defaultNamespace, prefix
+	}
+	return key.Namespace == namespace && strings.HasPrefix(foldID(key.ID), foldID(idPrefix))
+}
+
+// outOfScopeMessage is the message a write outside the scope of an
+// --api-key is rejected with.
+func outOfScopeMessage(key heartbeatKey) string {
+	return fmt.Sprintf("heartbeat %s/%s is outside the scope of this API key", key.Namespace, key.ID)
+}
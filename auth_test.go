@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func putWithAuth(h http.Handler, target, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, target, nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return serveRequest(h, r)
+}
+
+func TestInternalTokenAuthorized(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret")
+	h := requireInternalToken(internalRouter())
+
+	expectStatus(t, putWithAuth(h, "/worker?ttl=1m", "Bearer s3cret"), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+}
+
+func TestInternalTokenUnauthorized(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret")
+	h := requireInternalToken(internalRouter())
+
+	for _, authorization := range []string{"", "Bearer wrong", "Basic s3cret", "s3cret", "Bearer s3cret "} {
+		w := putWithAuth(h, "/worker?ttl=1m", authorization)
+		expectError(t, w, http.StatusUnauthorized, "unauthorized")
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("authorization %q: expected a WWW-Authenticate challenge", authorization)
+		}
+	}
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound)
+}
+
+func TestInternalTokenExemptsProbes(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret")
+	h := requireInternalToken(internalRouter())
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		expectStatus(t, serve(h, http.MethodGet, path, ""), http.StatusOK)
+	}
+}
+
+func TestInternalTokenDisabled(t *testing.T) {
+	setupTest(t)
+	h := requireInternalToken(internalRouter())
+
+	expectStatus(t, putWithAuth(h, "/worker?ttl=1m", ""), http.StatusNoContent)
+}
+
+func TestExternalServerNeedsNoToken(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret")
+	expectStatus(t, putWithAuth(requireInternalToken(internalRouter()), "/worker?ttl=1m", "Bearer s3cret"), http.StatusNoContent)
+
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+// withAPIKey sends a request authenticated with token through the internal
+// server.
+func withAPIKey(method, target, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return serveRequest(requireInternalToken(internalRouter()), r)
+}
+
+func TestAPIKeyInScope(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret", "--api-key", "billing-key=billing-", "--api-key", "team-key==team/")
+
+	expectStatus(t, withAPIKey(http.MethodPut, "/billing-worker?ttl=1m", "", "billing-key"), http.StatusNoContent)
+	getHeartbeat(t, "billing-worker", "?ttl=1m")
+	expectStatus(t, withAPIKey(http.MethodPatch, "/billing-worker", `{"metadata": {"zone": "a"}}`, "billing-key"), http.StatusNoContent)
+	expectStatus(t, withAPIKey(http.MethodPost, "/batch", `["billing-a", "billing-b"]`, "billing-key"), http.StatusNoContent)
+	expectStatus(t, withAPIKey(http.MethodDelete, "/billing-a", "", "billing-key"), http.StatusNoContent)
+
+	// The token keeps its padding, the prefix names the team namespace.
+	expectStatus(t, withAPIKey(http.MethodPut, "/team/worker?ttl=1m", "", "team-key="), http.StatusNoContent)
+	getHeartbeat(t, "team/worker", "?ttl=1m")
+}
+
+func TestAPIKeyOutOfScope(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret", "--api-key", "billing-key=billing-", "--api-key", "team-key=team/")
+
+	for _, target := range []string{"/worker", "/team/billing-worker", "/bill"} {
+		expectError(t, withAPIKey(http.MethodPut, target+"?ttl=1m", "", "billing-key"), http.StatusForbidden, "out_of_scope")
+	}
+	expectError(t, withAPIKey(http.MethodPut, "/teams/worker?ttl=1m", "", "team-key"), http.StatusForbidden, "out_of_scope")
+	expectError(t, withAPIKey(http.MethodPut, "/worker?ttl=1m", "", "team-key"), http.StatusForbidden, "out_of_scope")
+
+	// One id outside the scope rejects the whole batch.
+	expectError(t, withAPIKey(http.MethodPost, "/batch", `["billing-a", "worker"]`, "billing-key"), http.StatusForbidden, "out_of_scope")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/billing-a?ttl=1m", ""), http.StatusNotFound, "not_found")
+
+	// Deleting a heartbeat of another tenant is refused as well.
+	expectStatus(t, putWithAuth(requireInternalToken(internalRouter()), "/worker?ttl=1m", "Bearer s3cret"), http.StatusNoContent)
+	expectError(t, withAPIKey(http.MethodDelete, "/worker", "", "billing-key"), http.StatusForbidden, "out_of_scope")
+	getHeartbeat(t, "worker", "?ttl=1m")
+
+	// The internal endpoints that aren't about a single heartbeat are left
+	// to --internal-token.
+	expectError(t, withAPIKey(http.MethodPost, "/intervals", `{"prefix": "billing-", "interval": "1m"}`, "billing-key"), http.StatusForbidden, "out_of_scope")
+	expectError(t, withAPIKey(http.MethodPost, "/billing-worker/mute", "", "billing-key"), http.StatusForbidden, "out_of_scope")
+	expectError(t, withAPIKey(http.MethodPut, "/banner", `{"message": "down"}`, "billing-key"), http.StatusForbidden, "out_of_scope")
+	expectError(t, withAPIKey(http.MethodGet, "/snapshot", "", "billing-key"), http.StatusForbidden, "out_of_scope")
+}
+
+func TestAPIKeyWithoutInternalToken(t *testing.T) {
+	setupTest(t, "--api-key", "billing-key=billing-")
+
+	expectStatus(t, withAPIKey(http.MethodPut, "/billing-worker?ttl=1m", "", "billing-key"), http.StatusNoContent)
+	expectError(t, putWithAuth(requireInternalToken(internalRouter()), "/worker?ttl=1m", ""), http.StatusUnauthorized, "unauthorized")
+	expectError(t, withAPIKey(http.MethodPut, "/worker?ttl=1m", "", "wrong"), http.StatusUnauthorized, "unauthorized")
+}
+
+func TestAPIKeyValidated(t *testing.T) {
+	for _, v := range []string{"s3cret", "=billing-", "s3cret="} {
+		err := runUntilSignal(t, "--api-key", "other=billing-", "--api-key", v)
+		if err == nil || err.Error() != "invalid --api-key entry 2, expected token=prefix" {
+			t.Fatalf("%q: expected the entry to be rejected without its token, got %v", v, err)
+		}
+	}
+}
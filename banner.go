@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const bannerSettingKey = "banner"
+
+type Banner struct {
+	Message   string    `json:"message"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BannerUpdate struct {
+	Message string `json:"message"`
+}
+
+// handlePutBanner sets the banner shown to API consumers, an empty message
+// clears it.
+func handlePutBanner(w http.ResponseWriter, r *http.Request) {
+	var req BannerUpdate
+	if err := decodeJSONBody(w, r, 4096, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if err := store.SetBanner(r.Context(), req.Message, time.Now()); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetBanner returns the current banner, or 204 when none is set.
+func handleGetBanner(w http.ResponseWriter, r *http.Request) {
+	banner, ok, err := store.Banner(r.Context())
+	if errors.Is(err, errCorruptTimestamp) {
+		writeJSONError(w, http.StatusInternalServerError, "corrupt_timestamp", "stored banner date is corrupt")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(banner); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+func (s *sqliteStore) SetBanner(ctx context.Context, message string, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	var err error
+	if message == "" {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM settings WHERE key = ?`, bannerSettingKey)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+            INSERT INTO settings (key, value, updated_at) VALUES (?, ?, ?)
+            ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at;
+        `, bannerSettingKey, message, now.Format(storedTimeFormat))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store banner: %v", err)
+	}
+	return nil
+}
+
+// Banner returns an error wrapping errCorruptTimestamp when the stored date
+// cannot be parsed.
+func (s *sqliteStore) Banner(ctx context.Context) (Banner, bool, error) {
+	var (
+		banner       Banner
+		updatedAtStr string
+	)
+	defer recordDBTime(ctx, time.Now())
+	err := s.db.QueryRowContext(ctx, `
+        SELECT value, CAST(updated_at AS TEXT) FROM settings WHERE key = ?
+    `, bannerSettingKey).Scan(&banner.Message, &updatedAtStr)
+	if err == sql.ErrNoRows {
+		return Banner{}, false, nil
+	}
+	if err != nil {
+		return Banner{}, false, fmt.Errorf("failed to query banner: %v", err)
+	}
+	if banner.UpdatedAt, _, err = parseStoredTime(updatedAtStr); err != nil {
+		return Banner{}, false, err
+	}
+	return banner, true, nil
+}
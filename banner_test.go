@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBanner(t *testing.T) {
+	setupTest(t)
+	internal, external := internalRouter(), externalRouter()
+
+	expectStatus(t, serve(external, http.MethodGet, "/banner", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(internal, http.MethodPut, "/banner", `{"message":"scheduled maintenance 2am"}`), http.StatusNoContent)
+	w := serve(external, http.MethodGet, "/banner", "")
+	expectStatus(t, w, http.StatusOK)
+	var banner Banner
+	decodeBody(t, w, &banner)
+	if banner.Message != "scheduled maintenance 2am" || banner.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected banner %+v", banner)
+	}
+
+	expectStatus(t, serve(internal, http.MethodPut, "/banner", `{"message":"maintenance done"}`), http.StatusNoContent)
+	w = serve(external, http.MethodGet, "/banner", "")
+	expectStatus(t, w, http.StatusOK)
+	decodeBody(t, w, &banner)
+	if banner.Message != "maintenance done" {
+		t.Fatalf("expected the banner to be replaced, got %+v", banner)
+	}
+
+	expectStatus(t, serve(internal, http.MethodPut, "/banner", `{"message":""}`), http.StatusNoContent)
+	expectStatus(t, serve(external, http.MethodGet, "/banner", ""), http.StatusNoContent)
+}
+
+func TestBannerReadOnlyExternally(t *testing.T) {
+	setupTest(t)
+
+	expectStatus(t, serve(externalRouter(), http.MethodPut, "/banner", `{"message":"hello"}`), http.StatusMethodNotAllowed)
+	expectError(t, serve(internalRouter(), http.MethodPut, "/banner", `{"message":`), http.StatusBadRequest, "invalid_body")
+}
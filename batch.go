@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	maxBatchSize      = 1000
+	maxBatchBodyBytes = 4 << 20
+)
+
+// batchWriters holds a slot for every batch being written, --max-batch-writers
+// in all. Batch transactions are large and hold the SQLite write lock for
+// long, so concurrent imports queue here instead of piling up on the busy
+// timeout and failing with "database is locked".
+var batchWriters chan struct{}
+
+// acquireBatchWriter waits for a batch writer slot until ctx is done and
+// returns the function giving it back.
+func acquireBatchWriter(ctx context.Context) (func(), error) {
+	select {
+	case batchWriters <- struct{}{}:
+		return func() { <-batchWriters }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// BatchItem is an element of a batch: either a bare id or an object with an
+// id and an optional namespace, ttl and metadata.
+type BatchItem struct {
+	Namespace string          `json:"namespace"`
+	ID        string          `json:"id"`
+	TTL       string          `json:"ttl"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+func (b *BatchItem) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &b.ID)
+	}
+	type plain BatchItem
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// handleBatchPutHeartbeat records every heartbeat of a batch in one
+// transaction. An invalid item rejects the whole batch with 400 naming its
+// index, and a failed write leaves none of the heartbeats recorded. An empty
+// batch records nothing and succeeds. Batches are written one
+// --max-batch-writers slot at a time.
+func handleBatchPutHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !hasJSONContentType(r) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "batch body must be application/json")
+		return
+	}
+
+	var items []BatchItem
+	if err := decodeJSONBody(w, r, maxBatchBodyBytes, &items); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(items) > maxBatchSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("batch exceeds %d heartbeats", maxBatchSize))
+		return
+	}
+
+	puts, ok := batchPuts(w, r, items)
+	if !ok {
+		return
+	}
+	release, err := acquireBatchWriter(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded waiting for a batch writer")
+		return
+	}
+	defer release()
+
+	if err := writeBatch(r.Context(), puts); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to store heartbeats: %v", err))
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchPuts validates the items of a batch or import and turns them into
+// writes. An invalid item is answered with 400 naming its index, or 403
+// when it is outside the scope of the --api-key, and false is returned.
+func batchPuts(w http.ResponseWriter, r *http.Request, items []BatchItem) ([]HeartbeatPut, bool) {
+	puts := make([]HeartbeatPut, len(items))
+	for i, item := range items {
+		key := heartbeatKey{Namespace: normalizeID(item.Namespace), ID: normalizeID(item.ID)}
+		if key.ID == "" {
+			writeJSONError(w, http.StatusBadRequest, "missing_id", fmt.Sprintf("item %d: id is required", i))
+			return nil, false
+		}
+		if key.Namespace == "" {
+			key.Namespace = defaultNamespace
+		}
+		if code, message := reservedKey(key); code != "" {
+			writeJSONError(w, http.StatusBadRequest, code, fmt.Sprintf("item %d: %s", i, message))
+			return nil, false
+		}
+		if !inAPIKeyScope(r, key) {
+			writeJSONError(w, http.StatusForbidden, "out_of_scope", fmt.Sprintf("item %d: %s", i, outOfScopeMessage(key)))
+			return nil, false
+		}
+
+		var opts PutOptions
+		opts.InitialTTL = defaultIntervalSeconds()
+		if item.TTL != "" {
+			ttl, err := putTTL(item.TTL)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("item %d: ttl %v", i, err))
+				return nil, false
+			}
+			opts.TTL = ttl
+			opts.InitialTTL = ttl
+		}
+		metadata, err := putMetadata(item.Metadata)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_metadata", fmt.Sprintf("item %d: metadata %v", i, err))
+			return nil, false
+		}
+		if metadata.Valid {
+			limit, err := metadataLimitFor(r.Context(), key)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+				return nil, false
+			}
+			if int64(len(metadata.String)) > limit {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, "metadata_too_large", fmt.Sprintf("item %d: metadata exceeds %d bytes", i, limit))
+				return nil, false
+			}
+		}
+		opts.Metadata = metadata
+		if cf.RecordMethod {
+			opts.Method = sql.NullString{String: r.Method, Valid: true}
+		}
+
+		puts[i] = HeartbeatPut{Key: key, Opts: opts}
+	}
+	return puts, true
+}
+
+// writeBatch records puts in one transaction at the current time. The caller
+// must hold a batch writer slot.
+func writeBatch(ctx context.Context, puts []HeartbeatPut) error {
+	reportedAt := truncateTimestamp(heartbeatNow())
+	if err := store.PutMany(ctx, reportedAt, puts); err != nil {
+		return err
+	}
+	heartbeatPuts.Add(float64(len(puts)))
+	if producer != nil {
+		for _, p := range puts {
+			producer.Enqueue(newHeartbeatEvent(p.Key, reportedAt, p.Opts))
+		}
+	}
+	return nil
+}
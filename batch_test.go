@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchPut(t *testing.T) {
+	setupTest(t)
+
+	body := `["api", {"id": "worker", "ttl": "2m", "metadata": {"v": 1}}, {"namespace": "team", "id": "cron"}]`
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/batch", body), http.StatusNoContent)
+
+	getHeartbeat(t, "api", "?ttl=1m")
+	if hb := getHeartbeat(t, "worker", ""); string(hb.Metadata) != `{"v":1}` {
+		t.Fatalf("expected the batched metadata, got %s", hb.Metadata)
+	}
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 120 {
+		t.Fatalf("expected the batched ttl to be stored, got %+v", ttl)
+	}
+	getHeartbeat(t, "team/cron", "?ttl=1m")
+}
+
+func TestBatchMixedValidityRecordsNothing(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	for _, tc := range []struct {
+		body string
+		code string
+	}{
+		{`["api", {"id": "worker", "ttl": "soon"}, "cron"]`, "invalid_ttl"},
+		{`["api", {"id": ""}, "cron"]`, "missing_id"},
+		{`["api", {"id": "worker", "metadata": [1]}, "cron"]`, "invalid_metadata"},
+		{`["api", {"namespace": "admin", "id": "worker"}, "cron"]`, "reserved_namespace"},
+	} {
+		w := serve(h, http.MethodPost, "/batch", tc.body)
+		expectError(t, w, http.StatusBadRequest, tc.code)
+		if !strings.Contains(w.Body.String(), "item 1") {
+			t.Fatalf("expected the error to name the offending index, got %s", w.Body)
+		}
+		if rows := countRows(t); rows != 0 {
+			t.Fatalf("%s: expected nothing to be recorded, got %d rows", tc.code, rows)
+		}
+	}
+}
+
+func TestBatchFailedWriteRollsBack(t *testing.T) {
+	setupTest(t)
+	_, err := db.Exec(`
+        CREATE TRIGGER reject_poison BEFORE INSERT ON heartbeats WHEN NEW.id = 'poison'
+        BEGIN SELECT RAISE(ABORT, 'poisoned'); END
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/existing", ""), http.StatusNoContent)
+	before := storedLastUpdatedAt(t, "existing")
+
+	expectError(t, serve(h, http.MethodPost, "/batch", `["existing", "api", "poison", "cron"]`), http.StatusInternalServerError, "internal_error")
+	if rows := countRows(t); rows != 1 {
+		t.Fatalf("expected the batch to be rolled back, got %d rows", rows)
+	}
+	if after := storedLastUpdatedAt(t, "existing"); after != before {
+		t.Fatalf("expected the existing heartbeat to be left at %q, got %q", before, after)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	setupTest(t)
+
+	ids := make([]string, maxBatchSize+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%q", fmt.Sprintf("worker-%d", i))
+	}
+	body := "[" + strings.Join(ids, ",") + "]"
+	expectError(t, serve(internalRouter(), http.MethodPost, "/batch", body), http.StatusRequestEntityTooLarge, "batch_too_large")
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected nothing to be recorded, got %d rows", rows)
+	}
+}
+
+func TestBatchEmptyAndMalformed(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `[]`), http.StatusNoContent)
+	expectError(t, serve(h, http.MethodPost, "/batch", `{"id": "api"}`), http.StatusBadRequest, "invalid_body")
+	expectError(t, serve(h, http.MethodPost, "/batch", `["api"`), http.StatusBadRequest, "invalid_body")
+}
+
+func TestBatchRequiresJSONContentType(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+		r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`["worker"]`))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		expectError(t, serveRequest(h, r), http.StatusUnsupportedMediaType, "unsupported_media_type")
+	}
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected nothing to be recorded, got %d rows", rows)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`["worker"]`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	expectStatus(t, serveRequest(h, r), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `[]`), http.StatusNoContent)
+}
+
+func TestConcurrentBatchesQueue(t *testing.T) {
+	// Without a busy timeout to wait out, overlapping write transactions
+	// would fail with "database is locked" at once.
+	setupTest(t, "--max-batch-writers", "1", "--busy-timeout", "1ms")
+	h := internalRouter()
+
+	const batches, size = 8, 200
+	var wg sync.WaitGroup
+	for b := range batches {
+		ids := make([]string, size)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("%q", fmt.Sprintf("worker-%d-%d", b, i))
+		}
+		body := "[" + strings.Join(ids, ",") + "]"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(h, http.MethodPost, "/batch", body)
+			if w.Code != http.StatusNoContent {
+				t.Errorf("batch %d: expected 204, got %d: %s", b, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if rows := countRows(t); rows != batches*size {
+		t.Fatalf("expected every batch to be recorded, got %d rows", rows)
+	}
+}
+
+func TestBatchWaitsForWriter(t *testing.T) {
+	setupTest(t)
+	release, err := acquireBatchWriter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`["worker"]`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	expectError(t, serveRequest(internalRouter(), r), http.StatusServiceUnavailable, "deadline_exceeded")
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected the queued batch to record nothing, got %d rows", rows)
+	}
+
+	// A single PUT doesn't queue behind batches.
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/api", ""), http.StatusNoContent)
+
+	release()
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/batch", `["worker"]`), http.StatusNoContent)
+}
+
+func TestMaxBatchWritersMustBePositive(t *testing.T) {
+	for _, v := range []string{"0", "-1"} {
+		err := runUntilSignal(t, "--max-batch-writers", v)
+		if err == nil || err.Error() != "--max-batch-writers must be positive" {
+			t.Fatalf("%s: expected the limit to be rejected, got %v", v, err)
+		}
+	}
+}
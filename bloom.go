@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// bloomFalsePositiveRate is the share of unknown ids the filter lets through
+// to the database once it holds as many ids as it was sized for.
+const bloomFalsePositiveRate = 0.01
+
+// bloomFilter is a set of heartbeat keys with no false negatives: a key
+// reported as absent was never added. Keys can't be removed, so deleted
+// heartbeats stay "possibly present" until the filter is rebuilt on the next
+// start.
+type bloomFilter struct {
+	mu     sync.RWMutex
+	bits   []uint64
+	hashes uint32
+}
+
+// newBloomFilter sizes a filter for n ids at false positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint32(k),
+	}
+}
+
+// positions derives the filter's bit positions for key by double hashing.
+func (f *bloomFilter) positions(key heartbeatKey, fn func(word int, mask uint64)) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key.Namespace))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(foldID(key.ID)))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	size := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := uint64(h1+i*h2) % size
+		fn(int(bit/64), 1<<(bit%64))
+	}
+}
+
+func (f *bloomFilter) Add(key heartbeatKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions(key, func(word int, mask uint64) {
+		f.bits[word] |= mask
+	})
+}
+
+func (f *bloomFilter) MayContain(key heartbeatKey) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	found := true
+	f.positions(key, func(word int, mask uint64) {
+		if f.bits[word]&mask == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// bloomStore answers Get for ids that were never written with ErrNotFound
+// without querying the wrapped Store.
+type bloomStore struct {
+	Store
+	filter *bloomFilter
+}
+
+// newBloomStore fills a filter with every id currently in the database.
+func newBloomStore(ctx context.Context, next Store, expectedIDs int) (*bloomStore, error) {
+	filter := newBloomFilter(expectedIDs, bloomFalsePositiveRate)
+
+	if err := next.Keys(ctx, filter.Add); err != nil {
+		return nil, err
+	}
+
+	return &bloomStore{Store: next, filter: filter}, nil
+}
+
+// Put adds id to the filter before writing it, so a concurrent Get can't
+// miss a heartbeat that has already been stored.
+func (s *bloomStore) Put(ctx context.Context, key heartbeatKey, now time.Time, opts PutOptions) error {
+	s.add(key)
+	return s.Store.Put(ctx, key, now, opts)
+}
+
+func (s *bloomStore) PutMany(ctx context.Context, now time.Time, puts []HeartbeatPut) error {
+	for _, p := range puts {
+		s.add(p.Key)
+	}
+	return s.Store.PutMany(ctx, now, puts)
+}
+
+// add adds key to the filter, along with the parents the write registers as
+// pending entries under --register-parents.
+func (s *bloomStore) add(key heartbeatKey) {
+	s.filter.Add(key)
+	if !cf.RegisterParents {
+		return
+	}
+	for _, parent := range parentIDs(key.ID) {
+		s.filter.Add(heartbeatKey{Namespace: key.Namespace, ID: parent})
+	}
+}
+
+func (s *bloomStore) Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error) {
+	if !s.filter.MayContain(key) {
+		return storedHeartbeat{}, ErrNotFound
+	}
+	return s.Store.Get(ctx, key)
+}
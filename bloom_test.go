@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	// Overfilling the filter raises its false positive rate, but must never
+	// lose a key.
+	f := newBloomFilter(1000, bloomFalsePositiveRate)
+	for i := range 10000 {
+		f.Add(heartbeatKey{Namespace: defaultNamespace, ID: fmt.Sprintf("worker-%d", i)})
+	}
+	for i := range 10000 {
+		if key := (heartbeatKey{Namespace: defaultNamespace, ID: fmt.Sprintf("worker-%d", i)}); !f.MayContain(key) {
+			t.Fatalf("false negative for %v", key)
+		}
+	}
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	f := newBloomFilter(10000, bloomFalsePositiveRate)
+	for i := range 10000 {
+		f.Add(heartbeatKey{Namespace: defaultNamespace, ID: fmt.Sprintf("worker-%d", i)})
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if f.MayContain(heartbeatKey{Namespace: defaultNamespace, ID: fmt.Sprintf("unknown-%d", i)}) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 3*bloomFalsePositiveRate {
+		t.Fatalf("expected a false positive rate near %v, got %v", bloomFalsePositiveRate, rate)
+	}
+}
+
+// countingStore counts the Gets reaching the wrapped Store.
+type countingStore struct {
+	Store
+	gets atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error) {
+	s.gets.Add(1)
+	return s.Store.Get(ctx, key)
+}
+
+func TestBloomStoreRebuiltOnStartup(t *testing.T) {
+	setupTest(t)
+	insertHeartbeat(t, "worker", time.Now().UTC().Format(storedTimeFormat), sql.NullInt64{})
+
+	s, err := newBloomStore(context.Background(), newSQLiteStore(db), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+func TestBloomStoreSkipsDatabaseForUnknownIDs(t *testing.T) {
+	setupTest(t)
+	counting := &countingStore{Store: newSQLiteStore(db)}
+	s, err := newBloomStore(context.Background(), counting, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/missing?ttl=1m", ""), http.StatusNotFound, "not_found")
+	if gets := counting.gets.Load(); gets != 0 {
+		t.Fatalf("expected an unknown id to be answered without a database read, got %d", gets)
+	}
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/batch", `[{"id":"batched"}]`), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+	getHeartbeat(t, "batched", "?ttl=1m")
+	if gets := counting.gets.Load(); gets != 2 {
+		t.Fatalf("expected written ids to be read from the database, got %d reads", gets)
+	}
+}
+
+func TestBloomStoreAfterDelete(t *testing.T) {
+	setupTest(t)
+	s, err := newBloomStore(context.Background(), newSQLiteStore(db), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodDelete, "/worker", ""), http.StatusNoContent)
+
+	if _, err := store.Get(context.Background(), heartbeatKey{Namespace: defaultNamespace, ID: "worker"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a deleted id to be reported missing, got %v", err)
+	}
+}
+
+func TestBloomStoreNocase(t *testing.T) {
+	setupTest(t, "--id-collation", "nocase")
+	s, err := newBloomStore(context.Background(), newSQLiteStore(db), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/Worker", ""), http.StatusNoContent)
+
+	getHeartbeat(t, "worker", "?ttl=1m")
+}
+
+func TestBloomStoreRegisteredParents(t *testing.T) {
+	setupTest(t, "--register-parents", "--bloom-filter-ids", "100")
+	s, err := newBloomStore(context.Background(), newSQLiteStore(db), cf.BloomFilterIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team.svc.inst", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/batch", `["ops.db.primary"]`), http.StatusNoContent)
+
+	for _, id := range []string{"team.svc", "team", "ops.db", "ops"} {
+		expectError(t, serve(externalRouter(), http.MethodGet, "/"+id+"?ttl=1m", ""), http.StatusNotFound, "pending")
+	}
+}
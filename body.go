@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+)
+
+// withBodyReadTimeout bounds the time spent reading the request body of the
+// endpoints it wraps, so a client trickling its body can't hold the
+// connection open indefinitely.
+func withBodyReadTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cf.BodyReadTimeout > 0 {
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(time.Now().Add(cf.BodyReadTimeout)); err != nil {
+				httpLog.Warn("failed to set body read deadline", "path", r.URL.Path, "error", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSONBody decodes a JSON request body of at most limit bytes into v.
+// With --strict-json, fields v doesn't declare are rejected so typos don't
+// go unnoticed.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, limit int64, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if cf.StrictJSON {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// hasJSONContentType reports whether r declares its body as application/json,
+// with or without parameters such as charset.
+func hasJSONContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// writeBodyError responds to a failure reading or decoding a request body.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		writeJSONError(w, http.StatusRequestTimeout, "body_timeout", "timed out reading request body")
+	case errors.As(err, &maxBytesErr):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("invalid request body: %v", err))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrickledBodyTimesOut(t *testing.T) {
+	setupTest(t, "--body-read-timeout", "200ms")
+	srv := httptest.NewServer(internalRouter())
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	body := `{"metadata":{"region":"eu-west-1"}}`
+	_, err = fmt.Fprintf(conn, "PUT /worker HTTP/1.1\r\nHost: collector\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err == nil {
+			responses <- resp
+		}
+		close(responses)
+	}()
+
+	// Send a byte every 50ms, so the whole body would take far longer than
+	// the timeout to arrive.
+	for _, b := range []byte(body) {
+		select {
+		case resp, ok := <-responses:
+			if !ok {
+				t.Fatal("failed to read the response")
+			}
+			if resp.StatusCode != http.StatusRequestTimeout {
+				t.Fatalf("expected status 408, got %d", resp.StatusCode)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := conn.Write([]byte{b}); err != nil {
+			break
+		}
+	}
+	t.Fatal("expected the trickled body to time out before it was complete")
+}
+
+func TestBodyWithinTimeout(t *testing.T) {
+	setupTest(t, "--body-read-timeout", "1s")
+	srv := httptest.NewServer(internalRouter())
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/worker", strings.NewReader(`{"metadata":{"region":"eu-west-1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", resp.StatusCode)
+	}
+}
+
+func TestStrictJSONRejectsUnknownFields(t *testing.T) {
+	setupTest(t, "--strict-json")
+	h := internalRouter()
+
+	expectError(t, serve(h, http.MethodPut, "/worker", `{"metadta":{"region":"eu"}}`), http.StatusBadRequest, "invalid_body")
+	expectError(t, serve(h, http.MethodPost, "/intervals", `{"prefix":"web.","intervall":"30s"}`), http.StatusBadRequest, "invalid_body")
+	expectError(t, serve(h, http.MethodPut, "/banner", `{"mesage":"hello"}`), http.StatusBadRequest, "invalid_body")
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadata":{"region":"eu"}}`), http.StatusNoContent)
+}
+
+func TestLenientJSONIgnoresUnknownFields(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadta":{"region":"eu"}}`), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); hb.Metadata != nil {
+		t.Fatalf("expected the misspelt field to be ignored, got %s", hb.Metadata)
+	}
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `[{"id":"a","tll":"1m"}]`), http.StatusNoContent)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const defaultCadenceWindow = 24 * time.Hour
+
+// HeartbeatCadence describes the gaps between consecutive arrivals of a
+// heartbeat. The statistics are left out while fewer than two arrivals fall
+// in the window.
+type HeartbeatCadence struct {
+	Namespace     string   `json:"namespace"`
+	ID            string   `json:"id"`
+	WindowSeconds float64  `json:"window_seconds"`
+	Reports       int      `json:"reports"`
+	Intervals     int      `json:"intervals"`
+	MinSeconds    *float64 `json:"min_seconds,omitempty"`
+	AvgSeconds    *float64 `json:"avg_seconds,omitempty"`
+	MaxSeconds    *float64 `json:"max_seconds,omitempty"`
+	P95Seconds    *float64 `json:"p95_seconds,omitempty"`
+}
+
+// handleGetCadence returns how regularly a heartbeat reported over ?window=
+// (24h by default), to pick a ttl that rides out its usual jitter.
+func handleGetCadence(w http.ResponseWriter, r *http.Request) {
+	hb, ok := windowHeartbeat(w, r)
+	if !ok {
+		return
+	}
+	window, ok := historyWindow(w, r, defaultCadenceWindow)
+	if !ok {
+		return
+	}
+
+	var (
+		last      time.Time
+		reports   int
+		intervals []float64
+	)
+	err := store.Arrivals(r.Context(), heartbeatKey{Namespace: hb.Namespace, ID: hb.ID}, heartbeatNow().Add(-window), func(at time.Time) error {
+		if reports > 0 {
+			intervals = append(intervals, at.Sub(last).Seconds())
+		}
+		last = at
+		reports++
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to read heartbeat events: %v", err))
+		return
+	}
+
+	cadence := HeartbeatCadence{
+		Namespace:     hb.Namespace,
+		ID:            hb.ID,
+		WindowSeconds: window.Seconds(),
+		Reports:       reports,
+		Intervals:     len(intervals),
+	}
+	if len(intervals) > 0 {
+		slices.Sort(intervals)
+		var sum float64
+		for _, interval := range intervals {
+			sum += interval
+		}
+		avg := sum / float64(len(intervals))
+		cadence.MinSeconds = &intervals[0]
+		cadence.AvgSeconds = &avg
+		cadence.MaxSeconds = &intervals[len(intervals)-1]
+		cadence.P95Seconds = &intervals[nearestRank(len(intervals), 0.95)]
+	}
+	writeWindowResponse(w, cadence)
+}
+
+// nearestRank returns the index of the p quantile of n sorted values.
+func nearestRank(n int, p float64) int {
+	return max(int(math.Ceil(p*float64(n)))-1, 0)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getCadence(t *testing.T, path, query string) HeartbeatCadence {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+path+"/cadence"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var cadence HeartbeatCadence
+	decodeBody(t, w, &cadence)
+	return cadence
+}
+
+func TestCadence(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	// Gaps of 10s, 20s, 30s, 40s and 100s.
+	reportAt(t, c, start, "worker", 0, 10*time.Second, 30*time.Second, time.Minute, 100*time.Second, 200*time.Second)
+	c.Set(start.Add(5 * time.Minute))
+
+	cadence := getCadence(t, "worker", "")
+	if cadence.Reports != 6 || cadence.Intervals != 5 || cadence.WindowSeconds != 86400 {
+		t.Fatalf("expected 6 reports over the default window, got %+v", cadence)
+	}
+	for name, got := range map[string]*float64{"min": cadence.MinSeconds, "avg": cadence.AvgSeconds, "max": cadence.MaxSeconds, "p95": cadence.P95Seconds} {
+		want := map[string]float64{"min": 10, "avg": 40, "max": 100, "p95": 100}[name]
+		if got == nil || *got != want {
+			t.Errorf("expected %s interval %vs, got %v", name, want, got)
+		}
+	}
+
+	// The last 4 minutes hold the arrivals from 1m on.
+	if cadence := getCadence(t, "worker", "?window=4m"); cadence.Reports != 3 || *cadence.MinSeconds != 40 || *cadence.MaxSeconds != 100 {
+		t.Fatalf("expected the gaps inside the window only, got %+v", cadence)
+	}
+}
+
+func TestCadenceSparse(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	reportAt(t, c, start, "worker", 0)
+	c.Set(start.Add(10 * time.Minute))
+
+	for _, window := range []string{"", "?window=1m"} {
+		cadence := getCadence(t, "worker", window)
+		if cadence.Intervals != 0 || cadence.MinSeconds != nil || cadence.AvgSeconds != nil || cadence.MaxSeconds != nil || cadence.P95Seconds != nil {
+			t.Fatalf("expected no statistics without two arrivals, got %+v", cadence)
+		}
+	}
+	if cadence := getCadence(t, "worker", "?window=1m"); cadence.Reports != 0 {
+		t.Fatalf("expected no reports in the last minute, got %+v", cadence)
+	}
+}
+
+func TestNearestRank(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		p    float64
+		want int
+	}{
+		{1, 0.95, 0},
+		{5, 0.95, 4},
+		{20, 0.95, 18},
+		{100, 0.95, 94},
+	} {
+		if got := nearestRank(tc.n, tc.p); got != tc.want {
+			t.Errorf("expected rank %d of %d values at %v, got %d", tc.want, tc.n, tc.p, got)
+		}
+	}
+}
+
+func TestCadenceErrors(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/missing/cadence", ""), http.StatusNotFound, "not_found")
+	expectError(t, serve(h, http.MethodGet, "/worker/cadence?window=never", ""), http.StatusBadRequest, "invalid_window")
+	expectError(t, serve(internalRouter(), http.MethodPut, "/team/cadence", ""), http.StatusBadRequest, "reserved_id")
+}
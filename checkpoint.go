@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// walEnabled reports whether the database runs in WAL journal mode. enableWAL
+// turns it on at startup, only in-memory databases stay in memory mode.
+func walEnabled(ctx context.Context, db *sql.DB) (bool, error) {
+	var mode string
+	if err := db.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&mode); err != nil {
+		return false, fmt.Errorf("failed to read journal mode: %v", err)
+	}
+	return strings.EqualFold(mode, "wal"), nil
+}
+
+// runWALCheckpoints truncates the WAL file every interval, so it doesn't
+// keep growing under sustained writes. A checkpoint that fails or can't
+// complete because readers are busy is logged and retried next interval.
+func runWALCheckpoints(ctx context.Context, interval time.Duration, logger *slog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			var busy, logFrames, checkpointed int
+			err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed)
+			if ctx.Err() == nil {
+				reportJobRun("wal-checkpoint", err)
+			}
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					logger.Error("failed to checkpoint WAL", "error", err)
+				}
+			case busy != 0:
+				logger.Warn("WAL checkpoint blocked by active readers or writers", "log_frames", logFrames, "checkpointed_frames", checkpointed)
+			default:
+				logger.Info("checkpointed WAL", "log_frames", logFrames, "checkpointed_frames", checkpointed)
+			}
+		}
+	}
+}
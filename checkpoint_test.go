@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALEnabled(t *testing.T) {
+	setupTest(t)
+
+	wal, err := walEnabled(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wal {
+		t.Fatal("expected a file database to run in WAL mode")
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	setupTest(t)
+	for _, id := range []string{"a", "b", "c"} {
+		expectStatus(t, serve(internalRouter(), http.MethodPut, "/"+id, ""), http.StatusNoContent)
+	}
+	walPath := cf.SQLiteDSN + "-wal"
+	if info, err := os.Stat(walPath); err != nil || info.Size() == 0 {
+		t.Fatalf("expected the writes to be in the WAL file, got %v, %v", info, err)
+	}
+
+	logs := &logRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runWALCheckpoints(ctx, 10*time.Millisecond, logs.logger())
+	}()
+	logs.waitFor(t, "checkpointed WAL")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(walPath); err != nil || info.Size() != 0 {
+		t.Fatalf("expected the WAL file to be truncated, got %v, %v", info, err)
+	}
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/a?ttl=1m", ""), http.StatusOK)
+}
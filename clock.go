@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// clockJumpTolerance is how far the wall clock may fall behind the monotonic
+// clock before it is treated as having jumped backwards.
+const clockJumpTolerance = time.Second
+
+// Clock tells the time heartbeats are recorded and expired against.
+type Clock interface {
+	Now() time.Time
+}
+
+// clock is the Clock used by heartbeatNow. Tests replace it to move time
+// across expiry boundaries without sleeping.
+var clock Clock = systemClock{}
+
+// wallNow reads the wall clock. Tests replace it to step the wall clock
+// without touching the monotonic one.
+var wallNow = time.Now
+
+var (
+	// processStart anchors the monotonic clock to the wall clock at startup.
+	processStart = time.Now()
+
+	clockJumpMu     sync.Mutex
+	lastClockJumpAt time.Duration
+)
+
+// heartbeatNow returns the current time for recording and expiring
+// heartbeats.
+func heartbeatNow() time.Time {
+	return clock.Now()
+}
+
+// systemClock normally returns the wall clock, but when the wall clock has
+// been stepped backwards since startup it returns the time derived from the
+// monotonic clock instead, so heartbeats recorded before the jump don't stay
+// alive for the extra interval the clock moved back by.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	sinceStart := time.Since(processStart)
+	wall := wallNow().Round(0)
+	monotonic := processStart.Round(0).Add(sinceStart)
+
+	if jump := monotonic.Sub(wall); jump > clockJumpTolerance {
+		logClockJump(sinceStart, jump)
+		return monotonic.UTC()
+	}
+	return wall.UTC()
+}
+
+// logClockJump warns about a backwards clock jump at most once a minute.
+func logClockJump(sinceStart, jump time.Duration) {
+	clockJumpMu.Lock()
+	defer clockJumpMu.Unlock()
+	if lastClockJumpAt != 0 && sinceStart-lastClockJumpAt < time.Minute {
+		return
+	}
+	lastClockJumpAt = sinceStart
+	slog.Warn("wall clock is behind the monotonic clock, using monotonic time for heartbeats", "behind", jump.String())
+}
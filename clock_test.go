@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock makes heartbeatNow return start until the clock is moved.
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: start.UTC()}
+	clock = c
+	t.Cleanup(func() {
+		clock = systemClock{}
+	})
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock by d, backwards when d is negative.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to at.
+func (c *fakeClock) Set(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = at.UTC()
+}
+
+// stepWallClock moves the wall clock seen by systemClock by d for the rest
+// of the test.
+func stepWallClock(t *testing.T, d time.Duration) {
+	t.Helper()
+	wallNow = func() time.Time {
+		return time.Now().Add(d)
+	}
+	t.Cleanup(func() {
+		wallNow = time.Now
+	})
+}
+
+func TestSystemClockIgnoresBackwardJump(t *testing.T) {
+	stepWallClock(t, -time.Hour)
+
+	now := systemClock{}.Now()
+	if drift := time.Since(now); drift < -clockJumpTolerance || drift > clockJumpTolerance {
+		t.Fatalf("expected the monotonic time after a backward jump, got %v off", drift)
+	}
+}
+
+func TestSystemClockFollowsForwardJump(t *testing.T) {
+	stepWallClock(t, time.Hour)
+
+	now := systemClock{}.Now()
+	if drift := now.Sub(time.Now().Add(time.Hour)); drift < -clockJumpTolerance || drift > clockJumpTolerance {
+		t.Fatalf("expected the stepped wall clock after a forward jump, got %v off", drift)
+	}
+}
+
+func TestExpiryAcrossBackwardJump(t *testing.T) {
+	setupTest(t)
+	insertHeartbeat(t, "worker", time.Now().Add(-2*time.Minute).UTC().Format(storedTimeFormat), sql.NullInt64{Int64: 60, Valid: true})
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+
+	stepWallClock(t, -time.Hour)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	stored, _, err := parseStoredTime(storedLastUpdatedAt(t, "worker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift := time.Since(stored); drift < -clockJumpTolerance || drift > clockJumpTolerance {
+		t.Fatalf("expected a heartbeat recorded after the jump to be stamped with the monotonic time, got %v", stored)
+	}
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusOK)
+}
+
+func TestFakeClockMovingBackwards(t *testing.T) {
+	setupTest(t)
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, start)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+
+	c.Advance(2 * time.Minute)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+
+	// A heartbeat dated after a clock moved backwards is reset to now rather
+	// than staying alive until the clock catches up.
+	c.Advance(-time.Hour)
+	now := c.Now()
+	hb := getHeartbeat(t, "worker", "")
+	if !hb.LastUpdatedAt.Equal(now) || !hb.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected the heartbeat to be reset to %v, got %+v", now, hb)
+	}
+	if stored := storedLastUpdatedAt(t, "worker"); stored != now.Format(storedTimeFormat) {
+		t.Fatalf("expected the stored date to be repaired, got %s", stored)
+	}
+
+	c.Advance(2 * time.Minute)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+}
+
+func TestExpiryBoundary(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	c.Advance(time.Minute)
+	hb := getHeartbeat(t, "worker", "?ttl=1m")
+	if hb.RemainingSeconds == nil || *hb.RemainingSeconds != 0 {
+		t.Fatalf("expected a heartbeat exactly at its ttl to be alive with 0s left, got %+v", hb)
+	}
+
+	c.Advance(time.Nanosecond)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "expired")
+}
+
+func TestExpiryBoundaryStoredTTL(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=30s", ""), http.StatusNoContent)
+
+	c.Advance(30 * time.Second)
+	getHeartbeat(t, "worker", "")
+	c.Advance(time.Millisecond)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+
+	// A new heartbeat restarts the ttl from the clock's current time.
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(29 * time.Second)
+	getHeartbeat(t, "worker", "")
+}
+
+func TestListExpiryBoundary(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	c.Advance(time.Minute - 10*time.Millisecond)
+	if list := listHeartbeats(t, "?ttl=1m"); len(list) != 1 || list[0].Expired {
+		t.Fatalf("expected worker to be live just before its ttl, got %+v", list)
+	}
+	if ids := expiredIDs(t, "?ttl=1m"); len(ids) != 0 {
+		t.Fatalf("expected nothing expired just before the ttl, got %v", ids)
+	}
+
+	c.Advance(20 * time.Millisecond)
+	if list := listHeartbeats(t, "?ttl=1m"); len(list) != 1 || !list[0].Expired {
+		t.Fatalf("expected worker to be expired just after its ttl, got %+v", list)
+	}
+	if ids := expiredIDs(t, "?ttl=1m"); len(ids) != 1 || ids[0] != "worker" {
+		t.Fatalf("expected worker to be listed expired just after the ttl, got %v", ids)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const (
+	idCollationBinary = "binary"
+	idCollationNocase = "nocase"
+)
+
+func validIDCollation(collation string) error {
+	switch collation {
+	case idCollationBinary, idCollationNocase:
+		return nil
+	}
+	return fmt.Errorf("invalid id collation %q, expected %s or %s", collation, idCollationBinary, idCollationNocase)
+}
+
+// idCollate is the COLLATE clause for comparisons on expressions derived from
+// the id column, which don't inherit the column's collation.
+func idCollate() string {
+	return "COLLATE " + strings.ToUpper(cf.IDCollation)
+}
+
+// foldID maps an id to the form it is compared in under the configured
+// collation. Like SQLite's NOCASE, only ASCII letters are folded.
+func foldID(id string) string {
+	if cf.IDCollation != idCollationNocase {
+		return id
+	}
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, id)
+}
+
+var (
+	idColumnDef = regexp.MustCompile(`(?i)\bid\s+TEXT\s+NOT\s+NULL(\s+COLLATE\s+\w+)?`)
+	tableCreate = regexp.MustCompile(`(?i)^CREATE\s+TABLE\s+"?\w+"?`)
+)
+
+// idCollationTables are the tables keyed by (namespace, id), whose id column
+// carries the configured collation.
+var idCollationTables = []string{"heartbeats", "metadata_limits"}
+
+// eventsKeyIndex returns the definition of the heartbeat_events index for
+// collation. Events are only looked up by id, so the index rather than the
+// column takes the collation.
+func eventsKeyIndex(collation string) string {
+	if collation == idCollationNocase {
+		return `CREATE INDEX heartbeat_events_key ON heartbeat_events (namespace, id COLLATE NOCASE)`
+	}
+	return `CREATE INDEX heartbeat_events_key ON heartbeat_events (namespace, id)`
+}
+
+// applyIDCollation makes the collation of the id columns and of the
+// heartbeat_events index match collation. The collation of a column can't be
+// altered in place, so a table is rebuilt when it differs. Switching to nocase
+// fails if ids differing only in case already exist.
+func applyIDCollation(db *sql.DB, collation string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin id collation change: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var changed []string
+	for _, table := range idCollationTables {
+		rebuilt, err := applyTableIDCollation(tx, table, collation)
+		if err != nil {
+			return err
+		}
+		if rebuilt {
+			changed = append(changed, table)
+		}
+	}
+
+	var indexSQL sql.NullString
+	err = tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'index' AND name = 'heartbeat_events_key'`).Scan(&indexSQL)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read heartbeat_events_key index definition: %v", err)
+	}
+	if want := eventsKeyIndex(collation); indexSQL.String != want {
+		if _, err := tx.Exec(`DROP INDEX IF EXISTS heartbeat_events_key`); err != nil {
+			return fmt.Errorf("failed to drop heartbeat_events_key index: %v", err)
+		}
+		if _, err := tx.Exec(want); err != nil {
+			return fmt.Errorf("failed to create heartbeat_events_key index: %v", err)
+		}
+		changed = append(changed, "heartbeat_events_key")
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit id collation change: %v", err)
+	}
+
+	slog.Info("changed heartbeat id collation", "to", collation, "rebuilt", changed)
+	return nil
+}
+
+// applyTableIDCollation rebuilds table with collation on its id column unless
+// it already has it, and reports whether it did.
+func applyTableIDCollation(tx *sql.Tx, table, collation string) (bool, error) {
+	var createSQL string
+	err := tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&createSQL)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s table definition: %v", table, err)
+	}
+
+	m := idColumnDef.FindStringSubmatch(createSQL)
+	if m == nil {
+		return false, fmt.Errorf("failed to find id column in %s table definition", table)
+	}
+	current := idCollationBinary
+	if strings.Contains(strings.ToUpper(m[1]), "NOCASE") {
+		current = idCollationNocase
+	}
+	if current == collation {
+		return false, nil
+	}
+
+	rebuilt := idColumnDef.ReplaceAllString(createSQL, "id TEXT NOT NULL COLLATE "+strings.ToUpper(collation))
+	rebuilt = tableCreate.ReplaceAllString(rebuilt, "CREATE TABLE "+table+"_rebuild")
+
+	if _, err := tx.Exec(rebuilt); err != nil {
+		return false, fmt.Errorf("failed to create rebuilt %s table: %v", table, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO ` + table + `_rebuild SELECT * FROM ` + table); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return false, fmt.Errorf("cannot switch id collation to %s, some %s ids differ only in case", collation, table)
+		}
+		return false, fmt.Errorf("failed to copy %s: %v", table, err)
+	}
+	if _, err := tx.Exec(`DROP TABLE ` + table); err != nil {
+		return false, fmt.Errorf("failed to drop old %s table: %v", table, err)
+	}
+	if _, err := tx.Exec(`ALTER TABLE ` + table + `_rebuild RENAME TO ` + table); err != nil {
+		return false, fmt.Errorf("failed to rename rebuilt %s table: %v", table, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countRows counts the heartbeat rows in the default namespace.
+func countRows(t *testing.T) int {
+	t.Helper()
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM heartbeats WHERE namespace = ?`, defaultNamespace).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestBinaryCollation(t *testing.T) {
+	setupTest(t, "--id-collation", "binary")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/Worker", ""), http.StatusNoContent)
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if rows := countRows(t); rows != 2 {
+		t.Fatalf("expected ids differing in case to be distinct, got %d rows", rows)
+	}
+
+	w := serve(h, http.MethodPost, "/intervals", `{"prefix":"work","interval":"30s"}`)
+	var result IntervalUpdateResult
+	decodeBody(t, w, &result)
+	if result.Updated != 1 {
+		t.Fatalf("expected the prefix to match case-sensitively, got %d updated", result.Updated)
+	}
+}
+
+func TestNocaseCollation(t *testing.T) {
+	setupTest(t, "--id-collation", "nocase", "--prefix-ttl", "BATCH.*=1h")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/Worker", ""), http.StatusNoContent)
+
+	getHeartbeat(t, "worker", "?ttl=1m")
+	getHeartbeat(t, "WORKER", "?ttl=1m")
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if rows := countRows(t); rows != 1 {
+		t.Fatalf("expected ids differing in case to be the same heartbeat, got %d rows", rows)
+	}
+
+	w := serve(h, http.MethodPost, "/intervals", `{"prefix":"WORK","interval":"30s"}`)
+	var result IntervalUpdateResult
+	decodeBody(t, w, &result)
+	if result.Updated != 1 {
+		t.Fatalf("expected the prefix to match case-insensitively, got %d updated", result.Updated)
+	}
+
+	if d, ok := defaultTTLFor("batch.import"); !ok || d != time.Hour {
+		t.Fatalf("expected the prefix ttl to match case-insensitively, got %v, %v", d, ok)
+	}
+	expectStatus(t, serve(h, http.MethodDelete, "/WORKER", ""), http.StatusNoContent)
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected the heartbeat to be deleted, got %d rows", rows)
+	}
+}
+
+func TestSwitchingCollation(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/Worker?ttl=1m", ""), http.StatusNoContent)
+
+	if err := applyIDCollation(db, idCollationNocase); err != nil {
+		t.Fatal(err)
+	}
+	cf.IDCollation = idCollationNocase
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 60 {
+		t.Fatalf("expected the heartbeat to survive the rebuild, got %+v", ttl)
+	}
+
+	if err := applyIDCollation(db, idCollationBinary); err != nil {
+		t.Fatal(err)
+	}
+	cf.IDCollation = idCollationBinary
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if err := applyIDCollation(db, idCollationNocase); err == nil {
+		t.Fatal("expected switching to nocase to fail with ids differing only in case")
+	}
+}
+
+func TestNocaseMetadataLimits(t *testing.T) {
+	setupTest(t, "--id-collation", "nocase", "--max-metadata-bytes", "100")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/Inventory", `{"max_bytes": 4096}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/INVENTORY", `{"max_bytes": 2048}`), http.StatusNoContent)
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM metadata_limits`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected limits for ids differing in case to share a row, got %d rows", rows)
+	}
+	expectStatus(t, serve(h, http.MethodPut, "/inventory", metadataBody(2048)), http.StatusNoContent)
+	expectError(t, serve(h, http.MethodPut, "/inventory", metadataBody(2049)), http.StatusRequestEntityTooLarge, "metadata_too_large")
+
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": 0}`), http.StatusNoContent)
+	if err := db.QueryRow(`SELECT COUNT(*) FROM metadata_limits`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("expected the limit to be removed under another case, got %d rows", rows)
+	}
+}
+
+// eventsQueryPlan returns the plan of a heartbeat_events lookup by id under
+// the configured collation.
+func eventsQueryPlan(t *testing.T) string {
+	t.Helper()
+	rows, err := db.Query(`EXPLAIN QUERY PLAN SELECT received_at FROM heartbeat_events WHERE namespace = ? AND id = ? `+idCollate(), defaultNamespace, "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var plan []string
+	for rows.Next() {
+		var (
+			id, parent, unused int
+			detail             string
+		)
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(plan, "\n")
+}
+
+func TestSwitchingCollationRebuildsRelatedKeys(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/metadata-limits/Worker", `{"max_bytes": 4096}`), http.StatusNoContent)
+	if plan := eventsQueryPlan(t); !strings.Contains(plan, "heartbeat_events_key") {
+		t.Fatalf("expected binary lookups to use the events index, got plan %q", plan)
+	}
+
+	if err := applyIDCollation(db, idCollationNocase); err != nil {
+		t.Fatal(err)
+	}
+	cf.IDCollation = idCollationNocase
+	if plan := eventsQueryPlan(t); !strings.Contains(plan, "heartbeat_events_key (namespace=? AND id=?)") {
+		t.Fatalf("expected nocase lookups to use the events index, got plan %q", plan)
+	}
+	limit, ok, err := store.MetadataLimit(context.Background(), heartbeatKey{Namespace: defaultNamespace, ID: "worker"})
+	if err != nil || !ok || limit != 4096 {
+		t.Fatalf("expected the limit to survive the rebuild, got %d, %v, %v", limit, ok, err)
+	}
+
+	if err := applyIDCollation(db, idCollationBinary); err != nil {
+		t.Fatal(err)
+	}
+	cf.IDCollation = idCollationBinary
+	if plan := eventsQueryPlan(t); !strings.Contains(plan, "heartbeat_events_key (namespace=? AND id=?)") {
+		t.Fatalf("expected binary lookups to use the rebuilt events index, got plan %q", plan)
+	}
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/metadata-limits/worker", `{"max_bytes": 2048}`), http.StatusNoContent)
+	if err := applyIDCollation(db, idCollationNocase); err == nil {
+		t.Fatal("expected switching to nocase to fail with metadata limit ids differing only in case")
+	}
+}
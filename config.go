@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const redacted = "REDACTED"
+
+// redactedConfig returns the resolved configuration with secrets removed,
+// keyed by AppConfig field name. Fields tagged `redact:"true"` are hidden
+// entirely when set; `redact:"query"` keeps everything before the query
+// string, which is where DSNs carry credentials such as _auth_pass.
+func redactedConfig(c *AppConfig) map[string]any {
+	out := map[string]any{}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i).Addr().Interface()
+
+		var resolved any
+		switch fv := value.(type) {
+		case *cli.StringSlice:
+			resolved = fv.Value()
+		case *time.Duration:
+			resolved = fv.String()
+		default:
+			resolved = v.Field(i).Interface()
+		}
+
+		switch field.Tag.Get("redact") {
+		case "true":
+			if !v.Field(i).IsZero() {
+				resolved = redacted
+			}
+		case "query":
+			if s, ok := resolved.(string); ok {
+				resolved = redactQuery(s)
+			}
+		}
+
+		out[field.Name] = resolved
+	}
+	return out
+}
+
+// redactQuery hides the query string of a DSN or URL.
+func redactQuery(s string) string {
+	if base, _, found := strings.Cut(s, "?"); found {
+		return base + "?" + redacted
+	}
+	return s
+}
+
+// redactURLError drops the URL an *url.Error names, as webhook and remote
+// write URLs often carry credentials.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request failed: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+func handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(redactedConfig(&cf)); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// withCORS lets browser pages from --allowed-origins read the external
+// server. Allowed preflight requests are answered here, anything else is
+// passed on. Without any allowed origins no CORS headers are sent.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origins := cf.AllowedOrigins.Value()
+		origin := r.Header.Get("Origin")
+		if len(origins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		switch {
+		case slices.Contains(origins, "*"):
+			h.Set("Access-Control-Allow-Origin", "*")
+		case slices.Contains(origins, origin):
+			h.Set("Access-Control-Allow-Origin", origin)
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET")
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", strings.Join([]string{"ETag", staleHeader, retentionExceededHeader, asOfHeader}, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
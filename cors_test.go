@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func corsRequest(method, origin string) *http.Request {
+	r := httptest.NewRequest(method, "/worker?ttl=1m", nil)
+	r.Header.Set("Origin", origin)
+	if method == http.MethodOptions {
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		r.Header.Set("Access-Control-Request-Headers", "if-none-match")
+	}
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	setupTest(t, "--allowed-origins", "https://status.example.com,https://ops.example.com")
+	h := withCORS(externalRouter())
+
+	w := serveRequest(h, corsRequest(http.MethodOptions, "https://ops.example.com"))
+	expectStatus(t, w, http.StatusNoContent)
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://ops.example.com",
+		"Access-Control-Allow-Methods": "GET",
+		"Access-Control-Allow-Headers": "if-none-match",
+		"Vary":                         "Origin",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestCORSAllowedOriginGet(t *testing.T) {
+	setupTest(t, "--allowed-origins", "https://status.example.com")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	w := serveRequest(withCORS(externalRouter()), corsRequest(http.MethodGet, "https://status.example.com"))
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://status.example.com" {
+		t.Fatalf("expected the origin to be allowed, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "ETag, "+staleHeader+", "+retentionExceededHeader+", "+asOfHeader {
+		t.Fatalf("expected the ETag, stale, retention and as-of headers to be exposed, got %q", got)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	setupTest(t, "--allowed-origins", "*")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	w := serveRequest(withCORS(externalRouter()), corsRequest(http.MethodGet, "https://anywhere.example.com"))
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Fatalf("expected any origin to be allowed, got %q", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	setupTest(t, "--allowed-origins", "https://status.example.com")
+	h := withCORS(externalRouter())
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		w := serveRequest(h, corsRequest(method, "https://evil.example.com"))
+		if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Fatalf("%s: expected no CORS grant, got %v", method, w.Header())
+		}
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := withCORS(externalRouter())
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		w := serveRequest(h, corsRequest(method, "https://status.example.com"))
+		for name := range w.Header() {
+			if strings.HasPrefix(name, "Access-Control-") || name == "Vary" {
+				t.Fatalf("%s: expected no CORS headers without --allowed-origins, got %v", method, w.Header())
+			}
+		}
+	}
+}
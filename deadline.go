@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// requestTimeoutHeader lets clients bound how long the server spends on
+// their request, e.g. "X-Request-Timeout: 500ms".
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// withClientDeadline applies the deadline requested through
+// requestTimeoutHeader to the request context, capped at
+// --max-request-timeout. Requests without the header are unaffected.
+func withClientDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(requestTimeoutHeader)
+		if v == "" || cf.MaxRequestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_timeout", fmt.Sprintf("%s header must be a positive duration", requestTimeoutHeader))
+			return
+		}
+		timeout = min(timeout, cf.MaxRequestTimeout)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
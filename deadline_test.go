@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowStore blocks every Put until the request context is done.
+type slowStore struct {
+	Store
+}
+
+func (s slowStore) Put(ctx context.Context, key heartbeatKey, now time.Time, opts PutOptions) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return s.Store.Put(ctx, key, now, opts)
+	}
+}
+
+// serveWithTimeout sends a PUT for worker with the given X-Request-Timeout
+// through h.
+func serveWithTimeout(h http.Handler, timeout string) (*httptest.ResponseRecorder, time.Duration) {
+	r := httptest.NewRequest(http.MethodPut, "/worker", nil)
+	r.Header.Set(requestTimeoutHeader, timeout)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(w, r)
+	return w, time.Since(start)
+}
+
+func TestClientDeadlineAbortsSlowOperation(t *testing.T) {
+	setupTest(t, "--max-request-timeout", "10s")
+	store = slowStore{store}
+
+	w, elapsed := serveWithTimeout(withClientDeadline(internalRouter()), "50ms")
+	expectError(t, w, http.StatusServiceUnavailable, "deadline_exceeded")
+	if elapsed > time.Second {
+		t.Fatalf("expected the request to fail fast, took %v", elapsed)
+	}
+}
+
+func TestClientDeadlineCappedByServerMax(t *testing.T) {
+	setupTest(t, "--max-request-timeout", "50ms")
+	store = slowStore{store}
+
+	w, elapsed := serveWithTimeout(withClientDeadline(internalRouter()), "1h")
+	expectError(t, w, http.StatusServiceUnavailable, "deadline_exceeded")
+	if elapsed > time.Second {
+		t.Fatalf("expected the deadline to be capped at 50ms, took %v", elapsed)
+	}
+}
+
+func TestClientDeadlineInvalid(t *testing.T) {
+	setupTest(t, "--max-request-timeout", "10s")
+	h := withClientDeadline(internalRouter())
+
+	for _, timeout := range []string{"soon", "0s", "-1s"} {
+		w, _ := serveWithTimeout(h, timeout)
+		expectError(t, w, http.StatusBadRequest, "invalid_request_timeout")
+	}
+	w, _ := serveWithTimeout(h, "1s")
+	expectStatus(t, w, http.StatusNoContent)
+}
+
+func TestClientDeadlineIgnoredWithoutServerMax(t *testing.T) {
+	setupTest(t, "--max-request-timeout", "0s")
+
+	w, _ := serveWithTimeout(withClientDeadline(internalRouter()), "soon")
+	expectStatus(t, w, http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the body of every error response. Code is stable and meant
+// to be matched on, Message is for humans and may change.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError is the JSON counterpart of http.Error, it must be called
+// before anything else is written to w.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(w, status, ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// writeErrorResponse writes an error body carrying more than ErrorDetail,
+// such as the bucket state of a 429. Its error object must still have the
+// code and message of ErrorDetail.
+func writeErrorResponse(w http.ResponseWriter, status int, body any) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExpiredErrorBody(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(2 * time.Minute)
+
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", "")
+	expectStatus(t, w, http.StatusNotFound)
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("expected a JSON error, got Content-Type %q", got)
+	}
+	if want := "{\"error\":{\"code\":\"expired\",\"message\":\"heartbeat expired\"}}\n"; w.Body.String() != want {
+		t.Fatalf("expected body %q, got %q", want, w.Body)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/worker", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/worker?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+	expectError(t, serve(h, http.MethodGet, "/missing?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
+
+func TestWriteJSONErrorReplacesHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Length", "512")
+	w.Header().Set("Content-Type", "text/csv")
+
+	writeJSONError(w, http.StatusTeapot, "teapot", "short and stout")
+	expectError(t, w, http.StatusTeapot, "teapot")
+	if w.Header().Get("Content-Length") != "" || w.Header().Get("Content-Type") != "application/json" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected JSON error headers, got %v", w.Header())
+	}
+}
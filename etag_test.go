@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getWithETag(etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/worker?ttl=1m", nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	return serveRequest(externalRouter(), r)
+}
+
+func TestETagNotModified(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	w := getWithETag("")
+	expectStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+
+	// The ETag holds while only remaining_seconds counts down.
+	c.Advance(10 * time.Second)
+	w = getWithETag(etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected 304 without a body, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Fatalf("expected the 304 to repeat the ETag, got %q", w.Header().Get("ETag"))
+	}
+
+	// A new heartbeat changes it.
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	w = getWithETag(etag)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("ETag") == etag {
+		t.Fatal("expected a new heartbeat to change the ETag")
+	}
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	// max-age counts down the whole seconds left until the ttl runs out.
+	for _, tc := range []struct {
+		advance time.Duration
+		want    string
+	}{
+		{0, "max-age=60"},
+		{15500 * time.Millisecond, "max-age=44"},
+		{44500 * time.Millisecond, "max-age=0"},
+	} {
+		c.Advance(tc.advance)
+		w := getWithETag("")
+		expectStatus(t, w, http.StatusOK)
+		if got := w.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestNoCachingHeadersOnErrors(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(2 * time.Minute)
+
+	for _, target := range []string{"/worker?ttl=1m", "/missing?ttl=1m"} {
+		w := serve(externalRouter(), http.MethodGet, target, "")
+		expectStatus(t, w, http.StatusNotFound)
+		if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+			t.Fatalf("%s: expected no caching headers, got %v", target, w.Header())
+		}
+	}
+
+	// An expired heartbeat shown through include_expired must be revalidated.
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m&include_expired=true", "")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got != "max-age=0" {
+		t.Fatalf("expected max-age=0 for an expired heartbeat, got %q", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handleGetExpired returns the ids of every heartbeat in ?namespace= older
+// than the given ttl as a plain JSON array, computed in a single query.
+func handleGetExpired(w http.ResponseWriter, r *http.Request) {
+	ttlDuration, ok := globalDefaultTTL(ttlEndpointExpired)
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		var err error
+		ttlDuration, err = parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return
+		}
+	} else if !ok {
+		writeJSONError(w, http.StatusBadRequest, "missing_ttl", "ttl query parameter is required")
+		return
+	}
+	cutoff := heartbeatNow().Add(-clampTTL(ttlDuration))
+
+	ids, err := store.Expired(r.Context(), queryNamespace(r), cutoff)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ids); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+func (s *sqliteStore) Expired(ctx context.Context, namespace string, cutoff time.Time) ([]string, error) {
+	// julianday compares the instants rather than the strings, which don't
+	// sort chronologically once precisions differ.
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id FROM heartbeats
+        WHERE namespace = ? AND NOT pending AND julianday(last_updated_at) < julianday(?)
+        ORDER BY id
+    `, namespace, cutoff.Format(storedTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query heartbeats: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	ids := []string{}
+	for rows.Next() {
+		var hbID string
+		if err := rows.Scan(&hbID); err != nil {
+			return nil, fmt.Errorf("failed to scan heartbeat: %v", err)
+		}
+		ids = append(ids, hbID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+	return ids, nil
+}
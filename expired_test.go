@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// expiredIDs requests the expired ids of the external router with query.
+func expiredIDs(t *testing.T, query string) []string {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/expired"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var ids []string
+	decodeBody(t, w, &ids)
+	return ids
+}
+
+func TestExpiredMixedData(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/old-b", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/old-a", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/old", ""), http.StatusNoContent)
+	c.Advance(10 * time.Minute)
+	expectStatus(t, serve(h, http.MethodPut, "/fresh", ""), http.StatusNoContent)
+
+	if ids := expiredIDs(t, "?ttl=5m"); !slices.Equal(ids, []string{"old-a", "old-b"}) {
+		t.Fatalf("expected old-a and old-b to be expired, got %v", ids)
+	}
+	if ids := expiredIDs(t, "?ttl=5m&namespace=team"); !slices.Equal(ids, []string{"old"}) {
+		t.Fatalf("expected old to be expired in team, got %v", ids)
+	}
+	if ids := expiredIDs(t, "?ttl=1h"); len(ids) != 0 {
+		t.Fatalf("expected nothing to be expired under a 1h ttl, got %v", ids)
+	}
+}
+
+func TestExpiredIsPlainArray(t *testing.T) {
+	setupTest(t)
+
+	w := serve(externalRouter(), http.MethodGet, "/expired?ttl=5m", "")
+	expectStatus(t, w, http.StatusOK)
+	if body := w.Body.String(); body != "[]\n" {
+		t.Fatalf("expected an empty JSON array, got %q", body)
+	}
+}
+
+func TestExpiredInvalidTTL(t *testing.T) {
+	setupTest(t)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/expired", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/expired?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+)
+
+func validExportFormat(format string) error {
+	switch format {
+	case exportFormatNDJSON, exportFormatCSV:
+		return nil
+	}
+	return fmt.Errorf("invalid export format %q, expected %s or %s", format, exportFormatNDJSON, exportFormatCSV)
+}
+
+func exportContentType(format string) string {
+	if format == exportFormatCSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// encodeExport renders a snapshot as NDJSON, one heartbeat per line, or as
+// CSV with a header row.
+func encodeExport(snapshot Snapshot, format string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if format == exportFormatCSV {
+		w := csv.NewWriter(&buf)
+		_ = w.Write([]string{"namespace", "id", "last_updated_at"})
+		for _, hb := range snapshot.Heartbeats {
+			_ = w.Write([]string{hb.Namespace, hb.ID, hb.LastUpdatedAt.Format(time.RFC3339Nano)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, fmt.Errorf("failed to encode csv export: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	enc := json.NewEncoder(&buf)
+	for _, hb := range snapshot.Heartbeats {
+		if err := enc.Encode(hb); err != nil {
+			return nil, fmt.Errorf("failed to encode ndjson export: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// handleGetExport serves a snapshot as NDJSON or CSV. The export is rendered
+// in full before it is sent so Range requests can resume an interrupted
+// download. The ETag is derived from the content, so a resume sent with
+// If-Range restarts from the beginning once heartbeats have changed.
+func handleGetExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportFormatNDJSON
+	}
+	if err := validExportFormat(format); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_format", err.Error())
+		return
+	}
+
+	snapshot, err := store.Snapshot(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to take snapshot: %v", err))
+		return
+	}
+	body, err := encodeExport(snapshot, format)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// getExport requests the export with query and the given headers.
+func getExport(query string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/export"+query, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return serveRequest(internalRouter(), r)
+}
+
+func TestExportRange(t *testing.T) {
+	setupTest(t)
+	for _, id := range []string{"a", "b", "c"} {
+		expectStatus(t, serve(internalRouter(), http.MethodPut, "/"+id, ""), http.StatusNoContent)
+	}
+	full := getExport("", nil)
+	expectStatus(t, full, http.StatusOK)
+	if full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected byte ranges to be advertised, got %q", full.Header().Get("Accept-Ranges"))
+	}
+	body := full.Body.String()
+	if lines := strings.Count(body, "\n"); lines != 3 {
+		t.Fatalf("expected 3 NDJSON lines, got %d: %q", lines, body)
+	}
+
+	partial := getExport("", map[string]string{"Range": "bytes=10-"})
+	expectStatus(t, partial, http.StatusPartialContent)
+	if partial.Body.String() != body[10:] {
+		t.Fatalf("expected the export from byte 10, got %q", partial.Body.String())
+	}
+
+	partial = getExport("", map[string]string{"Range": "bytes=0-9"})
+	expectStatus(t, partial, http.StatusPartialContent)
+	if partial.Body.String() != body[:10] {
+		t.Fatalf("expected the first 10 bytes, got %q", partial.Body.String())
+	}
+	if want := "bytes 0-9/" + strconv.Itoa(len(body)); partial.Header().Get("Content-Range") != want {
+		t.Fatalf("expected Content-Range %q, got %q", want, partial.Header().Get("Content-Range"))
+	}
+}
+
+func TestExportRangeIfRange(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/a", ""), http.StatusNoContent)
+	etag := getExport("", nil).Header().Get("ETag")
+
+	expectStatus(t, getExport("", map[string]string{"Range": "bytes=5-", "If-Range": etag}), http.StatusPartialContent)
+
+	// Once a heartbeat changes the resume restarts from the beginning.
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/b", ""), http.StatusNoContent)
+	w := getExport("", map[string]string{"Range": "bytes=5-", "If-Range": etag})
+	expectStatus(t, w, http.StatusOK)
+	if strings.Count(w.Body.String(), "\n") != 2 {
+		t.Fatalf("expected the full export, got %q", w.Body.String())
+	}
+}
+
+func TestExportCSVRange(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/a", ""), http.StatusNoContent)
+
+	w := getExport("?format=csv", map[string]string{"Range": "bytes=0-8"})
+	expectStatus(t, w, http.StatusPartialContent)
+	if w.Body.String() != "namespace" {
+		t.Fatalf("expected the start of the CSV header, got %q", w.Body.String())
+	}
+	expectStatus(t, getExport("?format=csv", map[string]string{"Range": "bytes=100000-"}), http.StatusRequestedRangeNotSatisfiable)
+	expectError(t, getExport("?format=xml", nil), http.StatusBadRequest, "invalid_format")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultFlapWindow = time.Hour
+
+// Heartbeat states a FlapTransition moves into.
+const (
+	stateAlive   = "alive"
+	stateExpired = "expired"
+)
+
+// FlapTransition is a change of a heartbeat between alive and expired.
+type FlapTransition struct {
+	At    time.Time `json:"at"`
+	State string    `json:"state"`
+}
+
+type HeartbeatFlaps struct {
+	Namespace     string  `json:"namespace"`
+	ID            string  `json:"id"`
+	WindowSeconds float64 `json:"window_seconds"`
+	TTLSeconds    float64 `json:"ttl_seconds"`
+	// Flaps counts Transitions, which are oldest first.
+	Flaps       int              `json:"flaps"`
+	Transitions []FlapTransition `json:"transitions"`
+}
+
+// handleGetFlaps replays the arrivals of a heartbeat over ?window= (1h by
+// default) under the ttl a check would use and returns when it expired and
+// came back, to diagnose a publisher whose ttl is too tight.
+func handleGetFlaps(w http.ResponseWriter, r *http.Request) {
+	hb, ok := windowHeartbeat(w, r)
+	if !ok {
+		return
+	}
+	window, ok := historyWindow(w, r, defaultFlapWindow)
+	if !ok {
+		return
+	}
+	ttl, ok := windowTTL(w, r, hb)
+	if !ok {
+		return
+	}
+
+	now := heartbeatNow()
+	start := now.Add(-window)
+	replay := newFlapReplay(start, ttl, hb.CreatedAt)
+	// An expiry inside the window follows an arrival at most ttl before it.
+	if err := store.Arrivals(r.Context(), heartbeatKey{Namespace: hb.Namespace, ID: hb.ID}, start.Add(-ttl), replay.arrive); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to read heartbeat events: %v", err))
+		return
+	}
+	transitions := replay.finish(now)
+
+	writeWindowResponse(w, HeartbeatFlaps{
+		Namespace:     hb.Namespace,
+		ID:            hb.ID,
+		WindowSeconds: window.Seconds(),
+		TTLSeconds:    ttl.Seconds(),
+		Flaps:         len(transitions),
+		Transitions:   transitions,
+	})
+}
+
+// flapReplay turns arrivals, fed oldest first from at least ttl before start,
+// into the transitions at or after start.
+type flapReplay struct {
+	start       time.Time
+	ttl         time.Duration
+	createdAt   time.Time
+	last        time.Time
+	transitions []FlapTransition
+}
+
+func newFlapReplay(start time.Time, ttl time.Duration, createdAt time.Time) *flapReplay {
+	return &flapReplay{start: start, ttl: ttl, createdAt: createdAt, transitions: []FlapTransition{}}
+}
+
+func (f *flapReplay) arrive(at time.Time) error {
+	switch {
+	case !f.last.IsZero():
+		if at.Sub(f.last) > f.ttl {
+			f.add(f.last.Add(f.ttl), stateExpired)
+			f.add(at, stateAlive)
+		}
+	case !at.Before(f.start) && (f.createdAt.IsZero() || f.createdAt.Before(at)):
+		// Nothing arrived in the ttl before this first arrival, so a
+		// heartbeat that existed before it had expired.
+		f.add(at, stateAlive)
+	}
+	f.last = at
+	return nil
+}
+
+// finish adds the expiry of a heartbeat quiet for longer than ttl at now.
+func (f *flapReplay) finish(now time.Time) []FlapTransition {
+	if !f.last.IsZero() && now.Sub(f.last) > f.ttl {
+		f.add(f.last.Add(f.ttl), stateExpired)
+	}
+	return f.transitions
+}
+
+func (f *flapReplay) add(at time.Time, state string) {
+	if !at.Before(f.start) {
+		f.transitions = append(f.transitions, FlapTransition{At: at, State: state})
+	}
+}
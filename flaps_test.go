@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getFlaps(t *testing.T, path, query string) HeartbeatFlaps {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+path+"/flaps"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var flaps HeartbeatFlaps
+	decodeBody(t, w, &flaps)
+	return flaps
+}
+
+// reportAt records id at each offset from start, in order.
+func reportAt(t *testing.T, c *fakeClock, start time.Time, path string, offsets ...time.Duration) {
+	t.Helper()
+	for _, offset := range offsets {
+		c.Set(start.Add(offset))
+		expectStatus(t, serve(internalRouter(), http.MethodPut, "/"+path, ""), http.StatusNoContent)
+	}
+}
+
+func TestFlaps(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	// Every 30s, then a 90s gap, 30s again, a 2m gap and silence.
+	reportAt(t, c, start, "worker", 0, 30*time.Second, time.Minute, 150*time.Second, 180*time.Second, 300*time.Second)
+	c.Set(start.Add(10 * time.Minute))
+
+	flaps := getFlaps(t, "worker", "?ttl=1m")
+	want := []FlapTransition{
+		{At: start.Add(2 * time.Minute), State: stateExpired},
+		{At: start.Add(150 * time.Second), State: stateAlive},
+		{At: start.Add(4 * time.Minute), State: stateExpired},
+		{At: start.Add(5 * time.Minute), State: stateAlive},
+		{At: start.Add(6 * time.Minute), State: stateExpired},
+	}
+	if flaps.Flaps != len(want) || len(flaps.Transitions) != len(want) {
+		t.Fatalf("expected %d flaps, got %+v", len(want), flaps)
+	}
+	for i, tr := range flaps.Transitions {
+		if !tr.At.Equal(want[i].At) || tr.State != want[i].State {
+			t.Fatalf("expected transition %d to be %+v, got %+v", i, want[i], tr)
+		}
+	}
+	if flaps.WindowSeconds != 3600 || flaps.TTLSeconds != 60 {
+		t.Fatalf("expected the default window and the requested ttl, got %+v", flaps)
+	}
+
+	// A looser ttl rides out the gaps, only the final silence is left.
+	if flaps := getFlaps(t, "worker", "?ttl=2m"); flaps.Flaps != 1 || flaps.Transitions[0].State != stateExpired {
+		t.Fatalf("expected a single expiry under a 2m ttl, got %+v", flaps)
+	}
+	// The window starts after the first two transitions.
+	if flaps := getFlaps(t, "worker", "?ttl=1m&window=7m"); flaps.Flaps != 3 || !flaps.Transitions[0].At.Equal(start.Add(4*time.Minute)) {
+		t.Fatalf("expected the transitions of the last 7m, got %+v", flaps)
+	}
+}
+
+func TestFlapsRecoveryAtWindowStart(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	// Quiet for 20m before coming back, a window of the last 10m only sees
+	// the recovery.
+	reportAt(t, c, start, "worker", 0, 25*time.Minute, 25*time.Minute+30*time.Second)
+	c.Set(start.Add(26 * time.Minute))
+
+	flaps := getFlaps(t, "worker", "?ttl=1m&window=10m")
+	if flaps.Flaps != 1 || flaps.Transitions[0].State != stateAlive || !flaps.Transitions[0].At.Equal(start.Add(25*time.Minute)) {
+		t.Fatalf("expected the recovery inside the window, got %+v", flaps)
+	}
+
+	// The first report of a new heartbeat isn't a recovery.
+	reportAt(t, c, start, "new", 26*time.Minute)
+	if flaps := getFlaps(t, "new", "?ttl=1m&window=10m"); flaps.Flaps != 0 {
+		t.Fatalf("expected no flaps for a new heartbeat, got %+v", flaps)
+	}
+}
+
+func TestFlapsStoredTTL(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	reportAt(t, c, start, "worker", 3*time.Minute)
+	c.Set(start.Add(3*time.Minute + 30*time.Second))
+
+	if flaps := getFlaps(t, "worker", ""); flaps.TTLSeconds != 60 || flaps.Flaps != 2 {
+		t.Fatalf("expected the stored ttl to be replayed, got %+v", flaps)
+	}
+}
+
+func TestFlapsErrors(t *testing.T) {
+	setupTest(t, "--history-retention", "24h")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/missing/flaps?ttl=1m", ""), http.StatusNotFound, "not_found")
+	expectError(t, serve(h, http.MethodGet, "/worker/flaps", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/worker/flaps?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+	expectError(t, serve(h, http.MethodGet, "/worker/flaps?ttl=1m&window=0s", ""), http.StatusBadRequest, "invalid_window")
+	expectError(t, serve(h, http.MethodGet, "/worker/flaps?ttl=1m&window=48h", ""), http.StatusBadRequest, "invalid_window")
+	expectError(t, serve(internalRouter(), http.MethodPut, "/team/flaps", ""), http.StatusBadRequest, "reserved_id")
+}
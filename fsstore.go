@@ -0,0 +1,1295 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dbDriverSQLite = "sqlite"
+	dbDriverFS     = "fs"
+)
+
+func validDBDriver(driver string) error {
+	switch driver {
+	case dbDriverSQLite, dbDriverFS:
+		return nil
+	}
+	return fmt.Errorf("invalid db driver %q, expected %s or %s", driver, dbDriverSQLite, dbDriverFS)
+}
+
+// fsTempPrefix starts the name of a file being written. One left behind was
+// never renamed into place, so it is discarded when the directory is opened.
+const fsTempPrefix = ".tmp-"
+
+// fsRename is os.Rename, replaced by tests to fail a write at the point a
+// crash would.
+var fsRename = os.Rename
+
+// fsHeartbeat is a heartbeat as held in its file. Dates are kept in
+// storedTimeFormat as written, so a hand-edited date is reported as corrupt
+// the way a bad database value is.
+type fsHeartbeat struct {
+	Namespace        string          `json:"namespace"`
+	ID               string          `json:"id"`
+	LastUpdatedAt    string          `json:"last_updated_at"`
+	TTLSeconds       *int64          `json:"ttl_seconds,omitempty"`
+	AlertURL         *string         `json:"alert_url,omitempty"`
+	LastMethod       *string         `json:"last_method,omitempty"`
+	Metadata         json.RawMessage `json:"metadata,omitempty"`
+	CreatedAt        *string         `json:"created_at,omitempty"`
+	ExpiryNotifiedAt *string         `json:"expiry_notified_at,omitempty"`
+	MutedUntil       *string         `json:"muted_until,omitempty"`
+	SLATarget        *float64        `json:"sla_target,omitempty"`
+	Pending          bool            `json:"pending,omitempty"`
+	// Events are the arrivals of the heartbeat, oldest first.
+	Events []string `json:"events"`
+}
+
+// fsMetadataLimit is an entry of metadata-limits.json.
+type fsMetadataLimit struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// fsBanner is the content of banner.json.
+type fsBanner struct {
+	Message   string `json:"message"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// fsWebhookDelivery is a delivery in webhook-deliveries.json.
+type fsWebhookDelivery struct {
+	ID             int64           `json:"id"`
+	URL            string          `json:"url"`
+	Payload        json.RawMessage `json:"payload"`
+	Heartbeats     []heartbeatKey  `json:"heartbeats"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	NextAttemptAt  string          `json:"next_attempt_at"`
+	DeadLetteredAt *string         `json:"dead_lettered_at,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+}
+
+// fsWebhookQueue is the content of webhook-deliveries.json.
+type fsWebhookQueue struct {
+	// NextID numbers deliveries, ids are not reused once a delivery leaves
+	// the queue.
+	NextID     int64               `json:"next_id"`
+	Deliveries []fsWebhookDelivery `json:"deliveries"`
+}
+
+// fsTombstone is a removal in tombstones.json.
+type fsTombstone struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+// fsStore is a Store for --db-driver fs, a directory holding one JSON file per
+// heartbeat under heartbeats/<namespace>/, along with its history, and
+// metadata-limits.json and banner.json for the settings,
+// webhook-deliveries.json for the webhook delivery queue and tombstones.json
+// for the removals list deltas report. Each file is replaced by writing a
+// temporary file and renaming it into place, so a crash leaves either the old
+// or the new version. Everything is read into memory when the directory is
+// opened and the store must be its only writer. Writes touching several files,
+// a batch or a reap, can be cut short by a crash, a failed write is otherwise
+// undone. Removals are recorded once the files are gone, a crash in between
+// leaves them out of list deltas.
+type fsStore struct {
+	dir string
+
+	mu         sync.RWMutex
+	heartbeats map[heartbeatKey]*fsHeartbeat
+	// paths holds the file each heartbeat was read from or last written to.
+	paths      map[heartbeatKey]string
+	limits     map[heartbeatKey]fsMetadataLimit
+	banner     *fsBanner
+	webhooks   fsWebhookQueue
+	tombstones []fsTombstone
+}
+
+// newFSStore opens dir, creating it if needed. Heartbeats are keyed by their
+// id as compared under the configured collation.
+func newFSStore(dir string) (*fsStore, error) {
+	s := &fsStore{
+		dir:        dir,
+		heartbeats: map[heartbeatKey]*fsHeartbeat{},
+		paths:      map[heartbeatKey]string{},
+		limits:     map[heartbeatKey]fsMetadataLimit{},
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "heartbeats"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create heartbeat directory: %v", err)
+	}
+
+	err := filepath.WalkDir(filepath.Join(dir, "heartbeats"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), fsTempPrefix) {
+			slog.Warn("removing a heartbeat file left unfinished", "path", path)
+			return os.Remove(path)
+		}
+		if filepath.Ext(path) != ".json" {
+			return nil
+		}
+		var hb fsHeartbeat
+		if err := readJSONFile(path, &hb); err != nil {
+			return err
+		}
+		key := fsKey(heartbeatKey{Namespace: hb.Namespace, ID: hb.ID})
+		if _, ok := s.heartbeats[key]; ok {
+			return fmt.Errorf("cannot open %s with id collation %s, some heartbeat ids differ only in case", dir, cf.IDCollation)
+		}
+		s.heartbeats[key] = &hb
+		s.paths[key] = path
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+
+	var limits []fsMetadataLimit
+	if err := readJSONFile(filepath.Join(dir, "metadata-limits.json"), &limits); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, l := range limits {
+		s.limits[fsKey(heartbeatKey{Namespace: l.Namespace, ID: l.ID})] = l
+	}
+	var banner fsBanner
+	switch err := readJSONFile(filepath.Join(dir, "banner.json"), &banner); {
+	case err == nil:
+		s.banner = &banner
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	if err := readJSONFile(filepath.Join(dir, "webhook-deliveries.json"), &s.webhooks); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := readJSONFile(filepath.Join(dir, "tombstones.json"), &s.tombstones); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	unfinished, err := filepath.Glob(filepath.Join(dir, fsTempPrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find unfinished files: %v", err)
+	}
+	for _, path := range unfinished {
+		slog.Warn("removing a settings file left unfinished", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove unfinished file: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// fsKey is key as heartbeats compare under the configured collation.
+func fsKey(key heartbeatKey) heartbeatKey {
+	return heartbeatKey{Namespace: key.Namespace, ID: foldID(key.ID)}
+}
+
+// fsFileName escapes s into a file name that is the same on case-insensitive
+// file systems only when s is: anything but lower case letters, digits, _
+// and - is written as %XX, and so is a leading dot.
+func fsFileName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.' && i > 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func (s *fsStore) heartbeatPath(key heartbeatKey) string {
+	key = fsKey(key)
+	return filepath.Join(s.dir, "heartbeats", fsFileName(key.Namespace), fsFileName(key.ID)+".json")
+}
+
+func readJSONFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces path with v by renaming a synced temporary file over
+// it, then syncs the directory so the rename survives a power loss.
+func writeJSONFile(path string, v any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, fsTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fsRename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %v", dir, err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %v", dir, err)
+	}
+	return nil
+}
+
+// fsTx stages changes to heartbeats until commit writes them. A nil
+// heartbeat deletes the key.
+type fsTx struct {
+	s       *fsStore
+	changed map[heartbeatKey]*fsHeartbeat
+	order   []heartbeatKey
+}
+
+func (s *fsStore) begin() *fsTx {
+	return &fsTx{s: s, changed: map[heartbeatKey]*fsHeartbeat{}}
+}
+
+func (tx *fsTx) get(key heartbeatKey) *fsHeartbeat {
+	key = fsKey(key)
+	if hb, ok := tx.changed[key]; ok {
+		return hb
+	}
+	return tx.s.heartbeats[key]
+}
+
+func (tx *fsTx) set(key heartbeatKey, hb *fsHeartbeat) {
+	key = fsKey(key)
+	if _, ok := tx.changed[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.changed[key] = hb
+}
+
+// commit writes the staged heartbeats in the order they were first changed.
+// When a write fails the files already written are put back.
+func (tx *fsTx) commit() error {
+	s := tx.s
+	var done []heartbeatKey
+	for _, key := range tx.order {
+		if err := s.writeHeartbeat(key, tx.changed[key]); err != nil {
+			for _, key := range slices.Backward(done) {
+				if undoErr := s.writeHeartbeat(key, s.heartbeats[key]); undoErr != nil {
+					slog.Error("failed to restore heartbeat file", "namespace", key.Namespace, "id", key.ID, "error", undoErr)
+				}
+			}
+			return err
+		}
+		done = append(done, key)
+	}
+	for _, key := range tx.order {
+		if hb := tx.changed[key]; hb != nil {
+			s.heartbeats[key] = hb
+		} else {
+			delete(s.heartbeats, key)
+		}
+	}
+	return nil
+}
+
+// writeHeartbeat writes hb, or removes the file of key for nil, and moves
+// a file read from an outdated path, such as after the id collation changed.
+func (s *fsStore) writeHeartbeat(key heartbeatKey, hb *fsHeartbeat) error {
+	old := s.paths[key]
+	if hb == nil {
+		if old == "" {
+			return nil
+		}
+		if err := os.Remove(old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete heartbeat file: %v", err)
+		}
+		delete(s.paths, key)
+		return nil
+	}
+	path := s.heartbeatPath(key)
+	if err := writeJSONFile(path, hb); err != nil {
+		return err
+	}
+	if old != "" && old != path {
+		_ = os.Remove(old)
+	}
+	s.paths[key] = path
+	return nil
+}
+
+func nullInt64Ptr(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+func nullStringPtr(v sql.NullString) *string {
+	if !v.Valid {
+		return nil
+	}
+	return &v.String
+}
+
+func nullFloat64Ptr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+// compactJSON returns raw without insignificant whitespace, as the metadata
+// was stored.
+func compactJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to target, as SQLite's
+// json_patch does for sqliteStore.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+func decodeJSONValue(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergeMetadata merges patch into the metadata stored, an empty object for
+// none, and returns the compact result.
+func mergeMetadata(stored json.RawMessage, patch string) (json.RawMessage, error) {
+	target := any(map[string]any{})
+	if len(stored) > 0 {
+		var err error
+		if target, err = decodeJSONValue(string(stored)); err != nil {
+			return nil, fmt.Errorf("failed to decode stored metadata: %v", err)
+		}
+	}
+	p, err := decodeJSONValue(patch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata patch: %v", err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(mergePatch(target, p)); err != nil {
+		return nil, fmt.Errorf("failed to encode merged metadata: %v", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// put stages a heartbeat write the way putHeartbeat upserts a row.
+func (tx *fsTx) put(key heartbeatKey, now time.Time, opts PutOptions) error {
+	stamp := now.Format(storedTimeFormat)
+	var hb fsHeartbeat
+	if cur := tx.get(key); cur != nil {
+		hb = *cur
+		hb.LastUpdatedAt = stamp
+		switch {
+		case opts.TTL.Valid:
+			hb.TTLSeconds = &opts.TTL.Int64
+		case hb.Pending:
+			hb.TTLSeconds = nullInt64Ptr(opts.InitialTTL)
+		}
+		if opts.AlertURL.Valid {
+			hb.AlertURL = &opts.AlertURL.String
+		}
+		if opts.SLATarget.Valid {
+			hb.SLATarget = &opts.SLATarget.Float64
+		}
+		if hb.Pending {
+			hb.CreatedAt = &stamp
+		}
+		hb.ExpiryNotifiedAt = nil
+		hb.Pending = false
+		hb.Events = slices.Clip(hb.Events)
+	} else {
+		hb = fsHeartbeat{
+			Namespace:     key.Namespace,
+			ID:            key.ID,
+			LastUpdatedAt: stamp,
+			TTLSeconds:    nullInt64Ptr(opts.InitialTTL),
+			AlertURL:      nullStringPtr(opts.AlertURL),
+			CreatedAt:     &stamp,
+			SLATarget:     nullFloat64Ptr(opts.SLATarget),
+		}
+	}
+	hb.LastMethod = nullStringPtr(opts.Method)
+
+	switch {
+	case opts.MetadataPatch.Valid:
+		merged, err := mergeMetadata(hb.Metadata, opts.MetadataPatch.String)
+		if err != nil {
+			return err
+		}
+		if int64(len(merged)) > opts.MaxMetadataBytes {
+			return ErrMetadataTooLarge
+		}
+		hb.Metadata = merged
+	case opts.Metadata.Valid:
+		hb.Metadata = json.RawMessage(opts.Metadata.String)
+	}
+	hb.Events = append(hb.Events, stamp)
+	tx.set(key, &hb)
+
+	if cf.RegisterParents {
+		for _, parent := range parentIDs(key.ID) {
+			parentKey := heartbeatKey{Namespace: key.Namespace, ID: parent}
+			if code, _ := reservedKey(parentKey); code != "" || tx.get(parentKey) != nil {
+				continue
+			}
+			tx.set(parentKey, &fsHeartbeat{
+				Namespace:     key.Namespace,
+				ID:            parent,
+				LastUpdatedAt: stamp,
+				CreatedAt:     &stamp,
+				Pending:       true,
+				Events:        []string{},
+			})
+		}
+	}
+	return nil
+}
+
+func (s *fsStore) Put(ctx context.Context, key heartbeatKey, now time.Time, opts PutOptions) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.begin()
+	if err := tx.put(key, now, opts); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (s *fsStore) PutMany(ctx context.Context, now time.Time, puts []HeartbeatPut) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.begin()
+	for _, p := range puts {
+		if err := tx.put(p.Key, now, p.Opts); err != nil {
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+// Get repairs dates in a legacy format or in the future like sqliteStore.
+func (s *fsStore) Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	cur := s.heartbeats[fsKey(key)]
+	s.mu.RUnlock()
+	if cur == nil {
+		return storedHeartbeat{}, ErrNotFound
+	}
+
+	lastUpdatedAt, legacy, err := parseStoredTime(cur.LastUpdatedAt)
+	if err != nil {
+		slog.Error("heartbeat has a corrupt last updated at date", "namespace", key.Namespace, "id", key.ID, "value", cur.LastUpdatedAt)
+		return storedHeartbeat{}, err
+	}
+	if legacy {
+		slog.Warn("repairing heartbeat stored in a legacy date format", "namespace", key.Namespace, "id", key.ID, "value", cur.LastUpdatedAt)
+		s.repairStoredTime(key, cur.LastUpdatedAt, lastUpdatedAt)
+	}
+	if now := heartbeatNow(); lastUpdatedAt.Sub(now) > clockJumpTolerance {
+		slog.Warn("heartbeat was last updated in the future, the clock may have moved backwards", "namespace", key.Namespace, "id", key.ID, "value", cur.LastUpdatedAt)
+		lastUpdatedAt = now
+		s.repairStoredTime(key, cur.LastUpdatedAt, lastUpdatedAt)
+	}
+
+	hb := storedHeartbeat{
+		Namespace:     key.Namespace,
+		ID:            key.ID,
+		LastUpdatedAt: lastUpdatedAt,
+		Pending:       cur.Pending,
+	}
+	if cur.TTLSeconds != nil {
+		hb.TTL = sql.NullInt64{Int64: *cur.TTLSeconds, Valid: true}
+	}
+	if cur.LastMethod != nil {
+		hb.Method = sql.NullString{String: *cur.LastMethod, Valid: true}
+	}
+	if len(cur.Metadata) > 0 {
+		hb.Metadata = sql.NullString{String: compactJSON(cur.Metadata), Valid: true}
+	}
+	if cur.SLATarget != nil {
+		hb.SLATarget = sql.NullFloat64{Float64: *cur.SLATarget, Valid: true}
+	}
+	if cur.CreatedAt != nil {
+		if createdAt, _, err := parseStoredTime(*cur.CreatedAt); err == nil {
+			hb.CreatedAt = createdAt
+		}
+	}
+	if cur.MutedUntil != nil {
+		if mutedUntil, _, err := parseStoredTime(*cur.MutedUntil); err == nil {
+			hb.MutedUntil = mutedUntil
+		}
+	}
+	return hb, nil
+}
+
+// repairStoredTime rewrites a last_updated_at value that can't be used as
+// stored, unless the heartbeat changed since it was read.
+func (s *fsStore) repairStoredTime(key heartbeatKey, oldValue string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.begin()
+	cur := tx.get(key)
+	if cur == nil || cur.LastUpdatedAt != oldValue {
+		return
+	}
+	hb := *cur
+	hb.LastUpdatedAt = t.Format(storedTimeFormat)
+	tx.set(key, &hb)
+	if err := tx.commit(); err != nil {
+		slog.Error("failed to repair heartbeat date", "namespace", key.Namespace, "id", key.ID, "error", err)
+	}
+}
+
+func (s *fsStore) Delete(ctx context.Context, key heartbeatKey) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.begin()
+	cur := tx.get(key)
+	if cur == nil {
+		return ErrNotFound
+	}
+	tx.set(key, nil)
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	s.recordTombstones([]heartbeatKey{{Namespace: cur.Namespace, ID: cur.ID}}, heartbeatNow())
+	return nil
+}
+
+// recordTombstones remembers that keys were removed at now and forgets
+// removals older than listDeltaRetention. The heartbeats are already gone,
+// so a failed write is only logged and the removals are still reported
+// until the store is reopened. It must be called with mu held.
+func (s *fsStore) recordTombstones(keys []heartbeatKey, now time.Time) {
+	stamp := now.Format(storedTimeFormat)
+	s.tombstones = slices.DeleteFunc(s.tombstones, func(t fsTombstone) bool {
+		deletedAt, ok := storedTime(t.DeletedAt)
+		return !ok || deletedAt.Before(now.Add(-listDeltaRetention))
+	})
+	for _, key := range keys {
+		s.tombstones = append(s.tombstones, fsTombstone{Namespace: key.Namespace, ID: key.ID, DeletedAt: stamp})
+	}
+	if err := writeJSONFile(filepath.Join(s.dir, "tombstones.json"), s.tombstones); err != nil {
+		slog.Error("failed to record removed heartbeats", "error", err)
+	}
+}
+
+func (s *fsStore) Removed(ctx context.Context, namespace string, since time.Time) ([]string, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for _, t := range s.tombstones {
+		if deletedAt, ok := storedTime(t.DeletedAt); t.Namespace == namespace && ok && !deletedAt.Before(since) {
+			ids = append(ids, t.ID)
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// sorted returns the heartbeats for which keep is true ordered by namespace
+// and then id under the configured collation. It must be called with mu held.
+func (s *fsStore) sorted(keep func(*fsHeartbeat) bool) []*fsHeartbeat {
+	var hbs []*fsHeartbeat
+	for _, hb := range s.heartbeats {
+		if keep(hb) {
+			hbs = append(hbs, hb)
+		}
+	}
+	slices.SortFunc(hbs, func(a, b *fsHeartbeat) int {
+		return cmp.Or(
+			strings.Compare(a.Namespace, b.Namespace),
+			strings.Compare(foldID(a.ID), foldID(b.ID)),
+			strings.Compare(a.ID, b.ID),
+		)
+	})
+	return hbs
+}
+
+// storedTime parses a date, false when it is corrupt, which julianday
+// treats as NULL in the conditions of sqliteStore.
+func storedTime(value string) (time.Time, bool) {
+	t, _, err := parseStoredTime(value)
+	return t, err == nil
+}
+
+// metadataHas reports whether the dotted key holds a value other than null
+// in metadata, like json_extract in sqliteStore.List.
+func metadataHas(metadata json.RawMessage, key string) bool {
+	if len(metadata) == 0 {
+		return false
+	}
+	v, err := decodeJSONValue(string(metadata))
+	if err != nil {
+		return false
+	}
+	for _, segment := range strings.Split(key, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		if v, ok = obj[segment]; !ok {
+			return false
+		}
+	}
+	return v != nil
+}
+
+func (s *fsStore) List(ctx context.Context, q ListQuery, fn func(HeartbeatStatus) error) error {
+	dbStart := time.Now()
+	s.mu.RLock()
+	hbs := s.sorted(func(hb *fsHeartbeat) bool {
+		if hb.Namespace != q.Namespace {
+			return false
+		}
+		if len(q.Prefixes) > 0 && !hasAnyIDPrefix(hb.ID, q.Prefixes) {
+			return false
+		}
+		if !q.ChangedSince.IsZero() {
+			lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt)
+			expired := !hb.Pending && !lastUpdatedAt.Before(q.ExpiredAfter) && lastUpdatedAt.Before(q.Cutoff)
+			if !ok || lastUpdatedAt.Before(q.ChangedSince) && !expired {
+				return false
+			}
+		}
+		if q.Status != "" {
+			lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt)
+			if hb.Pending || !ok || lastUpdatedAt.Before(q.Cutoff) != (q.Status == "expired") {
+				return false
+			}
+		}
+		return q.HasMeta == "" || metadataHas(hb.Metadata, q.HasMeta)
+	})
+	s.mu.RUnlock()
+	recordDBTime(ctx, dbStart)
+
+	hbs = hbs[min(q.Offset, len(hbs)):]
+	hbs = hbs[:min(q.Limit, len(hbs))]
+	for _, cur := range hbs {
+		lastUpdatedAt, ok := storedTime(cur.LastUpdatedAt)
+		if !ok {
+			httpLog.Warn("skipping heartbeat with a corrupt last updated at date in list", "id", cur.ID, "value", cur.LastUpdatedAt)
+			continue
+		}
+		hb := HeartbeatStatus{
+			Heartbeat: Heartbeat{Namespace: cur.Namespace, ID: cur.ID, LastUpdatedAt: lastUpdatedAt},
+			Expired:   !cur.Pending && lastUpdatedAt.Before(q.Cutoff),
+			Pending:   cur.Pending,
+		}
+		if cur.LastMethod != nil {
+			hb.Method = *cur.LastMethod
+		}
+		if cur.CreatedAt != nil {
+			if createdAt, ok := storedTime(*cur.CreatedAt); ok {
+				hb.CreatedAt = &createdAt
+			}
+		}
+		if err := fn(hb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsStore) Keys(ctx context.Context, fn func(heartbeatKey)) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	keys := make([]heartbeatKey, 0, len(s.heartbeats))
+	for _, hb := range s.heartbeats {
+		keys = append(keys, heartbeatKey{Namespace: hb.Namespace, ID: hb.ID})
+	}
+	s.mu.RUnlock()
+	for _, key := range keys {
+		fn(key)
+	}
+	return nil
+}
+
+// Snapshot copies the heartbeats under the read lock, so writes can't
+// interleave with it.
+func (s *fsStore) Snapshot(ctx context.Context) (Snapshot, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := Snapshot{
+		TakenAt:    time.Now().UTC(),
+		Heartbeats: []Heartbeat{},
+	}
+	for _, hb := range s.sorted(func(hb *fsHeartbeat) bool { return !hb.Pending }) {
+		lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt)
+		if !ok {
+			slog.Warn("skipping heartbeat with a corrupt last updated at date in snapshot", "namespace", hb.Namespace, "id", hb.ID, "value", hb.LastUpdatedAt)
+			continue
+		}
+		snapshot.Heartbeats = append(snapshot.Heartbeats, Heartbeat{
+			Namespace:     hb.Namespace,
+			ID:            hb.ID,
+			LastUpdatedAt: lastUpdatedAt,
+		})
+	}
+	return snapshot, nil
+}
+
+func (s *fsStore) Expired(ctx context.Context, namespace string, cutoff time.Time) ([]string, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []string{}
+	for _, hb := range s.sorted(func(hb *fsHeartbeat) bool {
+		lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt)
+		return hb.Namespace == namespace && !hb.Pending && ok && lastUpdatedAt.Before(cutoff)
+	}) {
+		ids = append(ids, hb.ID)
+	}
+	return ids, nil
+}
+
+// hasIDPrefix compares like the substr condition of sqliteStore, under the
+// configured collation.
+func hasIDPrefix(id, prefix string) bool {
+	return strings.HasPrefix(foldID(id), foldID(prefix))
+}
+
+// hasAnyIDPrefix reports whether id starts with any of prefixes.
+func hasAnyIDPrefix(id string, prefixes []string) bool {
+	return slices.ContainsFunc(prefixes, func(prefix string) bool {
+		return hasIDPrefix(id, prefix)
+	})
+}
+
+func (s *fsStore) CountGroup(ctx context.Context, namespace, prefix string, cutoff time.Time) (total, expired int64, err error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, hb := range s.heartbeats {
+		if hb.Namespace != namespace || hb.Pending || !hasIDPrefix(hb.ID, prefix) {
+			continue
+		}
+		total++
+		if lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt); !ok || lastUpdatedAt.Before(cutoff) {
+			expired++
+		}
+	}
+	return total, expired, nil
+}
+
+// effectiveTTL is the stored ttl of hb raised to --min-ttl, false without one.
+func (hb *fsHeartbeat) effectiveTTL() (time.Duration, bool) {
+	if hb.TTLSeconds == nil {
+		return 0, false
+	}
+	return max(time.Duration(*hb.TTLSeconds)*time.Second, cf.MinTTL), true
+}
+
+func (s *fsStore) CountAlive(ctx context.Context, fallback time.Duration, now time.Time) (total, alive int64, err error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, hb := range s.heartbeats {
+		if hb.Pending {
+			continue
+		}
+		ttl, ok := hb.effectiveTTL()
+		if !ok {
+			if fallback <= 0 {
+				continue
+			}
+			ttl = max(fallback, cf.MinTTL)
+		}
+		total++
+		if lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt); ok && !lastUpdatedAt.Add(ttl).Before(now) {
+			alive++
+		}
+	}
+	return total, alive, nil
+}
+
+// events returns the arrivals of key, oldest first.
+func (s *fsStore) events(key heartbeatKey) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hb := s.heartbeats[fsKey(key)]; hb != nil {
+		return hb.Events
+	}
+	return nil
+}
+
+func (s *fsStore) History(ctx context.Context, key heartbeatKey, limit int) ([]time.Time, error) {
+	defer recordDBTime(ctx, time.Now())
+	events := s.events(key)
+	history := []time.Time{}
+	for _, value := range slices.Backward(events[max(len(events)-limit, 0):]) {
+		receivedAt, ok := storedTime(value)
+		if !ok {
+			httpLog.Warn("skipping heartbeat event with a corrupt date", "namespace", key.Namespace, "id", key.ID, "value", value)
+			continue
+		}
+		history = append(history, receivedAt)
+	}
+	return history, nil
+}
+
+func (s *fsStore) Arrivals(ctx context.Context, key heartbeatKey, since time.Time, fn func(time.Time) error) error {
+	defer recordDBTime(ctx, time.Now())
+	for _, value := range s.events(key) {
+		receivedAt, ok := storedTime(value)
+		if !ok || receivedAt.Before(since) {
+			continue
+		}
+		if err := fn(receivedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsStore) SetIntervals(ctx context.Context, namespace, prefix string, interval time.Duration) (int64, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	ttl := int64(interval / time.Second)
+	var updated int64
+	for key, cur := range s.heartbeats {
+		if cur.Namespace != namespace || cur.Pending || !hasIDPrefix(cur.ID, prefix) {
+			continue
+		}
+		hb := *cur
+		hb.TTLSeconds = &ttl
+		tx.set(key, &hb)
+		updated++
+	}
+	if err := tx.commit(); err != nil {
+		return 0, fmt.Errorf("failed to update intervals: %v", err)
+	}
+	return updated, nil
+}
+
+func (s *fsStore) Mute(ctx context.Context, key heartbeatKey, until time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	cur := tx.get(key)
+	if cur == nil {
+		return ErrNotFound
+	}
+	hb := *cur
+	mutedUntil := until.UTC().Format(storedTimeFormat)
+	hb.MutedUntil = &mutedUntil
+	tx.set(key, &hb)
+	if err := tx.commit(); err != nil {
+		return fmt.Errorf("failed to mute heartbeat: %v", err)
+	}
+	return nil
+}
+
+func (s *fsStore) MetadataLimit(ctx context.Context, key heartbeatKey) (int64, bool, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.limits[fsKey(key)]
+	return l.MaxBytes, ok, nil
+}
+
+// SetMetadataLimit rewrites metadata-limits.json, ordered like the
+// heartbeats.
+func (s *fsStore) SetMetadataLimit(ctx context.Context, key heartbeatKey, maxBytes int64) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits := make(map[heartbeatKey]fsMetadataLimit, len(s.limits)+1)
+	for k, l := range s.limits {
+		limits[k] = l
+	}
+	if maxBytes == 0 {
+		delete(limits, fsKey(key))
+	} else {
+		l, ok := limits[fsKey(key)]
+		if !ok {
+			l = fsMetadataLimit{Namespace: key.Namespace, ID: key.ID}
+		}
+		l.MaxBytes = maxBytes
+		limits[fsKey(key)] = l
+	}
+
+	sorted := []fsMetadataLimit{}
+	for _, l := range limits {
+		sorted = append(sorted, l)
+	}
+	slices.SortFunc(sorted, func(a, b fsMetadataLimit) int {
+		return cmp.Or(strings.Compare(a.Namespace, b.Namespace), strings.Compare(a.ID, b.ID))
+	})
+	if err := writeJSONFile(filepath.Join(s.dir, "metadata-limits.json"), sorted); err != nil {
+		return fmt.Errorf("failed to store metadata limit: %v", err)
+	}
+	s.limits = limits
+	return nil
+}
+
+func (s *fsStore) Banner(ctx context.Context) (Banner, bool, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.banner == nil {
+		return Banner{}, false, nil
+	}
+	banner := Banner{Message: s.banner.Message}
+	var err error
+	if banner.UpdatedAt, _, err = parseStoredTime(s.banner.UpdatedAt); err != nil {
+		return Banner{}, false, err
+	}
+	return banner, true, nil
+}
+
+func (s *fsStore) SetBanner(ctx context.Context, message string, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, "banner.json")
+	if message == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to store banner: %v", err)
+		}
+		s.banner = nil
+		return nil
+	}
+	banner := &fsBanner{Message: message, UpdatedAt: now.Format(storedTimeFormat)}
+	if err := writeJSONFile(path, banner); err != nil {
+		return fmt.Errorf("failed to store banner: %v", err)
+	}
+	s.banner = banner
+	return nil
+}
+
+// pastTTL reports whether hb with a stored ttl was last updated more than
+// that ttl plus grace before now.
+func (hb *fsHeartbeat) pastTTL(grace time.Duration, now time.Time) bool {
+	ttl, ok := hb.effectiveTTL()
+	if !ok {
+		return false
+	}
+	lastUpdatedAt, ok := storedTime(hb.LastUpdatedAt)
+	return ok && lastUpdatedAt.Add(ttl+grace).Before(now)
+}
+
+func (s *fsStore) Stale(ctx context.Context, now time.Time) ([]heartbeatKey, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stale := []heartbeatKey{}
+	for _, hb := range s.sorted(func(hb *fsHeartbeat) bool { return hb.pastTTL(0, now) }) {
+		stale = append(stale, heartbeatKey{Namespace: hb.Namespace, ID: hb.ID})
+	}
+	return stale, nil
+}
+
+func (s *fsStore) ExpiredUnnotified(ctx context.Context, now time.Time) ([]expiredUnnotified, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var expired []expiredUnnotified
+	for _, hb := range s.sorted(func(hb *fsHeartbeat) bool {
+		if hb.ExpiryNotifiedAt != nil || !hb.pastTTL(0, now) {
+			return false
+		}
+		if hb.MutedUntil == nil {
+			return true
+		}
+		mutedUntil, ok := storedTime(*hb.MutedUntil)
+		return ok && !mutedUntil.After(now)
+	}) {
+		lastUpdatedAt, _ := storedTime(hb.LastUpdatedAt)
+		e := expiredUnnotified{
+			notification: ExpiryNotification{
+				Namespace:     hb.Namespace,
+				ID:            hb.ID,
+				LastUpdatedAt: lastUpdatedAt,
+				ExpiredAt:     lastUpdatedAt.Add(clampTTL(time.Duration(*hb.TTLSeconds) * time.Second)),
+			},
+			stamp: hb.LastUpdatedAt,
+		}
+		if hb.AlertURL != nil {
+			e.url = *hb.AlertURL
+		}
+		expired = append(expired, e)
+	}
+	return expired, nil
+}
+
+// QueueWebhook writes the queue before the heartbeats, a crash in between
+// queues the notification without recording it, so it is queued again once
+// the store is reopened rather than lost.
+func (s *fsStore) QueueWebhook(ctx context.Context, d webhookDelivery, expired []expiredUnnotified, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stamp := now.Format(storedTimeFormat)
+	queue := fsWebhookQueue{NextID: s.webhooks.NextID + 1, Deliveries: slices.Clone(s.webhooks.Deliveries)}
+	queue.Deliveries = append(queue.Deliveries, fsWebhookDelivery{
+		ID:            queue.NextID,
+		URL:           d.url,
+		Payload:       d.payload,
+		Heartbeats:    d.heartbeats,
+		NextAttemptAt: stamp,
+		CreatedAt:     stamp,
+	})
+	if err := s.writeWebhooks(queue); err != nil {
+		return fmt.Errorf("failed to queue expiry notification: %v", err)
+	}
+
+	tx := s.begin()
+	for _, e := range expired {
+		key := heartbeatKey{Namespace: e.notification.Namespace, ID: e.notification.ID}
+		cur := tx.get(key)
+		if cur == nil || cur.LastUpdatedAt != e.stamp {
+			continue
+		}
+		hb := *cur
+		hb.ExpiryNotifiedAt = &stamp
+		tx.set(key, &hb)
+	}
+	if err := tx.commit(); err != nil {
+		if undoErr := s.writeWebhooks(s.webhooks); undoErr != nil {
+			slog.Error("failed to restore webhook delivery queue", "error", undoErr)
+		}
+		return fmt.Errorf("failed to record expiry notification: %v", err)
+	}
+	s.webhooks = queue
+	return nil
+}
+
+func (s *fsStore) writeWebhooks(queue fsWebhookQueue) error {
+	return writeJSONFile(filepath.Join(s.dir, "webhook-deliveries.json"), queue)
+}
+
+func (s *fsStore) DueWebhooks(ctx context.Context, now time.Time) ([]webhookDelivery, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var due []webhookDelivery
+	for _, d := range s.webhooks.Deliveries {
+		if d.DeadLetteredAt != nil {
+			continue
+		}
+		if next, ok := storedTime(d.NextAttemptAt); !ok || next.After(now) {
+			continue
+		}
+		due = append(due, webhookDelivery{
+			id:         d.ID,
+			url:        d.URL,
+			payload:    []byte(compactJSON(d.Payload)),
+			heartbeats: d.Heartbeats,
+			attempts:   d.Attempts,
+			lastError:  d.LastError,
+		})
+	}
+	return due, nil
+}
+
+// updateWebhook writes the queue with the delivery numbered id changed by
+// fn, or removed for a nil fn.
+func (s *fsStore) updateWebhook(id int64, fn func(*fsWebhookDelivery)) error {
+	queue := fsWebhookQueue{NextID: s.webhooks.NextID}
+	for _, d := range s.webhooks.Deliveries {
+		if d.ID == id {
+			if fn == nil {
+				continue
+			}
+			fn(&d)
+		}
+		queue.Deliveries = append(queue.Deliveries, d)
+	}
+	if err := s.writeWebhooks(queue); err != nil {
+		return err
+	}
+	s.webhooks = queue
+	return nil
+}
+
+func (s *fsStore) CompleteWebhook(ctx context.Context, id int64) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.updateWebhook(id, nil); err != nil {
+		return fmt.Errorf("failed to remove delivered webhook: %v", err)
+	}
+	return nil
+}
+
+func (s *fsStore) RetryWebhook(ctx context.Context, d webhookDelivery, next time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.updateWebhook(d.id, func(stored *fsWebhookDelivery) {
+		stored.Attempts, stored.LastError = d.attempts, d.lastError
+		stored.NextAttemptAt = next.Format(storedTimeFormat)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record failed webhook delivery: %v", err)
+	}
+	return nil
+}
+
+func (s *fsStore) DeadLetterWebhook(ctx context.Context, d webhookDelivery, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadLetteredAt := now.Format(storedTimeFormat)
+	err := s.updateWebhook(d.id, func(stored *fsWebhookDelivery) {
+		stored.Attempts, stored.LastError = d.attempts, d.lastError
+		stored.DeadLetteredAt = &deadLetteredAt
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter webhook delivery: %v", err)
+	}
+	return nil
+}
+
+// ReapExpired keeps heartbeats with a corrupt creation date, like
+// sqliteStore.
+func (s *fsStore) ReapExpired(ctx context.Context, grace, newGrace time.Duration, now time.Time) (int64, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	var reaped []heartbeatKey
+	for key, hb := range s.heartbeats {
+		if !hb.pastTTL(grace, now) {
+			continue
+		}
+		if hb.CreatedAt != nil {
+			createdAt, ok := storedTime(*hb.CreatedAt)
+			if !ok || createdAt.Add(newGrace).After(now) {
+				continue
+			}
+		}
+		tx.set(key, nil)
+		reaped = append(reaped, heartbeatKey{Namespace: hb.Namespace, ID: hb.ID})
+	}
+	if err := tx.commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete expired heartbeats: %v", err)
+	}
+	if len(reaped) > 0 {
+		s.recordTombstones(reaped, now)
+	}
+	return int64(len(reaped)), nil
+}
+
+func (s *fsStore) TrimHistory(ctx context.Context, cutoff time.Time) (int64, error) {
+	defer recordDBTime(ctx, time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	var removed int64
+	for key, cur := range s.heartbeats {
+		kept := slices.DeleteFunc(slices.Clone(cur.Events), func(value string) bool {
+			receivedAt, ok := storedTime(value)
+			return ok && receivedAt.Before(cutoff)
+		})
+		if len(kept) == len(cur.Events) {
+			continue
+		}
+		removed += int64(len(cur.Events) - len(kept))
+		hb := *cur
+		hb.Events = kept
+		tx.set(key, &hb)
+	}
+	if err := tx.commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete heartbeat events: %v", err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFSStore makes the handlers use an fsStore over a fresh directory with no
+// database behind them, and returns the store and its directory.
+func useFSStore(t *testing.T) (*fsStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := newFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteDB := db
+	t.Cleanup(func() {
+		db = sqliteDB
+	})
+	db, store = nil, s
+	cf.DBDriver, cf.SQLiteDSN = dbDriverFS, dir
+	return s, dir
+}
+
+// reopenFSStore reads dir again, as a restart would.
+func reopenFSStore(t *testing.T, dir string) *fsStore {
+	t.Helper()
+	s, err := newFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// failRenames makes every temp file rename fail, as if the process died
+// before it.
+func failRenames(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		fsRename = os.Rename
+	})
+	fsRename = func(oldPath, newPath string) error {
+		return errors.New("rename failed")
+	}
+}
+
+// tempFiles returns the unfinished writes left in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var temps []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && strings.HasPrefix(d.Name(), fsTempPrefix) {
+			temps = append(temps, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return temps
+}
+
+func TestFSStorePersists(t *testing.T) {
+	setupTest(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := reopenFSStore(t, dir)
+	base := storeTestBase()
+	mustPut(t, s, workerKey, base, PutOptions{InitialTTL: seconds(60), Metadata: text(`{"region":"eu-west-1"}`)})
+	mustPut(t, s, workerKey, base.Add(time.Minute), PutOptions{})
+	mustPut(t, s, teamKey, base, PutOptions{})
+	if err := s.Delete(ctx, teamKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMetadataLimit(ctx, workerKey, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBanner(ctx, "maintenance", base); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.QueueWebhook(ctx, webhookDelivery{url: "https://alerts.example.com", payload: []byte(`{"id":"worker"}`), heartbeats: []heartbeatKey{workerKey}}, nil, base); err != nil {
+		t.Fatal(err)
+	}
+
+	s = reopenFSStore(t, dir)
+	hb := mustGet(t, s, workerKey)
+	if !hb.LastUpdatedAt.Equal(base.Add(time.Minute)) || !hb.CreatedAt.Equal(base) || hb.TTL != seconds(60) || hb.Metadata != text(`{"region":"eu-west-1"}`) {
+		t.Fatalf("expected the heartbeat to survive a reopen, got %+v", hb)
+	}
+	if history, err := s.History(ctx, workerKey, 10); err != nil || len(history) != 2 {
+		t.Fatalf("expected the history to survive a reopen, got %v, %v", history, err)
+	}
+	if _, err := s.Get(ctx, teamKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the deleted heartbeat to stay deleted, got %v", err)
+	}
+	if ids, err := s.Removed(ctx, "team", base); err != nil || len(ids) != 1 {
+		t.Fatalf("expected the removal to survive a reopen, got %v, %v", ids, err)
+	}
+	if limit, ok, err := s.MetadataLimit(ctx, workerKey); err != nil || !ok || limit != 4096 {
+		t.Fatalf("expected the metadata limit to survive a reopen, got %d, %v, %v", limit, ok, err)
+	}
+	if banner, ok, err := s.Banner(ctx); err != nil || !ok || banner.Message != "maintenance" {
+		t.Fatalf("expected the banner to survive a reopen, got %+v, %v, %v", banner, ok, err)
+	}
+	if due, err := s.DueWebhooks(ctx, base); err != nil || len(due) != 1 || string(due[0].payload) != `{"id":"worker"}` {
+		t.Fatalf("expected the queued webhook to survive a reopen, got %+v, %v", due, err)
+	}
+}
+
+func TestFSStoreFailedWriteKeepsOldVersion(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	s := reopenFSStore(t, dir)
+	base := storeTestBase()
+	mustPut(t, s, workerKey, base, PutOptions{InitialTTL: seconds(60)})
+	before, err := os.ReadFile(s.heartbeatPath(workerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failRenames(t)
+	if err := s.Put(context.Background(), workerKey, base.Add(time.Minute), PutOptions{TTL: seconds(120)}); err == nil {
+		t.Fatal("expected the failed write to be reported")
+	}
+	after, err := os.ReadFile(s.heartbeatPath(workerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Fatalf("expected the file to keep its old version, got %s", after)
+	}
+	if temps := tempFiles(t, dir); len(temps) != 0 {
+		t.Fatalf("expected the temporary file to be removed, got %v", temps)
+	}
+	if hb := mustGet(t, s, workerKey); !hb.LastUpdatedAt.Equal(base) || hb.TTL != seconds(60) {
+		t.Fatalf("expected the failed write to be left out of the store, got %+v", hb)
+	}
+}
+
+func TestFSStoreFailedBatchUndone(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	s := reopenFSStore(t, dir)
+	base := storeTestBase()
+	mustPut(t, s, workerKey, base, PutOptions{})
+
+	// The first file of the batch is written, the second fails.
+	renames := 0
+	t.Cleanup(func() {
+		fsRename = os.Rename
+	})
+	fsRename = func(oldPath, newPath string) error {
+		if renames++; renames == 2 {
+			return errors.New("rename failed")
+		}
+		return os.Rename(oldPath, newPath)
+	}
+	err := s.PutMany(context.Background(), base.Add(time.Minute), []HeartbeatPut{{Key: workerKey}, {Key: teamKey}})
+	if err == nil {
+		t.Fatal("expected the failed batch to be reported")
+	}
+	fsRename = os.Rename
+
+	s = reopenFSStore(t, dir)
+	if hb := mustGet(t, s, workerKey); !hb.LastUpdatedAt.Equal(base) {
+		t.Fatalf("expected the written heartbeat to be put back, got %+v", hb)
+	}
+	if _, err := s.Get(context.Background(), teamKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the failed heartbeat to be missing, got %v", err)
+	}
+}
+
+func TestFSStoreDiscardsUnfinishedWrites(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	s := reopenFSStore(t, dir)
+	base := storeTestBase()
+	mustPut(t, s, workerKey, base, PutOptions{})
+	if err := s.SetBanner(context.Background(), "maintenance", base); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash between writing a temporary file and renaming it leaves it
+	// behind, possibly cut short.
+	for _, path := range []string{
+		filepath.Join(filepath.Dir(s.heartbeatPath(workerKey)), fsTempPrefix+"1234"),
+		filepath.Join(dir, fsTempPrefix+"5678"),
+	} {
+		if err := os.WriteFile(path, []byte(`{"namespace": "default", "id": "wor`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = reopenFSStore(t, dir)
+	if hb := mustGet(t, s, workerKey); !hb.LastUpdatedAt.Equal(base) {
+		t.Fatalf("expected the last complete write, got %+v", hb)
+	}
+	if banner, ok, err := s.Banner(context.Background()); err != nil || !ok || banner.Message != "maintenance" {
+		t.Fatalf("expected the last complete banner, got %+v, %v, %v", banner, ok, err)
+	}
+	if temps := tempFiles(t, dir); len(temps) != 0 {
+		t.Fatalf("expected the unfinished writes to be removed, got %v", temps)
+	}
+}
+
+func TestFSFileName(t *testing.T) {
+	for id, want := range map[string]string{
+		"worker-1.eu_west": "worker-1.eu_west",
+		"Worker":           "%57orker",
+		"../etc/passwd":    "%2E.%2Fetc%2Fpasswd",
+		".hidden":          "%2Ehidden",
+		"a b":              "a%20b",
+	} {
+		if got := fsFileName(id); got != want {
+			t.Errorf("%q: expected %q, got %q", id, want, got)
+		}
+	}
+}
+
+func TestFSStoreNocaseOneFile(t *testing.T) {
+	setupTest(t, "--id-collation", "nocase")
+	dir := t.TempDir()
+	s := reopenFSStore(t, dir)
+	mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "Worker"}, storeTestBase(), PutOptions{})
+	mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "WORKER"}, storeTestBase(), PutOptions{})
+
+	files, err := filepath.Glob(filepath.Join(dir, "heartbeats", defaultNamespace, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected ids differing in case to share a file, got %v", files)
+	}
+
+	// Switching back to binary finds the heartbeat under its first id.
+	cf.IDCollation = idCollationBinary
+	s = reopenFSStore(t, dir)
+	mustGet(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "Worker"})
+}
+
+func TestFSDriver(t *testing.T) {
+	setupTest(t)
+	useFSStore(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", `{"metadata": {"region": "eu"}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPatch, "/worker", `{"metadata": {"zone": "a"}}`), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", ""); string(hb.Metadata) != `{"region":"eu","zone":"a"}` {
+		t.Fatalf("expected the patch to be merged, got %s", hb.Metadata)
+	}
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `["a", "b"]`), http.StatusNoContent)
+	getHeartbeat(t, "b", "?ttl=1m")
+
+	expectStatus(t, serve(h, http.MethodGet, "/readyz", ""), http.StatusOK)
+	expectStatus(t, serve(h, http.MethodGet, "/selfstat", ""), http.StatusOK)
+	expectError(t, serve(h, http.MethodGet, "/schema-version", ""), http.StatusNotFound, "not_found")
+
+	expectStatus(t, serve(h, http.MethodDelete, "/worker", ""), http.StatusNoContent)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
+
+func TestFSDriverNotReady(t *testing.T) {
+	setupTest(t)
+	_, dir := useFSStore(t)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, serve(internalRouter(), http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable, "database_unavailable")
+}
+
+func TestDBDriverValidated(t *testing.T) {
+	err := runUntilSignal(t, "--db-driver", "mysql")
+	if err == nil || err.Error() != `invalid db driver "mysql", expected sqlite or fs` {
+		t.Fatalf("expected the driver to be rejected, got %v", err)
+	}
+	err = runUntilSignal(t, "--db-driver", "fs", "--seed-file", "seed.json")
+	if err == nil || err.Error() != "--seed-file requires --db-driver sqlite" {
+		t.Fatalf("expected seeding heartbeat files to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GroupStatus is the worst status among the heartbeats sharing a prefix.
+type GroupStatus struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	Status    string `json:"status"`
+	Total     int64  `json:"total"`
+	Expired   int64  `json:"expired"`
+}
+
+// handleGetGroupStatus reports a group as expired if any heartbeat in
+// ?namespace= whose id starts with the prefix has expired under ttl, and as
+// alive otherwise.
+// Heartbeats with a corrupt date count as expired.
+func handleGetGroupStatus(w http.ResponseWriter, r *http.Request) {
+	prefix := r.PathValue("prefix")
+	if prefix == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_prefix", "prefix value is required on path")
+		return
+	}
+
+	ttlDuration, ok := globalDefaultTTL(ttlEndpointGroup)
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		var err error
+		ttlDuration, err = parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return
+		}
+	} else if !ok {
+		writeJSONError(w, http.StatusBadRequest, "missing_ttl", "ttl query parameter is required")
+		return
+	}
+	cutoff := heartbeatNow().Add(-clampTTL(ttlDuration))
+
+	status := GroupStatus{Namespace: queryNamespace(r), Prefix: prefix}
+	var err error
+	status.Total, status.Expired, err = store.CountGroup(r.Context(), status.Namespace, prefix, cutoff)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeats: %v", err))
+		return
+	}
+	if status.Total == 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no heartbeats match prefix")
+		return
+	}
+
+	status.Status = "alive"
+	if status.Expired > 0 {
+		status.Status = "expired"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+func (s *sqliteStore) CountGroup(ctx context.Context, namespace, prefix string, cutoff time.Time) (total, expired int64, err error) {
+	defer recordDBTime(ctx, time.Now())
+	err = s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*), COALESCE(SUM(COALESCE(julianday(last_updated_at) < julianday(?), 1)), 0)
+        FROM heartbeats WHERE namespace = ? AND NOT pending AND substr(id, 1, length(?)) = ? `+idCollate(),
+		cutoff.Format(storedTimeFormat), namespace, prefix, prefix).Scan(&total, &expired)
+	return total, expired, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getGroupStatus(t *testing.T, prefix, query string) GroupStatus {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/groups/"+prefix+"/status"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var status GroupStatus
+	decodeBody(t, w, &status)
+	return status
+}
+
+func TestGroupStatusMixedChildren(t *testing.T) {
+	setupTest(t)
+	now := time.Now()
+	insertHeartbeat(t, "payments.api", now.Format(storedTimeFormat), sql.NullInt64{})
+	insertHeartbeat(t, "payments.worker", now.Add(-time.Hour).Format(storedTimeFormat), sql.NullInt64{})
+	insertHeartbeat(t, "payments.cron", now.Format(storedTimeFormat), sql.NullInt64{})
+	insertHeartbeat(t, "search.api", now.Add(-time.Hour).Format(storedTimeFormat), sql.NullInt64{})
+
+	status := getGroupStatus(t, "payments.", "?ttl=1m")
+	if status.Status != "expired" || status.Total != 3 || status.Expired != 1 {
+		t.Fatalf("expected 1 of 3 expired, got %+v", status)
+	}
+
+	if status := getGroupStatus(t, "payments.", "?ttl=2h"); status.Status != "alive" || status.Expired != 0 {
+		t.Fatalf("expected the group to be alive under a longer ttl, got %+v", status)
+	}
+}
+
+func TestGroupStatusAllAlive(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	for _, id := range []string{"payments.api", "payments.worker"} {
+		expectStatus(t, serve(h, http.MethodPut, "/"+id, ""), http.StatusNoContent)
+	}
+	insertHeartbeat(t, "paymentsx", time.Now().Add(-time.Hour).Format(storedTimeFormat), sql.NullInt64{})
+
+	if status := getGroupStatus(t, "payments.", "?ttl=1m"); status.Status != "alive" || status.Total != 2 {
+		t.Fatalf("expected 2 alive children, got %+v", status)
+	}
+}
+
+func TestGroupStatusCorruptDateCountsExpired(t *testing.T) {
+	setupTest(t)
+	insertHeartbeat(t, "payments.api", time.Now().Format(storedTimeFormat), sql.NullInt64{})
+	insertHeartbeat(t, "payments.worker", "not-a-date", sql.NullInt64{})
+
+	if status := getGroupStatus(t, "payments.", "?ttl=1m"); status.Status != "expired" || status.Expired != 1 {
+		t.Fatalf("expected the corrupt child to count as expired, got %+v", status)
+	}
+}
+
+func TestGroupStatusErrors(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/payments.api", ""), http.StatusNoContent)
+
+	h := externalRouter()
+	expectError(t, serve(h, http.MethodGet, "/groups/search./status?ttl=1m", ""), http.StatusNotFound, "not_found")
+	expectError(t, serve(h, http.MethodGet, "/groups/payments./status", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/groups/payments./status?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+}
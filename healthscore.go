@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	jobStatusMu sync.Mutex
+	// jobStatus holds the outcome of the latest run of each background job.
+	jobStatus = map[string]error{}
+)
+
+// reportJobRun records the outcome of a run of a background job for the
+// health score.
+func reportJobRun(job string, err error) {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	jobStatus[job] = err
+}
+
+// jobsHealthy returns the fraction of background jobs whose latest run
+// succeeded. Jobs that haven't run yet don't count against it.
+func jobsHealthy() float64 {
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	if len(jobStatus) == 0 {
+		return 1
+	}
+	healthy := 0
+	for _, err := range jobStatus {
+		if err == nil {
+			healthy++
+		}
+	}
+	return float64(healthy) / float64(len(jobStatus))
+}
+
+// HealthScore is a weighted 0-100 score with the signals it is made of, each
+// between 0 and 1.
+type HealthScore struct {
+	Score      int     `json:"score"`
+	Heartbeats float64 `json:"heartbeats"`
+	Database   float64 `json:"database"`
+	Jobs       float64 `json:"jobs"`
+}
+
+// handleGetHealthScore combines the fraction of alive heartbeats, database
+// reachability and background job health into a single number. Heartbeats
+// are evaluated against their stored ttl, falling back to ?ttl and then
+// --default-ttl; ones with no ttl at all are left out.
+func handleGetHealthScore(w http.ResponseWriter, r *http.Request) {
+	var fallback time.Duration
+	if cf.DefaultTTL > 0 {
+		fallback = clampTTL(cf.DefaultTTL)
+	}
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return
+		}
+		fallback = clampTTL(d)
+	}
+
+	score := HealthScore{Heartbeats: 1, Jobs: jobsHealthy()}
+
+	total, alive, err := store.CountAlive(r.Context(), fallback, heartbeatNow())
+	if err == nil {
+		score.Database = 1
+		if total > 0 {
+			score.Heartbeats = float64(alive) / float64(total)
+		}
+	} else {
+		score.Heartbeats = 0
+	}
+
+	weights := cf.HealthWeightHeartbeats + cf.HealthWeightDatabase + cf.HealthWeightJobs
+	if weights > 0 {
+		weighted := cf.HealthWeightHeartbeats*score.Heartbeats +
+			cf.HealthWeightDatabase*score.Database +
+			cf.HealthWeightJobs*score.Jobs
+		score.Score = int(math.Round(100 * weighted / weights))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(score); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+func (s *sqliteStore) CountAlive(ctx context.Context, fallback time.Duration, now time.Time) (total, alive int64, err error) {
+	var fallbackSeconds sql.NullFloat64
+	if fallback > 0 {
+		fallbackSeconds = sql.NullFloat64{Float64: fallback.Seconds(), Valid: true}
+	}
+	defer recordDBTime(ctx, time.Now())
+	err = s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*), COALESCE(SUM(alive), 0) FROM (
+            SELECT COALESCE(julianday(last_updated_at) + MAX(COALESCE(ttl_seconds, ?), ?) / 86400.0 >= julianday(?), 0) AS alive
+            FROM heartbeats WHERE NOT pending AND COALESCE(ttl_seconds, ?) IS NOT NULL
+        )
+    `, fallbackSeconds, cf.MinTTL.Seconds(), now.Format(storedTimeFormat), fallbackSeconds).Scan(&total, &alive)
+	return total, alive, err
+}
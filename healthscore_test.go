@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetJobStatus forgets the background job runs reported so far, for the
+// duration of the test.
+func resetJobStatus(t *testing.T) {
+	t.Helper()
+	jobStatusMu.Lock()
+	saved := jobStatus
+	jobStatus = map[string]error{}
+	jobStatusMu.Unlock()
+	t.Cleanup(func() {
+		jobStatusMu.Lock()
+		jobStatus = saved
+		jobStatusMu.Unlock()
+	})
+}
+
+func getHealthScore(t *testing.T, query string) HealthScore {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/health-score"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var score HealthScore
+	decodeBody(t, w, &score)
+	return score
+}
+
+func TestHealthScore(t *testing.T) {
+	minute := sql.NullInt64{Int64: 60, Valid: true}
+	tests := []struct {
+		name   string
+		args   []string
+		alive  int
+		dead   int
+		failed []string
+		closed bool
+		want   HealthScore
+	}{
+		{name: "empty", want: HealthScore{Score: 100, Heartbeats: 1, Database: 1, Jobs: 1}},
+		{name: "all alive", alive: 3, want: HealthScore{Score: 100, Heartbeats: 1, Database: 1, Jobs: 1}},
+		{name: "some expired", alive: 3, dead: 1, want: HealthScore{Score: 85, Heartbeats: 0.75, Database: 1, Jobs: 1}},
+		{name: "failing job", alive: 1, dead: 1, failed: []string{"reaper"}, want: HealthScore{Score: 65, Heartbeats: 0.5, Database: 1, Jobs: 0.5}},
+		{name: "database down", alive: 2, closed: true, want: HealthScore{Score: 10, Heartbeats: 0, Database: 0, Jobs: 1}},
+		{
+			name:  "custom weights",
+			args:  []string{"--health-weight-heartbeats", "1", "--health-weight-database", "0", "--health-weight-jobs", "0"},
+			alive: 1, dead: 3,
+			want: HealthScore{Score: 25, Heartbeats: 0.25, Database: 1, Jobs: 1},
+		},
+		{
+			name:  "no weights",
+			args:  []string{"--health-weight-heartbeats", "0", "--health-weight-database", "0", "--health-weight-jobs", "0"},
+			alive: 1,
+			want:  HealthScore{Score: 0, Heartbeats: 1, Database: 1, Jobs: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t, tt.args...)
+			resetJobStatus(t)
+			now := time.Now()
+			for i := range tt.alive {
+				insertHeartbeat(t, "alive-"+string(rune('a'+i)), now.Format(storedTimeFormat), minute)
+			}
+			for i := range tt.dead {
+				insertHeartbeat(t, "dead-"+string(rune('a'+i)), now.Add(-time.Hour).Format(storedTimeFormat), minute)
+			}
+			reportJobRun("wal-checkpoint", nil)
+			for _, job := range tt.failed {
+				reportJobRun(job, errors.New("failed"))
+			}
+			if tt.closed {
+				_ = db.Close()
+			}
+
+			if got := getHealthScore(t, ""); got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHealthScoreTTLFallback(t *testing.T) {
+	setupTest(t)
+	resetJobStatus(t)
+	insertHeartbeat(t, "alive", time.Now().Format(storedTimeFormat), sql.NullInt64{})
+	insertHeartbeat(t, "dead", time.Now().Add(-time.Hour).Format(storedTimeFormat), sql.NullInt64{})
+
+	// Without a ttl from anywhere the heartbeats can't be judged.
+	if got := getHealthScore(t, ""); got.Heartbeats != 1 || got.Score != 100 {
+		t.Fatalf("expected heartbeats without a ttl to be left out, got %+v", got)
+	}
+	if got := getHealthScore(t, "?ttl=5m"); got.Heartbeats != 0.5 || got.Score != 70 {
+		t.Fatalf("expected half alive under ?ttl, got %+v", got)
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/health-score?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// windowHeartbeat reads the heartbeat addressed by r for the endpoints that
+// replay its arrivals over a window, answering r itself and returning false
+// when there is none to replay.
+func windowHeartbeat(w http.ResponseWriter, r *http.Request) (storedHeartbeat, bool) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required")
+		return storedHeartbeat{}, false
+	}
+	hb, err := store.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeat: %v", err))
+		}
+		return storedHeartbeat{}, false
+	}
+	if hb.Pending {
+		writeJSONError(w, http.StatusNotFound, "pending", "heartbeat is a registered parent that hasn't reported yet")
+		return storedHeartbeat{}, false
+	}
+	return hb, true
+}
+
+// historyWindow parses ?window=, def when absent. Arrivals older than
+// --history-retention are trimmed, so neither may reach further back.
+func historyWindow(w http.ResponseWriter, r *http.Request, def time.Duration) (time.Duration, bool) {
+	if cf.HistoryRetention > 0 {
+		def = min(def, cf.HistoryRetention)
+	}
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return def, true
+	}
+	window, err := parseTTL(v, cf.StrictTTLUnits)
+	if err != nil || window <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_window", "window query parameter must be a positive duration")
+		return 0, false
+	}
+	if cf.HistoryRetention > 0 && window > cf.HistoryRetention {
+		writeJSONError(w, http.StatusBadRequest, "invalid_window", fmt.Sprintf("window exceeds --history-retention of %s", cf.HistoryRetention))
+		return 0, false
+	}
+	return window, true
+}
+
+// windowTTL resolves the ttl arrivals of hb are judged by the way a check
+// does: ?ttl=, the stored ttl, a --prefix-ttl pattern, then --default-ttl.
+func windowTTL(w http.ResponseWriter, r *http.Request, hb storedHeartbeat) (time.Duration, bool) {
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		var err error
+		if ttl, err = parseTTL(v, cf.StrictTTLUnits); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return 0, false
+		}
+	} else if hb.TTL.Valid {
+		ttl = time.Duration(hb.TTL.Int64) * time.Second
+	} else if d, ok := defaultTTLFor(hb.ID); ok {
+		ttl = d
+	} else if d, ok := globalDefaultTTL(ttlEndpointHeartbeat); ok {
+		ttl = d
+	} else {
+		writeJSONError(w, http.StatusBadRequest, "missing_ttl", "ttl query parameter is required")
+		return 0, false
+	}
+	if ttl = clampTTL(ttl); ttl <= 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "zero_ttl", "ttl resolves to zero, the heartbeat can never be alive")
+		return 0, false
+	}
+	return ttl, true
+}
+
+// writeWindowResponse encodes the response of a window endpoint.
+func writeWindowResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+type HeartbeatHistory struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	// ReceivedAt holds the arrivals most recent first.
+	ReceivedAt []time.Time `json:"received_at"`
+}
+
+// handleGetHistory returns the last ?limit= arrivals of a heartbeat, 50 by
+// default and at most 500, to tell a flapping publisher from one that
+// stopped.
+func handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required")
+		return
+	}
+	limit, err := listParam(r.URL.Query().Get("limit"), defaultHistoryLimit)
+	if err != nil || limit == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_limit", "limit query parameter must be a positive integer")
+		return
+	}
+	limit = min(limit, maxHistoryLimit)
+
+	receivedAt, err := store.History(r.Context(), key, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	history := HeartbeatHistory{Namespace: key.Namespace, ID: key.ID, ReceivedAt: receivedAt}
+	if len(history.ReceivedAt) == 0 {
+		if _, err := store.Get(r.Context(), key); errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+// History reads the last limit events of key. Events are only ever appended,
+// so rowid order is arrival order.
+func (s *sqliteStore) History(ctx context.Context, key heartbeatKey, limit int) ([]time.Time, error) {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT CAST(received_at AS TEXT) FROM heartbeat_events
+        WHERE namespace = ? AND id = ? `+idCollate()+`
+        ORDER BY rowid DESC LIMIT ?
+    `, key.Namespace, key.ID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query heartbeat events: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	history := []time.Time{}
+	for rows.Next() {
+		var receivedAtStr string
+		if err := rows.Scan(&receivedAtStr); err != nil {
+			return nil, fmt.Errorf("failed to scan heartbeat event: %v", err)
+		}
+		receivedAt, _, err := parseStoredTime(receivedAtStr)
+		if err != nil {
+			httpLog.Warn("skipping heartbeat event with a corrupt date", "namespace", key.Namespace, "id", key.ID, "value", receivedAtStr)
+			continue
+		}
+		history = append(history, receivedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read heartbeat events: %v", err)
+	}
+	return history, nil
+}
+
+// Arrivals reads the events of key since since in rowid, so arrival, order.
+func (s *sqliteStore) Arrivals(ctx context.Context, key heartbeatKey, since time.Time, fn func(time.Time) error) error {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT CAST(received_at AS TEXT) FROM heartbeat_events
+        WHERE namespace = ? AND id = ? `+idCollate()+` AND julianday(received_at) >= julianday(?)
+        ORDER BY rowid
+    `, key.Namespace, key.ID, since.Format(storedTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to query heartbeat events: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var receivedAtStr string
+		if err := rows.Scan(&receivedAtStr); err != nil {
+			return fmt.Errorf("failed to scan heartbeat event: %v", err)
+		}
+		receivedAt, _, err := parseStoredTime(receivedAtStr)
+		if err != nil {
+			httpLog.Warn("skipping heartbeat event with a corrupt date", "namespace", key.Namespace, "id", key.ID, "value", receivedAtStr)
+			continue
+		}
+		if err := fn(receivedAt); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read heartbeat events: %v", err)
+	}
+	return nil
+}
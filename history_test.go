@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getHistory(t *testing.T, path, query string) HeartbeatHistory {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+path+"/history"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var history HeartbeatHistory
+	decodeBody(t, w, &history)
+	return history
+}
+
+func TestHistoryMostRecentFirst(t *testing.T) {
+	setupTest(t)
+	start := time.Now().UTC()
+	c := useFakeClock(t, start)
+	h := internalRouter()
+	for range 3 {
+		expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+		expectStatus(t, serve(h, http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+		c.Advance(time.Second)
+	}
+
+	history := getHistory(t, "worker", "")
+	if history.Namespace != defaultNamespace || history.ID != "worker" || len(history.ReceivedAt) != 3 {
+		t.Fatalf("expected the 3 arrivals of worker, got %+v", history)
+	}
+	for i, at := range history.ReceivedAt {
+		if want := start.Add(time.Duration(2-i) * time.Second); !at.Equal(want) {
+			t.Fatalf("expected arrival %d at %v, got %v", i, want, at)
+		}
+	}
+
+	if history := getHistory(t, "worker", "?limit=2"); len(history.ReceivedAt) != 2 || !history.ReceivedAt[0].Equal(start.Add(2*time.Second)) {
+		t.Fatalf("expected the 2 latest arrivals, got %+v", history)
+	}
+}
+
+func TestHistoryLimitCapped(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range maxHistoryLimit + 100 {
+		if _, err := tx.Exec(`
+            INSERT INTO heartbeat_events (namespace, id, received_at) VALUES (?, 'worker', ?)
+        `, defaultNamespace, time.Now().Format(storedTimeFormat)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if history := getHistory(t, "worker", ""); len(history.ReceivedAt) != defaultHistoryLimit {
+		t.Fatalf("expected %d arrivals by default, got %d", defaultHistoryLimit, len(history.ReceivedAt))
+	}
+	if history := getHistory(t, "worker", "?limit=10000"); len(history.ReceivedAt) != maxHistoryLimit {
+		t.Fatalf("expected the limit to be capped at %d, got %d", maxHistoryLimit, len(history.ReceivedAt))
+	}
+}
+
+func TestHistoryErrors(t *testing.T) {
+	setupTest(t)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/missing/history", ""), http.StatusNotFound, "not_found")
+	expectError(t, serve(h, http.MethodGet, "/worker/history?limit=0", ""), http.StatusBadRequest, "invalid_limit")
+	expectError(t, serve(h, http.MethodGet, "/worker/history?limit=few", ""), http.StatusBadRequest, "invalid_limit")
+}
+
+func TestHistoryNamespacedAndReserved(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+
+	if history := getHistory(t, "team/worker", ""); history.Namespace != "team" || len(history.ReceivedAt) != 1 {
+		t.Fatalf("expected the arrival of team/worker, got %+v", history)
+	}
+
+	// /team/history reads the history of team, so no heartbeat named
+	// history can be checked in any namespace.
+	expectError(t, serve(h, http.MethodPut, "/team/history", ""), http.StatusBadRequest, "reserved_id")
+	expectError(t, serve(h, http.MethodPut, "/history", ""), http.StatusBadRequest, "reserved_id")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxImportBodyBytes = 256 << 20
+	// importJobRetention is how long a finished import job can still be
+	// polled.
+	importJobRetention = time.Hour
+)
+
+const (
+	importJobPending = "pending"
+	importJobRunning = "running"
+	importJobDone    = "done"
+	importJobFailed  = "failed"
+)
+
+// ImportJob is the state of an import as polled at /jobs/{id}. Imported
+// counts the heartbeats recorded so far, Error is set once the job failed.
+type ImportJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Imported   int        `json:"imported"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// importJobs holds the import jobs in memory, a restart forgets them.
+type importJobs struct {
+	mu     sync.Mutex
+	lastID int64
+	jobs   map[string]*ImportJob
+}
+
+var imports = &importJobs{jobs: map[string]*ImportJob{}}
+
+// add registers a pending job of total heartbeats, dropping the jobs that
+// finished more than importJobRetention before now.
+func (j *importJobs) add(total int, now time.Time) ImportJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for id, job := range j.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(now.Add(-importJobRetention)) {
+			delete(j.jobs, id)
+		}
+	}
+	j.lastID++
+	job := &ImportJob{ID: strconv.FormatInt(j.lastID, 10), Status: importJobPending, Total: total, CreatedAt: now}
+	j.jobs[job.ID] = job
+	return *job
+}
+
+func (j *importJobs) get(id string) (ImportJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return ImportJob{}, false
+	}
+	return *job, true
+}
+
+func (j *importJobs) update(id string, fn func(*ImportJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(j.jobs[id])
+}
+
+// handlePostImport accepts a batch too large to write within a request, up
+// to maxImportBodyBytes, and records it in the background. The items are
+// validated like a batch before the job is created, so an invalid import is
+// still answered with 400 naming its index; the job then writes them in
+// transactions of maxBatchSize, each taking a --max-batch-writers slot, and
+// a failed write stops it with the earlier ones kept.
+func handlePostImport(w http.ResponseWriter, r *http.Request) {
+	if !hasJSONContentType(r) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "import body must be application/json")
+		return
+	}
+
+	var items []BatchItem
+	if err := decodeJSONBody(w, r, maxImportBodyBytes, &items); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	puts, ok := batchPuts(w, r, items)
+	if !ok {
+		return
+	}
+
+	job := imports.add(len(puts), heartbeatNow())
+	go runImport(context.Background(), job.ID, puts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		httpLog.Error("failed to encode import job", "error", err)
+	}
+}
+
+// runImport writes the heartbeats of an import job a batch at a time.
+func runImport(ctx context.Context, id string, puts []HeartbeatPut) {
+	imports.update(id, func(job *ImportJob) {
+		job.Status = importJobRunning
+	})
+	finish := func(status string, err error) {
+		imports.update(id, func(job *ImportJob) {
+			finishedAt := heartbeatNow()
+			job.Status, job.FinishedAt = status, &finishedAt
+			if err != nil {
+				job.Error = err.Error()
+			}
+		})
+	}
+
+	for start := 0; start < len(puts); start += maxBatchSize {
+		chunk := puts[start:min(start+maxBatchSize, len(puts))]
+		release, err := acquireBatchWriter(ctx)
+		if err != nil {
+			finish(importJobFailed, err)
+			return
+		}
+		err = writeBatch(ctx, chunk)
+		release()
+		if err != nil {
+			httpLog.Error("failed to import heartbeats", "job", id, "error", err)
+			finish(importJobFailed, fmt.Errorf("failed to store heartbeats: %v", err))
+			return
+		}
+		imports.update(id, func(job *ImportJob) {
+			job.Imported += len(chunk)
+		})
+	}
+	finish(importJobDone, nil)
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := imports.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not_found", "import job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importBody is an import of n heartbeats named import-0 and up.
+func importBody(n int) string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("import-%d", i)
+	}
+	body, _ := json.Marshal(ids)
+	return string(body)
+}
+
+// submitImport posts body to /import and returns the accepted job.
+func submitImport(t *testing.T, body string) ImportJob {
+	t.Helper()
+	w := serve(internalRouter(), http.MethodPost, "/import", body)
+	expectStatus(t, w, http.StatusAccepted)
+	var job ImportJob
+	decodeBody(t, w, &job)
+	if location := w.Header().Get("Location"); location != "/jobs/"+job.ID {
+		t.Fatalf("expected the job to be located at /jobs/%s, got %q", job.ID, location)
+	}
+	return job
+}
+
+// waitForJob polls the job until it is finished.
+func waitForJob(t *testing.T, id string) ImportJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := serve(internalRouter(), http.MethodGet, "/jobs/"+id, "")
+		expectStatus(t, w, http.StatusOK)
+		var job ImportJob
+		decodeBody(t, w, &job)
+		if job.Status == importJobDone || job.Status == importJobFailed {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the import to finish, still %s with %d imported", job.Status, job.Imported)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImport(t *testing.T) {
+	setupTest(t)
+
+	n := 2*maxBatchSize + 1
+	job := submitImport(t, importBody(n))
+	if job.Total != n {
+		t.Fatalf("expected the job to count %d heartbeats, got %d", n, job.Total)
+	}
+
+	job = waitForJob(t, job.ID)
+	if job.Status != importJobDone || job.Imported != n || job.FinishedAt == nil {
+		t.Fatalf("expected every heartbeat to be imported, got %+v", job)
+	}
+	if rows := countRows(t); rows != n {
+		t.Fatalf("expected %d heartbeats to be recorded, got %d", n, rows)
+	}
+	getHeartbeat(t, fmt.Sprintf("import-%d", n-1), "?ttl=1m")
+}
+
+func TestImportWaitsForBatchWriter(t *testing.T) {
+	setupTest(t)
+	batchWriters <- struct{}{}
+
+	job := submitImport(t, importBody(1))
+	time.Sleep(50 * time.Millisecond)
+	w := serve(internalRouter(), http.MethodGet, "/jobs/"+job.ID, "")
+	expectStatus(t, w, http.StatusOK)
+	decodeBody(t, w, &job)
+	if job.Imported != 0 || job.Status == importJobDone {
+		t.Fatalf("expected the import to wait for a batch writer, got %+v", job)
+	}
+
+	<-batchWriters
+	if job = waitForJob(t, job.ID); job.Status != importJobDone {
+		t.Fatalf("expected the import to finish once a batch writer is free, got %+v", job)
+	}
+}
+
+func TestImportFailedWriteKeepsEarlierBatches(t *testing.T) {
+	setupTest(t)
+	_, err := db.Exec(`
+        CREATE TRIGGER reject_poison BEFORE INSERT ON heartbeats WHEN NEW.id = 'import-1500'
+        BEGIN SELECT RAISE(ABORT, 'poisoned'); END
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJob(t, submitImport(t, importBody(2*maxBatchSize)).ID)
+	if job.Status != importJobFailed || job.Imported != maxBatchSize || !strings.Contains(job.Error, "poisoned") {
+		t.Fatalf("expected the import to fail after the first batch, got %+v", job)
+	}
+	if rows := countRows(t); rows != maxBatchSize {
+		t.Fatalf("expected the first batch to be kept, got %d rows", rows)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	w := serve(h, http.MethodPost, "/import", `["api", {"id": ""}]`)
+	expectError(t, w, http.StatusBadRequest, "missing_id")
+	if !strings.Contains(w.Body.String(), "item 1") {
+		t.Fatalf("expected the error to name the offending index, got %s", w.Body)
+	}
+	expectError(t, serve(h, http.MethodPost, "/import", `{"id": "api"}`), http.StatusBadRequest, "invalid_body")
+
+	r := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(`["api"]`))
+	r.Header.Set("Content-Type", "text/plain")
+	expectError(t, serveRequest(h, r), http.StatusUnsupportedMediaType, "unsupported_media_type")
+
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected nothing to be recorded, got %d rows", rows)
+	}
+	expectError(t, serve(h, http.MethodGet, "/jobs/unknown", ""), http.StatusNotFound, "not_found")
+}
+
+func TestImportNotForAPIKeys(t *testing.T) {
+	setupTest(t, "--api-key", "writer=worker-")
+	expectError(t, withAPIKey(http.MethodPost, "/import", `["worker-1"]`, "writer"), http.StatusForbidden, "out_of_scope")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type IntervalUpdate struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	Interval  string `json:"interval"`
+}
+
+type IntervalUpdateResult struct {
+	Updated int64 `json:"updated"`
+}
+
+// handleSetIntervals sets the stored interval of every heartbeat in the
+// namespace whose id starts with the given prefix, all of them or none.
+func handleSetIntervals(w http.ResponseWriter, r *http.Request) {
+	var req IntervalUpdate
+	if err := decodeJSONBody(w, r, 4096, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req.Prefix = normalizeID(req.Prefix)
+	if req.Prefix == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_prefix", "prefix is required")
+		return
+	}
+	req.Namespace = normalizeID(req.Namespace)
+	if req.Namespace == "" {
+		req.Namespace = defaultNamespace
+	}
+
+	interval, err := parseTTL(req.Interval, cf.StrictTTLUnits)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", fmt.Sprintf("interval must be a valid duration: %v", err))
+		return
+	}
+	if interval < time.Second {
+		writeJSONError(w, http.StatusBadRequest, "invalid_interval", "interval must be at least 1s")
+		return
+	}
+
+	updated, err := store.SetIntervals(r.Context(), req.Namespace, req.Prefix, interval)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(IntervalUpdateResult{Updated: updated}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+// SetIntervals runs a single UPDATE, so either all matching rows change or
+// none do.
+func (s *sqliteStore) SetIntervals(ctx context.Context, namespace, prefix string, interval time.Duration) (int64, error) {
+	// LIKE is always case-insensitive in SQLite, so the prefix is compared
+	// with substr under the configured id collation instead.
+	defer recordDBTime(ctx, time.Now())
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE heartbeats SET ttl_seconds = ?
+        WHERE namespace = ? AND NOT pending AND substr(id, 1, length(?)) = ? `+idCollate(),
+		int64(interval/time.Second), namespace, prefix, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update intervals: %v", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count updated heartbeats: %v", err)
+	}
+	return updated, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetIntervalsByPrefix(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	for _, target := range []string{"/web.api?ttl=1m", "/web.frontend", "/webhooks", "/batch.import?ttl=1h", "/team/web.api?ttl=1m"} {
+		expectStatus(t, serve(h, http.MethodPut, target, ""), http.StatusNoContent)
+	}
+
+	w := serve(h, http.MethodPost, "/intervals", `{"prefix":"web.","interval":"30s"}`)
+	expectStatus(t, w, http.StatusOK)
+	var result IntervalUpdateResult
+	decodeBody(t, w, &result)
+	if result.Updated != 2 {
+		t.Fatalf("expected 2 heartbeats to be updated, got %d", result.Updated)
+	}
+
+	for id, want := range map[string]int64{"web.api": 30, "web.frontend": 30, "batch.import": 3600} {
+		if ttl := storedTTL(t, id); ttl.Int64 != want {
+			t.Errorf("expected %s to have an interval of %ds, got %+v", id, want, ttl)
+		}
+	}
+	if ttl := storedTTL(t, "webhooks"); ttl.Valid {
+		t.Errorf("expected webhooks not to match the prefix web., got %+v", ttl)
+	}
+}
+
+func TestSetIntervalsInNamespace(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/web.api?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/web.api?ttl=1m", ""), http.StatusNoContent)
+
+	w := serve(h, http.MethodPost, "/intervals", `{"namespace":"team","prefix":"web.","interval":"30s"}`)
+	expectStatus(t, w, http.StatusOK)
+	var result IntervalUpdateResult
+	decodeBody(t, w, &result)
+	if result.Updated != 1 {
+		t.Fatalf("expected 1 heartbeat to be updated, got %d", result.Updated)
+	}
+	if ttl := storedTTL(t, "web.api"); ttl.Int64 != 60 {
+		t.Fatalf("expected the default namespace to be untouched, got %+v", ttl)
+	}
+}
+
+func TestSetIntervalsNoMatch(t *testing.T) {
+	setupTest(t)
+
+	w := serve(internalRouter(), http.MethodPost, "/intervals", `{"prefix":"web.","interval":"30s"}`)
+	expectStatus(t, w, http.StatusOK)
+	var result IntervalUpdateResult
+	decodeBody(t, w, &result)
+	if result.Updated != 0 {
+		t.Fatalf("expected nothing to be updated, got %d", result.Updated)
+	}
+}
+
+func TestSetIntervalsInvalid(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectError(t, serve(h, http.MethodPost, "/intervals", `{"interval":"30s"}`), http.StatusBadRequest, "missing_prefix")
+	expectError(t, serve(h, http.MethodPost, "/intervals", `{"prefix":"web.","interval":"soon"}`), http.StatusBadRequest, "invalid_interval")
+	expectError(t, serve(h, http.MethodPost, "/intervals", `{"prefix":"web.","interval":"500ms"}`), http.StatusBadRequest, "invalid_interval")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaBatchSize caps how many queued events are written in one request.
+const kafkaBatchSize = 100
+
+type HeartbeatEvent struct {
+	Namespace string    `json:"namespace"`
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	// Metadata is what the heartbeat attached, absent when it sent none.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// newHeartbeatEvent builds the event for a heartbeat written with opts.
+func newHeartbeatEvent(key heartbeatKey, at time.Time, opts PutOptions) HeartbeatEvent {
+	event := HeartbeatEvent{Namespace: key.Namespace, ID: key.ID, Timestamp: at}
+	if opts.Metadata.Valid {
+		event.Metadata = json.RawMessage(opts.Metadata.String)
+	}
+	return event
+}
+
+// key is the message key, the namespace and id separated by a 0 byte so
+// equal ids in different namespaces land on their own partitions.
+func (e HeartbeatEvent) key() []byte {
+	return []byte(e.Namespace + "\x00" + e.ID)
+}
+
+// messageWriter is the part of kafka.Writer the producer needs.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaProducer publishes heartbeat events from a bounded buffer, so a slow
+// or unreachable broker never blocks the write path. Events arriving while
+// the buffer is full are dropped.
+type kafkaProducer struct {
+	writer messageWriter
+	queue  chan kafka.Message
+	logger *slog.Logger
+}
+
+// producer is nil unless --kafka-brokers and --kafka-topic are set.
+var producer *kafkaProducer
+
+func newKafkaProducer(brokers []string, topic string, bufferSize int, logger *slog.Logger) *kafkaProducer {
+	return &kafkaProducer{
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+			// Hashing on the key keeps each heartbeat's events in order.
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 50 * time.Millisecond,
+		},
+		queue:  make(chan kafka.Message, bufferSize),
+		logger: logger,
+	}
+}
+
+// Enqueue queues an event for publishing without blocking.
+func (p *kafkaProducer) Enqueue(event HeartbeatEvent) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		p.logger.Error("failed to encode heartbeat event", "namespace", event.Namespace, "id", event.ID, "error", err)
+		return
+	}
+
+	select {
+	case p.queue <- kafka.Message{Key: event.key(), Value: value}:
+	default:
+		p.logger.Warn("kafka buffer full, dropping heartbeat event", "namespace", event.Namespace, "id", event.ID)
+	}
+}
+
+// Run publishes queued events until ctx is done.
+func (p *kafkaProducer) Run(ctx context.Context) error {
+	defer func() {
+		if err := p.writer.Close(); err != nil {
+			p.logger.Error("failed to close kafka writer", "error", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if n := len(p.queue); n > 0 {
+				p.logger.Warn("dropping unpublished heartbeat events on shutdown", "count", n)
+			}
+			return nil
+		case msg := <-p.queue:
+			batch := []kafka.Message{msg}
+		drain:
+			for len(batch) < kafkaBatchSize {
+				select {
+				case msg := <-p.queue:
+					batch = append(batch, msg)
+				default:
+					break drain
+				}
+			}
+			err := p.writer.WriteMessages(ctx, batch...)
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				p.logger.Error("failed to publish heartbeat events", "count", len(batch), "error", err)
+			}
+			reportJobRun("kafka-producer", err)
+		}
+	}
+}
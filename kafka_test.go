@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeWriter is a messageWriter delivering the written messages on a
+// channel.
+type fakeWriter struct {
+	messages chan kafka.Message
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		f.messages <- msg
+	}
+	return nil
+}
+
+func (f *fakeWriter) Close() error {
+	return nil
+}
+
+// startFakeProducer runs a producer writing to a fakeWriter until the test
+// ends.
+func startFakeProducer(t *testing.T) *fakeWriter {
+	t.Helper()
+	writer := &fakeWriter{messages: make(chan kafka.Message, 10)}
+	producer = &kafkaProducer{writer: writer, queue: make(chan kafka.Message, 10), logger: slog.Default()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = producer.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		producer = nil
+	})
+	return writer
+}
+
+// nextEvent waits for the next message written to writer and decodes it.
+func nextEvent(t *testing.T, writer *fakeWriter) (kafka.Message, HeartbeatEvent) {
+	t.Helper()
+	var msg kafka.Message
+	select {
+	case msg = <-writer.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a heartbeat event to be published")
+	}
+	var event HeartbeatEvent
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		t.Fatalf("failed to decode %q: %v", msg.Value, err)
+	}
+	return msg, event
+}
+
+func TestKafkaPublishesOnPut(t *testing.T) {
+	setupTest(t)
+	writer := startFakeProducer(t)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team/worker", `{"metadata":{"region":"eu-west-1"}}`), http.StatusNoContent)
+	msg, event := nextEvent(t, writer)
+	if event.Namespace != "team" || event.ID != "worker" || event.Timestamp.IsZero() {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if string(event.Metadata) != `{"region":"eu-west-1"}` {
+		t.Fatalf("expected the metadata to be published, got %s", event.Metadata)
+	}
+	if string(msg.Key) != "team\x00worker" {
+		t.Fatalf("expected the message key to hold the namespace and id, got %q", msg.Key)
+	}
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if _, event := nextEvent(t, writer); event.Namespace != defaultNamespace || event.Metadata != nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestKafkaPublishesBatch(t *testing.T) {
+	setupTest(t)
+	writer := startFakeProducer(t)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/batch", `[{"id":"a"},{"id":"b"}]`), http.StatusNoContent)
+	ids := map[string]bool{}
+	for range 2 {
+		_, event := nextEvent(t, writer)
+		ids[event.ID] = true
+	}
+	if !ids["a"] || !ids["b"] {
+		t.Fatalf("expected events for a and b, got %v", ids)
+	}
+}
+
+func TestKafkaDropsWhenBufferFull(t *testing.T) {
+	p := &kafkaProducer{writer: &fakeWriter{}, queue: make(chan kafka.Message, 1), logger: slog.Default()}
+
+	p.Enqueue(HeartbeatEvent{Namespace: defaultNamespace, ID: "a"})
+	p.Enqueue(HeartbeatEvent{Namespace: defaultNamespace, ID: "b"})
+	if len(p.queue) != 1 {
+		t.Fatalf("expected the event beyond the buffer to be dropped, %d queued", len(p.queue))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	// maxListPrefixes is how many ?prefix= a list may combine.
+	maxListPrefixes = 20
+	// listFlushEvery is how many listed heartbeats are buffered before the
+	// response is flushed to the client.
+	listFlushEvery = 100
+)
+
+// HeartbeatStatus is a heartbeat as listed by handleListHeartbeats, along
+// with whether it has expired under the requested ttl. A pending parent has
+// neither expired nor is it live.
+type HeartbeatStatus struct {
+	Heartbeat
+	Expired bool `json:"expired"`
+	Pending bool `json:"pending,omitempty"`
+}
+
+// handleListHeartbeats returns a page of the heartbeats in ?namespace=
+// ordered by id, each evaluated against the same ttl, or with ?since= only
+// what changed, see handleListDelta. ?prefix=, any of up to maxListPrefixes,
+// ?status=live or ?status=expired and ?has_meta= narrow the list before it
+// is paginated. The
+// list is a JSON array, or a binary list for clients preferring
+// binaryListContentType, streamed as rows are read so memory use doesn't
+// grow with --max-list-limit; a failure after the first byte is sent cuts
+// the response short, leaving invalid JSON or a binary list without its end.
+func handleListHeartbeats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	ttlDuration, ok := globalDefaultTTL(ttlEndpointList)
+	if ttl := query.Get("ttl"); ttl != "" {
+		var err error
+		ttlDuration, err = parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return
+		}
+	} else if !ok {
+		writeJSONError(w, http.StatusBadRequest, "missing_ttl", "ttl query parameter is required")
+		return
+	}
+	now := heartbeatNow()
+	q := ListQuery{Namespace: queryNamespace(r), Cutoff: now.Add(-clampTTL(ttlDuration))}
+	if prefixes := query["prefix"]; len(prefixes) > 0 {
+		if len(prefixes) > maxListPrefixes {
+			writeJSONError(w, http.StatusBadRequest, "too_many_prefixes", fmt.Sprintf("at most %d prefix query parameters may be combined", maxListPrefixes))
+			return
+		}
+		for _, prefix := range prefixes {
+			if prefix = normalizeID(prefix); prefix == "" {
+				writeJSONError(w, http.StatusBadRequest, "invalid_prefix", "prefix query parameter must not be empty")
+				return
+			}
+			q.Prefixes = append(q.Prefixes, prefix)
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		handleListDelta(w, r, q, now, clampTTL(ttlDuration), since)
+		return
+	}
+
+	switch q.Status = query.Get("status"); q.Status {
+	case "", "live", "expired":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_status", fmt.Sprintf("invalid status %q, expected live or expired", q.Status))
+		return
+	}
+
+	if key := query.Get("has_meta"); key != "" {
+		if !metadataKeyPattern.MatchString(key) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_has_meta", fmt.Sprintf("invalid metadata key %q, expected dot-separated names of letters, digits, _ and -", key))
+			return
+		}
+		q.HasMeta = key
+	}
+
+	var err error
+	q.Limit, err = listParam(query.Get("limit"), defaultListLimit)
+	if err != nil || q.Limit == 0 || q.Limit > cf.MaxListLimit {
+		writeJSONError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("limit query parameter must be between 1 and %d", cf.MaxListLimit))
+		return
+	}
+	q.Offset, err = listParam(query.Get("offset"), 0)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_offset", "offset query parameter must be a non-negative integer")
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set(asOfHeader, now.Format(time.RFC3339Nano))
+	binaryList := prefersBinaryList(r.Header.Get("Accept"))
+	rc := http.NewResponseController(w)
+	listed := 0
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		if binaryList {
+			w.Header().Set("Content-Type", binaryListContentType)
+			_, _ = w.Write(appendBinaryListHeader(nil, q.Namespace))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "[")
+	}
+	var record []byte
+	err = store.List(r.Context(), q, func(hb HeartbeatStatus) error {
+		record = record[:0]
+		if binaryList {
+			record = appendBinaryHeartbeat(record, hb)
+		} else {
+			b, err := json.Marshal(hb)
+			if err != nil {
+				return fmt.Errorf("failed to encode heartbeat %q: %v", hb.ID, err)
+			}
+			if listed > 0 {
+				record = append(record, ',')
+			}
+			record = append(record, b...)
+		}
+		start()
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		listed++
+		if listed%listFlushEvery == 0 {
+			_ = rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !started {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeats: %v", err))
+			return
+		}
+		httpLog.Error("failed to list heartbeats", "error", err)
+		return
+	}
+	start()
+	if binaryList {
+		_, _ = w.Write([]byte{binaryListEnd})
+		return
+	}
+	_, _ = io.WriteString(w, "]\n")
+}
+
+// metadataKeyPattern is what ?has_meta= accepts: a top-level metadata key,
+// or a dotted path such as labels.region into nested objects.
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// ListQuery selects a page of a namespace for Store.List. Status is empty,
+// "live" or "expired", judged against Cutoff. HasMeta, when set, keeps the
+// heartbeats whose metadata has that dotted key. Prefixes, when set, keeps
+// the heartbeats whose id starts with any of them. ChangedSince, when set,
+// keeps the heartbeats last updated at or after it, and those last updated
+// at or after ExpiredAfter that are expired, for a list delta.
+type ListQuery struct {
+	Namespace    string
+	Cutoff       time.Time
+	Status       string
+	HasMeta      string
+	Prefixes     []string
+	ChangedSince time.Time
+	ExpiredAfter time.Time
+	Limit        int
+	Offset       int
+}
+
+// metadataJSONPath turns a dotted metadata key into an SQLite JSON path,
+// quoting each segment so keys like 1 or a-b aren't read as array indexes or
+// expressions.
+func metadataJSONPath(key string) string {
+	return `$."` + strings.ReplaceAll(key, ".", `"."`) + `"`
+}
+
+func (s *sqliteStore) List(ctx context.Context, q ListQuery, fn func(HeartbeatStatus) error) error {
+	cutoff := q.Cutoff.Format(storedTimeFormat)
+	args := []any{cutoff, q.Namespace}
+	var filter string
+	switch q.Status {
+	case "live":
+		filter = "AND NOT pending AND julianday(last_updated_at) >= julianday(?)"
+		args = append(args, cutoff)
+	case "expired":
+		filter = "AND NOT pending AND julianday(last_updated_at) < julianday(?)"
+		args = append(args, cutoff)
+	}
+	if q.HasMeta != "" {
+		filter += " AND json_extract(metadata, ?) IS NOT NULL"
+		args = append(args, metadataJSONPath(q.HasMeta))
+	}
+	if len(q.Prefixes) > 0 {
+		// A single query ORing the prefixes, each compared like CountGroup.
+		clauses := make([]string, len(q.Prefixes))
+		for i, prefix := range q.Prefixes {
+			clauses[i] = "substr(id, 1, length(?)) = ? " + idCollate()
+			args = append(args, prefix, prefix)
+		}
+		filter += " AND (" + strings.Join(clauses, " OR ") + ")"
+	}
+	if !q.ChangedSince.IsZero() {
+		filter += ` AND (julianday(last_updated_at) >= julianday(?)
+            OR NOT pending AND julianday(last_updated_at) >= julianday(?) AND julianday(last_updated_at) < julianday(?))`
+		args = append(args, q.ChangedSince.Format(storedTimeFormat), q.ExpiredAfter.Format(storedTimeFormat), cutoff)
+	}
+	args = append(args, q.Limit, q.Offset)
+
+	dbStart := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, CAST(last_updated_at AS TEXT), last_method, CAST(created_at AS TEXT),
+            julianday(last_updated_at) < julianday(?), pending
+        FROM heartbeats WHERE namespace = ? `+filter+`
+        ORDER BY id LIMIT ? OFFSET ?
+    `, args...)
+	recordDBTime(ctx, dbStart)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var (
+			hb               HeartbeatStatus
+			lastUpdatedAtStr string
+			method           sql.NullString
+			createdAtStr     sql.NullString
+			expired          sql.NullBool
+		)
+		if err := rows.Scan(&hb.ID, &lastUpdatedAtStr, &method, &createdAtStr, &expired, &hb.Pending); err != nil {
+			return fmt.Errorf("failed to scan heartbeat: %v", err)
+		}
+		lastUpdatedAt, _, err := parseStoredTime(lastUpdatedAtStr)
+		if err != nil || !expired.Valid {
+			httpLog.Warn("skipping heartbeat with a corrupt last updated at date in list", "id", hb.ID, "value", lastUpdatedAtStr)
+			continue
+		}
+		hb.Namespace = q.Namespace
+		hb.LastUpdatedAt = lastUpdatedAt
+		hb.Method = method.String
+		if createdAtStr.Valid {
+			if createdAt, _, err := parseStoredTime(createdAtStr.String); err == nil {
+				hb.CreatedAt = &createdAt
+			}
+		}
+		hb.Expired = expired.Bool && !hb.Pending
+		if err := fn(hb); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+	return nil
+}
+
+// listParam parses a non-negative integer query parameter, returning def
+// when it is absent.
+func listParam(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
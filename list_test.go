@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// listedIDs returns the ids of list in order.
+func listedIDs(list []HeartbeatStatus) []string {
+	ids := []string{}
+	for _, hb := range list {
+		ids = append(ids, hb.ID)
+	}
+	return ids
+}
+
+// putLiveAndExpired records old-a and old-b ten minutes before live-a and
+// live-b.
+func putLiveAndExpired(t *testing.T) {
+	t.Helper()
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/old-b", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/old-a", ""), http.StatusNoContent)
+	c.Advance(10 * time.Minute)
+	expectStatus(t, serve(h, http.MethodPut, "/live-b", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/live-a", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/other", ""), http.StatusNoContent)
+}
+
+func TestListHeartbeats(t *testing.T) {
+	setupTest(t)
+	putLiveAndExpired(t)
+
+	list := listHeartbeats(t, "?ttl=5m")
+	if ids := listedIDs(list); !slices.Equal(ids, []string{"live-a", "live-b", "old-a", "old-b"}) {
+		t.Fatalf("expected every heartbeat of the namespace ordered by id, got %v", ids)
+	}
+	for _, hb := range list {
+		if want := hb.ID[:3] == "old"; hb.Expired != want {
+			t.Errorf("expected %s to have expired=%v", hb.ID, want)
+		}
+		if hb.LastUpdatedAt.IsZero() || hb.Namespace != defaultNamespace {
+			t.Errorf("unexpected heartbeat %+v", hb)
+		}
+	}
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&namespace=team")); !slices.Equal(ids, []string{"other"}) {
+		t.Fatalf("expected only the team namespace, got %v", ids)
+	}
+}
+
+func TestListStatusFilter(t *testing.T) {
+	setupTest(t)
+	putLiveAndExpired(t)
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&status=live")); !slices.Equal(ids, []string{"live-a", "live-b"}) {
+		t.Fatalf("expected the live heartbeats, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&status=expired")); !slices.Equal(ids, []string{"old-a", "old-b"}) {
+		t.Fatalf("expected the expired heartbeats, got %v", ids)
+	}
+	// The filter applies before pagination.
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&status=expired&limit=1&offset=1")); !slices.Equal(ids, []string{"old-b"}) {
+		t.Fatalf("expected the second expired heartbeat, got %v", ids)
+	}
+}
+
+func TestListHasMeta(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/eu-api", `{"metadata": {"region": "eu", "labels": {"tier": "web"}}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/us-api", `{"metadata": {"region": "us"}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/cron", `{"metadata": {"owner": "ops", "region": null}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/bare", ""), http.StatusNoContent)
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&has_meta=region")); !slices.Equal(ids, []string{"eu-api", "us-api"}) {
+		t.Fatalf("expected the heartbeats with a region, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&has_meta=labels.tier")); !slices.Equal(ids, []string{"eu-api"}) {
+		t.Fatalf("expected the heartbeat with a nested tier, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&has_meta=region&limit=1&offset=1")); !slices.Equal(ids, []string{"us-api"}) {
+		t.Fatalf("expected the filter to apply before pagination, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&has_meta=missing")); len(ids) != 0 {
+		t.Fatalf("expected no heartbeats with an unknown key, got %v", ids)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	setupTest(t)
+	putLiveAndExpired(t)
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&limit=2")); !slices.Equal(ids, []string{"live-a", "live-b"}) {
+		t.Fatalf("expected the first page, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&limit=2&offset=2")); !slices.Equal(ids, []string{"old-a", "old-b"}) {
+		t.Fatalf("expected the second page, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&offset=10")); len(ids) != 0 {
+		t.Fatalf("expected an empty page past the end, got %v", ids)
+	}
+}
+
+func TestListPrefixes(t *testing.T) {
+	setupTest(t)
+	putLiveAndExpired(t)
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&prefix=live-&prefix=old-b")); !slices.Equal(ids, []string{"live-a", "live-b", "old-b"}) {
+		t.Fatalf("expected the union of the prefixes ordered by id, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&prefix=live-&prefix=live-a&status=live&limit=1&offset=1")); !slices.Equal(ids, []string{"live-b"}) {
+		t.Fatalf("expected overlapping prefixes to list each heartbeat once, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&prefix=other&namespace=team")); !slices.Equal(ids, []string{"other"}) {
+		t.Fatalf("expected the prefix to apply within the namespace, got %v", ids)
+	}
+	if ids := listedIDs(listHeartbeats(t, "?ttl=5m&prefix=dead-&prefix=gone-")); len(ids) != 0 {
+		t.Fatalf("expected nothing under unknown prefixes, got %v", ids)
+	}
+}
+
+func TestListPrefixCap(t *testing.T) {
+	setupTest(t)
+	putLiveAndExpired(t)
+	h := externalRouter()
+
+	query := "?ttl=5m"
+	for i := range maxListPrefixes {
+		query += fmt.Sprintf("&prefix=live-%d", i)
+	}
+	expectStatus(t, serve(h, http.MethodGet, "/"+query, ""), http.StatusOK)
+	expectError(t, serve(h, http.MethodGet, "/"+query+"&prefix=old-", ""), http.StatusBadRequest, "too_many_prefixes")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&prefix=live-&prefix=", ""), http.StatusBadRequest, "invalid_prefix")
+}
+
+func TestListInvalid(t *testing.T) {
+	setupTest(t)
+	h := externalRouter()
+
+	expectError(t, serve(h, http.MethodGet, "/", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&status=dead", ""), http.StatusBadRequest, "invalid_status")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&limit=0", ""), http.StatusBadRequest, "invalid_limit")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&limit=100000", ""), http.StatusBadRequest, "invalid_limit")
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&offset=-1", ""), http.StatusBadRequest, "invalid_offset")
+	for _, key := range []string{"$.region", "labels..tier", "region.", `a"b`, "re gion"} {
+		expectError(t, serve(h, http.MethodGet, "/?ttl=5m&has_meta="+url.QueryEscape(key), ""), http.StatusBadRequest, "invalid_has_meta")
+	}
+}
+
+// insertHeartbeats inserts n live heartbeats in a single transaction.
+func insertHeartbeats(t *testing.T, n int) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Format(storedTimeFormat)
+	for i := range n {
+		if _, err := tx.Exec(`
+            INSERT INTO heartbeats (namespace, id, last_updated_at) VALUES (?, ?, ?)
+        `, defaultNamespace, fmt.Sprintf("worker-%05d", i), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flushRecorder discards what is written to it, remembering the most bytes
+// it was handed between two flushes.
+type flushRecorder struct {
+	header     http.Header
+	pending    int
+	maxPending int
+	flushes    int
+}
+
+func (f *flushRecorder) Header() http.Header { return f.header }
+func (f *flushRecorder) WriteHeader(int)     {}
+
+func (f *flushRecorder) Write(p []byte) (int, error) {
+	f.pending += len(p)
+	f.maxPending = max(f.maxPending, f.pending)
+	return len(p), nil
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.pending = 0
+}
+
+func TestListStreamsManyRows(t *testing.T) {
+	const rows = 5000
+	setupTest(t, "--max-list-limit", fmt.Sprint(rows))
+	insertHeartbeats(t, rows)
+	target := fmt.Sprintf("/?ttl=5m&limit=%d", rows)
+
+	w := serve(externalRouter(), http.MethodGet, target, "")
+	expectStatus(t, w, http.StatusOK)
+	var list []HeartbeatStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("expected a valid JSON array: %v", err)
+	}
+	if len(list) != rows || list[0].ID != "worker-00000" || list[rows-1].ID != fmt.Sprintf("worker-%05d", rows-1) {
+		t.Fatalf("expected %d heartbeats in order, got %d", rows, len(list))
+	}
+
+	f := &flushRecorder{header: http.Header{}}
+	externalRouter().ServeHTTP(f, httptest.NewRequest(http.MethodGet, target, nil))
+	if f.flushes < rows/listFlushEvery {
+		t.Fatalf("expected at least %d flushes, got %d", rows/listFlushEvery, f.flushes)
+	}
+	// Each heartbeat encodes to well under 1KB, so a flush interval's worth
+	// of rows is all that should be buffered at once.
+	if limit := listFlushEvery << 10; f.maxPending > limit {
+		t.Fatalf("expected at most %d bytes between flushes, got %d", limit, f.maxPending)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// binaryListContentType is the compact encoding of the heartbeat list, sent
+// to clients naming it in Accept. Polling many ids this way costs a fraction
+// of the JSON bytes.
+const binaryListContentType = "application/vnd.heartbeat-list"
+
+// A binary list is binaryListMagic and the namespace, then a record for each
+// heartbeat:
+//
+//	flags            byte, binaryListExpired | binaryListPending | binaryListCreatedAt
+//	id               string
+//	last_updated_at  varint, Unix nanoseconds
+//	created_at       varint, Unix nanoseconds, only with binaryListCreatedAt
+//	method           string
+//
+// and binaryListEnd, so a response cut short is told apart from a complete
+// one. Strings are a uvarint byte length followed by the bytes, varints and
+// uvarints as encoding/binary writes them. Flag bits not listed here are
+// reserved.
+var binaryListMagic = []byte("HBL1")
+
+const (
+	binaryListExpired = 1 << iota
+	binaryListPending
+	binaryListCreatedAt
+
+	binaryListEnd = 0xff
+)
+
+func appendBinaryString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendBinaryListHeader starts a binary list of namespace.
+func appendBinaryListHeader(b []byte, namespace string) []byte {
+	b = append(b, binaryListMagic...)
+	return appendBinaryString(b, namespace)
+}
+
+// appendBinaryHeartbeat appends the record of hb, which must be in the
+// namespace of the list.
+func appendBinaryHeartbeat(b []byte, hb HeartbeatStatus) []byte {
+	var flags byte
+	if hb.Expired {
+		flags |= binaryListExpired
+	}
+	if hb.Pending {
+		flags |= binaryListPending
+	}
+	if hb.CreatedAt != nil {
+		flags |= binaryListCreatedAt
+	}
+	b = append(b, flags)
+	b = appendBinaryString(b, hb.ID)
+	b = binary.AppendVarint(b, hb.LastUpdatedAt.UnixNano())
+	if hb.CreatedAt != nil {
+		b = binary.AppendVarint(b, hb.CreatedAt.UnixNano())
+	}
+	return appendBinaryString(b, hb.Method)
+}
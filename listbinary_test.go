@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// decodeBinaryList reads the heartbeats of a binary list back, as a client
+// would.
+func decodeBinaryList(body []byte) ([]HeartbeatStatus, error) {
+	r := bytes.NewReader(body)
+	magic := make([]byte, len(binaryListMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, binaryListMagic) {
+		return nil, fmt.Errorf("missing magic, got %q", magic)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	namespace, err := readString()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []HeartbeatStatus{}
+	for {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("list cut short before its end")
+		}
+		if flags == binaryListEnd {
+			if r.Len() != 0 {
+				return nil, fmt.Errorf("%d bytes after the end of the list", r.Len())
+			}
+			return list, nil
+		}
+		hb := HeartbeatStatus{Expired: flags&binaryListExpired != 0, Pending: flags&binaryListPending != 0}
+		hb.Namespace = namespace
+		if hb.ID, err = readString(); err != nil {
+			return nil, err
+		}
+		lastUpdatedAt, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		hb.LastUpdatedAt = time.Unix(0, lastUpdatedAt).UTC()
+		if flags&binaryListCreatedAt != 0 {
+			createdAt, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			t := time.Unix(0, createdAt).UTC()
+			hb.CreatedAt = &t
+		}
+		if hb.Method, err = readString(); err != nil {
+			return nil, err
+		}
+		list = append(list, hb)
+	}
+}
+
+// listBinary GETs the list with query asking for the binary encoding.
+func listBinary(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+	r.Header.Set("Accept", binaryListContentType)
+	return serveRequest(externalRouter(), r)
+}
+
+func TestBinaryListRoundTrip(t *testing.T) {
+	setupTest(t, "--register-parents", "--record-method")
+	putLiveAndExpired(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/team.svc.api", ""), http.StatusNoContent)
+
+	for _, query := range []string{"?ttl=5m", "?ttl=5m&status=expired", "?ttl=5m&limit=2&offset=1", "?ttl=5m&namespace=team", "?ttl=5m&namespace=empty"} {
+		w := listBinary(t, query)
+		expectStatus(t, w, http.StatusOK)
+		if ct := w.Header().Get("Content-Type"); ct != binaryListContentType {
+			t.Fatalf("%s: expected a binary list, got %q", query, ct)
+		}
+		got, err := decodeBinaryList(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: failed to decode the binary list: %v", query, err)
+		}
+		want := listHeartbeats(t, query)
+		for i := range want {
+			want[i].LastUpdatedAt = want[i].LastUpdatedAt.UTC()
+			if want[i].CreatedAt != nil {
+				createdAt := want[i].CreatedAt.UTC()
+				want[i].CreatedAt = &createdAt
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected the binary list to hold the JSON list\n%+v, got\n%+v", query, want, got)
+		}
+	}
+
+	w := listBinary(t, "?ttl=5m")
+	jsonList := serve(externalRouter(), http.MethodGet, "/?ttl=5m", "")
+	if w.Body.Len() >= jsonList.Body.Len()/2 {
+		t.Fatalf("expected the binary list to be under half the JSON size, got %d bytes against %d", w.Body.Len(), jsonList.Body.Len())
+	}
+	if _, err := decodeBinaryList(w.Body.Bytes()[:w.Body.Len()-1]); err == nil {
+		t.Fatal("expected a list cut short to be detected")
+	}
+}
+
+func TestBinaryListNegotiated(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	for accept, want := range map[string]string{
+		"":                             "application/json",
+		"*/*":                          "application/json",
+		"application/json":             "application/json",
+		binaryListContentType:          binaryListContentType,
+		binaryListContentType + ";q=0": "application/json",
+		"application/json, " + binaryListContentType + ";q=0.5": "application/json",
+		binaryListContentType + ", application/json;q=0.5":      binaryListContentType,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?ttl=1m", nil)
+		r.Header.Set("Accept", accept)
+		w := serveRequest(externalRouter(), r)
+		expectStatus(t, w, http.StatusOK)
+		if ct := w.Header().Get("Content-Type"); ct != want {
+			t.Errorf("Accept %q: expected %s, got %q", accept, want, ct)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("Accept %q: expected Vary: Accept, got %q", accept, vary)
+		}
+	}
+
+	// Errors stay JSON.
+	r := httptest.NewRequest(http.MethodGet, "/?ttl=soon", nil)
+	r.Header.Set("Accept", binaryListContentType)
+	expectError(t, serveRequest(externalRouter(), r), http.StatusBadRequest, "invalid_ttl")
+}
+
+func TestBinaryListUnderStrictAccept(t *testing.T) {
+	setupTest(t, "--strict-accept")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	r := httptest.NewRequest(http.MethodGet, "/?ttl=1m", nil)
+	r.Header.Set("Accept", binaryListContentType)
+	w := httptest.NewRecorder()
+	requireAcceptableType(externalRouter()).ServeHTTP(w, r)
+	expectStatus(t, w, http.StatusOK)
+
+	// Only the list has a binary encoding.
+	r = httptest.NewRequest(http.MethodGet, "/worker?ttl=1m", nil)
+	r.Header.Set("Accept", binaryListContentType)
+	w = httptest.NewRecorder()
+	requireAcceptableType(externalRouter()).ServeHTTP(w, r)
+	expectError(t, w, http.StatusNotAcceptable, "not_acceptable")
+}
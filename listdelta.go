@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// listDeltaRetention is how long deleted and reaped heartbeats are
+// remembered for list deltas, a ?since= further back is refused.
+const listDeltaRetention = 24 * time.Hour
+
+// asOfHeader carries the time a list was read at on every page of it, the
+// since of a first delta.
+const asOfHeader = "X-As-Of"
+
+// listDeltaOverlap is how far before ?since= a list delta looks for writes.
+// A write is stamped before it commits, at most --busy-timeout later, and
+// stamps are truncated to --timestamp-precision, so a write stamped just
+// before the previous poll may only have become visible after it.
+func listDeltaOverlap() time.Duration {
+	return cf.BusyTimeout + cf.TimestampPrecision + time.Second
+}
+
+// ListChange is a change to the list since the previous poll. An add holds
+// the whole heartbeat, an update only the fields that changed and a remove
+// just the id.
+type ListChange struct {
+	Op        string           `json:"op"`
+	ID        string           `json:"id"`
+	Heartbeat *HeartbeatStatus `json:"heartbeat,omitempty"`
+	Fields    *ListFields      `json:"fields,omitempty"`
+}
+
+// ListFields are the fields of a listed heartbeat an update changes. A
+// heartbeat that only expired has just Expired set.
+type ListFields struct {
+	LastUpdatedAt *time.Time `json:"last_updated_at,omitempty"`
+	Method        *string    `json:"method,omitempty"`
+	Expired       bool       `json:"expired"`
+}
+
+// handleListDelta answers a list with ?since=, the as_of of the previous
+// poll, with what changed in the namespace since: removes for the heartbeats
+// deleted or reaped, adds for those created, updates for those written
+// again and for those that expired under ttl without being written. Writes
+// from up to listDeltaOverlap before since are reported again, applying a
+// change twice leaves the same list, so a client applying the changes in
+// order to its copy ends up with the list as of as_of. The ttl and any
+// ?prefix= must be the ones the previous poll used.
+func handleListDelta(w http.ResponseWriter, r *http.Request, q ListQuery, now time.Time, ttl time.Duration, sinceValue string) {
+	query := r.URL.Query()
+	for _, name := range []string{"status", "has_meta", "limit", "offset"} {
+		if query.Has(name) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_since", "since query parameter cannot be combined with status, has_meta, limit or offset")
+			return
+		}
+	}
+	if cf.StrictAccept && !acceptsJSON(r.Header.Get("Accept")) {
+		writeJSONError(w, http.StatusNotAcceptable, "not_acceptable", "list deltas are only available as application/json")
+		return
+	}
+	since, err := time.Parse(time.RFC3339Nano, sinceValue)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_since", "since query parameter must be an RFC 3339 timestamp, the as_of of the previous poll")
+		return
+	}
+	from := since.Add(-listDeltaOverlap())
+	if from.Before(now.Add(-listDeltaRetention)) {
+		writeJSONError(w, http.StatusGone, "since_too_old", fmt.Sprintf("removals are only kept for %s, list the heartbeats again", listDeltaRetention))
+		return
+	}
+
+	removed, err := store.Removed(r.Context(), q.Namespace, from)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query removed heartbeats: %v", err))
+		return
+	}
+
+	// A response cut short by a failure is invalid JSON, a client can't
+	// mistake it for a complete delta.
+	rc := http.NewResponseController(w)
+	written := 0
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		asOf, _ := now.MarshalJSON()
+		w.Header().Set(asOfHeader, now.Format(time.RFC3339Nano))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"as_of":%s,"changes":[`, asOf)
+	}
+	write := func(change ListChange) error {
+		b, err := json.Marshal(change)
+		if err != nil {
+			return fmt.Errorf("failed to encode change of %q: %v", change.ID, err)
+		}
+		if written > 0 {
+			b = append([]byte{','}, b...)
+		}
+		start()
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		written++
+		if written%listFlushEvery == 0 {
+			_ = rc.Flush()
+		}
+		return nil
+	}
+	for _, id := range removed {
+		if len(q.Prefixes) > 0 && !hasAnyIDPrefix(id, q.Prefixes) {
+			continue
+		}
+		if err := write(ListChange{Op: "remove", ID: id}); err != nil {
+			httpLog.Error("failed to list heartbeat changes", "error", err)
+			return
+		}
+	}
+
+	q.ChangedSince, q.ExpiredAfter = from, from.Add(-ttl)
+	q.Limit = math.MaxInt
+	err = store.List(r.Context(), q, func(hb HeartbeatStatus) error {
+		switch {
+		case hb.LastUpdatedAt.Before(from):
+			return write(ListChange{Op: "update", ID: hb.ID, Fields: &ListFields{Expired: true}})
+		case hb.CreatedAt != nil && !hb.CreatedAt.Before(from):
+			return write(ListChange{Op: "add", ID: hb.ID, Heartbeat: &hb})
+		default:
+			return write(ListChange{Op: "update", ID: hb.ID, Fields: &ListFields{
+				LastUpdatedAt: &hb.LastUpdatedAt,
+				Method:        &hb.Method,
+				Expired:       hb.Expired,
+			}})
+		}
+	})
+	if err != nil {
+		if !started {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeats: %v", err))
+			return
+		}
+		httpLog.Error("failed to list heartbeat changes", "error", err)
+		return
+	}
+	start()
+	_, _ = io.WriteString(w, "]}\n")
+}
+
+// recordTombstone remembers that key is being deleted at now, and forgets
+// removals older than listDeltaRetention. It must run in the transaction
+// deleting the heartbeat, before the row is gone.
+func recordTombstone(ctx context.Context, db execer, key heartbeatKey, now time.Time) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO heartbeat_tombstones (namespace, id, deleted_at)
+        SELECT namespace, id, ? FROM heartbeats WHERE namespace = ? AND id = ?
+    `, now.Format(storedTimeFormat), key.Namespace, key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record deleted heartbeat: %v", err)
+	}
+	return pruneTombstones(ctx, db, now)
+}
+
+// pruneTombstones forgets the removals older than listDeltaRetention at now.
+func pruneTombstones(ctx context.Context, db execer, now time.Time) error {
+	_, err := db.ExecContext(ctx, `
+        DELETE FROM heartbeat_tombstones WHERE julianday(deleted_at) < julianday(?)
+    `, now.Add(-listDeltaRetention).Format(storedTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to prune deleted heartbeats: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Removed(ctx context.Context, namespace string, since time.Time) ([]string, error) {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT DISTINCT id FROM heartbeat_tombstones
+        WHERE namespace = ? AND julianday(deleted_at) >= julianday(?)
+        ORDER BY id
+    `, namespace, since.Format(storedTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query removed heartbeats: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan removed heartbeat: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read removed heartbeats: %v", err)
+	}
+	return ids, nil
+}
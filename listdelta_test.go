@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// listDelta polls the list for what changed since and decodes the delta.
+func listDelta(t *testing.T, query string, since time.Time) (time.Time, []ListChange) {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+query+"&since="+url.QueryEscape(since.Format(time.RFC3339Nano)), "")
+	expectStatus(t, w, http.StatusOK)
+	var delta struct {
+		AsOf    time.Time    `json:"as_of"`
+		Changes []ListChange `json:"changes"`
+	}
+	decodeBody(t, w, &delta)
+	return delta.AsOf, delta.Changes
+}
+
+// listCopy lists query the way a dashboard keeps it, by id, along with the
+// time the list was read at.
+func listCopy(t *testing.T, query string) (time.Time, map[string]HeartbeatStatus) {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	asOf, err := time.Parse(time.RFC3339Nano, w.Header().Get(asOfHeader))
+	if err != nil {
+		t.Fatalf("expected the list to say when it was read, got %v", err)
+	}
+	var list []HeartbeatStatus
+	decodeBody(t, w, &list)
+	listed := map[string]HeartbeatStatus{}
+	for _, hb := range list {
+		listed[hb.ID] = hb
+	}
+	return asOf, listed
+}
+
+// applyDelta applies changes to a copy of the list as a client would.
+func applyDelta(listed map[string]HeartbeatStatus, changes []ListChange) {
+	for _, change := range changes {
+		switch change.Op {
+		case "remove":
+			delete(listed, change.ID)
+		case "add":
+			listed[change.ID] = *change.Heartbeat
+		case "update":
+			hb := listed[change.ID]
+			if change.Fields.LastUpdatedAt != nil {
+				hb.LastUpdatedAt = *change.Fields.LastUpdatedAt
+			}
+			if change.Fields.Method != nil {
+				hb.Method = *change.Fields.Method
+			}
+			hb.Expired = change.Fields.Expired
+			listed[change.ID] = hb
+		}
+	}
+}
+
+// expectSameList fails unless a copy kept up to date by deltas matches a
+// fresh list.
+func expectSameList(t *testing.T, got, want map[string]HeartbeatStatus) {
+	t.Helper()
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotJSON) != string(wantJSON) {
+		t.Fatalf("expected the deltas to bring the list up to date\ngot  %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+// changeOps returns the op and id of each change.
+func changeOps(changes []ListChange) []string {
+	ops := []string{}
+	for _, change := range changes {
+		ops = append(ops, change.Op+" "+change.ID)
+	}
+	return ops
+}
+
+func TestListDeltaTwoPolls(t *testing.T) {
+	setupTest(t, "--record-method")
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	for _, path := range []string{"/expires", "/rewritten", "/deleted", "/reaped?ttl=1m"} {
+		expectStatus(t, serve(h, http.MethodPut, path, ""), http.StatusNoContent)
+	}
+	c.Advance(4 * time.Minute)
+	expectStatus(t, serve(h, http.MethodPut, "/unchanged", ""), http.StatusNoContent)
+	c.Advance(time.Minute)
+
+	asOf, listed := listCopy(t, "?ttl=5m")
+
+	c.Advance(2 * time.Minute)
+	expectStatus(t, serve(h, http.MethodPost, "/rewritten", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodDelete, "/deleted", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/added", ""), http.StatusNoContent)
+	if reaped, err := store.ReapExpired(context.Background(), 0, 0, heartbeatNow()); err != nil || reaped != 1 {
+		t.Fatalf("expected one heartbeat to be reaped, got %d, %v", reaped, err)
+	}
+	c.Advance(10 * time.Second)
+
+	asOf, changes := listDelta(t, "?ttl=5m", asOf)
+	want := []string{"remove deleted", "remove reaped", "add added", "update expires", "update rewritten"}
+	if ops := changeOps(changes); !slices.Equal(ops, want) {
+		t.Fatalf("expected %v, got %v", want, ops)
+	}
+	for _, change := range changes {
+		switch change.ID {
+		case "expires":
+			if *change.Fields != (ListFields{Expired: true}) {
+				t.Errorf("expected only the expiry of an unwritten heartbeat, got %+v", change.Fields)
+			}
+		case "rewritten":
+			if change.Fields.LastUpdatedAt == nil || *change.Fields.Method != http.MethodPost || change.Fields.Expired {
+				t.Errorf("expected the new write of a heartbeat, got %+v", change.Fields)
+			}
+		}
+	}
+	applyDelta(listed, changes)
+	_, fresh := listCopy(t, "?ttl=5m")
+	expectSameList(t, listed, fresh)
+
+	// Past the overlap only the heartbeat that expired since is reported.
+	c.Advance(4 * time.Minute)
+	_, changes = listDelta(t, "?ttl=5m", asOf)
+	if ops := changeOps(changes); !slices.Equal(ops, []string{"update unchanged"}) {
+		t.Fatalf("expected only the newly expired heartbeat, got %v", ops)
+	}
+	applyDelta(listed, changes)
+	_, fresh = listCopy(t, "?ttl=5m")
+	expectSameList(t, listed, fresh)
+}
+
+func TestListDeltaRepeatsOverlap(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(time.Second)
+	asOf, listed := listCopy(t, "?ttl=5m")
+
+	// A write stamped just before the previous poll may have committed after
+	// it, so it is sent again.
+	c.Advance(time.Second)
+	_, changes := listDelta(t, "?ttl=5m", asOf)
+	if ops := changeOps(changes); !slices.Equal(ops, []string{"add worker"}) {
+		t.Fatalf("expected the write to be repeated, got %v", ops)
+	}
+	applyDelta(listed, changes)
+	_, fresh := listCopy(t, "?ttl=5m")
+	expectSameList(t, listed, fresh)
+}
+
+func TestListDeltaFS(t *testing.T) {
+	setupTest(t)
+	useFSStore(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/deleted", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/expires", ""), http.StatusNoContent)
+	c.Advance(time.Minute)
+	asOf, listed := listCopy(t, "?ttl=5m")
+
+	c.Advance(5 * time.Minute)
+	expectStatus(t, serve(h, http.MethodDelete, "/deleted", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/added", ""), http.StatusNoContent)
+	_, changes := listDelta(t, "?ttl=5m", asOf)
+	if ops := changeOps(changes); !slices.Equal(ops, []string{"remove deleted", "add added", "update expires"}) {
+		t.Fatalf("unexpected changes %v", ops)
+	}
+	if _, changes := listDelta(t, "?ttl=5m&prefix=del&prefix=add", asOf); !slices.Equal(changeOps(changes), []string{"remove deleted", "add added"}) {
+		t.Fatalf("expected only the changes under the prefixes, got %v", changeOps(changes))
+	}
+	applyDelta(listed, changes)
+	_, fresh := listCopy(t, "?ttl=5m")
+	expectSameList(t, listed, fresh)
+}
+
+func TestListDeltaInvalid(t *testing.T) {
+	setupTest(t)
+	h := externalRouter()
+	since := url.QueryEscape(heartbeatNow().Format(time.RFC3339Nano))
+	for _, query := range []string{"&limit=10", "&offset=0", "&status=live", "&has_meta=region"} {
+		expectError(t, serve(h, http.MethodGet, "/?ttl=5m&since="+since+query, ""), http.StatusBadRequest, "invalid_since")
+	}
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&since=yesterday", ""), http.StatusBadRequest, "invalid_since")
+	old := url.QueryEscape(heartbeatNow().Add(-listDeltaRetention).Format(time.RFC3339Nano))
+	expectError(t, serve(h, http.MethodGet, "/?ttl=5m&since="+old, ""), http.StatusGone, "since_too_old")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// inFlight counts requests currently being served by either server.
+var inFlight atomic.Int64
+
+// trackInFlight counts the requests handled by next in inFlight.
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overloaded reports whether any configured load threshold is exceeded.
+func overloaded() bool {
+	if cf.ShedMaxInFlight > 0 && inFlight.Load() > int64(cf.ShedMaxInFlight) {
+		return true
+	}
+	if cf.ShedMaxDBInUse > 0 && db != nil && db.Stats().InUse >= cf.ShedMaxDBInUse {
+		return true
+	}
+	return false
+}
+
+// shedLoad rejects requests with 503 while the collector is overloaded. It
+// wraps the non-critical read endpoints only, so heartbeats keep being
+// recorded under load. Shed requests are counted in http_shed_total and only
+// logged at debug level, an overloaded collector has no room for a log line
+// per request.
+func shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if overloaded() {
+			shedRequests.Inc()
+			httpLog.Debug("shedding request while overloaded", "path", r.URL.Path, "in_flight", inFlight.Load())
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusServiceUnavailable, "overloaded", "collector is overloaded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
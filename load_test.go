@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// saturate starts n requests through trackInFlight that block until the
+// returned function is called.
+func saturate(t *testing.T, n int) (release func()) {
+	t.Helper()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	blocking := trackInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			blocking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+		<-started
+	}
+	return func() {
+		close(unblock)
+		wg.Wait()
+	}
+}
+
+func TestShedLoadWhenTooManyInFlight(t *testing.T) {
+	setupTest(t, "--shed-max-in-flight", "2")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := trackInFlight(shedLoad(externalRouter()))
+
+	shed := metricValue(t, scrapeMetrics(t), "http_shed_total")
+	release := saturate(t, 2)
+	w := serve(h, http.MethodGet, "/worker?ttl=1m", "")
+	release()
+	expectError(t, w, http.StatusServiceUnavailable, "overloaded")
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+	if got := metricValue(t, scrapeMetrics(t), "http_shed_total"); got != shed+1 {
+		t.Fatalf("expected http_shed_total to grow by 1, got %v after %v", got, shed)
+	}
+
+	expectStatus(t, serve(h, http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+func TestShedLoadWhenDBBusy(t *testing.T) {
+	setupTest(t, "--shed-max-db-in-use", "1")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := shedLoad(externalRouter())
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, http.MethodGet, "/worker?ttl=1m", "")
+	_ = tx.Rollback()
+	expectError(t, w, http.StatusServiceUnavailable, "overloaded")
+
+	expectStatus(t, serve(h, http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+func TestShedLoadSparesWrites(t *testing.T) {
+	setupTest(t, "--shed-max-in-flight", "1")
+	h := trackInFlight(internalRouter())
+
+	release := saturate(t, 2)
+	defer release()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+}
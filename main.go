@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/sync/errgroup"
 )
@@ -22,12 +28,148 @@ type AppConfig struct {
 	AppName      string
 	InternalAddr string
 	ExternalAddr string
-	SQLiteDSN    string
+	SQLiteDSN    string `redact:"query"`
+	DBDriver     string
+	LogLevel     string
+
+	DefaultInterval time.Duration
+	StrictTTLUnits  bool
+
+	InternalRawReads bool
+
+	ShedMaxInFlight int
+	ShedMaxDBInUse  int
+
+	ExternalRate      float64
+	ExternalBurst     int
+	TrustForwardedFor bool
+
+	RecordMethod bool
+
+	MaxBatchWriters int
+
+	PrefixTTLs cli.StringSlice
+	MinTTL     time.Duration
+	ZeroTTL    string
+
+	DefaultTTL          time.Duration
+	DefaultTTLEndpoints cli.StringSlice
+
+	SeedFile string
+
+	BodyReadTimeout   time.Duration
+	MaxRequestTimeout time.Duration
+
+	KafkaBrokers    cli.StringSlice
+	KafkaTopic      string
+	KafkaBufferSize int
+
+	StrictAccept bool
+
+	ExposeConfig bool
+	AdminScan    bool
+
+	TimestampPrecision time.Duration
+
+	TrailingSlash string
+	IDCollation   string
+	NFCIDs        bool
+
+	S3Endpoint       string
+	S3Bucket         string
+	S3Region         string
+	S3AccessKey      string `redact:"true"`
+	S3SecretKey      string `redact:"true"`
+	S3UseSSL         bool
+	S3KeyPrefix      string
+	S3ExportFormat   string
+	S3ExportInterval time.Duration
+
+	RemoteWriteURL      string `redact:"true"`
+	RemoteWriteInterval time.Duration
+
+	StatsdAddr             string
+	StatsdInterval         time.Duration
+	MetricsRefreshInterval time.Duration
+
+	WALCheckpointInterval time.Duration
+
+	ReapInterval time.Duration
+	ReapGrace    time.Duration
+	ReapNewGrace time.Duration
+
+	TTLBeyondRetention string
+
+	HistoryRetention time.Duration
+	RegisterParents  bool
+
+	ExpiryWebhookURL     string `redact:"true"`
+	ExpiryCheckInterval  time.Duration
+	ExpiryWebhookTimeout time.Duration
+	AlertDigest          bool
+	WebhookMaxAttempts   int
+	WebhookRetryBackoff  time.Duration
+
+	BloomFilterIDs int
+	StaleCache     bool
+
+	StrictJSON bool
+
+	AllowedOrigins cli.StringSlice
+
+	InternalToken string          `redact:"true"`
+	APIKeys       cli.StringSlice `redact:"true"`
+	APIKeyRate    float64
+	APIKeyBurst   int
+	APIKeyWeights cli.StringSlice
+
+	MaxListLimit int
+
+	HealthWeightHeartbeats float64
+	HealthWeightDatabase   float64
+	HealthWeightJobs       float64
+
+	BusyTimeout time.Duration
+
+	ShutdownTimeout time.Duration
+
+	MaxHeaderBytes int
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	MaxMetadataBytes int64
 }
 
 type Heartbeat struct {
+	Namespace     string          `json:"namespace"`
+	ID            string          `json:"id"`
+	LastUpdatedAt time.Time       `json:"last_updated_at"`
+	Method        string          `json:"method,omitempty"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+	CreatedAt     *time.Time      `json:"created_at,omitempty"`
+	MutedUntil    *time.Time      `json:"muted_until,omitempty"`
+	// ExpiresAt and RemainingSeconds are only set on single heartbeat
+	// checks. RemainingSeconds is negative for an expired heartbeat returned
+	// with ?include_expired=true.
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	RemainingSeconds *float64   `json:"remaining_seconds,omitempty"`
+}
+
+// HeartbeatBody is the optional JSON body of a heartbeat.
+type HeartbeatBody struct {
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// RawHeartbeat is the stored state of a heartbeat without any expiry
+// evaluation, leaving the decision to the caller.
+type RawHeartbeat struct {
+	Namespace     string    `json:"namespace"`
 	ID            string    `json:"id"`
 	LastUpdatedAt time.Time `json:"last_updated_at"`
+	AgeSeconds    float64   `json:"age_seconds"`
+	TTLSeconds    *int64    `json:"ttl_seconds,omitempty"`
 }
 
 var (
@@ -38,7 +180,14 @@ var (
 )
 
 func main() {
-	app := &cli.App{
+	if err := newApp().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp declares the command line, whose flags are parsed into cf.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:  cf.AppName,
 		Usage: "A service to collect and monitor heartbeats",
 		Flags: []cli.Flag{
@@ -58,197 +207,1314 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:        "db-path",
-				Usage:       "Path to the SQLite database file",
+				Usage:       "Path to the SQLite database file, or with --db-driver fs to the directory of JSON files",
 				EnvVars:     []string{"SQLITE_DSN"},
 				Destination: &cf.SQLiteDSN,
 				Value:       "/tmp/heartbeats.db",
 			},
+			&cli.StringFlag{
+				Name:        "db-driver",
+				Usage:       "Where heartbeats are stored: sqlite, or fs for a directory with a JSON file per heartbeat",
+				EnvVars:     []string{"DB_DRIVER"},
+				Destination: &cf.DBDriver,
+				Value:       dbDriverSQLite,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Usage:       "Minimum level of log lines written: debug, info, warn or error",
+				EnvVars:     []string{"LOG_LEVEL"},
+				Destination: &cf.LogLevel,
+				Value:       "info",
+			},
+			&cli.DurationFlag{
+				Name:        "busy-timeout",
+				Usage:       "How long a database write waits for a concurrent writer before failing",
+				EnvVars:     []string{"BUSY_TIMEOUT"},
+				Destination: &cf.BusyTimeout,
+				Value:       5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "default-interval",
+				Usage:       "Interval stored on a heartbeat when it is first created, used when GET omits ttl (0 disables)",
+				EnvVars:     []string{"DEFAULT_INTERVAL"},
+				Destination: &cf.DefaultInterval,
+			},
+			&cli.BoolFlag{
+				Name:        "strict-ttl-units",
+				Usage:       "Only accept ttl values in Go duration syntax, rejecting unit aliases such as 30sec or 1d",
+				EnvVars:     []string{"STRICT_TTL_UNITS"},
+				Destination: &cf.StrictTTLUnits,
+			},
+			&cli.BoolFlag{
+				Name:        "internal-raw-reads",
+				Usage:       "Serve GET /raw/{id} on the internal server, returning stored state without ttl evaluation",
+				EnvVars:     []string{"INTERNAL_RAW_READS"},
+				Destination: &cf.InternalRawReads,
+			},
+			&cli.IntFlag{
+				Name:        "shed-max-in-flight",
+				Usage:       "Return 503 from external reads while more requests than this are in flight (0 disables)",
+				EnvVars:     []string{"SHED_MAX_IN_FLIGHT"},
+				Destination: &cf.ShedMaxInFlight,
+			},
+			&cli.IntFlag{
+				Name:        "shed-max-db-in-use",
+				Usage:       "Return 503 from external reads while this many DB connections are in use (0 disables)",
+				EnvVars:     []string{"SHED_MAX_DB_IN_USE"},
+				Destination: &cf.ShedMaxDBInUse,
+			},
+			&cli.Float64Flag{
+				Name:        "external-rate",
+				Usage:       "Requests per second each client IP may make to the external server, answered with 429 beyond it (0 disables)",
+				EnvVars:     []string{"EXTERNAL_RATE"},
+				Destination: &cf.ExternalRate,
+			},
+			&cli.IntFlag{
+				Name:        "external-burst",
+				Usage:       "Requests a client IP may make at once before --external-rate applies",
+				EnvVars:     []string{"EXTERNAL_BURST"},
+				Destination: &cf.ExternalBurst,
+				Value:       20,
+			},
+			&cli.BoolFlag{
+				Name:        "trust-forwarded-for",
+				Usage:       "Rate limit by the address the proxy in front of the external server appended to X-Forwarded-For",
+				EnvVars:     []string{"TRUST_FORWARDED_FOR"},
+				Destination: &cf.TrustForwardedFor,
+			},
+			&cli.BoolFlag{
+				Name:        "record-method",
+				Usage:       "Record the HTTP method that last updated each heartbeat and return it from GET",
+				EnvVars:     []string{"RECORD_METHOD"},
+				Destination: &cf.RecordMethod,
+			},
+			&cli.StringSliceFlag{
+				Name:        "prefix-ttl",
+				Usage:       "Default ttl for ids matching a pattern, e.g. batch.*=1h, used when neither the request nor the heartbeat has one",
+				EnvVars:     []string{"PREFIX_TTLS"},
+				Destination: &cf.PrefixTTLs,
+			},
+			&cli.DurationFlag{
+				Name:        "default-ttl",
+				Usage:       "Ttl used when a request omits it, on the endpoints listed in --default-ttl-endpoints",
+				EnvVars:     []string{"DEFAULT_TTL"},
+				Destination: &cf.DefaultTTL,
+			},
+			&cli.StringSliceFlag{
+				Name:        "default-ttl-endpoints",
+				Usage:       "External endpoints that fall back to --default-ttl instead of returning 400 on a missing ttl: heartbeat, list, expired, group",
+				EnvVars:     []string{"DEFAULT_TTL_ENDPOINTS"},
+				Destination: &cf.DefaultTTLEndpoints,
+			},
+			&cli.DurationFlag{
+				Name:        "min-ttl",
+				Usage:       "Floor that shorter ttls are raised to, preventing alive/expired flapping (0 disables)",
+				EnvVars:     []string{"MIN_TTL"},
+				Destination: &cf.MinTTL,
+			},
+			&cli.StringFlag{
+				Name:        "zero-ttl",
+				Usage:       "How GET answers a heartbeat whose ttl resolves to zero: reject (422) or expire (404, as if it had expired)",
+				EnvVars:     []string{"ZERO_TTL"},
+				Destination: &cf.ZeroTTL,
+				Value:       zeroTTLReject,
+			},
+			&cli.StringFlag{
+				Name:        "seed-file",
+				Usage:       "JSON file of heartbeats (id and optional interval) inserted at startup when the database is empty",
+				EnvVars:     []string{"SEED_FILE"},
+				Destination: &cf.SeedFile,
+			},
+			&cli.DurationFlag{
+				Name:        "body-read-timeout",
+				Usage:       "Deadline for reading request bodies on internal write endpoints, answered with 408 when exceeded (0 disables)",
+				EnvVars:     []string{"BODY_READ_TIMEOUT"},
+				Destination: &cf.BodyReadTimeout,
+				Value:       10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "max-request-timeout",
+				Usage:       "Upper bound for deadlines clients request with the X-Request-Timeout header (0 ignores the header)",
+				EnvVars:     []string{"MAX_REQUEST_TIMEOUT"},
+				Destination: &cf.MaxRequestTimeout,
+				Value:       30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				Usage:       "How long shutdown waits for in-flight requests before closing their connections",
+				EnvVars:     []string{"SHUTDOWN_TIMEOUT"},
+				Destination: &cf.ShutdownTimeout,
+				Value:       10 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:        "max-header-bytes",
+				Usage:       "Largest request header, in bytes, either server reads before answering 431",
+				EnvVars:     []string{"MAX_HEADER_BYTES"},
+				Destination: &cf.MaxHeaderBytes,
+				Value:       http.DefaultMaxHeaderBytes,
+			},
+			&cli.StringFlag{
+				Name:        "tls-cert",
+				Usage:       "PEM certificate both servers serve HTTPS with, requires --tls-key",
+				EnvVars:     []string{"TLS_CERT"},
+				Destination: &cf.TLSCert,
+			},
+			&cli.StringFlag{
+				Name:        "tls-key",
+				Usage:       "PEM private key of --tls-cert",
+				EnvVars:     []string{"TLS_KEY"},
+				Destination: &cf.TLSKey,
+			},
+			&cli.StringFlag{
+				Name:        "tls-client-ca",
+				Usage:       "PEM bundle of CAs internal server clients must present a certificate from, reloaded on SIGHUP",
+				EnvVars:     []string{"TLS_CLIENT_CA"},
+				Destination: &cf.TLSClientCA,
+			},
+			&cli.StringSliceFlag{
+				Name:        "kafka-brokers",
+				Usage:       "Kafka brokers to publish heartbeat events to, requires --kafka-topic",
+				EnvVars:     []string{"KAFKA_BROKERS"},
+				Destination: &cf.KafkaBrokers,
+			},
+			&cli.StringFlag{
+				Name:        "kafka-topic",
+				Usage:       "Kafka topic heartbeat events are published to",
+				EnvVars:     []string{"KAFKA_TOPIC"},
+				Destination: &cf.KafkaTopic,
+			},
+			&cli.IntFlag{
+				Name:        "kafka-buffer-size",
+				Usage:       "Number of heartbeat events buffered for Kafka before new ones are dropped",
+				EnvVars:     []string{"KAFKA_BUFFER_SIZE"},
+				Destination: &cf.KafkaBufferSize,
+				Value:       1000,
+			},
+			&cli.BoolFlag{
+				Name:        "strict-accept",
+				Usage:       "Answer 406 on external endpoints when the Accept header doesn't allow JSON",
+				EnvVars:     []string{"STRICT_ACCEPT"},
+				Destination: &cf.StrictAccept,
+			},
+			&cli.BoolFlag{
+				Name:        "expose-config",
+				Usage:       "Serve the resolved configuration, with secrets redacted, at GET /admin/config on the internal server",
+				EnvVars:     []string{"EXPOSE_CONFIG"},
+				Destination: &cf.ExposeConfig,
+			},
+			&cli.BoolFlag{
+				Name:        "admin-scan",
+				Usage:       "Serve POST /admin/scan on the internal server, which runs an expiry scan and notification pass immediately",
+				EnvVars:     []string{"ADMIN_SCAN"},
+				Destination: &cf.AdminScan,
+			},
+			&cli.DurationFlag{
+				Name:        "timestamp-precision",
+				Usage:       "Truncate stored heartbeat timestamps to this precision, e.g. 1m (0 keeps full precision)",
+				EnvVars:     []string{"TIMESTAMP_PRECISION"},
+				Destination: &cf.TimestampPrecision,
+			},
+			&cli.StringFlag{
+				Name:        "trailing-slash",
+				Usage:       "How paths with a trailing slash are handled: strip (route without it), redirect (308 to the path without it) or off",
+				EnvVars:     []string{"TRAILING_SLASH"},
+				Destination: &cf.TrailingSlash,
+				Value:       trailingSlashStrip,
+			},
+			&cli.StringFlag{
+				Name:        "id-collation",
+				Usage:       "How heartbeat ids are compared: binary (case-sensitive) or nocase (ASCII case-insensitive)",
+				EnvVars:     []string{"ID_COLLATION"},
+				Destination: &cf.IDCollation,
+				Value:       idCollationBinary,
+			},
+			&cli.BoolFlag{
+				Name:        "nfc-ids",
+				Usage:       "Normalize heartbeat ids to Unicode NFC, so composed and decomposed spellings match",
+				EnvVars:     []string{"NFC_IDS"},
+				Destination: &cf.NFCIDs,
+			},
+			&cli.StringFlag{
+				Name:        "s3-endpoint",
+				Usage:       "S3-compatible endpoint (host:port) to export heartbeat snapshots to, requires --s3-bucket",
+				EnvVars:     []string{"S3_ENDPOINT"},
+				Destination: &cf.S3Endpoint,
+			},
+			&cli.StringFlag{
+				Name:        "s3-bucket",
+				Usage:       "Bucket heartbeat snapshots are exported to",
+				EnvVars:     []string{"S3_BUCKET"},
+				Destination: &cf.S3Bucket,
+			},
+			&cli.StringFlag{
+				Name:        "s3-region",
+				Usage:       "Region of the export bucket",
+				EnvVars:     []string{"S3_REGION"},
+				Destination: &cf.S3Region,
+			},
+			&cli.StringFlag{
+				Name:        "s3-access-key",
+				Usage:       "Access key for the export bucket",
+				EnvVars:     []string{"S3_ACCESS_KEY"},
+				Destination: &cf.S3AccessKey,
+			},
+			&cli.StringFlag{
+				Name:        "s3-secret-key",
+				Usage:       "Secret key for the export bucket",
+				EnvVars:     []string{"S3_SECRET_KEY"},
+				Destination: &cf.S3SecretKey,
+			},
+			&cli.BoolFlag{
+				Name:        "s3-use-ssl",
+				Usage:       "Connect to the S3 endpoint over HTTPS",
+				EnvVars:     []string{"S3_USE_SSL"},
+				Destination: &cf.S3UseSSL,
+				Value:       true,
+			},
+			&cli.StringFlag{
+				Name:        "s3-key-prefix",
+				Usage:       "Prefix of the timestamped object keys snapshots are exported under",
+				EnvVars:     []string{"S3_KEY_PREFIX"},
+				Destination: &cf.S3KeyPrefix,
+				Value:       "heartbeats/",
+			},
+			&cli.StringFlag{
+				Name:        "s3-export-format",
+				Usage:       "Format of exported snapshots: ndjson or csv",
+				EnvVars:     []string{"S3_EXPORT_FORMAT"},
+				Destination: &cf.S3ExportFormat,
+				Value:       exportFormatNDJSON,
+			},
+			&cli.DurationFlag{
+				Name:        "s3-export-interval",
+				Usage:       "How often a snapshot is exported to S3",
+				EnvVars:     []string{"S3_EXPORT_INTERVAL"},
+				Destination: &cf.S3ExportInterval,
+				Value:       time.Hour,
+			},
+			&cli.StringFlag{
+				Name:        "remote-write-url",
+				Usage:       "Prometheus remote-write endpoint the age of every heartbeat is pushed to",
+				EnvVars:     []string{"REMOTE_WRITE_URL"},
+				Destination: &cf.RemoteWriteURL,
+			},
+			&cli.DurationFlag{
+				Name:        "remote-write-interval",
+				Usage:       "How often heartbeat ages are pushed to --remote-write-url",
+				EnvVars:     []string{"REMOTE_WRITE_INTERVAL"},
+				Destination: &cf.RemoteWriteInterval,
+				Value:       time.Minute,
+			},
+			&cli.StringFlag{
+				Name:        "statsd-addr",
+				Usage:       "statsd server (host:port) heartbeat ages and request counts are pushed to over UDP, with DogStatsD tags",
+				EnvVars:     []string{"STATSD_ADDR"},
+				Destination: &cf.StatsdAddr,
+			},
+			&cli.DurationFlag{
+				Name:        "statsd-interval",
+				Usage:       "How often metrics are pushed to --statsd-addr",
+				EnvVars:     []string{"STATSD_INTERVAL"},
+				Destination: &cf.StatsdInterval,
+				Value:       10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "metrics-refresh-interval",
+				Usage:       "Serve the heartbeat gauges of /metrics and statsd from a snapshot refreshed this often instead of reading every heartbeat per scrape, 0 to read them live",
+				EnvVars:     []string{"METRICS_REFRESH_INTERVAL"},
+				Destination: &cf.MetricsRefreshInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "wal-checkpoint-interval",
+				Usage:       "How often the WAL file is checkpointed and truncated when the database runs in WAL mode, 0 to disable",
+				EnvVars:     []string{"WAL_CHECKPOINT_INTERVAL"},
+				Destination: &cf.WALCheckpointInterval,
+				Value:       5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:        "reap-interval",
+				Usage:       "How often heartbeats past their stored ttl and --reap-grace are deleted, 0 to disable",
+				EnvVars:     []string{"REAP_INTERVAL"},
+				Destination: &cf.ReapInterval,
+				Value:       time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:        "reap-grace",
+				Usage:       "How long a heartbeat is kept after its stored ttl ran out before it is reaped",
+				EnvVars:     []string{"REAP_GRACE"},
+				Destination: &cf.ReapGrace,
+				Value:       24 * time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:        "reap-new-grace",
+				Usage:       "How long after it was created a heartbeat is never reaped, so one set up and left quiet isn't deleted, 0 to disable",
+				EnvVars:     []string{"REAP_NEW_GRACE"},
+				Destination: &cf.ReapNewGrace,
+			},
+			&cli.StringFlag{
+				Name:        "ttl-beyond-retention",
+				Usage:       "How GET answers a ttl longer than the reaper keeps the heartbeat: warn (sets " + retentionExceededHeader + ") or reject (422)",
+				EnvVars:     []string{"TTL_BEYOND_RETENTION"},
+				Destination: &cf.TTLBeyondRetention,
+				Value:       ttlBeyondRetentionWarn,
+			},
+			&cli.DurationFlag{
+				Name:        "history-retention",
+				Usage:       "How long heartbeat arrivals are kept for /{id}/history, trimmed every --reap-interval, 0 to keep them forever",
+				EnvVars:     []string{"HISTORY_RETENTION"},
+				Destination: &cf.HistoryRetention,
+				Value:       7 * 24 * time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:        "register-parents",
+				Usage:       "Register the dot-separated parents of a reported id, team.svc and team for team.svc.inst, as pending entries",
+				EnvVars:     []string{"REGISTER_PARENTS"},
+				Destination: &cf.RegisterParents,
+			},
+			&cli.StringFlag{
+				Name:        "expiry-webhook-url",
+				Usage:       "URL a JSON notification is POSTed to when a heartbeat passes its stored ttl, unless it has its own alert_url",
+				EnvVars:     []string{"EXPIRY_WEBHOOK_URL"},
+				Destination: &cf.ExpiryWebhookURL,
+			},
+			&cli.DurationFlag{
+				Name:        "expiry-check-interval",
+				Usage:       "How often heartbeats are checked for expiry when --expiry-webhook-url is set",
+				EnvVars:     []string{"EXPIRY_CHECK_INTERVAL"},
+				Destination: &cf.ExpiryCheckInterval,
+				Value:       30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "expiry-webhook-timeout",
+				Usage:       "Timeout for delivering a single expiry notification",
+				EnvVars:     []string{"EXPIRY_WEBHOOK_TIMEOUT"},
+				Destination: &cf.ExpiryWebhookTimeout,
+				Value:       5 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:        "alert-digest",
+				Usage:       "POST the heartbeats that expired since the last check as one digest per webhook URL instead of one notification each",
+				EnvVars:     []string{"ALERT_DIGEST"},
+				Destination: &cf.AlertDigest,
+			},
+			&cli.IntFlag{
+				Name:        "webhook-max-attempts",
+				Usage:       "Dead-letter an expiry notification after this many failed deliveries",
+				EnvVars:     []string{"WEBHOOK_MAX_ATTEMPTS"},
+				Destination: &cf.WebhookMaxAttempts,
+				Value:       10,
+			},
+			&cli.DurationFlag{
+				Name:        "webhook-retry-backoff",
+				Usage:       "Wait after a failed expiry notification delivery, doubled with every further failure up to 1h",
+				EnvVars:     []string{"WEBHOOK_RETRY_BACKOFF"},
+				Destination: &cf.WebhookRetryBackoff,
+				Value:       30 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:        "bloom-filter-ids",
+				Usage:       "Number of ids to size an in-memory filter for that answers GETs of unknown ids without a database query, 0 to disable",
+				EnvVars:     []string{"BLOOM_FILTER_IDS"},
+				Destination: &cf.BloomFilterIDs,
+			},
+			&cli.BoolFlag{
+				Name:        "stale-cache",
+				Usage:       "Answer GETs from the last successfully read state of a heartbeat when the database fails, flagged with X-Heartbeat-Stale",
+				EnvVars:     []string{"STALE_CACHE"},
+				Destination: &cf.StaleCache,
+			},
+			&cli.BoolFlag{
+				Name:        "strict-json",
+				Usage:       "Reject JSON request bodies containing unknown fields",
+				EnvVars:     []string{"STRICT_JSON"},
+				Destination: &cf.StrictJSON,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allowed-origins",
+				Usage:       "Origins, or *, whose browser pages may read the external server through CORS",
+				EnvVars:     []string{"ALLOWED_ORIGINS"},
+				Destination: &cf.AllowedOrigins,
+			},
+			&cli.Int64Flag{
+				Name:        "max-metadata-bytes",
+				Usage:       "Largest metadata a heartbeat may store, in bytes of compacted JSON, unless overridden for its id",
+				EnvVars:     []string{"MAX_METADATA_BYTES"},
+				Destination: &cf.MaxMetadataBytes,
+				Value:       64 << 10,
+			},
+			&cli.StringFlag{
+				Name:        "internal-token",
+				Usage:       "Bearer token required on every internal server request, auth is disabled when empty",
+				EnvVars:     []string{"INTERNAL_TOKEN"},
+				Destination: &cf.InternalToken,
+			},
+			&cli.StringSliceFlag{
+				Name:        "api-key",
+				Usage:       "Bearer token that may only write heartbeats under a prefix, as token=prefix, e.g. s3cret=tenant-a/ for the tenant-a namespace",
+				EnvVars:     []string{"API_KEYS"},
+				Destination: &cf.APIKeys,
+			},
+			&cli.Float64Flag{
+				Name:        "api-key-rate",
+				Usage:       "Requests per second the API keys of each prefix may make to the internal server, answered with 429 beyond it (0 disables)",
+				EnvVars:     []string{"API_KEY_RATE"},
+				Destination: &cf.APIKeyRate,
+			},
+			&cli.IntFlag{
+				Name:        "api-key-burst",
+				Usage:       "Requests the API keys of a prefix may make at once before --api-key-rate applies",
+				EnvVars:     []string{"API_KEY_BURST"},
+				Destination: &cf.APIKeyBurst,
+				Value:       20,
+			},
+			&cli.StringSliceFlag{
+				Name:        "api-key-weight",
+				Usage:       "Multiplier of --api-key-rate and --api-key-burst for the API keys of a prefix, as prefix=weight, e.g. tenant-a/=2",
+				EnvVars:     []string{"API_KEY_WEIGHTS"},
+				Destination: &cf.APIKeyWeights,
+			},
+			&cli.IntFlag{
+				Name:        "max-list-limit",
+				Usage:       "Largest page of heartbeats a list request may ask for with ?limit=",
+				EnvVars:     []string{"MAX_LIST_LIMIT"},
+				Destination: &cf.MaxListLimit,
+				Value:       1000,
+			},
+			&cli.IntFlag{
+				Name:        "max-batch-writers",
+				Usage:       "Write at most this many batches at once, further batches wait their turn (single PUTs are not limited)",
+				EnvVars:     []string{"MAX_BATCH_WRITERS"},
+				Destination: &cf.MaxBatchWriters,
+				Value:       1,
+			},
+			&cli.Float64Flag{
+				Name:        "health-weight-heartbeats",
+				Usage:       "Weight of the fraction of alive heartbeats in the health score",
+				EnvVars:     []string{"HEALTH_WEIGHT_HEARTBEATS"},
+				Destination: &cf.HealthWeightHeartbeats,
+				Value:       60,
+			},
+			&cli.Float64Flag{
+				Name:        "health-weight-database",
+				Usage:       "Weight of database reachability in the health score",
+				EnvVars:     []string{"HEALTH_WEIGHT_DATABASE"},
+				Destination: &cf.HealthWeightDatabase,
+				Value:       30,
+			},
+			&cli.Float64Flag{
+				Name:        "health-weight-jobs",
+				Usage:       "Weight of the fraction of healthy background jobs in the health score",
+				EnvVars:     []string{"HEALTH_WEIGHT_JOBS"},
+				Destination: &cf.HealthWeightJobs,
+				Value:       10,
+			},
 		},
-		Action: run,
+		Commands: []*cli.Command{rebuildCommand()},
+		Action:   run,
 	}
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+}
+
+// openDatabase opens --db-path and brings its schema and id collation up
+// to date.
+func openDatabase() (*sql.DB, error) {
+	db, err := sql.Open(sqliteDriverName, cf.SQLiteDSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := enableWAL(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := initSchema(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := applyIDCollation(db, cf.IDCollation); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	return db, nil
+}
+
+// validDefaultInterval checks --default-interval. Intervals are stored in
+// whole seconds, a shorter one would be stored as 0 and expire every new
+// heartbeat the moment it is created.
+func validDefaultInterval(d time.Duration) error {
+	if d < 0 || (d > 0 && d < time.Second) {
+		return fmt.Errorf("--default-interval must be 0 or at least 1s")
+	}
+	return nil
 }
 
 func run(cliCtx *cli.Context) error {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cf.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", cf.LogLevel)
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 	slog.SetDefault(logger)
+	httpLog = componentLogger(logger, "http")
+	rateLimitLog = componentLogger(logger, "ratelimit")
+	staleCacheLog = componentLogger(logger, "stale-cache")
+
+	logger.Info("starting with config", "config", redactedConfig(&cf))
+
+	if err := validTrailingSlashMode(cf.TrailingSlash); err != nil {
+		return err
+	}
+	if err := validDBDriver(cf.DBDriver); err != nil {
+		return err
+	}
+	if cf.DBDriver == dbDriverFS && cf.SeedFile != "" {
+		return fmt.Errorf("--seed-file requires --db-driver %s", dbDriverSQLite)
+	}
+	if err := validIDCollation(cf.IDCollation); err != nil {
+		return err
+	}
+	if err := validZeroTTLMode(cf.ZeroTTL); err != nil {
+		return err
+	}
+	if err := validTTLBeyondRetentionMode(cf.TTLBeyondRetention); err != nil {
+		return err
+	}
+	if err := validTLSConfig(cf.TLSCert, cf.TLSKey, cf.TLSClientCA); err != nil {
+		return err
+	}
+	if cf.ExternalRate < 0 {
+		return fmt.Errorf("--external-rate must not be negative")
+	}
+	if cf.ExternalRate > 0 && cf.ExternalBurst <= 0 {
+		return fmt.Errorf("--external-burst must be positive")
+	}
+	if cf.APIKeyRate < 0 {
+		return fmt.Errorf("--api-key-rate must not be negative")
+	}
+	if cf.APIKeyRate > 0 && cf.APIKeyBurst <= 0 {
+		return fmt.Errorf("--api-key-burst must be positive")
+	}
+	if err := validDefaultInterval(cf.DefaultInterval); err != nil {
+		return err
+	}
+	if cf.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("--max-header-bytes must be positive")
+	}
+	if cf.MaxBatchWriters <= 0 {
+		return fmt.Errorf("--max-batch-writers must be positive")
+	}
+	if cf.ExpiryWebhookURL != "" {
+		if !validAlertURL(cf.ExpiryWebhookURL) {
+			return fmt.Errorf("--expiry-webhook-url must be an absolute http(s) URL")
+		}
+		if cf.ExpiryCheckInterval <= 0 {
+			return fmt.Errorf("--expiry-check-interval must be positive")
+		}
+	}
+	if cf.WebhookMaxAttempts <= 0 {
+		return fmt.Errorf("--webhook-max-attempts must be positive")
+	}
+	if cf.WebhookRetryBackoff <= 0 {
+		return fmt.Errorf("--webhook-retry-backoff must be positive")
+	}
+	if cf.StatsdAddr != "" && cf.StatsdInterval <= 0 {
+		return fmt.Errorf("--statsd-interval must be positive")
+	}
+	if cf.MetricsRefreshInterval < 0 {
+		return fmt.Errorf("--metrics-refresh-interval must not be negative")
+	}
 
 	var err error
-	db, err = sql.Open("sqlite3", cf.SQLiteDSN)
+	prefixTTLs, err = parsePrefixTTLs(cf.PrefixTTLs.Value())
 	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
+		return err
 	}
-	defer func() {
-		_ = db.Close()
-		log.Printf("closed DB at %s\n", cf.SQLiteDSN)
-	}()
-
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS heartbeats (
-            id TEXT PRIMARY KEY,
-            last_updated_at DATETIME NOT NULL
-        );
-    `)
+	defaultTTLEndpoints, err = parseDefaultTTLEndpoints(cf.DefaultTTLEndpoints.Value())
+	if err != nil {
+		return err
+	}
+	batchWriters = make(chan struct{}, cf.MaxBatchWriters)
+	apiKeys, err = parseAPIKeys(cf.APIKeys.Value())
+	if err != nil {
+		return err
+	}
+	apiKeyWeights, err = parseAPIKeyWeights(cf.APIKeyWeights.Value(), apiKeys)
 	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
+		return err
 	}
 
-	log.Printf("DB opened at %s\n", cf.SQLiteDSN)
+	if cf.DBDriver == dbDriverFS {
+		// There is no database, which leaves db nil for the few handlers
+		// and jobs reading it directly.
+		db = nil
+		store, err = newFSStore(cf.SQLiteDSN)
+		if err != nil {
+			return err
+		}
+		log.Printf("heartbeat files opened at %s\n", cf.SQLiteDSN)
+	} else {
+		db, err = openDatabase()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = db.Close()
+			log.Printf("closed DB at %s\n", redactQuery(cf.SQLiteDSN))
+		}()
+		store = newSQLiteStore(db)
+
+		log.Printf("DB opened at %s\n", redactQuery(cf.SQLiteDSN))
+	}
+
+	if cf.SeedFile != "" {
+		seeded, err := seedHeartbeats(db, cf.SeedFile)
+		if err != nil {
+			return err
+		}
+		if seeded {
+			log.Printf("seeded heartbeats from %s\n", cf.SeedFile)
+		} else {
+			log.Printf("skipped seeding from %s, database already has heartbeats\n", cf.SeedFile)
+		}
+	}
+
+	if cf.StaleCache {
+		store = newStaleCacheStore(store)
+	}
+	if cf.BloomFilterIDs > 0 {
+		store, err = newBloomStore(cliCtx.Context, store, cf.BloomFilterIDs)
+		if err != nil {
+			return err
+		}
+	}
 
 	ctx, exitApp := context.WithCancel(cliCtx.Context)
 	defer exitApp()
 
 	g, groupCtx := errgroup.WithContext(ctx)
 
+	if len(cf.KafkaBrokers.Value()) > 0 || cf.KafkaTopic != "" {
+		if len(cf.KafkaBrokers.Value()) == 0 || cf.KafkaTopic == "" {
+			return fmt.Errorf("--kafka-brokers and --kafka-topic must be set together")
+		}
+		kafkaLog := componentLogger(logger, "kafka-producer")
+		producer = newKafkaProducer(cf.KafkaBrokers.Value(), cf.KafkaTopic, cf.KafkaBufferSize, kafkaLog)
+		g.Go(func() error {
+			kafkaLog.Info("publishing heartbeat events", "topic", cf.KafkaTopic)
+			return producer.Run(groupCtx)
+		})
+	}
+
+	if cf.S3Endpoint != "" || cf.S3Bucket != "" {
+		if cf.S3Endpoint == "" || cf.S3Bucket == "" {
+			return fmt.Errorf("--s3-endpoint and --s3-bucket must be set together")
+		}
+		exportLog := componentLogger(logger, "s3-export")
+		exporter, err := newS3Exporter(exportLog)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			exportLog.Info("exporting heartbeats", "bucket", cf.S3Bucket, "interval", cf.S3ExportInterval.String())
+			return exporter.Run(groupCtx)
+		})
+	}
+
+	if cf.RemoteWriteURL != "" {
+		if !validAlertURL(cf.RemoteWriteURL) {
+			return fmt.Errorf("--remote-write-url must be an absolute http(s) URL")
+		}
+		if cf.RemoteWriteInterval <= 0 {
+			return fmt.Errorf("--remote-write-interval must be positive")
+		}
+		remoteWriteLog := componentLogger(logger, "remote-write")
+		g.Go(func() error {
+			remoteWriteLog.Info("pushing heartbeat ages", "interval", cf.RemoteWriteInterval.String())
+			return runRemoteWrite(groupCtx, cf.RemoteWriteInterval, remoteWriteLog)
+		})
+	}
+
+	internalTLSConfig, err := newInternalTLSConfig()
+	if err != nil {
+		return err
+	}
+	if cf.TLSClientCA != "" {
+		pool, err := loadClientCAs(cf.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		clientCAs.Store(pool)
+		g.Go(func() error {
+			return runClientCAReloader(groupCtx, componentLogger(logger, "client-ca-reloader"))
+		})
+	}
+
+	if cf.ExternalRate > 0 || cf.APIKeyRate > 0 {
+		g.Go(func() error {
+			return runLimiterEviction(groupCtx, time.Minute, componentLogger(logger, "rate-limiter"))
+		})
+	}
+
+	if cf.MetricsRefreshInterval > 0 {
+		metricsLog := componentLogger(logger, "metrics-refresh")
+		g.Go(func() error {
+			metricsLog.Info("serving heartbeat gauges from a snapshot", "interval", cf.MetricsRefreshInterval.String())
+			return runMetricsRefresh(groupCtx, cf.MetricsRefreshInterval, metricsLog)
+		})
+	}
+
+	if cf.StatsdAddr != "" {
+		statsdLog := componentLogger(logger, "statsd")
+		emitter, err := newStatsdEmitter(cf.StatsdAddr, statsdLog)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			statsdLog.Info("pushing statsd metrics", "addr", cf.StatsdAddr, "interval", cf.StatsdInterval.String())
+			return emitter.Run(groupCtx, cf.StatsdInterval)
+		})
+	}
+
+	if cf.WALCheckpointInterval > 0 && db != nil {
+		wal, err := walEnabled(ctx, db)
+		if err != nil {
+			return err
+		}
+		if wal {
+			checkpointLog := componentLogger(logger, "wal-checkpoint")
+			g.Go(func() error {
+				checkpointLog.Info("checkpointing WAL", "interval", cf.WALCheckpointInterval.String())
+				return runWALCheckpoints(groupCtx, cf.WALCheckpointInterval, checkpointLog)
+			})
+		}
+	}
+
+	if cf.ReapInterval > 0 {
+		reaperLog := componentLogger(logger, "reaper")
+		g.Go(func() error {
+			reaperLog.Info("reaping expired heartbeats", "interval", cf.ReapInterval.String(), "grace", cf.ReapGrace.String(), "new_grace", cf.ReapNewGrace.String())
+			return runReaper(groupCtx, cf.ReapInterval, reaperLog)
+		})
+	}
+
+	if cf.ExpiryWebhookURL != "" {
+		webhookLog := componentLogger(logger, "expiry-webhook")
+		client := &http.Client{Timeout: cf.ExpiryWebhookTimeout}
+		g.Go(func() error {
+			webhookLog.Info("notifying about expired heartbeats", "interval", cf.ExpiryCheckInterval.String())
+			return runExpiryNotifier(groupCtx, cf.ExpiryCheckInterval, client, webhookLog)
+		})
+	}
+
 	g.Go(func() error {
+		internalLog := componentLogger(logger, "internal-server")
 		internalServer := &http.Server{
-			Addr:    cf.InternalAddr,
-			Handler: internalRouter(),
+			Addr:           cf.InternalAddr,
+			Handler:        withRequestLog(internalLog, trackInFlight(withServerTiming(withClientDeadline(requireClientCert(requireInternalToken(normalizeTrailingSlash(normalizeIDPath(internalRouter())))))))),
+			ErrorLog:       slog.NewLogLogger(internalLog.Handler(), slog.LevelError),
+			MaxHeaderBytes: cf.MaxHeaderBytes,
+			TLSConfig:      internalTLSConfig,
 		}
 
+		shutdownDone := make(chan struct{})
 		go func() {
+			defer close(shutdownDone)
 			<-groupCtx.Done()
-			if err := internalServer.Shutdown(context.Background()); err != nil {
-				log.Printf("failed to shutdown internal server: %v", err)
-			} else {
-				log.Println("internal server shutdown")
-			}
-
+			shutdownServer(internalServer, internalLog, "internal server")
 		}()
 
-		log.Printf("internal server starting on %s\n", cf.InternalAddr)
-		if err := internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		internalLog.Info("internal server starting", "addr", cf.InternalAddr, "tls", tlsEnabled())
+		if err := listenAndServe(internalServer); err != nil && err != http.ErrServerClosed {
 			return fmt.Errorf("internal server error: %v", err)
 		}
+		<-shutdownDone
 		return nil
 	})
 
 	g.Go(func() error {
+		externalLog := componentLogger(logger, "external-server")
 		externalServer := &http.Server{
-			Addr:    cf.ExternalAddr,
-			Handler: externalRouter(),
+			Addr:           cf.ExternalAddr,
+			Handler:        withRequestLog(externalLog, trackInFlight(withServerTiming(withCORS(rateLimitByIP(shedLoad(withClientDeadline(requireAcceptableType(normalizeTrailingSlash(normalizeIDPath(externalRouter())))))))))),
+			ErrorLog:       slog.NewLogLogger(externalLog.Handler(), slog.LevelError),
+			MaxHeaderBytes: cf.MaxHeaderBytes,
 		}
+		shutdownDone := make(chan struct{})
 		go func() {
+			defer close(shutdownDone)
 			<-groupCtx.Done()
-			if err := externalServer.Shutdown(context.Background()); err != nil {
-				log.Printf("failed to shutdown external server: %v", err)
-			} else {
-				log.Println("external server shutdown")
-			}
+			shutdownServer(externalServer, externalLog, "external server")
 		}()
-		log.Printf("external server starting on %s\n", cf.ExternalAddr)
-		if err := externalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		externalLog.Info("external server starting", "addr", cf.ExternalAddr, "tls", tlsEnabled())
+		if err := listenAndServe(externalServer); err != nil && err != http.ErrServerClosed {
 			return fmt.Errorf("external server error: %v", err)
 		}
+		<-shutdownDone
 		return nil
 	})
 
 	g.Go(func() error {
+		signalLog := componentLogger(logger, "signal-listener")
 		signalChannel := make(chan os.Signal, 1)
 		signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
 
-		log.Println("starting signal listener")
+		signalLog.Info("starting signal listener")
 
 		select {
 		case sig := <-signalChannel:
-			log.Printf("received sig-%s, exiting\n", sig)
+			signalLog.Info("received signal, exiting", "signal", sig.String())
 			exitApp()
 		case <-groupCtx.Done():
-			log.Println("ending signal listener, main context done")
+			signalLog.Info("ending signal listener, main context done")
 			return groupCtx.Err()
 		}
 
 		return nil
 	})
 
-	err = g.Wait()
-	return err
+	// A shutdown triggered by a signal cancels the group context, which is a
+	// clean exit rather than a failure. The server goroutines only return once
+	// their requests have drained, so the database is open until then.
+	if err := g.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
 }
 
+// shutdownServer stops server gracefully, waiting at most --shutdown-timeout
+// for in-flight requests before closing their connections.
+func shutdownServer(server *http.Server, logger *slog.Logger, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cf.ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn(name+" shutdown timed out, closing remaining connections", "timeout", cf.ShutdownTimeout.String())
+		_ = server.Close()
+	case err != nil:
+		logger.Error("failed to shutdown "+name, "error", err)
+	default:
+		logger.Info(name + " shutdown")
+	}
+}
+
+// componentLogger derives the logger for a subsystem from the base logger,
+// tagging every record with the component name so logs can be filtered.
+func componentLogger(base *slog.Logger, component string) *slog.Logger {
+	return base.With("component", component)
+}
+
+// Loggers of the code running inside request handlers, tagged once run has
+// set up the base logger.
+var (
+	httpLog       = slog.Default()
+	rateLimitLog  = slog.Default()
+	staleCacheLog = slog.Default()
+)
+
 func internalRouter() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/{id}", handlePutHeartbeat)
-	return mux
+	mux.Handle("/{id}", withBodyReadTimeout(http.HandlerFunc(handlePutHeartbeat)))
+	mux.Handle("/{namespace}/{id}", withBodyReadTimeout(http.HandlerFunc(handlePutHeartbeat)))
+	mux.HandleFunc("DELETE /{id}", handleDeleteHeartbeat)
+	mux.HandleFunc("DELETE /{namespace}/{id}", handleDeleteHeartbeat)
+	mux.HandleFunc("GET /snapshot", handleGetSnapshot)
+	mux.HandleFunc("GET /export", handleGetExport)
+	mux.Handle("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /schema-version", handleGetSchemaVersion)
+	mux.HandleFunc("GET /selfstat", handleGetSelfStat)
+	mux.HandleFunc("GET /healthz", handleGetHealthz)
+	mux.HandleFunc("GET /readyz", handleGetReadyz)
+	mux.Handle("POST /intervals", withBodyReadTimeout(http.HandlerFunc(handleSetIntervals)))
+	mux.Handle("POST /batch", withBodyReadTimeout(http.HandlerFunc(handleBatchPutHeartbeat)))
+	mux.Handle("POST /import", withBodyReadTimeout(http.HandlerFunc(handlePostImport)))
+	mux.HandleFunc("GET /jobs/{id}", handleGetJob)
+	mux.Handle("PUT /metadata-limits/{id}", withBodyReadTimeout(http.HandlerFunc(handlePutMetadataLimit)))
+	mux.Handle("PUT /metadata-limits/{namespace}/{id}", withBodyReadTimeout(http.HandlerFunc(handlePutMetadataLimit)))
+	mux.HandleFunc("POST /{id}/mute", handlePostMute)
+	mux.HandleFunc("POST /{namespace}/{id}/mute", handlePostMute)
+	mux.Handle("PUT /banner", withBodyReadTimeout(http.HandlerFunc(handlePutBanner)))
+	if cf.ExposeConfig {
+		mux.HandleFunc("GET /admin/config", handleGetConfig)
+	}
+	if cf.AdminScan {
+		mux.HandleFunc("POST /admin/scan", handlePostScan)
+	}
+	if cf.InternalRawReads {
+		mux.HandleFunc("GET /raw/{id}", handleGetRawHeartbeat)
+		mux.HandleFunc("GET /raw/{namespace}/{id}", handleGetRawHeartbeat)
+	}
+	return logRouteID(rateLimitByAPIKey(restrictAPIKeys(mux)))
 }
 
 func externalRouter() http.Handler {
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", handleListHeartbeats)
 	mux.HandleFunc("GET /{id}", handleGetHeartbeat)
-	return mux
+	mux.HandleFunc("GET /{namespace}/{id}", handleGetHeartbeat)
+	mux.HandleFunc("GET /{id}/history", handleGetHistory)
+	mux.HandleFunc("GET /{namespace}/{id}/history", handleGetHistory)
+	mux.HandleFunc("GET /{id}/flaps", handleGetFlaps)
+	mux.HandleFunc("GET /{namespace}/{id}/flaps", handleGetFlaps)
+	mux.HandleFunc("GET /{id}/cadence", handleGetCadence)
+	mux.HandleFunc("GET /{namespace}/{id}/cadence", handleGetCadence)
+	mux.HandleFunc("GET /{id}/sla", handleGetSLA)
+	mux.HandleFunc("GET /{namespace}/{id}/sla", handleGetSLA)
+	mux.HandleFunc("GET /banner", handleGetBanner)
+	mux.HandleFunc("GET /expired", handleGetExpired)
+	mux.HandleFunc("GET /groups/{prefix}/status", handleGetGroupStatus)
+	mux.HandleFunc("GET /health-score", handleGetHealthScore)
+	return logRouteID(mux)
 }
 
 func handlePutHeartbeat(w http.ResponseWriter, r *http.Request) {
-	hbID := r.PathValue("id")
-	if hbID == "" {
-		http.Error(w, "ID value is required on path", http.StatusBadRequest)
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required on path")
+		return
+	}
+	if !inAPIKeyScope(r, key) {
+		writeJSONError(w, http.StatusForbidden, "out_of_scope", outOfScopeMessage(key))
+		return
+	}
+	if code, message := reservedKey(key); code != "" {
+		writeJSONError(w, http.StatusBadRequest, code, message)
 		return
 	}
 
-	_, err := db.Exec(`
-       INSERT OR REPLACE INTO heartbeats (id, last_updated_at)
-        VALUES (?, ?);
-    `, hbID, time.Now().Format(time.RFC3339))
+	// The default interval only applies when the row is first created, an
+	// existing heartbeat keeps whatever interval it already has unless the
+	// publisher supplies its own ttl.
+	opts := PutOptions{InitialTTL: defaultIntervalSeconds()}
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		ttl, err := putTTL(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", "ttl query parameter "+err.Error())
+			return
+		}
+		opts.TTL = ttl
+		opts.InitialTTL = ttl
+	}
+
+	// An alert_url is only changed when supplied, so services don't need to
+	// repeat it on every heartbeat.
+	if v := r.URL.Query().Get("alert_url"); v != "" {
+		if !validAlertURL(v) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_alert_url", "alert_url query parameter must be an absolute http(s) URL")
+			return
+		}
+		opts.AlertURL = sql.NullString{String: v, Valid: true}
+	}
+
+	if v := r.URL.Query().Get("sla"); v != "" {
+		target, err := parseSLATarget(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_sla", "sla query parameter "+err.Error())
+			return
+		}
+		opts.SLATarget = sql.NullFloat64{Float64: target, Valid: true}
+	}
+
+	if cf.RecordMethod {
+		opts.Method = sql.NullString{String: r.Method, Valid: true}
+	}
+
+	// The body is optional, metadata is only changed when one supplies it.
+	if r.ContentLength != 0 {
+		metadataLimit, err := metadataLimitFor(r.Context(), key)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+		var body HeartbeatBody
+		if err := decodeJSONBody(w, r, metadataLimit+metadataEnvelopeBytes, &body); err != nil && err != io.EOF {
+			writeBodyError(w, err)
+			return
+		}
+		metadata, err := putMetadata(body.Metadata)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_metadata", "metadata "+err.Error())
+			return
+		}
+		if int64(len(metadata.String)) > metadataLimit {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "metadata_too_large", fmt.Sprintf("metadata exceeds %d bytes", metadataLimit))
+			return
+		}
+		// A PATCH merges its metadata into what is stored, null values
+		// removing keys.
+		if r.Method == http.MethodPatch {
+			opts.MetadataPatch = metadata
+			opts.MaxMetadataBytes = metadataLimit
+		} else {
+			opts.Metadata = metadata
+		}
+	}
+
+	reportedAt := truncateTimestamp(heartbeatNow())
+	if err := store.Put(r.Context(), key, reportedAt, opts); err != nil {
+		if errors.Is(err, ErrMetadataTooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "metadata_too_large", fmt.Sprintf("merged metadata exceeds %d bytes", opts.MaxMetadataBytes))
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to store heartbeat: %v", err))
+		}
+		return
+	}
+
+	heartbeatPuts.Inc()
+	if producer != nil {
+		producer.Enqueue(newHeartbeatEvent(key, reportedAt, opts))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultIntervalSeconds is the ttl stored on new heartbeats that don't
+// supply their own.
+func defaultIntervalSeconds() sql.NullInt64 {
+	if cf.DefaultInterval <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(cf.DefaultInterval / time.Second), Valid: true}
+}
+
+// putTTL converts a ttl supplied with a heartbeat into the whole seconds it
+// is stored as.
+func putTTL(v string) (sql.NullInt64, error) {
+	d, err := parseTTL(v, cf.StrictTTLUnits)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to store heartbeat: %v", err), http.StatusInternalServerError)
+		return sql.NullInt64{}, fmt.Errorf("must be a valid duration: %v", err)
+	}
+	if d < time.Second {
+		return sql.NullInt64{}, errors.New("must be at least 1s")
+	}
+	return sql.NullInt64{Int64: int64(d / time.Second), Valid: true}, nil
+}
+
+// putMetadata checks that metadata supplied with a heartbeat is a JSON
+// object and compacts it for storage. Absent or null metadata is returned
+// as null, leaving the stored metadata untouched.
+func putMetadata(raw json.RawMessage) (sql.NullString, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return sql.NullString{}, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return sql.NullString{}, errors.New("must be a JSON object")
+	}
+	var compact bytes.Buffer
+	_ = json.Compact(&compact, raw)
+	return sql.NullString{String: compact.String(), Valid: true}, nil
+}
+
+func handleDeleteHeartbeat(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required on path")
+		return
+	}
+	if !inAPIKeyScope(r, key) {
+		writeJSONError(w, http.StatusForbidden, "out_of_scope", outOfScopeMessage(key))
+		return
+	}
+
+	if err := store.Delete(r.Context(), key); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to delete heartbeat: %v", err))
+		}
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func validAlertURL(v string) bool {
+	u, err := url.Parse(v)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
 func handleGetHeartbeat(w http.ResponseWriter, r *http.Request) {
-	hbID := r.PathValue("id")
-	if hbID == "" {
-		http.Error(w, "ID value is required", http.StatusBadRequest)
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required")
 		return
 	}
 
+	var (
+		ttlDuration time.Duration
+		err         error
+	)
 	ttl := r.URL.Query().Get("ttl")
-	if ttl == "" {
-		http.Error(w, "ttl query parameter is required", http.StatusBadRequest)
-		return
+	if ttl != "" {
+		ttlDuration, err = parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_ttl", fmt.Sprintf("ttl query parameter must be a valid duration: %v", err))
+			return
+		}
+	}
+	includeExpired := false
+	if v := r.URL.Query().Get("include_expired"); v != "" {
+		includeExpired, err = strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_include_expired", "include_expired query parameter must be true or false")
+			return
+		}
 	}
 
-	ttlSeconds, err := time.ParseDuration(ttl)
+	hb, err := store.Get(r.Context(), key)
 	if err != nil {
-		http.Error(w, "ttl query parameter must be a valid duration", http.StatusBadRequest)
+		if errors.Is(err, ErrNotFound) {
+			// An unknown id may have been reaped while alive under ttl.
+			if retention, ok := minReapRetention(); ok && ttl != "" && retentionExceeded(w, clampTTL(ttlDuration), retention) {
+				return
+			}
+			heartbeatGets.WithLabelValues("notfound").Inc()
+			writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+		} else if errors.Is(err, errCorruptTimestamp) {
+			writeJSONError(w, http.StatusInternalServerError, "corrupt_timestamp", "stored last updated at date is corrupt")
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeat: %v", err))
+		}
 		return
 	}
+	if hb.Pending {
+		heartbeatGets.WithLabelValues("notfound").Inc()
+		writeJSONError(w, http.StatusNotFound, "pending", "heartbeat is a registered parent that hasn't reported yet")
+		return
+	}
+	if hb.Stale {
+		w.Header().Set(staleHeader, "true")
+	}
 
-	var lastUpdatedAtStr string
-	err = db.QueryRow(`
-        SELECT last_updated_at FROM heartbeats WHERE id = ?
-    `, hbID).Scan(&lastUpdatedAtStr)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "heartbeat not found", http.StatusNotFound)
+	ttlSource := "query"
+	if ttl == "" {
+		if hb.TTL.Valid {
+			ttlDuration, ttlSource = time.Duration(hb.TTL.Int64)*time.Second, "stored"
+		} else if d, ok := defaultTTLFor(key.ID); ok {
+			ttlDuration, ttlSource = d, "prefix"
+		} else if d, ok := globalDefaultTTL(ttlEndpointHeartbeat); ok {
+			ttlDuration, ttlSource = d, "default"
 		} else {
-			http.Error(w, fmt.Sprintf("failed to query heartbeat: %v", err), http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadRequest, "missing_ttl", "ttl query parameter is required")
+			return
 		}
+	}
+	ttlDuration = clampTTL(ttlDuration)
+	// A zero ttl expires every heartbeat the moment it is recorded, which is
+	// a misconfiguration rather than an outage of the publisher.
+	if ttlDuration <= 0 && cf.ZeroTTL == zeroTTLReject {
+		httpLog.Warn("ttl resolves to zero, the heartbeat can never be alive", "namespace", key.Namespace, "id", key.ID, "source", ttlSource)
+		writeJSONError(w, http.StatusUnprocessableEntity, "zero_ttl", fmt.Sprintf("%s ttl resolves to zero, the heartbeat can never be alive", ttlSource))
+		return
+	}
+	if retention, ok := reapRetention(hb.TTL); ok && retentionExceeded(w, ttlDuration, retention) {
 		return
 	}
+	lastUpdatedAt := hb.LastUpdatedAt
+
+	now := heartbeatNow()
+	expiryTime := lastUpdatedAt.Add(ttlDuration)
+	if now.After(expiryTime) {
+		heartbeatGets.WithLabelValues("expired").Inc()
+		if !includeExpired {
+			writeJSONError(w, http.StatusNotFound, "expired", "heartbeat expired")
+			return
+		}
+	} else {
+		heartbeatGets.WithLabelValues("hit").Inc()
+	}
+
+	response := Heartbeat{
+		Namespace:     key.Namespace,
+		ID:            key.ID,
+		LastUpdatedAt: lastUpdatedAt,
+		Method:        hb.Method.String,
+		ExpiresAt:     &expiryTime,
+	}
+	if hb.Metadata.Valid {
+		response.Metadata = json.RawMessage(hb.Metadata.String)
+	}
+	if !hb.CreatedAt.IsZero() {
+		response.CreatedAt = &hb.CreatedAt
+	}
+	if hb.MutedUntil.After(now) {
+		response.MutedUntil = &hb.MutedUntil
+	}
 
-	lastUpdatedAt, err := time.Parse(time.RFC3339, lastUpdatedAtStr)
+	// Apart from remaining_seconds, which only counts down to expires_at,
+	// the body changes with a new heartbeat only. The weak ETag is taken
+	// without it, so pollers can revalidate with If-None-Match and needn't
+	// ask again before the heartbeat could expire. Stale reads aren't
+	// cached, the real state may differ.
+	unchanging, err := json.Marshal(response)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+		return
+	}
+	remaining := expiryTime.Sub(now).Seconds()
+	response.RemainingSeconds = &remaining
+	body, err := json.Marshal(response)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to parse last updated at date: %v", err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
 		return
 	}
+	body = append(body, '\n')
 
-	expiryTime := lastUpdatedAt.Add(ttlSeconds)
-	if time.Now().After(expiryTime) {
-		http.Error(w, "heartbeat expired", http.StatusNotFound)
+	w.Header().Set("Content-Type", "application/json")
+	if !hb.Stale {
+		sum := sha256.Sum256(unchanging)
+		w.Header().Set("ETag", `W/"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", max(int64(expiryTime.Sub(now)/time.Second), 0)))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+func handleGetRawHeartbeat(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required")
 		return
 	}
 
-	response := Heartbeat{
-		ID:            hbID,
-		LastUpdatedAt: lastUpdatedAt,
+	hb, err := store.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+		} else if errors.Is(err, errCorruptTimestamp) {
+			writeJSONError(w, http.StatusInternalServerError, "corrupt_timestamp", "stored last updated at date is corrupt")
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			writeJSONError(w, http.StatusServiceUnavailable, "deadline_exceeded", "request deadline exceeded")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to query heartbeat: %v", err))
+		}
+		return
+	}
+	if hb.Pending {
+		writeJSONError(w, http.StatusNotFound, "pending", "heartbeat is a registered parent that hasn't reported yet")
+		return
+	}
+
+	response := RawHeartbeat{
+		Namespace:     hb.Namespace,
+		ID:            hb.ID,
+		LastUpdatedAt: hb.LastUpdatedAt,
+		AgeSeconds:    heartbeatNow().Sub(hb.LastUpdatedAt).Seconds(),
+	}
+	if hb.TTL.Valid {
+		response.TTLSeconds = &hb.TTL.Int64
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
 	}
 }
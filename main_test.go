@@ -0,0 +1,758 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// setupTest configures the collector as run would with args on the command
+// line, against a fresh database in a temporary directory.
+func setupTest(t *testing.T, args ...string) {
+	t.Helper()
+
+	cf = AppConfig{AppName: "heartbeat-collector"}
+	app := newApp()
+	app.Action = func(*cli.Context) error { return nil }
+	dsn := filepath.Join(t.TempDir(), "heartbeats.db")
+	if err := app.Run(append([]string{cf.AppName, "--db-path", dsn}, args...)); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	var err error
+	if prefixTTLs, err = parsePrefixTTLs(cf.PrefixTTLs.Value()); err != nil {
+		t.Fatal(err)
+	}
+	if defaultTTLEndpoints, err = parseDefaultTTLEndpoints(cf.DefaultTTLEndpoints.Value()); err != nil {
+		t.Fatal(err)
+	}
+	batchWriters = make(chan struct{}, cf.MaxBatchWriters)
+	if apiKeys, err = parseAPIKeys(cf.APIKeys.Value()); err != nil {
+		t.Fatal(err)
+	}
+	if apiKeyWeights, err = parseAPIKeyWeights(cf.APIKeyWeights.Value(), apiKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = sql.Open(sqliteDriverName, cf.SQLiteDSN)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if err := enableWAL(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := initSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyIDCollation(db, cf.IDCollation); err != nil {
+		t.Fatal(err)
+	}
+	store = newSQLiteStore(db)
+	clock = systemClock{}
+	producer = nil
+}
+
+// serve sends a request with an optional JSON body through h and returns the
+// recorded response.
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return serveRequest(h, req)
+}
+
+// serveRequest sends r through h and returns the recorded response.
+func serveRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// expectStatus fails the test unless w has the given status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+}
+
+// decodeBody decodes the JSON body of w into v.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode %q: %v", w.Body.String(), err)
+	}
+}
+
+// storedTTL returns the ttl stored for id in the default namespace.
+func storedTTL(t *testing.T, id string) sql.NullInt64 {
+	t.Helper()
+	hb, err := store.Get(context.Background(), heartbeatKey{Namespace: defaultNamespace, ID: id})
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", id, err)
+	}
+	return hb.TTL
+}
+
+func TestDefaultIntervalStoredOnFirstPut(t *testing.T) {
+	setupTest(t, "--default-interval", "5m")
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "worker"); !ttl.Valid || ttl.Int64 != 300 {
+		t.Fatalf("expected the default interval of 300s to be stored, got %+v", ttl)
+	}
+
+	expectStatus(t, serve(h, http.MethodPut, "/other?ttl=1m", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "other"); ttl.Int64 != 60 {
+		t.Fatalf("expected a supplied ttl to win over the default interval, got %+v", ttl)
+	}
+}
+
+func TestDefaultIntervalKeepsExistingInterval(t *testing.T) {
+	setupTest(t, "--default-interval", "5m")
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 60 {
+		t.Fatalf("expected a later PUT to keep the stored interval, got %+v", ttl)
+	}
+}
+
+func TestNoDefaultInterval(t *testing.T) {
+	setupTest(t)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "worker"); ttl.Valid {
+		t.Fatalf("expected no interval without --default-interval, got %+v", ttl)
+	}
+}
+
+// expectError fails the test unless w is a JSON error with the given status
+// and code.
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	decodeBody(t, w, &body)
+	if body.Error.Code != code {
+		t.Fatalf("expected error code %q, got %q", code, body.Error.Code)
+	}
+}
+
+// insertHeartbeat writes a heartbeat row in the default namespace directly,
+// bypassing the handlers, with lastUpdatedAt stored verbatim.
+func insertHeartbeat(t *testing.T, id, lastUpdatedAt string, ttl sql.NullInt64) {
+	t.Helper()
+	_, err := db.Exec(`
+        INSERT INTO heartbeats (namespace, id, last_updated_at, ttl_seconds) VALUES (?, ?, ?, ?)
+    `, defaultNamespace, id, lastUpdatedAt, ttl)
+	if err != nil {
+		t.Fatalf("failed to insert %s: %v", id, err)
+	}
+}
+
+// storedLastUpdatedAt returns last_updated_at of id as stored.
+func storedLastUpdatedAt(t *testing.T, id string) string {
+	t.Helper()
+	var value string
+	err := db.QueryRow(`
+        SELECT CAST(last_updated_at AS TEXT) FROM heartbeats WHERE namespace = ? AND id = ?
+    `, defaultNamespace, id).Scan(&value)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", id, err)
+	}
+	return value
+}
+
+func TestDefaultIntervalMustBeWholeSeconds(t *testing.T) {
+	for _, v := range []string{"500ms", "-1s"} {
+		err := runUntilSignal(t, "--default-interval", v)
+		if err == nil || err.Error() != "--default-interval must be 0 or at least 1s" {
+			t.Fatalf("%s: expected the interval to be rejected, got %v", v, err)
+		}
+	}
+}
+
+func TestRawRead(t *testing.T) {
+	setupTest(t, "--internal-raw-reads")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+
+	w := serve(h, http.MethodGet, "/raw/worker", "")
+	expectStatus(t, w, http.StatusOK)
+	var raw RawHeartbeat
+	decodeBody(t, w, &raw)
+	if raw.ID != "worker" || raw.Namespace != defaultNamespace || raw.LastUpdatedAt.IsZero() || raw.AgeSeconds < 0 {
+		t.Fatalf("unexpected raw heartbeat %+v", raw)
+	}
+	if raw.TTLSeconds == nil || *raw.TTLSeconds != 60 {
+		t.Fatalf("expected the stored ttl of 60s, got %v", raw.TTLSeconds)
+	}
+
+	w = serve(h, http.MethodGet, "/raw/team/worker", "")
+	expectStatus(t, w, http.StatusOK)
+	var namespaced RawHeartbeat
+	decodeBody(t, w, &namespaced)
+	if namespaced.Namespace != "team" || namespaced.TTLSeconds != nil {
+		t.Fatalf("unexpected raw heartbeat %+v", namespaced)
+	}
+
+	expectError(t, serve(h, http.MethodGet, "/raw/missing", ""), http.StatusNotFound, "not_found")
+}
+
+func TestRawReadDisabled(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	// Without the flag the path falls through to the heartbeat route, which
+	// won't record a heartbeat in the reserved namespace either.
+	expectError(t, serve(internalRouter(), http.MethodGet, "/raw/worker", ""), http.StatusBadRequest, "reserved_namespace")
+}
+
+func TestExternalReadStillRequiresTTL(t *testing.T) {
+	setupTest(t, "--internal-raw-reads")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusBadRequest, "missing_ttl")
+}
+
+// getHeartbeat reads id from the external router with query and decodes it.
+func getHeartbeat(t *testing.T, id, query string) Heartbeat {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+id+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var hb Heartbeat
+	decodeBody(t, w, &hb)
+	return hb
+}
+
+func TestRecordMethod(t *testing.T) {
+	setupTest(t, "--record-method")
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); hb.Method != http.MethodPut {
+		t.Fatalf("expected method PUT, got %q", hb.Method)
+	}
+
+	expectStatus(t, serve(h, http.MethodPost, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); hb.Method != http.MethodPost {
+		t.Fatalf("expected method POST, got %q", hb.Method)
+	}
+}
+
+func TestRecordMethodDisabled(t *testing.T) {
+	setupTest(t)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); hb.Method != "" {
+		t.Fatalf("expected no method without --record-method, got %q", hb.Method)
+	}
+}
+
+// runUntilSignal runs the collector with args on ephemeral ports, then
+// interrupts it with SIGINT and returns the error run exited with.
+func runUntilSignal(t *testing.T, args ...string) error {
+	t.Helper()
+
+	// With a handler of its own registered the test binary survives a SIGINT
+	// that arrives before run has registered its listener.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, os.Interrupt)
+	defer signal.Stop(ignored)
+
+	// run installs its own loggers, the following tests keep the defaults.
+	defaultLog := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLog)
+		httpLog, rateLimitLog, staleCacheLog = defaultLog, defaultLog, defaultLog
+	})
+
+	cf = AppConfig{AppName: "heartbeat-collector"}
+	dsn := filepath.Join(t.TempDir(), "heartbeats.db")
+	args = append([]string{cf.AppName, "--db-path", dsn, "--internal-addr", "127.0.0.1:0", "--external-port", "127.0.0.1:0"}, args...)
+	done := make(chan error, 1)
+	go func() {
+		done <- newApp().Run(args)
+	}()
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if err := self.Signal(os.Interrupt); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("collector didn't exit after SIGINT")
+		}
+	}
+}
+
+func TestSignalShutdownExitsCleanly(t *testing.T) {
+	if err := runUntilSignal(t); err != nil {
+		t.Fatalf("expected a clean exit after SIGINT, got %v", err)
+	}
+}
+
+func TestComponentLoggers(t *testing.T) {
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = out
+	err = runUntilSignal(t, "--reap-interval", "1h", "--expiry-webhook-url", "http://127.0.0.1:1/expired")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	components := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(logs)), "\n") {
+		var record struct {
+			Msg       string `json:"msg"`
+			Component string `json:"component"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			continue
+		}
+		components[record.Msg] = record.Component
+	}
+	for msg, want := range map[string]string{
+		"internal server starting":           "internal-server",
+		"external server starting":           "external-server",
+		"reaping expired heartbeats":         "reaper",
+		"notifying about expired heartbeats": "expiry-webhook",
+	} {
+		if got, ok := components[msg]; !ok || got != want {
+			t.Errorf("expected %q to be logged with component %q, got %q", msg, want, got)
+		}
+	}
+}
+
+func TestConcurrentFirstPutsCreateOnce(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	codes := make(chan int, 20)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			codes <- serve(h, http.MethodPut, "/worker", "").Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusNoContent {
+			t.Fatalf("expected every concurrent PUT to succeed, got %d", code)
+		}
+	}
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM heartbeats WHERE id = 'worker'`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected a single row, got %d", rows)
+	}
+	createdAt := getHeartbeat(t, "worker", "?ttl=1m").CreatedAt
+	if createdAt == nil {
+		t.Fatal("expected created_at to be set")
+	}
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if later := getHeartbeat(t, "worker", "?ttl=1m").CreatedAt; !later.Equal(*createdAt) {
+		t.Fatalf("expected created_at to stay %v, got %v", createdAt, later)
+	}
+}
+
+// listHeartbeats lists the external heartbeats with query and decodes them.
+func listHeartbeats(t *testing.T, query string) []HeartbeatStatus {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var list []HeartbeatStatus
+	decodeBody(t, w, &list)
+	return list
+}
+
+func TestDeleteHeartbeat(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(h, http.MethodDelete, "/worker", ""), http.StatusNoContent)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/team/worker?ttl=1m", ""), http.StatusOK)
+
+	expectStatus(t, serve(h, http.MethodDelete, "/team/worker", ""), http.StatusNoContent)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/team/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
+
+func TestDeleteMissingHeartbeat(t *testing.T) {
+	setupTest(t)
+
+	expectError(t, serve(internalRouter(), http.MethodDelete, "/missing", ""), http.StatusNotFound, "not_found")
+}
+
+func TestDeleteEmptyID(t *testing.T) {
+	setupTest(t)
+
+	expectError(t, serve(http.HandlerFunc(handleDeleteHeartbeat), http.MethodDelete, "/", ""), http.StatusBadRequest, "missing_id")
+}
+
+func TestDeleteNotExternal(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(externalRouter(), http.MethodDelete, "/worker", ""), http.StatusMethodNotAllowed)
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+// logRecorder collects the records logged through its logger.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []map[string]any
+}
+
+func (l *logRecorder) Write(p []byte) (int, error) {
+	var record map[string]any
+	if err := json.Unmarshal(p, &record); err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	return len(p), nil
+}
+
+func (l *logRecorder) logger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(l, nil))
+}
+
+// waitFor returns the first record logged with msg, waiting up to 5s for
+// it.
+func (l *logRecorder) waitFor(t *testing.T, msg string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		for _, record := range l.records {
+			if record["msg"] == msg {
+				l.mu.Unlock()
+				return record
+			}
+		}
+		l.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %q to be logged", msg)
+	return nil
+}
+
+func TestStoredTTL(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=90s", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 90 {
+		t.Fatalf("expected the ttl of 90s to be stored, got %+v", ttl)
+	}
+	hb := getHeartbeat(t, "worker", "")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != 90*time.Second {
+		t.Fatalf("expected GET to fall back to the stored ttl, got %v", remaining)
+	}
+	hb = getHeartbeat(t, "worker", "?ttl=1h")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != time.Hour {
+		t.Fatalf("expected the requested ttl to win over the stored one, got %v", remaining)
+	}
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 90 {
+		t.Fatalf("expected a PUT without ttl to keep the stored one, got %+v", ttl)
+	}
+}
+
+func TestUpdateKeepsRelatedRows(t *testing.T) {
+	setupTest(t)
+	// Foreign keys are enforced per connection, so pin the pool to one.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`
+        PRAGMA foreign_keys = ON;
+        CREATE TABLE heartbeat_notes (
+            namespace TEXT NOT NULL,
+            id TEXT NOT NULL,
+            note TEXT NOT NULL,
+            FOREIGN KEY (namespace, id) REFERENCES heartbeats (namespace, id) ON DELETE CASCADE
+        );
+    `); err != nil {
+		t.Fatal(err)
+	}
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if _, err := db.Exec(`INSERT INTO heartbeat_notes (namespace, id, note) VALUES (?, 'worker', 'on call')`, defaultNamespace); err != nil {
+		t.Fatal(err)
+	}
+	rowid := func() int64 {
+		t.Helper()
+		var rowid int64
+		if err := db.QueryRow(`SELECT rowid FROM heartbeats WHERE id = 'worker'`).Scan(&rowid); err != nil {
+			t.Fatal(err)
+		}
+		return rowid
+	}
+	before := rowid()
+	createdAt := getHeartbeat(t, "worker", "?ttl=1m").CreatedAt
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadata": {"v": 2}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `["worker"]`), http.StatusNoContent)
+
+	var notes int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM heartbeat_notes WHERE id = 'worker'`).Scan(&notes); err != nil {
+		t.Fatal(err)
+	}
+	if notes != 1 {
+		t.Fatalf("expected the related row to survive the updates, got %d", notes)
+	}
+	if after := rowid(); after != before {
+		t.Fatalf("expected the row to keep rowid %d, got %d", before, after)
+	}
+	if later := getHeartbeat(t, "worker", "?ttl=1m").CreatedAt; !later.Equal(*createdAt) {
+		t.Fatalf("expected created_at to stay %v, got %v", createdAt, later)
+	}
+}
+
+func TestPutInvalidTTL(t *testing.T) {
+	setupTest(t)
+
+	expectError(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=soon", ""), http.StatusBadRequest, "invalid_ttl")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
+
+func TestPutMetadataEchoedOnGet(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadata": {"version": "1.2.3", "region": "eu"}}`), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); string(hb.Metadata) != `{"version":"1.2.3","region":"eu"}` {
+		t.Fatalf("expected compacted metadata, got %s", hb.Metadata)
+	}
+
+	// A later heartbeat without a body leaves the metadata in place.
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); string(hb.Metadata) != `{"version":"1.2.3","region":"eu"}` {
+		t.Fatalf("expected metadata to be kept, got %s", hb.Metadata)
+	}
+}
+
+func TestPatchMergesMetadata(t *testing.T) {
+	setupTest(t)
+	start := time.Now().UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	h := internalRouter()
+
+	// A new heartbeat is merged into an empty object, dropping null keys.
+	expectStatus(t, serve(h, http.MethodPatch, "/worker", `{"metadata": {"version": "1.2.3", "labels": {"tier": "web", "zone": "a"}, "gone": null}}`), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); string(hb.Metadata) != `{"version":"1.2.3","labels":{"tier":"web","zone":"a"}}` {
+		t.Fatalf("expected the patch to be stored, got %s", hb.Metadata)
+	}
+
+	c.Advance(10 * time.Second)
+	expectStatus(t, serve(h, http.MethodPatch, "/worker", `{"metadata": {"version": "1.2.4", "labels": {"zone": null, "rack": 7}, "region": "eu"}}`), http.StatusNoContent)
+	hb := getHeartbeat(t, "worker", "?ttl=1m")
+	if string(hb.Metadata) != `{"version":"1.2.4","labels":{"tier":"web","rack":7},"region":"eu"}` {
+		t.Fatalf("expected the patch to be merged, got %s", hb.Metadata)
+	}
+	if want := start.Add(10 * time.Second); !hb.LastUpdatedAt.Equal(want) {
+		t.Fatalf("expected the patch to refresh the heartbeat to %v, got %v", want, hb.LastUpdatedAt)
+	}
+
+	// Without a body a PATCH only refreshes the heartbeat.
+	expectStatus(t, serve(h, http.MethodPatch, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "worker", "?ttl=1m"); string(hb.Metadata) != `{"version":"1.2.4","labels":{"tier":"web","rack":7},"region":"eu"}` {
+		t.Fatalf("expected metadata to be kept, got %s", hb.Metadata)
+	}
+	if history := getHistory(t, "worker", ""); len(history.ReceivedAt) != 3 {
+		t.Fatalf("expected every patch to be recorded as an arrival, got %d", len(history.ReceivedAt))
+	}
+}
+
+func TestPatchMergedMetadataTooLarge(t *testing.T) {
+	setupTest(t, "--max-metadata-bytes", "40")
+	start := time.Now().UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadata": {"version": "1.2.3"}}`), http.StatusNoContent)
+
+	// Each patch fits, but merged they exceed the limit.
+	c.Advance(time.Second)
+	expectError(t, serve(h, http.MethodPatch, "/worker", `{"metadata": {"owner": "platform-team"}}`), http.StatusRequestEntityTooLarge, "metadata_too_large")
+	hb := getHeartbeat(t, "worker", "?ttl=1m")
+	if string(hb.Metadata) != `{"version":"1.2.3"}` || !hb.LastUpdatedAt.Equal(start) {
+		t.Fatalf("expected the rejected patch to change nothing, got %s at %v", hb.Metadata, hb.LastUpdatedAt)
+	}
+}
+
+func TestPutWithoutBodyOmitsMetadata(t *testing.T) {
+	setupTest(t)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", "")
+	expectStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), `"metadata"`) {
+		t.Fatalf("expected metadata to be omitted, got %s", w.Body)
+	}
+}
+
+func TestPutMetadataTooLarge(t *testing.T) {
+	setupTest(t)
+
+	body := `{"metadata": {"blob": "` + strings.Repeat("x", 70<<10) + `"}}`
+	w := serve(internalRouter(), http.MethodPut, "/worker", body)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d: %s", w.Code, w.Body)
+	}
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound)
+}
+
+func TestPutMalformedMetadata(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectError(t, serve(h, http.MethodPut, "/worker", `{"metadata": {`), http.StatusBadRequest, "invalid_body")
+	expectError(t, serve(h, http.MethodPut, "/worker", `{"metadata": ["not", "an", "object"]}`), http.StatusBadRequest, "invalid_metadata")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound)
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	setupTest(t, "--max-header-bytes", "1024")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: internalRouter(), MaxHeaderBytes: cf.MaxHeaderBytes}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+	url := "http://" + ln.Addr().String() + "/worker"
+
+	put := func(header string) int {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodPut, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Padding", header)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// net/http allows 4KB beyond MaxHeaderBytes before rejecting headers.
+	if status := put(strings.Repeat("x", 16<<10)); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected oversized headers to be rejected with 431, got %d", status)
+	}
+	if status := put(strings.Repeat("x", 512)); status != http.StatusNoContent {
+		t.Fatalf("expected headers within the limit to be accepted, got %d", status)
+	}
+}
+
+func TestMaxHeaderBytesMustBePositive(t *testing.T) {
+	for _, v := range []string{"0", "-1"} {
+		err := runUntilSignal(t, "--max-header-bytes", v)
+		if err == nil || err.Error() != "--max-header-bytes must be positive" {
+			t.Fatalf("%s: expected the limit to be rejected, got %v", v, err)
+		}
+	}
+}
+
+func TestRemainingTimeLive(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(15 * time.Second)
+
+	hb := getHeartbeat(t, "worker", "?ttl=1m")
+	if hb.ExpiresAt == nil || !hb.ExpiresAt.Equal(hb.LastUpdatedAt.Add(time.Minute)) {
+		t.Fatalf("expected expires_at a minute after last_updated_at, got %+v", hb)
+	}
+	if hb.RemainingSeconds == nil || *hb.RemainingSeconds != 45 {
+		t.Fatalf("expected 45 remaining seconds, got %+v", hb)
+	}
+}
+
+func TestRemainingTimeIncludeExpired(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(90 * time.Second)
+
+	// Expired heartbeats are still 404 unless asked for.
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "expired")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m&include_expired=false", ""), http.StatusNotFound, "expired")
+
+	hb := getHeartbeat(t, "worker", "?ttl=1m&include_expired=true")
+	if hb.RemainingSeconds == nil || *hb.RemainingSeconds != -30 {
+		t.Fatalf("expected -30 remaining seconds, got %+v", hb)
+	}
+	if !hb.ExpiresAt.Equal(hb.LastUpdatedAt.Add(time.Minute)) {
+		t.Fatalf("expected expires_at a minute after last_updated_at, got %v", hb.ExpiresAt)
+	}
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m&include_expired=maybe", ""), http.StatusBadRequest, "invalid_include_expired")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/missing?ttl=1m&include_expired=true", ""), http.StatusNotFound, "not_found")
+}
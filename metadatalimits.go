@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// metadataEnvelopeBytes is the room a heartbeat body is allowed beyond its
+// metadata limit for the surrounding {"metadata": ...} and whitespace.
+const metadataEnvelopeBytes = 1024
+
+type MetadataLimitUpdate struct {
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// metadataLimitFor returns the largest metadata, in compacted bytes, key may
+// store: its override if one is set, --max-metadata-bytes otherwise.
+func metadataLimitFor(ctx context.Context, key heartbeatKey) (int64, error) {
+	limit, ok, err := store.MetadataLimit(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return cf.MaxMetadataBytes, nil
+	}
+	return limit, nil
+}
+
+// handlePutMetadataLimit overrides the metadata limit of a single id, which
+// may be set before its first heartbeat. A max_bytes of 0 removes the
+// override.
+func handlePutMetadataLimit(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required on path")
+		return
+	}
+
+	var req MetadataLimitUpdate
+	if err := decodeJSONBody(w, r, 4096, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.MaxBytes < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_max_bytes", "max_bytes must not be negative")
+		return
+	}
+
+	if err := store.SetMetadataLimit(r.Context(), key, req.MaxBytes); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *sqliteStore) MetadataLimit(ctx context.Context, key heartbeatKey) (int64, bool, error) {
+	defer recordDBTime(ctx, time.Now())
+	var limit int64
+	err := s.db.QueryRowContext(ctx, `
+        SELECT max_bytes FROM metadata_limits WHERE namespace = ? AND id = ? `+idCollate(),
+		key.Namespace, key.ID).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read metadata limit: %v", err)
+	}
+	return limit, true, nil
+}
+
+func (s *sqliteStore) SetMetadataLimit(ctx context.Context, key heartbeatKey, maxBytes int64) error {
+	defer recordDBTime(ctx, time.Now())
+	var err error
+	if maxBytes == 0 {
+		_, err = s.db.ExecContext(ctx, `
+            DELETE FROM metadata_limits WHERE namespace = ? AND id = ?
+        `, key.Namespace, key.ID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+            INSERT INTO metadata_limits (namespace, id, max_bytes) VALUES (?, ?, ?)
+            ON CONFLICT(namespace, id) DO UPDATE SET max_bytes = excluded.max_bytes;
+        `, key.Namespace, key.ID, maxBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store metadata limit: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// metadataBody is a heartbeat body whose metadata compacts to size bytes.
+func metadataBody(size int) string {
+	const envelope = len(`{"blob":""}`)
+	return `{"metadata": {"blob": "` + strings.Repeat("x", size-envelope) + `"}}`
+}
+
+func TestMetadataLimitDefault(t *testing.T) {
+	setupTest(t, "--max-metadata-bytes", "100")
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", metadataBody(100)), http.StatusNoContent)
+	expectError(t, serve(h, http.MethodPut, "/worker", metadataBody(101)), http.StatusRequestEntityTooLarge, "metadata_too_large")
+	expectError(t, serve(h, http.MethodPost, "/batch", `[{"id": "worker", "metadata": {"blob": "`+strings.Repeat("x", 100)+`"}}]`), http.StatusRequestEntityTooLarge, "metadata_too_large")
+}
+
+func TestMetadataLimitOverrideAllowsLargerBody(t *testing.T) {
+	setupTest(t, "--max-metadata-bytes", "100")
+	h := internalRouter()
+
+	// The override may be set before the id's first heartbeat.
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": 4096}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/inventory", metadataBody(4096)), http.StatusNoContent)
+	if hb := getHeartbeat(t, "inventory", "?ttl=1m"); len(hb.Metadata) != 4096 {
+		t.Fatalf("expected the larger metadata to be stored, got %d bytes", len(hb.Metadata))
+	}
+	expectError(t, serve(h, http.MethodPut, "/inventory", metadataBody(4097)), http.StatusRequestEntityTooLarge, "metadata_too_large")
+	expectStatus(t, serve(h, http.MethodPost, "/batch", `[{"id": "inventory", "metadata": {"blob": "`+strings.Repeat("x", 1000)+`"}}]`), http.StatusNoContent)
+
+	// Other ids keep the default, including the same id in another namespace.
+	// Their body is cut off before it is decoded.
+	expectError(t, serve(h, http.MethodPut, "/worker", metadataBody(4096)), http.StatusRequestEntityTooLarge, "body_too_large")
+	expectError(t, serve(h, http.MethodPut, "/team/inventory", metadataBody(4096)), http.StatusRequestEntityTooLarge, "body_too_large")
+}
+
+func TestMetadataLimitOverrideRemoved(t *testing.T) {
+	setupTest(t, "--max-metadata-bytes", "100")
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": 4096}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": 0}`), http.StatusNoContent)
+	expectError(t, serve(h, http.MethodPut, "/inventory", metadataBody(101)), http.StatusRequestEntityTooLarge, "metadata_too_large")
+}
+
+func TestMetadataLimitInvalid(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectError(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": -1}`), http.StatusBadRequest, "invalid_max_bytes")
+	expectError(t, serve(h, http.MethodPut, "/metadata-limits/inventory", `{"max_bytes": "big"}`), http.StatusBadRequest, "invalid_body")
+}
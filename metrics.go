@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	heartbeatPuts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heartbeat_put_total",
+		Help: "Heartbeats recorded.",
+	})
+	heartbeatGets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "heartbeat_get_total",
+		Help: "Heartbeat checks by result: hit, expired or notfound.",
+	}, []string{"result"})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_rate_limited_total",
+		Help: "External requests rejected for exceeding --external-rate.",
+	})
+	apiKeyRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_api_key_rate_limited_total",
+		Help: "Internal requests rejected for exceeding --api-key-rate, by the prefix of the API key.",
+	}, []string{"prefix"})
+	shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_shed_total",
+		Help: "External requests rejected with 503 while the collector was overloaded.",
+	})
+	staleReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heartbeat_stale_reads_total",
+		Help: "Heartbeat checks answered from the stale cache after a database error.",
+	})
+	webhookDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_dead_letters_total",
+		Help: "Expiry notifications given up on after --webhook-max-attempts failed deliveries.",
+	})
+
+	metricsRegistry = prometheus.NewRegistry()
+	metricsHandler  = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		heartbeatPuts,
+		heartbeatGets,
+		rateLimited,
+		apiKeyRateLimited,
+		shedRequests,
+		staleReads,
+		webhookDeadLetters,
+		freshnessCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var lastUpdatedDesc = prometheus.NewDesc(
+	"heartbeat_last_updated_timestamp_seconds",
+	"Unix time a heartbeat was last recorded.",
+	[]string{"namespace", "id"}, nil,
+)
+
+var snapshotTakenDesc = prometheus.NewDesc(
+	"heartbeat_metrics_snapshot_timestamp_seconds",
+	"Unix time the heartbeats behind heartbeat_last_updated_timestamp_seconds were read, with --metrics-refresh-interval set.",
+	nil, nil,
+)
+
+// freshnessSnapshot is what the freshness gauges are served from with
+// --metrics-refresh-interval set, nil until the first refresh.
+var freshnessSnapshot atomic.Pointer[Snapshot]
+
+// freshnessCollector reads every heartbeat on scrape, so the gauges always
+// reflect the stored state, including heartbeats recorded before a restart
+// and ones deleted since the last scrape. With --metrics-refresh-interval set
+// it serves the last snapshot runMetricsRefresh took instead, keeping the
+// table scan off the scrape path of large databases.
+type freshnessCollector struct{}
+
+func (freshnessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastUpdatedDesc
+	ch <- snapshotTakenDesc
+}
+
+func (freshnessCollector) Collect(ch chan<- prometheus.Metric) {
+	if cf.MetricsRefreshInterval > 0 {
+		if snapshot := freshnessSnapshot.Load(); snapshot != nil {
+			ch <- prometheus.MustNewConstMetric(snapshotTakenDesc, prometheus.GaugeValue,
+				float64(snapshot.TakenAt.UnixNano())/float64(time.Second))
+			collectFreshness(ch, *snapshot)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	snapshot, err := store.Snapshot(ctx)
+	if err != nil {
+		slog.Error("failed to read heartbeats for metrics", "error", err)
+		ch <- prometheus.NewInvalidMetric(lastUpdatedDesc, err)
+		return
+	}
+	collectFreshness(ch, snapshot)
+}
+
+func collectFreshness(ch chan<- prometheus.Metric, snapshot Snapshot) {
+	for _, hb := range snapshot.Heartbeats {
+		ch <- prometheus.MustNewConstMetric(lastUpdatedDesc, prometheus.GaugeValue,
+			float64(hb.LastUpdatedAt.UnixNano())/float64(time.Second), hb.Namespace, hb.ID)
+	}
+}
+
+// refreshFreshnessSnapshot replaces the snapshot the freshness gauges are
+// served from. On failure the previous one is kept.
+func refreshFreshnessSnapshot(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	snapshot, err := store.Snapshot(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read heartbeats for metrics: %v", err)
+	}
+	freshnessSnapshot.Store(&snapshot)
+	return len(snapshot.Heartbeats), nil
+}
+
+// runMetricsRefresh takes the snapshot freshnessCollector serves right away,
+// so the first scrape doesn't fall back to reading the database, and then
+// every interval until ctx is done.
+func runMetricsRefresh(ctx context.Context, interval time.Duration, logger *slog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		heartbeats, err := refreshFreshnessSnapshot(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		reportJobRun("metrics-refresh", err)
+		if err != nil {
+			logger.Error("failed to refresh metrics snapshot", "error", err)
+		} else {
+			logger.Debug("refreshed metrics snapshot", "heartbeats", heartbeats)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
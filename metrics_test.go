@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the internal metrics in the text exposition format.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	w := serve(internalRouter(), http.MethodGet, "/metrics", "")
+	expectStatus(t, w, http.StatusOK)
+	return w.Body.String()
+}
+
+// metricValue returns the value of the sample named series, with its
+// labels, in metrics.
+func metricValue(t *testing.T, metrics, series string) float64 {
+	t.Helper()
+	m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(series) + ` (\S+)$`).FindStringSubmatch(metrics)
+	if m == nil {
+		t.Fatalf("expected %s in the metrics", series)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// counterValue reads a counter from the registry directly, which works while
+// scrapes fail, such as with the database closed.
+func counterValue(t *testing.T, name string) float64 {
+	t.Helper()
+	families, _ := metricsRegistry.Gather()
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("expected %s in the metrics", name)
+	return 0
+}
+
+func TestLastUpdatedGauge(t *testing.T) {
+	setupTest(t)
+	reportedAt := time.Date(2026, 3, 1, 12, 0, 0, 500000000, time.UTC)
+	useFakeClock(t, reportedAt)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+
+	metrics := scrapeMetrics(t)
+	want := float64(reportedAt.UnixNano()) / float64(time.Second)
+	for _, namespace := range []string{defaultNamespace, "team"} {
+		series := fmt.Sprintf(`heartbeat_last_updated_timestamp_seconds{id="worker",namespace="%s"}`, namespace)
+		if got := metricValue(t, metrics, series); got != want {
+			t.Errorf("expected %s to be %v, got %v", series, want, got)
+		}
+	}
+
+	expectStatus(t, serve(internalRouter(), http.MethodDelete, "/team/worker", ""), http.StatusNoContent)
+	if strings.Contains(scrapeMetrics(t), `namespace="team"`) {
+		t.Fatal("expected a deleted heartbeat to disappear from the metrics")
+	}
+}
+
+func TestHeartbeatCounters(t *testing.T) {
+	setupTest(t)
+	before := scrapeMetrics(t)
+	puts := metricValue(t, before, "heartbeat_put_total")
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/missing?ttl=1m", ""), http.StatusNotFound)
+
+	after := scrapeMetrics(t)
+	if got := metricValue(t, after, "heartbeat_put_total"); got != puts+1 {
+		t.Errorf("expected heartbeat_put_total to grow by 1, got %v after %v", got, puts)
+	}
+	for _, result := range []string{"hit", "notfound"} {
+		series := fmt.Sprintf(`heartbeat_get_total{result="%s"}`, result)
+		var previous float64
+		if strings.Contains(before, series) {
+			previous = metricValue(t, before, series)
+		}
+		if got := metricValue(t, after, series); got != previous+1 {
+			t.Errorf("expected %s to grow by 1, got %v after %v", series, got, previous)
+		}
+	}
+}
+
+// useMetricsSnapshot clears the freshness snapshot when the test ends.
+func useMetricsSnapshot(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		freshnessSnapshot.Store(nil)
+	})
+}
+
+func TestMetricsServedFromSnapshot(t *testing.T) {
+	setupTest(t, "--metrics-refresh-interval", "1h")
+	useMetricsSnapshot(t)
+	reportedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(t, reportedAt)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if _, err := refreshFreshnessSnapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(time.Minute)
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/cron", ""), http.StatusNoContent)
+
+	metrics := scrapeMetrics(t)
+	want := float64(reportedAt.Unix())
+	if got := metricValue(t, metrics, `heartbeat_last_updated_timestamp_seconds{id="worker",namespace="default"}`); got != want {
+		t.Fatalf("expected the cached last update %v, got %v", want, got)
+	}
+	if strings.Contains(metrics, `id="cron"`) {
+		t.Fatal("expected a heartbeat recorded after the snapshot to be left out until the next refresh")
+	}
+	takenAt := float64(freshnessSnapshot.Load().TakenAt.UnixNano()) / float64(time.Second)
+	if got := metricValue(t, metrics, "heartbeat_metrics_snapshot_timestamp_seconds"); got != takenAt {
+		t.Fatalf("expected the snapshot time %v, got %v", takenAt, got)
+	}
+
+	// Statsd pushes gather the same snapshot.
+	l := newStatsdListener(t)
+	if err := newTestEmitter(t, l).push(); err != nil {
+		t.Fatal(err)
+	}
+	lines := l.lines(t)
+	if want := "heartbeat.age_seconds:60|g|#id:worker,namespace:default"; !slices.Contains(lines, want) {
+		t.Errorf("expected %q, got %v", want, lines)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "id:cron") {
+			t.Errorf("expected statsd to push the cached heartbeats, got %q", line)
+		}
+	}
+}
+
+func TestMetricsSnapshotRefreshes(t *testing.T) {
+	setupTest(t, "--metrics-refresh-interval", "10ms")
+	useMetricsSnapshot(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runMetricsRefresh(ctx, cf.MetricsRefreshInterval, slog.Default())
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("expected the refresh to stop cleanly, got %v", err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for freshnessSnapshot.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a snapshot to be taken on start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	first := freshnessSnapshot.Load()
+	if len(first.Heartbeats) != 0 {
+		t.Fatalf("expected an empty first snapshot, got %d heartbeats", len(first.Heartbeats))
+	}
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	for !strings.Contains(scrapeMetrics(t), `id="worker"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the next refresh to pick up the new heartbeat")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if freshnessSnapshot.Load() == first {
+		t.Fatal("expected the snapshot to have been replaced")
+	}
+}
+
+func TestMetricsRefreshIntervalValidated(t *testing.T) {
+	err := runUntilSignal(t, "--metrics-refresh-interval", "-1s")
+	if err == nil || err.Error() != "--metrics-refresh-interval must not be negative" {
+		t.Fatalf("expected a negative refresh interval to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// migration is a single schema change. Migrations are applied in order and
+// the number of the last one applied is recorded in schema_migrations.
+type migration func(tx *sql.Tx) error
+
+// migrations must only ever be appended to, the position of a migration in
+// this list is its version.
+var migrations = []migration{
+	// 1
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE IF NOT EXISTS heartbeats (
+                id TEXT PRIMARY KEY,
+                last_updated_at DATETIME NOT NULL
+            );
+        `)
+		return err
+	},
+	// 2
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "ttl_seconds INTEGER") },
+	// 3
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "alert_url TEXT") },
+	// 4
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "last_method TEXT") },
+	// 5
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "created_at DATETIME") },
+	// 6
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE IF NOT EXISTS settings (
+                key TEXT PRIMARY KEY,
+                value TEXT NOT NULL,
+                updated_at DATETIME NOT NULL
+            );
+        `)
+		return err
+	},
+	// 7
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "metadata TEXT") },
+	// 8
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE IF NOT EXISTS metadata_limits (
+                id TEXT PRIMARY KEY,
+                max_bytes INTEGER NOT NULL
+            );
+        `)
+		return err
+	},
+	// 9
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "expiry_notified_at DATETIME") },
+	// 10
+	func(tx *sql.Tx) error {
+		// SQLite can't change a primary key in place, so both tables keyed
+		// by id are rebuilt keyed by (namespace, id), with existing rows
+		// moved to the default namespace. A nocase id collation is restored
+		// by applyIDCollation afterwards.
+		_, err := tx.Exec(`
+            CREATE TABLE heartbeats_namespaced (
+                namespace TEXT NOT NULL DEFAULT 'default',
+                id TEXT NOT NULL,
+                last_updated_at DATETIME NOT NULL,
+                ttl_seconds INTEGER,
+                alert_url TEXT,
+                last_method TEXT,
+                created_at DATETIME,
+                metadata TEXT,
+                expiry_notified_at DATETIME,
+                PRIMARY KEY (namespace, id)
+            );
+            INSERT INTO heartbeats_namespaced
+                (id, last_updated_at, ttl_seconds, alert_url, last_method, created_at, metadata, expiry_notified_at)
+            SELECT id, last_updated_at, ttl_seconds, alert_url, last_method, created_at, metadata, expiry_notified_at
+            FROM heartbeats;
+            DROP TABLE heartbeats;
+            ALTER TABLE heartbeats_namespaced RENAME TO heartbeats;
+
+            CREATE TABLE metadata_limits_namespaced (
+                namespace TEXT NOT NULL DEFAULT 'default',
+                id TEXT NOT NULL,
+                max_bytes INTEGER NOT NULL,
+                PRIMARY KEY (namespace, id)
+            );
+            INSERT INTO metadata_limits_namespaced (id, max_bytes) SELECT id, max_bytes FROM metadata_limits;
+            DROP TABLE metadata_limits;
+            ALTER TABLE metadata_limits_namespaced RENAME TO metadata_limits;
+        `)
+		return err
+	},
+	// 11
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "muted_until DATETIME") },
+	// 12
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE heartbeat_events (
+                namespace TEXT NOT NULL DEFAULT 'default',
+                id TEXT NOT NULL,
+                received_at DATETIME NOT NULL
+            );
+            CREATE INDEX heartbeat_events_key ON heartbeat_events (namespace, id);
+        `)
+		return err
+	},
+	// 13
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "pending INTEGER NOT NULL DEFAULT 0") },
+	// 14
+	func(tx *sql.Tx) error { return addColumn(tx, "heartbeats", "sla_target REAL") },
+	// 15
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE webhook_deliveries (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                url TEXT NOT NULL,
+                payload TEXT NOT NULL,
+                heartbeats TEXT NOT NULL,
+                attempts INTEGER NOT NULL DEFAULT 0,
+                last_error TEXT,
+                next_attempt_at DATETIME NOT NULL,
+                dead_lettered_at DATETIME,
+                created_at DATETIME NOT NULL
+            );
+        `)
+		return err
+	},
+	// 16
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+            CREATE TABLE heartbeat_tombstones (
+                namespace TEXT NOT NULL,
+                id TEXT NOT NULL,
+                deleted_at DATETIME NOT NULL
+            );
+            CREATE INDEX heartbeat_tombstones_deleted_at ON heartbeat_tombstones (namespace, deleted_at);
+        `)
+		return err
+	},
+}
+
+// initSchema applies any migrations not yet recorded in schema_migrations.
+func initSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            applied_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	current, err := schemaVersion(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	// Tables created before any migration ran on this database must at least
+	// hold what the first migrations would have created, before the rest
+	// alter them.
+	if current == 0 {
+		if err := checkTable(db, "heartbeats", []string{"id"}, []string{"id", "last_updated_at"}); err != nil {
+			return err
+		}
+		if err := checkTable(db, "settings", []string{"key"}, []string{"key", "value", "updated_at"}); err != nil {
+			return err
+		}
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %v", version, err)
+		}
+		if err := migrations[i](tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %v", version, err)
+		}
+		_, err = tx.Exec(`
+            INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)
+        `, version, time.Now().Format(storedTimeFormat))
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %v", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %v", version, err)
+		}
+	}
+
+	return checkTable(db, "heartbeats", []string{"namespace", "id"}, []string{
+		"namespace", "id", "last_updated_at", "ttl_seconds", "alert_url", "last_method", "created_at", "metadata",
+		"expiry_notified_at", "muted_until", "pending", "sla_target",
+	})
+}
+
+// schemaVersion returns the last applied migration, or 0 if none has been.
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, `
+        SELECT COALESCE(MAX(version), 0) FROM schema_migrations
+    `).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// addColumn adds a column to an existing table, ignoring the error SQLite
+// returns when the column is already present. Databases from before
+// schema_migrations existed may already have the column.
+func addColumn(tx *sql.Tx, table, definition string) error {
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, definition))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return fmt.Errorf("failed to add column to %s: %v", table, err)
+	}
+	return nil
+}
+
+type SchemaVersion struct {
+	Version int `json:"version"`
+}
+
+func handleGetSchemaVersion(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat files have no schema version")
+		return
+	}
+	version, err := schemaVersion(r.Context(), db)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(SchemaVersion{Version: version}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaVersionAfterMigrations(t *testing.T) {
+	setupTest(t)
+
+	w := serve(internalRouter(), http.MethodGet, "/schema-version", "")
+	expectStatus(t, w, http.StatusOK)
+	var version SchemaVersion
+	decodeBody(t, w, &version)
+	if version.Version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations), version.Version)
+	}
+
+	if err := initSchema(db); err != nil {
+		t.Fatalf("expected migrating again to be a no-op, got %v", err)
+	}
+	if v, err := schemaVersion(context.Background(), db); err != nil || v != len(migrations) {
+		t.Fatalf("expected schema version %d after migrating again, got %d, %v", len(migrations), v, err)
+	}
+}
+
+func TestSchemaVersionNoneApplied(t *testing.T) {
+	setupTest(t)
+	db, err := sql.Open(sqliteDriverName, filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := schemaVersion(context.Background(), db); err != nil || v != 0 {
+		t.Fatalf("expected schema version 0, got %d, %v", v, err)
+	}
+}
+
+func TestMigratingDatabaseWithExistingColumns(t *testing.T) {
+	setupTest(t)
+	db, err := sql.Open(sqliteDriverName, filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A database from before schema_migrations existed, with ttl_seconds
+	// already added by hand.
+	_, err = db.Exec(`
+        CREATE TABLE heartbeats (id TEXT PRIMARY KEY, last_updated_at DATETIME NOT NULL, ttl_seconds INTEGER);
+        INSERT INTO heartbeats (id, last_updated_at, ttl_seconds) VALUES ('worker', '2026-03-01T12:00:00Z', 60);
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initSchema(db); err != nil {
+		t.Fatalf("expected the existing column to be tolerated, got %v", err)
+	}
+	var ttl sql.NullInt64
+	if err := db.QueryRow(`SELECT ttl_seconds FROM heartbeats WHERE id = 'worker'`).Scan(&ttl); err != nil || ttl.Int64 != 60 {
+		t.Fatalf("expected the stored ttl to be kept, got %+v, %v", ttl, err)
+	}
+}
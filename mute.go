@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handlePostMute suppresses expiry notifications for a heartbeat until the
+// RFC 3339 time in ?until=. The heartbeat is still recorded and served as
+// usual, and an expiry during the mute is notified once it ends if no
+// heartbeat arrived in between. An until in the past ends a mute early.
+func handlePostMute(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r)
+	if key.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_id", "ID value is required on path")
+		return
+	}
+
+	untilStr := r.URL.Query().Get("until")
+	if untilStr == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_until", "until query parameter is required")
+		return
+	}
+	until, err := time.Parse(time.RFC3339Nano, untilStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_until", "until query parameter must be an RFC 3339 time")
+		return
+	}
+
+	err = store.Mute(r.Context(), key, until)
+	if errors.Is(err, ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "heartbeat not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *sqliteStore) Mute(ctx context.Context, key heartbeatKey, until time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE heartbeats SET muted_until = ? WHERE namespace = ? AND id = ?
+    `, until.UTC().Format(storedTimeFormat), key.Namespace, key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mute heartbeat: %v", err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count muted heartbeats: %v", err)
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
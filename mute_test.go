@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func muteUntil(t *testing.T, path string, until time.Time) {
+	t.Helper()
+	expectStatus(t, serve(internalRouter(), http.MethodPost, "/"+path+"/mute?until="+until.Format(time.RFC3339Nano), ""), http.StatusNoContent)
+}
+
+func TestMuteSuppressesThenResumesAlerts(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	muteUntil(t, "worker", c.Now().Add(10*time.Minute))
+
+	// Expired while muted: tracked and visible, but not alerted on.
+	c.Advance(5 * time.Minute)
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 0 {
+		t.Fatalf("expected no alert while muted, got %v", ids)
+	}
+	hb := getHeartbeat(t, "worker", "?include_expired=true")
+	if hb.MutedUntil == nil || !hb.MutedUntil.Equal(c.Now().Add(5*time.Minute)) {
+		t.Fatalf("expected the mute to be shown, got %+v", hb)
+	}
+
+	// Once the mute ends the pending expiry is alerted on, once.
+	c.Advance(5*time.Minute + time.Second)
+	runNotifier(t)
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 1 || ids[0] != "worker" {
+		t.Fatalf("expected one alert after the mute, got %v", ids)
+	}
+	if hb := getHeartbeat(t, "worker", "?include_expired=true"); hb.MutedUntil != nil {
+		t.Fatalf("expected an ended mute not to be shown, got %v", hb.MutedUntil)
+	}
+}
+
+func TestMuteDoesNotAffectOtherHeartbeats(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/worker?ttl=1m", ""), http.StatusNoContent)
+	muteUntil(t, "worker", c.Now().Add(time.Hour))
+
+	c.Advance(2 * time.Minute)
+	notified := runNotifier(t)
+	if len(notified) != 1 || notified[0] != (heartbeatKey{Namespace: "team", ID: "worker"}) {
+		t.Fatalf("expected only the unmuted heartbeat to be alerted on, got %v", notified)
+	}
+}
+
+func TestMuteEndedEarly(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	muteUntil(t, "worker", c.Now().Add(time.Hour))
+
+	c.Advance(2 * time.Minute)
+	muteUntil(t, "worker", c.Now().Add(-time.Second))
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 1 {
+		t.Fatalf("expected an alert once the mute was lifted, got %v", ids)
+	}
+}
+
+func TestMuteInvalid(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectError(t, serve(h, http.MethodPost, "/worker/mute", ""), http.StatusBadRequest, "missing_until")
+	expectError(t, serve(h, http.MethodPost, "/worker/mute?until=tomorrow", ""), http.StatusBadRequest, "invalid_until")
+	expectError(t, serve(h, http.MethodPost, "/missing/mute?until=2030-01-01T00:00:00Z", ""), http.StatusNotFound, "not_found")
+}
+
+func TestMuteNamespacedAndReserved(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/team/worker?ttl=1m", ""), http.StatusNoContent)
+
+	muteUntil(t, "team/worker", c.Now().Add(time.Hour))
+	if hb := getHeartbeat(t, "team/worker", ""); hb.MutedUntil == nil {
+		t.Fatalf("expected team/worker to be muted, got %+v", hb)
+	}
+
+	expectError(t, serve(h, http.MethodPut, "/team/mute", ""), http.StatusBadRequest, "reserved_id")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultNamespace holds heartbeats reported without a namespace, including
+// every heartbeat recorded before namespaces existed.
+const defaultNamespace = "default"
+
+// adminNamespace is the path prefix of the collector's internal-only
+// endpoints, such as /admin/config.
+const adminNamespace = "admin"
+
+// reservedNamespaces are the first path segments of the collector's own
+// two-segment routes, which shadow every heartbeat in a namespace of that
+// name.
+var reservedNamespaces = map[string]bool{
+	adminNamespace:    true,
+	"raw":             true,
+	"jobs":            true,
+	"metadata-limits": true,
+}
+
+// reservedIDs are the paths of the collector's own single-segment routes on
+// either server, which shadow the heartbeat of that id in the default
+// namespace.
+var reservedIDs = map[string]bool{
+	"snapshot":       true,
+	"export":         true,
+	"metrics":        true,
+	"schema-version": true,
+	"selfstat":       true,
+	"healthz":        true,
+	"readyz":         true,
+	"intervals":      true,
+	"batch":          true,
+	"import":         true,
+	"banner":         true,
+	"expired":        true,
+	"health-score":   true,
+}
+
+// reservedSubpaths are the last segments of the collector's per-heartbeat
+// routes such as /{id}/history, which shadow the heartbeat of that id in
+// every namespace.
+var reservedSubpaths = map[string]bool{
+	"history": true,
+	"mute":    true,
+	"flaps":   true,
+	"cadence": true,
+	"sla":     true,
+}
+
+// reservedKey returns the error code and message a heartbeat is rejected
+// with when one of the collector's own routes shadows its path, so it
+// couldn't be checked once recorded. It returns an empty code for any other
+// heartbeat.
+func reservedKey(key heartbeatKey) (code, message string) {
+	switch {
+	case reservedNamespaces[key.Namespace]:
+		return "reserved_namespace", fmt.Sprintf("namespace %q is reserved for the collector's own endpoints", key.Namespace)
+	case key.Namespace == defaultNamespace && reservedIDs[key.ID]:
+		return "reserved_id", fmt.Sprintf("id %q is reserved for the collector's own endpoints", key.ID)
+	case reservedSubpaths[key.ID]:
+		return "reserved_id", fmt.Sprintf("id %q is reserved for the collector's per-heartbeat endpoints", key.ID)
+	}
+	return "", ""
+}
+
+// heartbeatKey identifies a heartbeat. Ids are only unique within their
+// namespace.
+type heartbeatKey struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+}
+
+// pathKey reads the heartbeat addressed by the {namespace} and {id} path
+// values. Single-segment routes have no namespace and address the default
+// one.
+func pathKey(r *http.Request) heartbeatKey {
+	namespace := r.PathValue("namespace")
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	return heartbeatKey{Namespace: namespace, ID: r.PathValue("id")}
+}
+
+// queryNamespace returns the ?namespace= an endpoint covering many
+// heartbeats is scoped to, the default namespace when absent.
+func queryNamespace(r *http.Request) string {
+	if namespace := normalizeID(r.URL.Query().Get("namespace")); namespace != "" {
+		return namespace
+	}
+	return defaultNamespace
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNamespacesAreIndependent(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/payments/worker?ttl=1m", `{"metadata":{"team":"payments"}}`), http.StatusNoContent)
+	c.Advance(time.Minute)
+	expectStatus(t, serve(h, http.MethodPut, "/search/worker?ttl=5m", `{"metadata":{"team":"search"}}`), http.StatusNoContent)
+
+	payments := getHeartbeat(t, "payments/worker", "")
+	search := getHeartbeat(t, "search/worker", "")
+	if payments.Namespace != "payments" || search.Namespace != "search" || payments.ID != "worker" || search.ID != "worker" {
+		t.Fatalf("expected each heartbeat to report its namespace, got %+v and %+v", payments, search)
+	}
+	if payments.LastUpdatedAt.Equal(search.LastUpdatedAt) || string(payments.Metadata) != `{"team":"payments"}` || string(search.Metadata) != `{"team":"search"}` {
+		t.Fatalf("expected the heartbeats not to share state, got %+v and %+v", payments, search)
+	}
+
+	// Each keeps its own ttl.
+	c.Advance(time.Second)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/payments/worker", ""), http.StatusNotFound, "expired")
+	getHeartbeat(t, "search/worker", "")
+
+	// Neither is visible in the default namespace, and deleting one leaves
+	// the other.
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1h", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(h, http.MethodDelete, "/payments/worker", ""), http.StatusNoContent)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/payments/worker?ttl=1h", ""), http.StatusNotFound, "not_found")
+	getHeartbeat(t, "search/worker", "")
+}
+
+func TestSingleSegmentUsesDefaultNamespace(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	if hb := getHeartbeat(t, "default/worker", "?ttl=1m"); hb.Namespace != defaultNamespace {
+		t.Fatalf("expected the default namespace, got %q", hb.Namespace)
+	}
+	expectStatus(t, serve(h, http.MethodPut, "/default/worker", ""), http.StatusNoContent)
+	if rows := countRows(t); rows != 1 {
+		t.Fatalf("expected both paths to address one heartbeat, got %d rows", rows)
+	}
+}
+
+func TestListScopedToNamespace(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	for _, path := range []string{"/worker", "/team/worker", "/team/cron"} {
+		expectStatus(t, serve(h, http.MethodPut, path, ""), http.StatusNoContent)
+	}
+
+	if ids := listedIDs(listHeartbeats(t, "?ttl=1m")); len(ids) != 1 || ids[0] != "worker" {
+		t.Fatalf("expected only the default namespace, got %v", ids)
+	}
+	list := listHeartbeats(t, "?ttl=1m&namespace=team")
+	if ids := listedIDs(list); len(ids) != 2 || ids[0] != "cron" || ids[1] != "worker" || list[0].Namespace != "team" {
+		t.Fatalf("expected the team namespace, got %+v", list)
+	}
+}
+
+func TestReservedKeysRejected(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectError(t, serve(h, http.MethodPut, "/admin/worker", ""), http.StatusBadRequest, "reserved_namespace")
+	expectError(t, serve(h, http.MethodPut, "/raw/worker", ""), http.StatusBadRequest, "reserved_namespace")
+	expectError(t, serve(h, http.MethodPut, "/snapshot", ""), http.StatusBadRequest, "reserved_id")
+	expectError(t, serve(h, http.MethodPut, "/default/expired", ""), http.StatusBadRequest, "reserved_id")
+	expectError(t, serve(h, http.MethodPost, "/batch", `["worker", {"id": "banner"}]`), http.StatusBadRequest, "reserved_id")
+	expectError(t, serve(h, http.MethodPost, "/batch", `[{"namespace": "admin", "id": "worker"}]`), http.StatusBadRequest, "reserved_namespace")
+	if rows := countRows(t); rows != 0 {
+		t.Fatalf("expected no reserved heartbeat to be recorded, got %d rows", rows)
+	}
+
+	// Reserved ids are only shadowed in the default namespace.
+	expectStatus(t, serve(h, http.MethodPut, "/team/snapshot", ""), http.StatusNoContent)
+	getHeartbeat(t, "team/snapshot", "?ttl=1m")
+
+	// The collector's own endpoints keep answering their paths.
+	w := serve(h, http.MethodGet, "/snapshot", "")
+	expectStatus(t, w, http.StatusOK)
+	var snapshot Snapshot
+	decodeBody(t, w, &snapshot)
+	if len(snapshot.Heartbeats) != 1 || snapshot.Heartbeats[0].Namespace != "team" {
+		t.Fatalf("expected the snapshot endpoint to serve the snapshot, got %+v", snapshot)
+	}
+}
+
+func TestReservedParentsNotRegistered(t *testing.T) {
+	setupTest(t)
+	cf.RegisterParents = true
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/batch.nightly", ""), http.StatusNoContent)
+	if rows := countRows(t); rows != 1 {
+		t.Fatalf("expected only batch.nightly to be recorded, got %d rows", rows)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeID maps an id to Unicode NFC when --nfc-ids is set, so composed
+// and decomposed spellings of the same text name the same heartbeat.
+func normalizeID(id string) string {
+	if !cf.NFCIDs {
+		return id
+	}
+	return norm.NFC.String(id)
+}
+
+// normalizeIDPath applies normalizeID to the request path before routing, so
+// every id and prefix taken from the path is in NFC.
+func normalizeIDPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cf.NFCIDs || norm.NFC.IsNormalString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path, r2.URL.RawPath = norm.NFC.String(r.URL.Path), ""
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	composedCafe   = "caf%C3%A9"  // é as a single code point
+	decomposedCafe = "cafe%CC%81" // e followed by a combining acute accent
+)
+
+func TestNFCIDsMatchDecomposedSpelling(t *testing.T) {
+	setupTest(t, "--nfc-ids")
+	internal := normalizeIDPath(internalRouter())
+	external := normalizeIDPath(externalRouter())
+
+	expectStatus(t, serve(internal, http.MethodPut, "/"+decomposedCafe, ""), http.StatusNoContent)
+	w := serve(external, http.MethodGet, "/"+composedCafe+"?ttl=1m", "")
+	expectStatus(t, w, http.StatusOK)
+	var hb Heartbeat
+	decodeBody(t, w, &hb)
+	if hb.ID != "café" {
+		t.Fatalf("expected the id to be stored in NFC, got %q", hb.ID)
+	}
+	expectStatus(t, serve(external, http.MethodGet, "/"+decomposedCafe+"?ttl=1m", ""), http.StatusOK)
+
+	// Batches and namespaces are normalized too.
+	expectStatus(t, serve(internal, http.MethodPost, "/batch", `[{"namespace": "café", "id": "café"}]`), http.StatusNoContent)
+	expectStatus(t, serve(external, http.MethodGet, "/"+composedCafe+"/"+composedCafe+"?ttl=1m", ""), http.StatusOK)
+	if rows := countRows(t); rows != 1 {
+		t.Fatalf("expected both spellings to share a row, got %d rows", rows)
+	}
+}
+
+func TestNFCIDsDisabled(t *testing.T) {
+	setupTest(t)
+	internal := normalizeIDPath(internalRouter())
+	external := normalizeIDPath(externalRouter())
+
+	expectStatus(t, serve(internal, http.MethodPut, "/"+decomposedCafe, ""), http.StatusNoContent)
+	expectError(t, serve(external, http.MethodGet, "/"+composedCafe+"?ttl=1m", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(external, http.MethodGet, "/"+decomposedCafe+"?ttl=1m", ""), http.StatusOK)
+}
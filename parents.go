@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// parentIDs returns the ids above id in its dot-separated hierarchy, nearest
+// first: team.svc and team for team.svc.inst. Empty segments don't make a
+// parent.
+func parentIDs(id string) []string {
+	var parents []string
+	for i := strings.LastIndexByte(id, '.'); i > 0; i = strings.LastIndexByte(id, '.') {
+		id = id[:i]
+		if !strings.HasSuffix(id, ".") {
+			parents = append(parents, id)
+		}
+	}
+	return parents
+}
+
+// registerParents inserts the parents of key as pending entries for
+// --register-parents. Parents that exist already, pending or not, are left
+// untouched, and reserved parents such as batch for batch.nightly aren't
+// registered. A pending entry has no ttl and is left out of expiry checks,
+// counts and snapshots until it reports itself.
+func registerParents(ctx context.Context, db execer, key heartbeatKey, stamp string) error {
+	for _, parent := range parentIDs(key.ID) {
+		if code, _ := reservedKey(heartbeatKey{Namespace: key.Namespace, ID: parent}); code != "" {
+			continue
+		}
+		_, err := db.ExecContext(ctx, `
+            INSERT INTO heartbeats (namespace, id, last_updated_at, created_at, pending) VALUES (?, ?, ?, ?, 1)
+            ON CONFLICT(namespace, id) DO NOTHING
+        `, key.Namespace, parent, stamp, stamp)
+		if err != nil {
+			return fmt.Errorf("failed to register parent %q: %v", parent, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParentIDs(t *testing.T) {
+	for id, want := range map[string][]string{
+		"team.svc.inst": {"team.svc", "team"},
+		"team.svc":      {"team"},
+		"worker":        nil,
+		".worker":       nil,
+		"team..inst":    {"team"},
+		"team.svc.":     {"team.svc", "team"},
+	} {
+		if got := parentIDs(id); !slices.Equal(got, want) {
+			t.Errorf("parentIDs(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRegisterParents(t *testing.T) {
+	setupTest(t, "--register-parents")
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team.svc.inst?ttl=1m", ""), http.StatusNoContent)
+
+	pending := map[string]bool{}
+	for _, hb := range listHeartbeats(t, "?ttl=1m") {
+		pending[hb.ID] = hb.Pending
+		if hb.Expired {
+			t.Errorf("expected %s not to be expired", hb.ID)
+		}
+	}
+	if len(pending) != 3 || !pending["team"] || !pending["team.svc"] || pending["team.svc.inst"] {
+		t.Fatalf("expected team and team.svc to be pending parents, got %v", pending)
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/team.svc?ttl=1m", ""), http.StatusNotFound, "pending")
+
+	// Pending parents never expire, they haven't reported anything yet.
+	c.Advance(time.Hour)
+	w := serve(externalRouter(), http.MethodGet, "/expired?ttl=1m", "")
+	expectStatus(t, w, http.StatusOK)
+	var expired []string
+	decodeBody(t, w, &expired)
+	if !slices.Equal(expired, []string{"team.svc.inst"}) {
+		t.Fatalf("expected only team.svc.inst to be expired, got %v", expired)
+	}
+	if live := listHeartbeats(t, "?ttl=1m&status=live"); len(live) != 0 {
+		t.Fatalf("expected no live heartbeats, got %+v", live)
+	}
+}
+
+func TestParentReportingItself(t *testing.T) {
+	setupTest(t, "--register-parents")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/team.svc.inst", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(h, http.MethodPut, "/team.svc?ttl=5m", ""), http.StatusNoContent)
+	hb := getHeartbeat(t, "team.svc", "")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != 5*time.Minute {
+		t.Fatalf("expected the reported ttl of 5m, got %v", remaining)
+	}
+	if ttl := storedTTL(t, "team.svc"); ttl.Int64 != 300 {
+		t.Fatalf("expected the ttl to be stored on the former parent, got %+v", ttl)
+	}
+
+	// Reporting a child again leaves the existing parent alone.
+	expectStatus(t, serve(h, http.MethodPut, "/team.svc.other", ""), http.StatusNoContent)
+	getHeartbeat(t, "team.svc", "")
+}
+
+func TestRegisterParentsDisabled(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team.svc.inst", ""), http.StatusNoContent)
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/team.svc?ttl=1m", ""), http.StatusNotFound, "not_found")
+	if list := listHeartbeats(t, "?ttl=1m"); len(list) != 1 {
+		t.Fatalf("expected only the reported heartbeat, got %+v", list)
+	}
+}
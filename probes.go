@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// readyPingTimeout bounds the database ping of a readiness probe.
+const readyPingTimeout = 2 * time.Second
+
+// probePaths are served without the internal token, so orchestrators can
+// probe the collector without holding it.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// handleGetHealthz is the liveness probe, it succeeds while the process
+// serves requests.
+func handleGetHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// handleGetReadyz is the readiness probe, it fails with 503 while the
+// database, or with --db-driver fs its directory, can't be reached.
+func handleGetReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+	defer cancel()
+
+	var err error
+	if db == nil {
+		_, err = os.Stat(cf.SQLiteDSN)
+	} else {
+		err = db.PingContext(ctx)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "database_unavailable", fmt.Sprintf("database unreachable: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintln(w, "ok")
+}
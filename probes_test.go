@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLiveness(t *testing.T) {
+	setupTest(t)
+
+	w := serve(internalRouter(), http.MethodGet, "/healthz", "")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "ok\n" {
+		t.Fatalf("expected ok, got %q", w.Body)
+	}
+
+	// Liveness doesn't depend on the database.
+	_ = db.Close()
+	expectStatus(t, serve(internalRouter(), http.MethodGet, "/healthz", ""), http.StatusOK)
+}
+
+func TestReadiness(t *testing.T) {
+	setupTest(t)
+
+	w := serve(internalRouter(), http.MethodGet, "/readyz", "")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "ok\n" {
+		t.Fatalf("expected ok, got %q", w.Body)
+	}
+}
+
+func TestReadinessDatabaseClosed(t *testing.T) {
+	setupTest(t)
+	_ = db.Close()
+
+	expectError(t, serve(internalRouter(), http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable, "database_unavailable")
+}
+
+func TestProbesNotExternal(t *testing.T) {
+	setupTest(t)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if w := serve(externalRouter(), http.MethodGet, path, ""); w.Code == http.StatusOK && w.Body.String() == "ok\n" {
+			t.Fatalf("expected %s not to be served externally", path)
+		}
+	}
+}
+
+func TestProbePathsNotRecorded(t *testing.T) {
+	setupTest(t)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		expectError(t, serve(internalRouter(), http.MethodPut, path, ""), http.StatusBadRequest, "reserved_id")
+	}
+}
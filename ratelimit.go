@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long a client's limiter is kept after its last
+// request. A bucket left alone this long has refilled for any sensible rate,
+// so dropping it forgets nothing.
+const rateLimiterIdleTTL = 5 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters holds a token bucket per client IP, or per --api-key scope.
+type clientLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*clientLimiter
+}
+
+var (
+	externalLimiters = &clientLimiters{limiters: map[string]*clientLimiter{}}
+	apiKeyLimiters   = &clientLimiters{limiters: map[string]*clientLimiter{}}
+)
+
+// get returns the limiter of key, creating it with limit and burst.
+func (c *clientLimiters) get(key string, now time.Time, limit rate.Limit, burst int) *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.limiters[key]
+	if !ok {
+		l = &clientLimiter{limiter: rate.NewLimiter(limit, burst)}
+		c.limiters[key] = l
+	}
+	l.lastSeen = now
+	return l.limiter
+}
+
+// evictIdle drops the limiters of clients not seen since before cutoff.
+func (c *clientLimiters) evictIdle(cutoff time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for ip, l := range c.limiters {
+		if l.lastSeen.Before(cutoff) {
+			delete(c.limiters, ip)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// runLimiterEviction evicts idle limiters every interval until ctx is done.
+func runLimiterEviction(ctx context.Context, interval time.Duration, logger *slog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			cutoff := time.Now().Add(-rateLimiterIdleTTL)
+			if evicted := externalLimiters.evictIdle(cutoff) + apiKeyLimiters.evictIdle(cutoff); evicted > 0 {
+				logger.Debug("evicted idle rate limiters", "evicted", evicted)
+			}
+		}
+	}
+}
+
+// clientIP returns the address a request is rate limited by. Behind a proxy
+// trusted with --trust-forwarded-for it is the last X-Forwarded-For entry,
+// the one the proxy itself appended, as earlier entries are set by the client.
+func clientIP(r *http.Request) string {
+	if cf.TrustForwardedFor {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitResponse is the body of a 429 from the external server.
+type RateLimitResponse struct {
+	Error RateLimitDetail `json:"error"`
+}
+
+// RateLimitDetail tells a rate limited client how its bucket stands: Limit is
+// its rate in requests per second, Used how many of its Burst requests it has
+// spent, and ResetAt when the bucket will be full again.
+type RateLimitDetail struct {
+	ErrorDetail
+	Limit   float64   `json:"limit"`
+	Burst   int       `json:"burst"`
+	Used    int       `json:"used"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// rateLimitDetail describes limiter as of now.
+func rateLimitDetail(limiter *rate.Limiter, now time.Time) RateLimitDetail {
+	missing := float64(limiter.Burst()) - math.Max(0, limiter.TokensAt(now))
+	return RateLimitDetail{
+		ErrorDetail: ErrorDetail{Code: "rate_limited", Message: "too many requests, retry later"},
+		Limit:       float64(limiter.Limit()),
+		Burst:       limiter.Burst(),
+		Used:        int(math.Ceil(missing)),
+		ResetAt:     now.Add(time.Duration(missing / float64(limiter.Limit()) * float64(time.Second))).UTC(),
+	}
+}
+
+// rateLimitByIP answers clients exceeding --external-rate with 429 and a
+// Retry-After of when their next request would be allowed, and the state of
+// their bucket in the body. Rejections are
+// counted in http_rate_limited_total and only logged at debug level, so a
+// client hammering the server can't flood the logs too.
+func rateLimitByIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cf.ExternalRate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		now := time.Now()
+		limiter := externalLimiters.get(ip, now, rate.Limit(cf.ExternalRate), cf.ExternalBurst)
+		if !allowRequest(w, limiter, now) {
+			rateLimited.Inc()
+			rateLimitLog.Debug("rate limiting client", "ip", ip, "path", r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowRequest takes a token from limiter, or answers 429 with a Retry-After
+// of when the next request would be allowed.
+func allowRequest(w http.ResponseWriter, limiter *rate.Limiter, now time.Time) bool {
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		writeErrorResponse(w, http.StatusTooManyRequests, RateLimitResponse{Error: rateLimitDetail(limiter, now)})
+		return false
+	}
+	return true
+}
+
+// apiKeyWeights holds the parsed --api-key-weight entries by prefix.
+var apiKeyWeights map[string]float64
+
+// parseAPIKeyWeights parses entries of the form "prefix=weight", each naming
+// the prefix of an --api-key.
+func parseAPIKeyWeights(values []string, keys []apiKey) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, v := range values {
+		sep := strings.LastIndex(v, "=")
+		if sep <= 0 {
+			return nil, fmt.Errorf("invalid --api-key-weight %q, expected prefix=weight", v)
+		}
+		prefix := v[:sep]
+		weight, err := strconv.ParseFloat(v[sep+1:], 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid --api-key-weight %q, weight must be a positive number", v)
+		}
+		if !slices.ContainsFunc(keys, func(k apiKey) bool { return k.prefix == prefix }) {
+			return nil, fmt.Errorf("invalid --api-key-weight %q, no --api-key is scoped to %q", v, prefix)
+		}
+		weights[prefix] = weight
+	}
+	return weights, nil
+}
+
+// apiKeyLimit is the rate and burst of the bucket of the --api-key scope
+// prefix: --api-key-rate and --api-key-burst times its --api-key-weight.
+func apiKeyLimit(prefix string) (rate.Limit, int) {
+	weight, ok := apiKeyWeights[prefix]
+	if !ok {
+		weight = 1
+	}
+	return rate.Limit(cf.APIKeyRate * weight), max(1, int(math.Round(float64(cf.APIKeyBurst)*weight)))
+}
+
+// rateLimitByAPIKey gives each --api-key scope a token bucket of its own on
+// the internal server, so a tenant flooding it is answered with 429 like an
+// external client while the other tenants keep their full rate. Keys sharing
+// a prefix share its bucket. Requests with --internal-token or without any
+// token configured aren't limited.
+func rateLimitByAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, scoped := r.Context().Value(apiKeyScopeKey{}).(string)
+		if cf.APIKeyRate <= 0 || !scoped {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		limit, burst := apiKeyLimit(prefix)
+		if !allowRequest(w, apiKeyLimiters.get(prefix, now, limit, burst), now) {
+			apiKeyRateLimited.WithLabelValues(prefix).Inc()
+			rateLimitLog.Debug("rate limiting API key", "prefix", prefix, "path", r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
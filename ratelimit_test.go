@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// resetLimiters gives the test fresh per-client buckets.
+func resetLimiters(t *testing.T) {
+	t.Helper()
+	saved, savedAPIKeys := externalLimiters, apiKeyLimiters
+	externalLimiters = &clientLimiters{limiters: map[string]*clientLimiter{}}
+	apiKeyLimiters = &clientLimiters{limiters: map[string]*clientLimiter{}}
+	t.Cleanup(func() {
+		externalLimiters, apiKeyLimiters = saved, savedAPIKeys
+	})
+}
+
+func getFrom(h http.Handler, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/worker?ttl=1m", nil)
+	r.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return serveRequest(h, r)
+}
+
+func TestRateLimitExhaustedBucket(t *testing.T) {
+	setupTest(t, "--external-rate", "0.5", "--external-burst", "3")
+	resetLimiters(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := rateLimitByIP(externalRouter())
+
+	start := time.Now()
+	for range 3 {
+		expectStatus(t, getFrom(h, "192.0.2.1:1234", ""), http.StatusOK)
+	}
+	w := getFrom(h, "192.0.2.1:5678", "")
+	expectError(t, w, http.StatusTooManyRequests, "rate_limited")
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+
+	var body RateLimitResponse
+	decodeBody(t, w, &body)
+	if body.Error.Limit != 0.5 || body.Error.Burst != 3 || body.Error.Used != 3 {
+		t.Fatalf("expected the spent bucket to be described, got %+v", body.Error)
+	}
+	// An empty bucket of 3 refills at 0.5/s in 6s.
+	if reset := body.Error.ResetAt; reset.Before(start.Add(5*time.Second)) || reset.After(time.Now().Add(6*time.Second)) {
+		t.Fatalf("expected the bucket to reset about 6s from now, got %v", reset)
+	}
+
+	// Other clients have buckets of their own.
+	expectStatus(t, getFrom(h, "192.0.2.2:1234", ""), http.StatusOK)
+}
+
+func TestRateLimitDetail(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter := rate.NewLimiter(2, 10)
+	limiter.AllowN(now, 7)
+
+	detail := rateLimitDetail(limiter, now.Add(time.Second))
+	// 7 spent, 2 refilled a second later: 5 used, full again 2.5s after that.
+	if detail.Code != "rate_limited" || detail.Limit != 2 || detail.Burst != 10 || detail.Used != 5 {
+		t.Fatalf("expected 5 of 10 used at 2/s, got %+v", detail)
+	}
+	if want := now.Add(3500 * time.Millisecond); !detail.ResetAt.Equal(want) {
+		t.Fatalf("expected the bucket to reset at %v, got %v", want, detail.ResetAt)
+	}
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	setupTest(t, "--external-rate", "1", "--external-burst", "1", "--trust-forwarded-for")
+	resetLimiters(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := rateLimitByIP(externalRouter())
+
+	// Clients behind the same proxy are told apart by the entry it appended.
+	expectStatus(t, getFrom(h, "10.0.0.1:1234", "203.0.113.9, 198.51.100.1"), http.StatusOK)
+	expectStatus(t, getFrom(h, "10.0.0.1:1234", "198.51.100.2"), http.StatusOK)
+	expectError(t, getFrom(h, "10.0.0.1:1234", "spoofed, 198.51.100.1"), http.StatusTooManyRequests, "rate_limited")
+}
+
+func TestRateLimitIgnoresUntrustedForwardedFor(t *testing.T) {
+	setupTest(t, "--external-rate", "1", "--external-burst", "1")
+	resetLimiters(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := rateLimitByIP(externalRouter())
+
+	expectStatus(t, getFrom(h, "192.0.2.1:1234", "198.51.100.1"), http.StatusOK)
+	expectError(t, getFrom(h, "192.0.2.1:1234", "198.51.100.2"), http.StatusTooManyRequests, "rate_limited")
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	setupTest(t)
+	resetLimiters(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := rateLimitByIP(externalRouter())
+
+	for range 50 {
+		expectStatus(t, getFrom(h, "192.0.2.1:1234", ""), http.StatusOK)
+	}
+	if len(externalLimiters.limiters) != 0 {
+		t.Fatalf("expected no limiters without --external-rate, got %d", len(externalLimiters.limiters))
+	}
+}
+
+func TestEvictIdleLimiters(t *testing.T) {
+	setupTest(t, "--external-rate", "1")
+	limiters := &clientLimiters{limiters: map[string]*clientLimiter{}}
+	now := time.Now()
+	limiters.get("192.0.2.1", now.Add(-time.Hour), 1, 20)
+	limiters.get("192.0.2.2", now, 1, 20)
+
+	if evicted := limiters.evictIdle(now.Add(-rateLimiterIdleTTL)); evicted != 1 {
+		t.Fatalf("expected the idle limiter to be evicted, got %d", evicted)
+	}
+	if _, ok := limiters.limiters["192.0.2.2"]; !ok || len(limiters.limiters) != 1 {
+		t.Fatalf("expected the active limiter to be kept, got %v", limiters.limiters)
+	}
+}
+
+func TestAPIKeyRateLimitPerTenant(t *testing.T) {
+	setupTest(t, "--internal-token", "s3cret", "--api-key", "noisy-key=noisy-", "--api-key", "noisy-spare=noisy-",
+		"--api-key", "quiet-key=quiet-", "--api-key-rate", "0.5", "--api-key-burst", "3")
+	resetLimiters(t)
+
+	for range 3 {
+		expectStatus(t, withAPIKey(http.MethodPut, "/noisy-worker", "", "noisy-key"), http.StatusNoContent)
+	}
+	w := withAPIKey(http.MethodPut, "/noisy-worker", "", "noisy-key")
+	expectError(t, w, http.StatusTooManyRequests, "rate_limited")
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+	// Keys of the same prefix draw on its bucket.
+	expectError(t, withAPIKey(http.MethodPost, "/batch", `["noisy-a"]`, "noisy-spare"), http.StatusTooManyRequests, "rate_limited")
+
+	// The flood doesn't hold back the other tenant or the internal token.
+	for range 3 {
+		expectStatus(t, withAPIKey(http.MethodPut, "/quiet-worker", "", "quiet-key"), http.StatusNoContent)
+	}
+	for range 5 {
+		expectStatus(t, withAPIKey(http.MethodPut, "/worker", "", "s3cret"), http.StatusNoContent)
+	}
+}
+
+func TestAPIKeyRateLimitWeight(t *testing.T) {
+	setupTest(t, "--api-key", "small-key=small-", "--api-key", "large-key=team/", "--api-key-rate", "1",
+		"--api-key-burst", "2", "--api-key-weight", "team/=2.5")
+	resetLimiters(t)
+
+	// 2.5 times a burst of 2 rounds to 5.
+	for range 5 {
+		expectStatus(t, withAPIKey(http.MethodPut, "/team/worker", "", "large-key"), http.StatusNoContent)
+	}
+	w := withAPIKey(http.MethodPut, "/team/worker", "", "large-key")
+	expectError(t, w, http.StatusTooManyRequests, "rate_limited")
+	var body RateLimitResponse
+	decodeBody(t, w, &body)
+	if body.Error.Limit != 2.5 || body.Error.Burst != 5 {
+		t.Fatalf("expected the weighted bucket to be described, got %+v", body.Error)
+	}
+
+	for range 2 {
+		expectStatus(t, withAPIKey(http.MethodPut, "/small-worker", "", "small-key"), http.StatusNoContent)
+	}
+	expectError(t, withAPIKey(http.MethodPut, "/small-worker", "", "small-key"), http.StatusTooManyRequests, "rate_limited")
+}
+
+func TestAPIKeyRateLimitValidated(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--api-key-rate", "-1"}, "--api-key-rate must not be negative"},
+		{[]string{"--api-key-rate", "1", "--api-key-burst", "0"}, "--api-key-burst must be positive"},
+		{[]string{"--api-key", "k=team/", "--api-key-weight", "team/"}, `invalid --api-key-weight "team/", expected prefix=weight`},
+		{[]string{"--api-key", "k=team/", "--api-key-weight", "team/=0"}, `invalid --api-key-weight "team/=0", weight must be a positive number`},
+		{[]string{"--api-key", "k=team/", "--api-key-weight", "other/=2"}, `invalid --api-key-weight "other/=2", no --api-key is scoped to "other/"`},
+	} {
+		if err := runUntilSignal(t, tc.args...); err == nil || err.Error() != tc.want {
+			t.Errorf("%v: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
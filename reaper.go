@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// retentionExceededHeader marks a check whose ttl outlasts how long the
+// reaper keeps the heartbeat, see --ttl-beyond-retention.
+const retentionExceededHeader = "X-Heartbeat-Retention-Exceeded"
+
+// How a check whose ttl outlasts retention is answered, see
+// --ttl-beyond-retention.
+const (
+	ttlBeyondRetentionWarn   = "warn"
+	ttlBeyondRetentionReject = "reject"
+)
+
+func validTTLBeyondRetentionMode(mode string) error {
+	switch mode {
+	case ttlBeyondRetentionWarn, ttlBeyondRetentionReject:
+		return nil
+	}
+	return fmt.Errorf("invalid ttl beyond retention mode %q, expected %s or %s", mode, ttlBeyondRetentionWarn, ttlBeyondRetentionReject)
+}
+
+// reapRetention returns how long after its last report the reaper keeps a
+// heartbeat with storedTTL, false when it is never reaped.
+func reapRetention(storedTTL sql.NullInt64) (time.Duration, bool) {
+	if cf.ReapInterval <= 0 || !storedTTL.Valid {
+		return 0, false
+	}
+	return max(time.Duration(storedTTL.Int64)*time.Second, cf.MinTTL) + cf.ReapGrace, true
+}
+
+// minReapRetention is the shortest time any reaped heartbeat was kept for,
+// what a check of an unknown id is judged against: stored ttls are at least
+// 1s.
+func minReapRetention() (time.Duration, bool) {
+	return reapRetention(sql.NullInt64{Int64: 1, Valid: true})
+}
+
+// retentionExceeded handles a check whose ttl outlasts retention: the
+// heartbeat may have been reaped, or be reaped, while it is still alive
+// under ttl. Under --ttl-beyond-retention warn the response is marked with
+// retentionExceededHeader, under reject it is answered with 422 and true is
+// returned.
+func retentionExceeded(w http.ResponseWriter, ttl, retention time.Duration) bool {
+	if ttl <= retention {
+		return false
+	}
+	if cf.TTLBeyondRetention == ttlBeyondRetentionReject {
+		writeJSONError(w, http.StatusUnprocessableEntity, "ttl_exceeds_retention",
+			fmt.Sprintf("ttl %s exceeds the %s heartbeats are kept for before being reaped", ttl, retention))
+		return true
+	}
+	w.Header().Set(retentionExceededHeader, "true")
+	return false
+}
+
+// runReaper deletes expired heartbeats, and heartbeat events older than
+// --history-retention, every interval until ctx is done.
+func runReaper(ctx context.Context, interval time.Duration, logger *slog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			removed, err := store.ReapExpired(ctx, cf.ReapGrace, cf.ReapNewGrace, heartbeatNow())
+			if ctx.Err() == nil {
+				reportJobRun("reaper", err)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("failed to reap expired heartbeats", "error", err)
+				}
+				continue
+			}
+			logger.Info("reaped expired heartbeats", "removed", removed)
+
+			if cf.HistoryRetention <= 0 {
+				continue
+			}
+			trimmed, err := store.TrimHistory(ctx, heartbeatNow().Add(-cf.HistoryRetention))
+			if ctx.Err() == nil {
+				reportJobRun("reaper", err)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("failed to trim heartbeat history", "error", err)
+				}
+				continue
+			}
+			logger.Info("trimmed heartbeat history", "removed", trimmed)
+		}
+	}
+}
+
+// ReapExpired raises stored ttls to --min-ttl. Heartbeats without a stored
+// ttl are never reaped, nor are rows whose date is corrupt, as julianday
+// can't interpret it. Rows from before created_at was recorded count as old.
+func (s *sqliteStore) ReapExpired(ctx context.Context, grace, newGrace time.Duration, now time.Time) (int64, error) {
+	defer recordDBTime(ctx, time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stamp := now.Format(storedTimeFormat)
+	args := []any{cf.MinTTL.Seconds(), grace.Seconds(), stamp, newGrace.Seconds(), stamp}
+	_, err = tx.ExecContext(ctx, `
+        DELETE FROM heartbeat_events WHERE EXISTS (
+            SELECT 1 FROM heartbeats
+            WHERE heartbeats.namespace = heartbeat_events.namespace AND heartbeats.id = heartbeat_events.id
+                AND ttl_seconds IS NOT NULL
+                AND julianday(last_updated_at) + (MAX(ttl_seconds, ?) + ?) / 86400.0 < julianday(?)
+                AND (created_at IS NULL OR julianday(created_at) + ? / 86400.0 <= julianday(?))
+        )
+    `, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete heartbeat events: %v", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO heartbeat_tombstones (namespace, id, deleted_at)
+        SELECT namespace, id, ? FROM heartbeats
+        WHERE ttl_seconds IS NOT NULL
+            AND julianday(last_updated_at) + (MAX(ttl_seconds, ?) + ?) / 86400.0 < julianday(?)
+            AND (created_at IS NULL OR julianday(created_at) + ? / 86400.0 <= julianday(?))
+    `, append([]any{stamp}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record reaped heartbeats: %v", err)
+	}
+	if err := pruneTombstones(ctx, tx, now); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `
+        DELETE FROM heartbeats
+        WHERE ttl_seconds IS NOT NULL
+            AND julianday(last_updated_at) + (MAX(ttl_seconds, ?) + ?) / 86400.0 < julianday(?)
+            AND (created_at IS NULL OR julianday(created_at) + ? / 86400.0 <= julianday(?))
+    `, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired heartbeats: %v", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count deleted heartbeats: %v", err)
+	}
+	return removed, tx.Commit()
+}
+
+func (s *sqliteStore) TrimHistory(ctx context.Context, cutoff time.Time) (int64, error) {
+	defer recordDBTime(ctx, time.Now())
+	res, err := s.db.ExecContext(ctx, `
+        DELETE FROM heartbeat_events WHERE julianday(received_at) < julianday(?)
+    `, cutoff.Format(storedTimeFormat))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete heartbeat events: %v", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count deleted heartbeat events: %v", err)
+	}
+	return removed, nil
+}
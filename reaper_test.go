@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runReaperUntil runs the reaper until it logs msg and returns the number
+// of rows that record reports removing.
+func runReaperUntil(t *testing.T, msg string) float64 {
+	t.Helper()
+	logs := &logRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runReaper(ctx, 10*time.Millisecond, logs.logger())
+	}()
+	record := logs.waitFor(t, msg)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected the reaper to stop cleanly, got %v", err)
+	}
+	removed, _ := record["removed"].(float64)
+	return removed
+}
+
+func TestReaper(t *testing.T) {
+	setupTest(t, "--reap-grace", "10m")
+	twoHoursAgo := time.Now().Add(-2 * time.Hour).UTC().Format(storedTimeFormat)
+	insertHeartbeat(t, "dead", twoHoursAgo, sql.NullInt64{Int64: 60, Valid: true})
+	insertHeartbeat(t, "no-ttl", twoHoursAgo, sql.NullInt64{})
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/fresh?ttl=1m", ""), http.StatusNoContent)
+
+	if removed := runReaperUntil(t, "reaped expired heartbeats"); removed != 1 {
+		t.Fatalf("expected 1 heartbeat to be reaped, got %v", removed)
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/dead?ttl=1h", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/fresh", ""), http.StatusOK)
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/no-ttl?ttl=3h", ""), http.StatusOK)
+}
+
+func TestReaperGrace(t *testing.T) {
+	setupTest(t, "--reap-grace", "1h")
+	fiveMinutesAgo := time.Now().Add(-5 * time.Minute).UTC().Format(storedTimeFormat)
+	insertHeartbeat(t, "recent", fiveMinutesAgo, sql.NullInt64{Int64: 60, Valid: true})
+
+	if removed := runReaperUntil(t, "reaped expired heartbeats"); removed != 0 {
+		t.Fatalf("expected a heartbeat within the grace period to survive, got %v removed", removed)
+	}
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/recent?ttl=1h", ""), http.StatusOK)
+}
+
+func TestReaperNewGrace(t *testing.T) {
+	setupTest(t, "--reap-grace", "1m", "--reap-new-grace", "1h")
+	c := useFakeClock(t, time.Now().Add(-3*time.Hour))
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/old?ttl=1m", ""), http.StatusNoContent)
+	c.Advance(150 * time.Minute)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/old?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/new?ttl=1m", ""), http.StatusNoContent)
+	c.Advance(30 * time.Minute)
+
+	// Both went quiet 30 minutes ago, but new was only created then.
+	if removed := runReaperUntil(t, "reaped expired heartbeats"); removed != 1 {
+		t.Fatalf("expected only the old heartbeat to be reaped, got %v", removed)
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/old?ttl=1h", ""), http.StatusNotFound, "not_found")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/new?ttl=1h", ""), http.StatusOK)
+}
+
+func TestReaperTrimsHistory(t *testing.T) {
+	setupTest(t, "--history-retention", "1h")
+	c := useFakeClock(t, time.Now().Add(-2*time.Hour))
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	c.Advance(2 * time.Hour)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	if removed := runReaperUntil(t, "trimmed heartbeat history"); removed != 1 {
+		t.Fatalf("expected 1 arrival to be trimmed, got %v", removed)
+	}
+	history, err := store.History(context.Background(), heartbeatKey{Namespace: defaultNamespace, ID: "worker"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected arrivals older than the retention to be trimmed, got %v", history)
+	}
+}
+
+func TestTTLBeyondRetentionWarns(t *testing.T) {
+	setupTest(t, "--reap-grace", "10m")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/no-ttl", ""), http.StatusNoContent)
+
+	for _, tc := range []struct {
+		target string
+		status int
+		warned bool
+	}{
+		// worker is kept for its 1m ttl plus the 10m grace.
+		{"/worker?ttl=5m", http.StatusOK, false},
+		{"/worker?ttl=1h", http.StatusOK, true},
+		{"/no-ttl?ttl=1h", http.StatusOK, false},
+		{"/missing?ttl=5m", http.StatusNotFound, false},
+		{"/missing?ttl=1h", http.StatusNotFound, true},
+	} {
+		w := serve(externalRouter(), http.MethodGet, tc.target, "")
+		expectStatus(t, w, tc.status)
+		if warned := w.Header().Get(retentionExceededHeader) == "true"; warned != tc.warned {
+			t.Errorf("expected %s to be warned about: %v, got %v", tc.target, tc.warned, warned)
+		}
+	}
+}
+
+func TestTTLBeyondRetentionRejected(t *testing.T) {
+	setupTest(t, "--reap-grace", "10m", "--ttl-beyond-retention", "reject")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=5m", ""), http.StatusOK)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1h", ""), http.StatusUnprocessableEntity, "ttl_exceeds_retention")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/missing?ttl=1h", ""), http.StatusUnprocessableEntity, "ttl_exceeds_retention")
+}
+
+func TestTTLBeyondRetentionWithoutReaper(t *testing.T) {
+	setupTest(t, "--reap-interval", "0", "--reap-grace", "10m")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+
+	// Nothing is reaped, so no ttl can outlast retention.
+	for _, target := range []string{"/worker?ttl=1h", "/missing?ttl=1h"} {
+		if w := serve(externalRouter(), http.MethodGet, target, ""); w.Header().Get(retentionExceededHeader) != "" {
+			t.Fatalf("expected %s not to be warned about without a reaper", target)
+		}
+	}
+}
+
+func TestTTLBeyondRetentionModeValidated(t *testing.T) {
+	if err := runUntilSignal(t, "--ttl-beyond-retention", "ignore"); err == nil || !strings.Contains(err.Error(), "invalid ttl beyond retention mode") {
+		t.Fatalf("expected an unknown mode to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli/v2"
+)
+
+func rebuildCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "rebuild",
+		Usage:  "Rebuild the latest state of every heartbeat from heartbeat_events and exit",
+		Action: runRebuild,
+	}
+}
+
+func runRebuild(cliCtx *cli.Context) error {
+	if cf.DBDriver == dbDriverFS {
+		return fmt.Errorf("rebuild requires --db-driver %s, heartbeat files keep their history inline", dbDriverSQLite)
+	}
+	if err := validIDCollation(cf.IDCollation); err != nil {
+		return err
+	}
+	if err := validDefaultInterval(cf.DefaultInterval); err != nil {
+		return err
+	}
+
+	rebuildDB, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rebuildDB.Close()
+	}()
+
+	rebuilt, err := rebuildHeartbeats(cliCtx.Context, rebuildDB)
+	if err != nil {
+		return err
+	}
+	log.Printf("rebuilt %d heartbeats from heartbeat_events in %s\n", rebuilt, redactQuery(cf.SQLiteDSN))
+	return nil
+}
+
+// rebuiltHeartbeat is the state of a heartbeat its events tell: when it
+// first and last reported.
+type rebuiltHeartbeat struct {
+	key         heartbeatKey
+	first, last string
+}
+
+// rebuildHeartbeats restores the heartbeats table from heartbeat_events, for
+// when the table was lost but the history survived. Each heartbeat with
+// events gets the time of its last one as last_updated_at and of its first
+// as created_at, new rows taking --default-interval as their ttl. Rows that
+// exist keep everything else, including a later last_updated_at. Only what
+// the events record can come back: stored ttls, alert URLs and metadata of
+// lost rows are gone, and so is a heartbeat whose history was trimmed.
+func rebuildHeartbeats(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin rebuild transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Events are only ever appended, so rowid order is arrival order.
+	rows, err := tx.QueryContext(ctx, `
+        SELECT namespace, id, CAST(received_at AS TEXT) FROM heartbeat_events ORDER BY rowid
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query heartbeat events: %v", err)
+	}
+	var (
+		rebuilt []*rebuiltHeartbeat
+		byKey   = map[heartbeatKey]*rebuiltHeartbeat{}
+	)
+	for rows.Next() {
+		var (
+			key        heartbeatKey
+			receivedAt string
+		)
+		if err := rows.Scan(&key.Namespace, &key.ID, &receivedAt); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to scan heartbeat event: %v", err)
+		}
+		if _, _, err := parseStoredTime(receivedAt); err != nil {
+			log.Printf("skipping heartbeat event of %s/%s with a corrupt date %q\n", key.Namespace, key.ID, receivedAt)
+			continue
+		}
+		folded := heartbeatKey{Namespace: key.Namespace, ID: foldID(key.ID)}
+		hb, ok := byKey[folded]
+		if !ok {
+			hb = &rebuiltHeartbeat{key: key, first: receivedAt}
+			byKey[folded] = hb
+			rebuilt = append(rebuilt, hb)
+		}
+		hb.last = receivedAt
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read heartbeat events: %v", err)
+	}
+
+	for _, hb := range rebuilt {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO heartbeats (namespace, id, last_updated_at, created_at, ttl_seconds) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(namespace, id) DO UPDATE SET
+                last_updated_at = CASE
+                    WHEN julianday(excluded.last_updated_at) > julianday(heartbeats.last_updated_at) THEN excluded.last_updated_at
+                    ELSE heartbeats.last_updated_at
+                END,
+                created_at = CASE WHEN heartbeats.pending THEN excluded.created_at ELSE COALESCE(heartbeats.created_at, excluded.created_at) END,
+                pending = 0
+        `, hb.key.Namespace, hb.key.ID, hb.last, hb.first, defaultIntervalSeconds())
+		if err != nil {
+			return 0, fmt.Errorf("failed to rebuild heartbeat %q: %v", hb.key.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit rebuild transaction: %v", err)
+	}
+	return len(rebuilt), nil
+}
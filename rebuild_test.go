@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRebuildHeartbeats(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	reportAt(t, c, start, "worker", 0, 1500*time.Millisecond, time.Minute)
+	reportAt(t, c, start, "team/worker", 30*time.Second)
+	reportAt(t, c, start, "cron", 2*time.Minute)
+	if _, err := db.Exec(`DELETE FROM heartbeats WHERE id = 'worker'`); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := rebuildHeartbeats(context.Background(), db)
+	if err != nil || rebuilt != 3 {
+		t.Fatalf("expected 3 heartbeats to be rebuilt, got %d, %v", rebuilt, err)
+	}
+	for path, want := range map[string]struct{ created, last time.Duration }{
+		"worker":      {0, time.Minute},
+		"team/worker": {30 * time.Second, 30 * time.Second},
+		"cron":        {2 * time.Minute, 2 * time.Minute},
+	} {
+		hb := getHeartbeat(t, path, "?ttl=2h")
+		if !hb.LastUpdatedAt.Equal(start.Add(want.last)) || hb.CreatedAt == nil || !hb.CreatedAt.Equal(start.Add(want.created)) {
+			t.Errorf("expected %s to be rebuilt as created at %v and last updated at %v, got %+v", path, want.created, want.last, hb)
+		}
+	}
+}
+
+func TestRebuildKeepsExistingState(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=5m", `{"metadata": {"v": 1}}`), http.StatusNoContent)
+	reportAt(t, c, start, "worker", time.Minute)
+	// The row was written after its last event, say by a restored backup.
+	if _, err := db.Exec(`UPDATE heartbeats SET last_updated_at = ? WHERE id = 'worker'`, start.Add(2*time.Minute).Format(storedTimeFormat)); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(start.Add(3 * time.Minute))
+
+	if _, err := rebuildHeartbeats(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	hb := getHeartbeat(t, "worker", "")
+	if !hb.LastUpdatedAt.Equal(start.Add(2*time.Minute)) || string(hb.Metadata) != `{"v":1}` {
+		t.Fatalf("expected the existing row to be kept, got %+v", hb)
+	}
+}
+
+func TestRebuildCommand(t *testing.T) {
+	setupTest(t, "--default-interval", "90s")
+	for _, path := range []string{"/worker", "/team/cron"} {
+		expectStatus(t, serve(internalRouter(), http.MethodPut, path, ""), http.StatusNoContent)
+	}
+	if _, err := db.Exec(`DELETE FROM heartbeats`); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newApp()
+	if err := app.Run([]string{cf.AppName, "--db-path", cf.SQLiteDSN, "--default-interval", "90s", "rebuild"}); err != nil {
+		t.Fatalf("expected the rebuild to succeed, got %v", err)
+	}
+	// Rebuilt heartbeats get the default interval as their ttl, so they can
+	// be checked without one.
+	for _, path := range []string{"worker", "team/cron"} {
+		if hb := getHeartbeat(t, path, ""); hb.ExpiresAt == nil || hb.ExpiresAt.Sub(hb.LastUpdatedAt) != 90*time.Second {
+			t.Fatalf("expected %s to be rebuilt with a 90s ttl, got %+v", path, hb)
+		}
+	}
+}
+
+func TestRebuildNocase(t *testing.T) {
+	setupTest(t, "--id-collation", "nocase")
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	reportAt(t, c, start, "Worker", 0)
+	reportAt(t, c, start, "worker", time.Minute)
+	if _, err := db.Exec(`DELETE FROM heartbeats`); err != nil {
+		t.Fatal(err)
+	}
+
+	if rebuilt, err := rebuildHeartbeats(context.Background(), db); err != nil || rebuilt != 1 {
+		t.Fatalf("expected the two spellings to rebuild one heartbeat, got %d, %v", rebuilt, err)
+	}
+	if hb := getHeartbeat(t, "WORKER", "?ttl=2h"); !hb.LastUpdatedAt.Equal(start.Add(time.Minute)) || !hb.CreatedAt.Equal(start) {
+		t.Fatalf("expected the rebuilt heartbeat to span both spellings, got %+v", hb)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteTimeout bounds a single push to --remote-write-url.
+const remoteWriteTimeout = 10 * time.Second
+
+// heartbeatAgeMetric is the series pushed per heartbeat, its value is the
+// number of seconds since the heartbeat was last recorded.
+const heartbeatAgeMetric = "heartbeat_age_seconds"
+
+// runRemoteWrite pushes the age of every heartbeat to --remote-write-url
+// every interval until ctx is done. A failed push is logged and the next one
+// carries fresh samples, so nothing is buffered between runs.
+func runRemoteWrite(ctx context.Context, interval time.Duration, logger *slog.Logger) error {
+	client := &http.Client{Timeout: remoteWriteTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := pushRemoteWrite(ctx, client)
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				logger.Error("failed to push heartbeat ages", "error", err)
+			}
+			reportJobRun("remote-write", err)
+		}
+	}
+}
+
+func pushRemoteWrite(ctx context.Context, client *http.Client) error {
+	snapshot, err := store.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, encodeRemoteWrite(snapshot, heartbeatNow()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cf.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", redactURLError(err))
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write responded with %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// encodeRemoteWrite encodes the age of each heartbeat at now as a
+// prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeRemoteWrite(snapshot Snapshot, now time.Time) []byte {
+	var req []byte
+	for _, hb := range snapshot.Heartbeats {
+		var series []byte
+		// Labels must be sorted by name.
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, encodeLabel("__name__", heartbeatAgeMetric))
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, encodeLabel("id", hb.ID))
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, encodeLabel("namespace", hb.Namespace))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, encodeSample(now.Sub(hb.LastUpdatedAt).Seconds(), now.UnixMilli()))
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
+
+func encodeLabel(name, value string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, value)
+	return b
+}
+
+func encodeSample(value float64, timestampMillis int64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(value))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(timestampMillis))
+	return b
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSeries is a decoded prometheus.TimeSeries with a single sample.
+type remoteWriteSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeRemoteWrite decodes a prometheus.WriteRequest, failing on anything
+// other than the fields a remote-write receiver reads.
+func decodeRemoteWrite(t *testing.T, b []byte) []remoteWriteSeries {
+	t.Helper()
+	var series []remoteWriteSeries
+	eachField(t, b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected WriteRequest field %d of type %d", num, typ)
+		}
+		s := remoteWriteSeries{labels: map[string]string{}}
+		samples := 0
+		eachField(t, v, func(num protowire.Number, typ protowire.Type, v []byte) {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				var name, value string
+				eachField(t, v, func(num protowire.Number, _ protowire.Type, v []byte) {
+					switch num {
+					case 1:
+						name = string(v)
+					case 2:
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+			case num == 2 && typ == protowire.BytesType:
+				samples++
+				eachField(t, v, func(num protowire.Number, typ protowire.Type, v []byte) {
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						bits, _ := protowire.ConsumeFixed64(v)
+						s.value = math.Float64frombits(bits)
+					case num == 2 && typ == protowire.VarintType:
+						ts, _ := protowire.ConsumeVarint(v)
+						s.timestamp = int64(ts)
+					default:
+						t.Fatalf("unexpected Sample field %d of type %d", num, typ)
+					}
+				})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d of type %d", num, typ)
+			}
+		})
+		if samples != 1 {
+			t.Fatalf("expected a single sample per series, got %d", samples)
+		}
+		series = append(series, s)
+	})
+	return series
+}
+
+// eachField calls fn with every field of the protobuf message b. Bytes
+// fields are passed their contents, scalar fields their raw encoding.
+func eachField(t *testing.T, b []byte, fn func(protowire.Number, protowire.Type, []byte)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		size := protowire.ConsumeFieldValue(num, typ, b)
+		if size < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(size))
+		}
+		v := b[:size]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		fn(num, typ, v)
+		b = b[size:]
+	}
+}
+
+func TestEncodeRemoteWriteDecodes(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	snapshot := Snapshot{Heartbeats: []Heartbeat{
+		{Namespace: defaultNamespace, ID: "api", LastUpdatedAt: now.Add(-90 * time.Second)},
+		{Namespace: "team", ID: "worker", LastUpdatedAt: now.Add(-1500 * time.Millisecond)},
+	}}
+
+	series := decodeRemoteWrite(t, encodeRemoteWrite(snapshot, now))
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	for i, want := range []struct {
+		namespace, id string
+		age           float64
+	}{
+		{defaultNamespace, "api", 90},
+		{"team", "worker", 1.5},
+	} {
+		s := series[i]
+		if s.labels["__name__"] != heartbeatAgeMetric || s.labels["namespace"] != want.namespace || s.labels["id"] != want.id || len(s.labels) != 3 {
+			t.Errorf("series %d: unexpected labels %v", i, s.labels)
+		}
+		if s.value != want.age || s.timestamp != now.UnixMilli() {
+			t.Errorf("series %d: expected age %v at %d, got %v at %d", i, want.age, now.UnixMilli(), s.value, s.timestamp)
+		}
+	}
+}
+
+func TestPushRemoteWrite(t *testing.T) {
+	received := make(chan []remoteWriteSeries, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Prometheus-Remote-Write-Version") == "" {
+			t.Errorf("unexpected remote-write headers %v", r.Header)
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("failed to decompress payload: %v", err)
+		}
+		received <- decodeRemoteWrite(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	setupTest(t, "--remote-write-url", receiver.URL)
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/api", ""), http.StatusNoContent)
+	c.Advance(30 * time.Second)
+
+	if err := pushRemoteWrite(context.Background(), http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	series := <-received
+	if len(series) != 1 || series[0].labels["id"] != "api" || math.Abs(series[0].value-30) > 0.001 {
+		t.Fatalf("expected api to be pushed 30s old, got %+v", series)
+	}
+}
+
+func TestPushRemoteWriteRejected(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+	setupTest(t, "--remote-write-url", receiver.URL)
+
+	err := pushRemoteWrite(context.Background(), http.DefaultClient)
+	if want := fmt.Sprintf("remote write responded with %d %s: out of order sample", http.StatusBadRequest, http.StatusText(http.StatusBadRequest)); err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type requestLogKey struct{}
+
+// requestLogEntry collects what is logged about a request once it is served.
+type requestLogEntry struct {
+	namespace string
+	id        string
+}
+
+// statusResponseWriter records the status code of a response, including the
+// implicit 200 of a handler that only writes a body.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withRequestLog logs the method, path, heartbeat key, status and duration of
+// every request handled by next. It wraps the whole middleware chain, so
+// requests rejected before reaching the router are logged too.
+func withRequestLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLogEntry{}
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry)))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", status, "duration", time.Since(start).String()}
+		if entry.namespace != "" {
+			attrs = append(attrs, "namespace", entry.namespace)
+		}
+		if entry.id != "" {
+			attrs = append(attrs, "id", entry.id)
+		}
+		logger.Info("handled request", attrs...)
+	})
+}
+
+// logRouteID records the key the router resolved for a request in its log
+// entry. The mux stores path values on the request it is given, so they can
+// only be read once it has routed.
+func logRouteID(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if entry, ok := r.Context().Value(requestLogKey{}).(*requestLogEntry); ok {
+			entry.namespace, entry.id = r.PathValue("namespace"), r.PathValue("id")
+		}
+	})
+}
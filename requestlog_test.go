@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestLogRecordsNotFound(t *testing.T) {
+	setupTest(t)
+	var logs logRecorder
+	h := withRequestLog(logs.logger(), externalRouter())
+
+	expectStatus(t, serve(h, http.MethodGet, "/missing?ttl=1m", ""), http.StatusNotFound)
+	record := logs.waitFor(t, "handled request")
+	if record["status"] != float64(http.StatusNotFound) {
+		t.Fatalf("expected status 404 to be logged, got %v", record["status"])
+	}
+	if record["method"] != http.MethodGet || record["path"] != "/missing" || record["id"] != "missing" || record["namespace"] != nil {
+		t.Fatalf("unexpected request log %v", record)
+	}
+	if _, ok := record["duration"].(string); !ok {
+		t.Fatalf("expected a duration, got %v", record)
+	}
+}
+
+func TestRequestLogRecordsUnroutedPath(t *testing.T) {
+	setupTest(t)
+	var logs logRecorder
+	h := withRequestLog(logs.logger(), externalRouter())
+
+	// The mux answers with http.Error, which must be captured as well.
+	expectStatus(t, serve(h, http.MethodGet, "/a/b/c", ""), http.StatusNotFound)
+	if record := logs.waitFor(t, "handled request"); record["status"] != float64(http.StatusNotFound) || record["id"] != nil {
+		t.Fatalf("expected status 404 without an id, got %v", record)
+	}
+}
+
+func TestRequestLogRecordsImplicitOK(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team/worker", ""), http.StatusNoContent)
+	var logs logRecorder
+	h := withRequestLog(logs.logger(), externalRouter())
+
+	expectStatus(t, serve(h, http.MethodGet, "/team/worker?ttl=1m", ""), http.StatusOK)
+	record := logs.waitFor(t, "handled request")
+	if record["status"] != float64(http.StatusOK) || record["namespace"] != "team" || record["id"] != "worker" {
+		t.Fatalf("expected status 200 for team/worker, got %v", record)
+	}
+}
+
+func TestInvalidLogLevel(t *testing.T) {
+	err := runUntilSignal(t, "--log-level", "loud")
+	if err == nil || err.Error() != `invalid log level "loud", expected debug, info, warn or error` {
+		t.Fatalf("expected the log level to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const s3ExportAttempts = 3
+
+// s3Exporter periodically uploads a snapshot of all heartbeats to an
+// S3-compatible bucket, one object per run under a timestamped key.
+type s3Exporter struct {
+	client *minio.Client
+	logger *slog.Logger
+}
+
+func newS3Exporter(logger *slog.Logger) (*s3Exporter, error) {
+	if err := validExportFormat(cf.S3ExportFormat); err != nil {
+		return nil, err
+	}
+	if cf.S3ExportInterval <= 0 {
+		return nil, fmt.Errorf("s3 export interval must be positive")
+	}
+
+	client, err := minio.New(cf.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cf.S3AccessKey, cf.S3SecretKey, ""),
+		Secure: cf.S3UseSSL,
+		Region: cf.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %v", err)
+	}
+
+	return &s3Exporter{client: client, logger: logger}, nil
+}
+
+// Run exports a snapshot every --s3-export-interval until ctx is done. A
+// failed export is logged and retried on the next tick.
+func (e *s3Exporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(cf.S3ExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := e.export(ctx)
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				e.logger.Error("failed to export heartbeats", "error", err)
+			}
+			reportJobRun("s3-export", err)
+		}
+	}
+}
+
+func (e *s3Exporter) export(ctx context.Context) error {
+	snapshot, err := store.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	body, err := encodeExport(snapshot, cf.S3ExportFormat)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s.%s", cf.S3KeyPrefix, snapshot.TakenAt.Format("20060102T150405Z"), cf.S3ExportFormat)
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		_, err = e.client.PutObject(ctx, cf.S3Bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+			ContentType: exportContentType(cf.S3ExportFormat),
+		})
+		if err == nil {
+			e.logger.Info("exported heartbeats", "bucket", cf.S3Bucket, "key", key, "count", len(snapshot.Heartbeats))
+			return nil
+		}
+		if attempt == s3ExportAttempts {
+			return fmt.Errorf("failed to upload %s after %d attempts: %v", key, attempt, err)
+		}
+
+		e.logger.Warn("failed to upload export, retrying", "key", key, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
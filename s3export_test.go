@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// s3Upload is an object written to the mock S3 endpoint.
+type s3Upload struct {
+	path        string
+	contentType string
+	body        string
+}
+
+// mockS3 is an S3-compatible endpoint accepting PutObject requests. The
+// first failures requests are denied.
+type mockS3 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	uploads  []s3Upload
+}
+
+func newMockS3(t *testing.T, failures int) *mockS3 {
+	t.Helper()
+	m := &mockS3{failures: failures}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body, err = decodeAWSChunked(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.attempts++
+		if m.attempts <= m.failures {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+			return
+		}
+		m.uploads = append(m.uploads, s3Upload{path: r.URL.Path, contentType: r.Header.Get("Content-Type"), body: string(body)})
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// decodeAWSChunked strips the chunk framing of a streaming signed upload,
+// "<size>;chunk-signature=<sig>\r\n<data>\r\n" repeated until a 0 size.
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	var out []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, fmt.Errorf("truncated chunk header")
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size+2 {
+			return nil, fmt.Errorf("invalid chunk header %q", header)
+		}
+		if size == 0 {
+			return out, nil
+		}
+		out = append(out, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+// exportTo runs a single export to the bucket backups on m.
+func exportTo(t *testing.T, m *mockS3) error {
+	t.Helper()
+	cf.S3Endpoint = strings.TrimPrefix(m.URL, "http://")
+	cf.S3Bucket = "backups"
+	cf.S3Region = "us-east-1"
+	cf.S3AccessKey, cf.S3SecretKey = "access", "secret"
+	cf.S3UseSSL = false
+	exporter, err := newS3Exporter(slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter.export(context.Background())
+}
+
+func TestS3ExportNDJSON(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/team/web", ""), http.StatusNoContent)
+	m := newMockS3(t, 0)
+
+	if err := exportTo(t, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.uploads) != 1 {
+		t.Fatalf("expected a single upload, got %d", len(m.uploads))
+	}
+	upload := m.uploads[0]
+	if !strings.HasPrefix(upload.path, "/backups/heartbeats/") || !strings.HasSuffix(upload.path, "Z.ndjson") {
+		t.Fatalf("expected a timestamped key in the bucket, got %s", upload.path)
+	}
+	if upload.contentType != "application/x-ndjson" {
+		t.Fatalf("expected an NDJSON content type, got %q", upload.contentType)
+	}
+	lines := strings.Split(strings.TrimSpace(upload.body), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":"worker"`) || !strings.Contains(lines[1], `"id":"web"`) {
+		t.Fatalf("unexpected payload %q", upload.body)
+	}
+}
+
+func TestS3ExportCSV(t *testing.T) {
+	setupTest(t, "--s3-export-format", "csv", "--s3-key-prefix", "nightly/")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	m := newMockS3(t, 0)
+
+	if err := exportTo(t, m); err != nil {
+		t.Fatal(err)
+	}
+	upload := m.uploads[0]
+	if !strings.HasPrefix(upload.path, "/backups/nightly/") || !strings.HasSuffix(upload.path, ".csv") {
+		t.Fatalf("expected a csv key under the prefix, got %s", upload.path)
+	}
+	if !strings.HasPrefix(upload.body, "namespace,id,last_updated_at\ndefault,worker,") {
+		t.Fatalf("unexpected payload %q", upload.body)
+	}
+}
+
+func TestS3ExportRetries(t *testing.T) {
+	setupTest(t)
+	m := newMockS3(t, 1)
+
+	if err := exportTo(t, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.attempts != 2 || len(m.uploads) != 1 {
+		t.Fatalf("expected the upload to succeed on the second attempt, got %d attempts", m.attempts)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ScanResult is the outcome of a stale scan started through POST /admin/scan.
+type ScanResult struct {
+	// Stale holds every heartbeat past its stored ttl, notified before or not.
+	Stale []heartbeatKey `json:"stale"`
+	// Notified holds the heartbeats an expiry notification was delivered for
+	// by this scan.
+	Notified []heartbeatKey `json:"notified"`
+	// Error describes the first failed delivery, which a scan or notifier run
+	// retries once its backoff has passed.
+	Error string `json:"error,omitempty"`
+}
+
+// handlePostScan runs the expiry notifier's pass synchronously, so stale
+// heartbeats can be checked and alerted on without waiting for
+// --expiry-check-interval.
+func handlePostScan(w http.ResponseWriter, r *http.Request) {
+	stale, err := store.Stale(r.Context(), heartbeatNow())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	client := &http.Client{Timeout: cf.ExpiryWebhookTimeout}
+	result := ScanResult{Stale: stale}
+	result.Notified, err = notifyExpired(r.Context(), client, slog.Default())
+	if result.Notified == nil {
+		result.Notified = []heartbeatKey{}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+// Stale raises stored ttls to --min-ttl.
+func (s *sqliteStore) Stale(ctx context.Context, now time.Time) ([]heartbeatKey, error) {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT namespace, id FROM heartbeats
+        WHERE ttl_seconds IS NOT NULL
+            AND julianday(last_updated_at) + MAX(ttl_seconds, ?) / 86400.0 < julianday(?)
+        ORDER BY namespace, id
+    `, cf.MinTTL.Seconds(), now.Format(storedTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stale heartbeats: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	stale := []heartbeatKey{}
+	for rows.Next() {
+		var key heartbeatKey
+		if err := rows.Scan(&key.Namespace, &key.ID); err != nil {
+			return nil, fmt.Errorf("failed to scan heartbeat: %v", err)
+		}
+		stale = append(stale, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+	return stale, nil
+}
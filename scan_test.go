@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func postScan(t *testing.T, h http.Handler) ScanResult {
+	t.Helper()
+	w := serve(h, http.MethodPost, "/admin/scan", "")
+	expectStatus(t, w, http.StatusOK)
+	var result ScanResult
+	decodeBody(t, w, &result)
+	return result
+}
+
+func TestScanFiresAlertsForStaleRows(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--admin-scan", "--expiry-webhook-url", hook.URL)
+	h := internalRouter()
+	insertExpired(t, "api")
+	insertExpired(t, "worker")
+	expectStatus(t, serve(h, http.MethodPut, "/live?ttl=1m", ""), http.StatusNoContent)
+
+	result := postScan(t, h)
+	want := []heartbeatKey{{Namespace: defaultNamespace, ID: "api"}, {Namespace: defaultNamespace, ID: "worker"}}
+	if !slices.Equal(result.Stale, want) || !slices.Equal(result.Notified, want) || result.Error != "" {
+		t.Fatalf("expected api and worker to be found stale and notified, got %+v", result)
+	}
+	if ids := hook.ids(); !slices.Equal(ids, []string{"api", "worker"}) {
+		t.Fatalf("expected an alert for each stale heartbeat, got %v", ids)
+	}
+
+	// A second scan still reports them stale, but doesn't alert again.
+	result = postScan(t, h)
+	if !slices.Equal(result.Stale, want) || len(result.Notified) != 0 {
+		t.Fatalf("expected no new alerts, got %+v", result)
+	}
+	if ids := hook.ids(); len(ids) != 2 {
+		t.Fatalf("expected no further alerts, got %v", ids)
+	}
+}
+
+func TestScanReportsFailedDelivery(t *testing.T) {
+	setupTest(t, "--admin-scan", "--expiry-webhook-url", "http://127.0.0.1:1/expired")
+	insertExpired(t, "api")
+
+	result := postScan(t, internalRouter())
+	if len(result.Stale) != 1 || len(result.Notified) != 0 || result.Error == "" {
+		t.Fatalf("expected the failed delivery to be reported, got %+v", result)
+	}
+}
+
+func TestScanDisabled(t *testing.T) {
+	setupTest(t, "--expiry-webhook-url", "http://127.0.0.1:1/expired")
+
+	// Without --admin-scan the path falls through to the heartbeat route,
+	// which refuses the reserved namespace.
+	expectError(t, serve(internalRouter(), http.MethodPost, "/admin/scan", ""), http.StatusBadRequest, "reserved_namespace")
+}
+
+func TestScanRequiresInternalToken(t *testing.T) {
+	setupTest(t, "--admin-scan", "--internal-token", "s3cret")
+
+	expectError(t, serve(requireInternalToken(internalRouter()), http.MethodPost, "/admin/scan", ""), http.StatusUnauthorized, "unauthorized")
+}
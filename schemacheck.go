@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// tableColumn is a column as reported by PRAGMA table_info.
+type tableColumn struct {
+	name       string
+	notNull    bool
+	hasDefault bool
+	primaryKey bool
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]tableColumn, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %v", table, err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns := map[string]tableColumn{}
+	for rows.Next() {
+		var (
+			cid          int
+			name, ctype  string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("failed to scan column of %s: %v", table, err)
+		}
+		columns[name] = tableColumn{name: name, notNull: notNull != 0, hasDefault: defaultValue.Valid, primaryKey: pk != 0}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %v", table, err)
+	}
+	return columns, nil
+}
+
+// checkTable verifies that table, if it exists, can be used by the collector:
+// it has every expected column, the primaryKey columns form its primary key,
+// and any other column can be left out of inserts. A table that fails this
+// most likely belongs to another application sharing the database file.
+func checkTable(db *sql.DB, table string, primaryKey, expected []string) error {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	mismatch := func(reason string, args ...any) error {
+		return fmt.Errorf("existing %s table does not match the expected schema, %s; is the database shared with another application?", table, fmt.Sprintf(reason, args...))
+	}
+
+	known := map[string]bool{}
+	for _, name := range expected {
+		known[name] = true
+		if _, ok := columns[name]; !ok {
+			return mismatch("column %s is missing", name)
+		}
+	}
+	keyColumns := map[string]bool{}
+	for _, name := range primaryKey {
+		keyColumns[name] = true
+		if !columns[name].primaryKey {
+			return mismatch("column %s is not part of its primary key", name)
+		}
+	}
+	for name, c := range columns {
+		if c.primaryKey && !keyColumns[name] {
+			return mismatch("column %s is part of its primary key", name)
+		}
+		if !known[name] && c.notNull && !c.hasDefault {
+			return mismatch("unknown column %s is required", name)
+		}
+	}
+	return nil
+}
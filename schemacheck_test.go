@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncompatibleTableFailsStartup(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "missing column",
+			schema: `CREATE TABLE heartbeats (id TEXT PRIMARY KEY, host TEXT)`,
+			want:   "column last_updated_at is missing",
+		},
+		{
+			name:   "different primary key",
+			schema: `CREATE TABLE heartbeats (rowid_ INTEGER PRIMARY KEY, id TEXT, last_updated_at DATETIME)`,
+			want:   "column id is not part of its primary key",
+		},
+		{
+			name:   "required unknown column",
+			schema: `CREATE TABLE heartbeats (id TEXT PRIMARY KEY, last_updated_at DATETIME NOT NULL, owner TEXT NOT NULL)`,
+			want:   "unknown column owner is required",
+		},
+		{
+			name:   "settings",
+			schema: `CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT)`,
+			want:   "existing settings table",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			db, err := sql.Open(sqliteDriverName, filepath.Join(t.TempDir(), "shared.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec(tt.schema); err != nil {
+				t.Fatal(err)
+			}
+
+			err = initSchema(db)
+			if err == nil {
+				t.Fatal("expected the incompatible table to be rejected")
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "shared with another application") {
+				t.Fatalf("expected a clear schema mismatch error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestCompatibleTableWithExtraColumns(t *testing.T) {
+	setupTest(t)
+	db, err := sql.Open(sqliteDriverName, filepath.Join(t.TempDir(), "shared.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE heartbeats (id TEXT PRIMARY KEY, last_updated_at DATETIME NOT NULL, note TEXT)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initSchema(db); err != nil {
+		t.Fatalf("expected an optional extra column to be tolerated, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type SeedHeartbeat struct {
+	Namespace string `json:"namespace,omitempty"`
+	ID        string `json:"id"`
+	Interval  string `json:"interval,omitempty"`
+}
+
+// seedHeartbeats inserts the heartbeats listed in path when the table is
+// empty. Seeded heartbeats are stamped with the current time, giving each
+// service one interval to start reporting. It reports whether seeding ran.
+func seedHeartbeats(db *sql.DB, path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read seed file: %v", err)
+	}
+	var seeds []SeedHeartbeat
+	if err := json.Unmarshal(data, &seeds); err != nil {
+		return false, fmt.Errorf("failed to parse seed file: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin seed transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM heartbeats`).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to count heartbeats: %v", err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	now := truncateTimestamp(heartbeatNow()).Format(storedTimeFormat)
+	for i, seed := range seeds {
+		seed.ID = normalizeID(seed.ID)
+		if seed.ID == "" {
+			return false, fmt.Errorf("seed %d has no id", i)
+		}
+		seed.Namespace = normalizeID(seed.Namespace)
+		if seed.Namespace == "" {
+			seed.Namespace = defaultNamespace
+		}
+		if code, message := reservedKey(heartbeatKey{Namespace: seed.Namespace, ID: seed.ID}); code != "" {
+			return false, fmt.Errorf("seed %d: %s", i, message)
+		}
+		var interval sql.NullInt64
+		if seed.Interval != "" {
+			d, err := parseTTL(seed.Interval, cf.StrictTTLUnits)
+			if err != nil || d < time.Second {
+				return false, fmt.Errorf("seed %q has an invalid interval %q", seed.ID, seed.Interval)
+			}
+			interval = sql.NullInt64{Int64: int64(d / time.Second), Valid: true}
+		}
+		_, err := tx.Exec(`
+            INSERT INTO heartbeats (namespace, id, last_updated_at, ttl_seconds, created_at) VALUES (?, ?, ?, ?, ?)
+        `, seed.Namespace, seed.ID, now, interval, now)
+		if err != nil {
+			return false, fmt.Errorf("failed to seed heartbeat %q: %v", seed.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit seed transaction: %v", err)
+	}
+	return true, nil
+}
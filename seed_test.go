@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSeedFile writes content to a seed file in a temporary directory.
+func writeSeedFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSeedEmptyDatabase(t *testing.T) {
+	setupTest(t)
+	path := writeSeedFile(t, `[{"id":"worker","interval":"5m"},{"namespace":"team","id":"web.api"}]`)
+
+	seeded, err := seedHeartbeats(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !seeded {
+		t.Fatal("expected an empty database to be seeded")
+	}
+	if ttl := storedTTL(t, "worker"); ttl.Int64 != 300 {
+		t.Fatalf("expected the seeded interval of 300s, got %+v", ttl)
+	}
+	getHeartbeat(t, "worker", "")
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/team/web.api?ttl=1m", ""), http.StatusOK)
+}
+
+func TestSeedSkipsPopulatedDatabase(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/existing", ""), http.StatusNoContent)
+	path := writeSeedFile(t, `[{"id":"worker","interval":"5m"}]`)
+
+	seeded, err := seedHeartbeats(db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeded {
+		t.Fatal("expected seeding to be skipped when heartbeats exist")
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
+
+func TestSeedInvalid(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`[{"interval":"5m"}]`,
+		`[{"id":"worker","interval":"soon"}]`,
+		`[{"namespace":"admin","id":"worker"}]`,
+	} {
+		setupTest(t)
+		if _, err := seedHeartbeats(db, writeSeedFile(t, content)); err == nil {
+			t.Errorf("expected seed file %s to be rejected", content)
+		}
+	}
+	setupTest(t)
+	if _, err := seedHeartbeats(db, writeSeedFile(t, `[{"id":"a"},{"id":"b","interval":"soon"}]`)); err == nil {
+		t.Fatal("expected the seed file to be rejected")
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/a?ttl=1m", ""), http.StatusNotFound, "not_found")
+}
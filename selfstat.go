@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// SelfStat is a quick view of the collector's own resource usage.
+type SelfStat struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapSysBytes   uint64 `json:"heap_sys_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	NumGC          uint32 `json:"num_gc"`
+	DBOpen         int    `json:"db_open_connections"`
+	DBInUse        int    `json:"db_in_use_connections"`
+	DBIdle         int    `json:"db_idle_connections"`
+	InFlight       int64  `json:"in_flight_requests"`
+}
+
+func handleGetSelfStat(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	// With --db-driver fs there is no connection pool to report.
+	var dbStats sql.DBStats
+	if db != nil {
+		dbStats = db.Stats()
+	}
+
+	stat := SelfStat{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapSysBytes:   mem.HeapSys,
+		HeapObjects:    mem.HeapObjects,
+		NumGC:          mem.NumGC,
+		DBOpen:         dbStats.OpenConnections,
+		DBInUse:        dbStats.InUse,
+		DBIdle:         dbStats.Idle,
+		InFlight:       inFlight.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stat); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func getSelfStat(t *testing.T) SelfStat {
+	t.Helper()
+	w := serve(internalRouter(), http.MethodGet, "/selfstat", "")
+	expectStatus(t, w, http.StatusOK)
+	var stat SelfStat
+	decodeBody(t, w, &stat)
+	return stat
+}
+
+func TestSelfStatPlausible(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	runtime.GC()
+
+	stat := getSelfStat(t)
+	if stat.Goroutines < 1 {
+		t.Errorf("expected at least one goroutine, got %d", stat.Goroutines)
+	}
+	if stat.HeapAllocBytes == 0 || stat.HeapAllocBytes > stat.HeapSysBytes {
+		t.Errorf("expected a heap in use within the heap obtained, got %d of %d", stat.HeapAllocBytes, stat.HeapSysBytes)
+	}
+	if stat.HeapObjects == 0 || stat.NumGC == 0 {
+		t.Errorf("expected live objects and a GC cycle, got %d objects, %d cycles", stat.HeapObjects, stat.NumGC)
+	}
+	if stat.DBOpen < 1 || stat.DBInUse != 0 || stat.DBIdle != stat.DBOpen {
+		t.Errorf("expected idle open connections after the PUT, got %d open, %d in use, %d idle", stat.DBOpen, stat.DBInUse, stat.DBIdle)
+	}
+	if stat.InFlight != 0 {
+		t.Errorf("expected no in-flight requests outside the middleware, got %d", stat.InFlight)
+	}
+}
+
+func TestSelfStatCountsConnectionsInUse(t *testing.T) {
+	setupTest(t)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stat := getSelfStat(t)
+	if stat.DBInUse != 1 || stat.DBOpen != stat.DBInUse+stat.DBIdle {
+		t.Fatalf("expected the held connection in use, got %d open, %d in use, %d idle", stat.DBOpen, stat.DBInUse, stat.DBIdle)
+	}
+}
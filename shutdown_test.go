@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServer serves handler on a local port until the test ends.
+func startServer(t *testing.T, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return server, "http://" + ln.Addr().String()
+}
+
+func TestShutdownTimesOutOnHungRequest(t *testing.T) {
+	setupTest(t, "--shutdown-timeout", "100ms")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+
+	requestErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		requestErr <- err
+	}()
+	<-entered
+
+	var logs logRecorder
+	started := time.Now()
+	shutdownServer(server, logs.logger(), "test server")
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected shutdown to give up after the timeout, took %v", elapsed)
+	}
+	record := logs.waitFor(t, "test server shutdown timed out, closing remaining connections")
+	if record["level"] != "WARN" || record["timeout"] != "100ms" {
+		t.Fatalf("expected a warning with the timeout, got %v", record)
+	}
+	select {
+	case err := <-requestErr:
+		if err == nil {
+			t.Fatal("expected the hung request's connection to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the hung request's connection to be closed")
+	}
+}
+
+func TestShutdownDrainsInFlightRequest(t *testing.T) {
+	setupTest(t, "--shutdown-timeout", "5s")
+	entered := make(chan struct{})
+	server, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-entered
+
+	var logs logRecorder
+	shutdownServer(server, logs.logger(), "test server")
+	logs.waitFor(t, "test server shutdown")
+	if code := <-status; code != http.StatusNoContent {
+		t.Fatalf("expected the in-flight request to complete, got %d", code)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultSLAWindow = 7 * 24 * time.Hour
+
+// HeartbeatSLA is the availability of a heartbeat over a window, the share
+// of it the heartbeat was alive under its ttl, against its SLA target. Both
+// are percentages.
+type HeartbeatSLA struct {
+	Namespace              string  `json:"namespace"`
+	ID                     string  `json:"id"`
+	WindowSeconds          float64 `json:"window_seconds"`
+	TTLSeconds             float64 `json:"ttl_seconds"`
+	Target                 float64 `json:"target"`
+	Availability           float64 `json:"availability"`
+	DowntimeSeconds        float64 `json:"downtime_seconds"`
+	AllowedDowntimeSeconds float64 `json:"allowed_downtime_seconds"`
+	Breached               bool    `json:"breached"`
+}
+
+// parseSLATarget parses an availability target in percent.
+func parseSLATarget(v string) (float64, error) {
+	target, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(target > 0 && target <= 100) {
+		return 0, errors.New("must be a percentage above 0 and at most 100")
+	}
+	return target, nil
+}
+
+// handleGetSLA replays the arrivals of a heartbeat over ?window= (7 days by
+// default) under the ttl a check would use and reports whether its
+// availability has fallen below its target: ?target=, or the sla it was
+// reported with. A heartbeat created inside the window is judged from its
+// creation on.
+func handleGetSLA(w http.ResponseWriter, r *http.Request) {
+	hb, ok := windowHeartbeat(w, r)
+	if !ok {
+		return
+	}
+	window, ok := historyWindow(w, r, defaultSLAWindow)
+	if !ok {
+		return
+	}
+	ttl, ok := windowTTL(w, r, hb)
+	if !ok {
+		return
+	}
+	target := hb.SLATarget.Float64
+	if v := r.URL.Query().Get("target"); v != "" {
+		var err error
+		if target, err = parseSLATarget(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_target", "target query parameter "+err.Error())
+			return
+		}
+	} else if !hb.SLATarget.Valid {
+		writeJSONError(w, http.StatusBadRequest, "missing_target", "target query parameter is required for a heartbeat reported without an sla")
+		return
+	}
+
+	now := heartbeatNow()
+	start := now.Add(-window)
+	if hb.CreatedAt.After(start) {
+		start = hb.CreatedAt
+	}
+	replay := &availabilityReplay{start: start, ttl: ttl}
+	if err := store.Arrivals(r.Context(), heartbeatKey{Namespace: hb.Namespace, ID: hb.ID}, start.Add(-ttl), replay.arrive); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to read heartbeat events: %v", err))
+		return
+	}
+	alive := replay.finish(now)
+
+	judged := now.Sub(start)
+	availability := 100.0
+	if judged > 0 {
+		availability = 100 * alive.Seconds() / judged.Seconds()
+	}
+	writeWindowResponse(w, HeartbeatSLA{
+		Namespace:              hb.Namespace,
+		ID:                     hb.ID,
+		WindowSeconds:          window.Seconds(),
+		TTLSeconds:             ttl.Seconds(),
+		Target:                 target,
+		Availability:           availability,
+		DowntimeSeconds:        (judged - alive).Seconds(),
+		AllowedDowntimeSeconds: judged.Seconds() * (100 - target) / 100,
+		Breached:               availability < target,
+	})
+}
+
+// availabilityReplay adds up the time at or after start a heartbeat was
+// alive, each arrival keeping it alive for ttl or until the next one. Like
+// flapReplay, it must be fed arrivals from ttl before start on.
+type availabilityReplay struct {
+	start time.Time
+	ttl   time.Duration
+	last  time.Time
+	alive time.Duration
+}
+
+func (a *availabilityReplay) arrive(at time.Time) error {
+	if !a.last.IsZero() {
+		a.cover(at)
+	}
+	a.last = at
+	return nil
+}
+
+// finish returns the alive time up to now.
+func (a *availabilityReplay) finish(now time.Time) time.Duration {
+	if !a.last.IsZero() {
+		a.cover(now)
+	}
+	return a.alive
+}
+
+// cover adds the time the last arrival kept the heartbeat alive before
+// until.
+func (a *availabilityReplay) cover(until time.Time) {
+	from := a.last
+	if from.Before(a.start) {
+		from = a.start
+	}
+	if end := a.last.Add(a.ttl); end.Before(until) {
+		until = end
+	}
+	if until.After(from) {
+		a.alive += until.Sub(from)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getSLA(t *testing.T, path, query string) HeartbeatSLA {
+	t.Helper()
+	w := serve(externalRouter(), http.MethodGet, "/"+path+"/sla"+query, "")
+	expectStatus(t, w, http.StatusOK)
+	var sla HeartbeatSLA
+	decodeBody(t, w, &sla)
+	return sla
+}
+
+func TestSLA(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m&sla=99", ""), http.StatusNoContent)
+	// Reports every minute for 100 minutes but misses the one at 50m, so
+	// the 1m ttl runs out a minute before the report at 51m.
+	var offsets []time.Duration
+	for i := 1; i <= 100; i++ {
+		if i != 50 {
+			offsets = append(offsets, time.Duration(i)*time.Minute)
+		}
+	}
+	reportAt(t, c, start, "worker", offsets...)
+	c.Set(start.Add(100 * time.Minute))
+
+	sla := getSLA(t, "worker", "")
+	if sla.Target != 99 || sla.TTLSeconds != 60 || sla.DowntimeSeconds != 60 {
+		t.Fatalf("expected a minute of downtime against the stored target, got %+v", sla)
+	}
+	// Created 100 minutes ago, so judged over those only.
+	if sla.Availability != 99 || sla.AllowedDowntimeSeconds != 60 || sla.Breached {
+		t.Fatalf("expected 99%% availability, right at the target, got %+v", sla)
+	}
+
+	if sla := getSLA(t, "worker", "?target=99.5"); !sla.Breached || sla.Target != 99.5 {
+		t.Fatalf("expected a stricter target to be breached, got %+v", sla)
+	}
+	// The last 40 minutes hold no downtime.
+	if sla := getSLA(t, "worker", "?window=40m"); sla.Availability != 100 || sla.DowntimeSeconds != 0 || sla.Breached {
+		t.Fatalf("expected full availability over the last 40m, got %+v", sla)
+	}
+}
+
+func TestSLAStoppedPublisher(t *testing.T) {
+	setupTest(t)
+	start := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	c := useFakeClock(t, start)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1m&sla=99.9", ""), http.StatusNoContent)
+	reportAt(t, c, start, "worker", time.Minute, 2*time.Minute)
+	c.Set(start.Add(10 * time.Minute))
+
+	// Alive until 3m, silent for the 7 minutes since.
+	sla := getSLA(t, "worker", "?window=10m")
+	if math.Abs(sla.Availability-30) > 1e-9 || sla.DowntimeSeconds != 420 || !sla.Breached {
+		t.Fatalf("expected 30%% availability, got %+v", sla)
+	}
+	// A later report without ?sla= keeps the target.
+	reportAt(t, c, start, "worker", 10*time.Minute)
+	if sla := getSLA(t, "worker", "?window=10m"); sla.Target != 99.9 {
+		t.Fatalf("expected the stored target to be kept, got %+v", sla)
+	}
+}
+
+func TestSLAErrors(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+
+	for _, sla := range []string{"0", "100.1", "-5", "high"} {
+		expectError(t, serve(h, http.MethodPut, "/worker?sla="+sla, ""), http.StatusBadRequest, "invalid_sla")
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker/sla", ""), http.StatusBadRequest, "missing_target")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker/sla?target=101", ""), http.StatusBadRequest, "invalid_target")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/missing/sla?target=99", ""), http.StatusNotFound, "not_found")
+	expectError(t, serve(h, http.MethodPut, "/team/sla", ""), http.StatusBadRequest, "reserved_id")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	trailingSlashStrip    = "strip"
+	trailingSlashRedirect = "redirect"
+	trailingSlashOff      = "off"
+)
+
+func validTrailingSlashMode(mode string) error {
+	switch mode {
+	case trailingSlashStrip, trailingSlashRedirect, trailingSlashOff:
+		return nil
+	}
+	return fmt.Errorf("invalid trailing slash mode %q, expected %s, %s or %s", mode, trailingSlashStrip, trailingSlashRedirect, trailingSlashOff)
+}
+
+// normalizeTrailingSlash makes "/{id}/" reach the same handler as "/{id}",
+// either by routing it as if the slash was absent or by redirecting the
+// client to the canonical path, depending on --trailing-slash.
+func normalizeTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if cf.TrailingSlash == trailingSlashOff || path == "/" || !strings.HasSuffix(path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		canonical := strings.TrimRight(path, "/")
+		if canonical == "" {
+			canonical = "/"
+		}
+
+		if cf.TrailingSlash == trailingSlashRedirect {
+			target := *r.URL
+			target.Path, target.RawPath = canonical, ""
+			http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path, r2.URL.RawPath = canonical, ""
+		next.ServeHTTP(w, r2)
+	})
+}
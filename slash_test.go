@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrailingSlashStrip(t *testing.T) {
+	setupTest(t, "--trailing-slash", "strip")
+	internal, external := normalizeTrailingSlash(internalRouter()), normalizeTrailingSlash(externalRouter())
+
+	expectStatus(t, serve(internal, http.MethodPut, "/worker/", ""), http.StatusNoContent)
+	expectStatus(t, serve(internal, http.MethodPut, "/team/worker//", ""), http.StatusNoContent)
+	for _, target := range []string{"/worker/?ttl=1m", "/worker?ttl=1m", "/team/worker/?ttl=1m"} {
+		expectStatus(t, serve(external, http.MethodGet, target, ""), http.StatusOK)
+	}
+	expectStatus(t, serve(external, http.MethodGet, "/expired/?ttl=1m", ""), http.StatusOK)
+	expectStatus(t, serve(external, http.MethodGet, "/?ttl=1m", ""), http.StatusOK)
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	setupTest(t, "--trailing-slash", "redirect")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	external := normalizeTrailingSlash(externalRouter())
+
+	w := serve(external, http.MethodGet, "/worker/?ttl=1m", "")
+	expectStatus(t, w, http.StatusPermanentRedirect)
+	if location := w.Header().Get("Location"); location != "/worker?ttl=1m" {
+		t.Fatalf("expected a redirect to /worker?ttl=1m, got %q", location)
+	}
+	expectStatus(t, serve(external, http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+}
+
+func TestTrailingSlashOff(t *testing.T) {
+	setupTest(t, "--trailing-slash", "off")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(normalizeTrailingSlash(externalRouter()), http.MethodGet, "/worker/?ttl=1m", ""), http.StatusNotFound)
+}
+
+func TestValidTrailingSlashMode(t *testing.T) {
+	for _, mode := range []string{trailingSlashStrip, trailingSlashRedirect, trailingSlashOff} {
+		if err := validTrailingSlashMode(mode); err != nil {
+			t.Errorf("expected %q to be valid, got %v", mode, err)
+		}
+	}
+	if err := validTrailingSlashMode("keep"); err == nil {
+		t.Error("expected an unknown mode to be rejected")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type Snapshot struct {
+	TakenAt    time.Time   `json:"taken_at"`
+	Heartbeats []Heartbeat `json:"heartbeats"`
+}
+
+// Snapshot reads every heartbeat inside a single read transaction, so the
+// result is a point-in-time view even while writes continue.
+func (s *sqliteStore) Snapshot(ctx context.Context) (Snapshot, error) {
+	defer recordDBTime(ctx, time.Now())
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to begin read transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT namespace, id, CAST(last_updated_at AS TEXT) FROM heartbeats WHERE NOT pending ORDER BY namespace, id
+    `)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to query heartbeats: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	snapshot := Snapshot{
+		TakenAt:    time.Now().UTC(),
+		Heartbeats: []Heartbeat{},
+	}
+	for rows.Next() {
+		var namespace, hbID, lastUpdatedAtStr string
+		if err := rows.Scan(&namespace, &hbID, &lastUpdatedAtStr); err != nil {
+			return Snapshot{}, fmt.Errorf("failed to scan heartbeat: %v", err)
+		}
+		lastUpdatedAt, _, err := parseStoredTime(lastUpdatedAtStr)
+		if err != nil {
+			slog.Warn("skipping heartbeat with a corrupt last updated at date in snapshot", "namespace", namespace, "id", hbID, "value", lastUpdatedAtStr)
+			continue
+		}
+		snapshot.Heartbeats = append(snapshot.Heartbeats, Heartbeat{
+			Namespace:     namespace,
+			ID:            hbID,
+			LastUpdatedAt: lastUpdatedAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+
+	return snapshot, nil
+}
+
+func handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := store.Snapshot(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to take snapshot: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+}
+
+func (s *sqliteStore) Keys(ctx context.Context, fn func(heartbeatKey)) error {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `SELECT namespace, id FROM heartbeats`)
+	if err != nil {
+		return fmt.Errorf("failed to query heartbeat ids: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var key heartbeatKey
+		if err := rows.Scan(&key.Namespace, &key.ID); err != nil {
+			return fmt.Errorf("failed to scan heartbeat id: %v", err)
+		}
+		fn(key)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read heartbeat ids: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotEndpoint(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/b", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/a", ""), http.StatusNoContent)
+
+	w := serve(h, http.MethodGet, "/snapshot", "")
+	expectStatus(t, w, http.StatusOK)
+	var snapshot Snapshot
+	decodeBody(t, w, &snapshot)
+	if len(snapshot.Heartbeats) != 2 {
+		t.Fatalf("expected 2 heartbeats, got %+v", snapshot.Heartbeats)
+	}
+	if got := snapshot.Heartbeats[0]; got.Namespace != defaultNamespace || got.ID != "b" {
+		t.Fatalf("expected heartbeats ordered by namespace and id, got %+v", snapshot.Heartbeats)
+	}
+	if snapshot.TakenAt.IsZero() {
+		t.Fatal("expected taken_at to be set")
+	}
+}
+
+// TestSnapshotConsistentUnderConcurrentWrites rewrites a set of heartbeats
+// in single transactions while snapshots are taken, and expects every
+// snapshot to see all of them from the same write.
+func TestSnapshotConsistentUnderConcurrentWrites(t *testing.T) {
+	setupTest(t)
+	ctx := context.Background()
+
+	var puts []HeartbeatPut
+	for i := range 20 {
+		puts = append(puts, HeartbeatPut{Key: heartbeatKey{Namespace: defaultNamespace, ID: fmt.Sprintf("hb-%02d", i)}})
+	}
+	if err := store.PutMany(ctx, time.Now().UTC(), puts); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := store.PutMany(ctx, time.Now().UTC(), puts); err != nil {
+				t.Errorf("failed to write heartbeats: %v", err)
+				return
+			}
+		}
+	}()
+
+	for range 50 {
+		snapshot, err := store.Snapshot(ctx)
+		if err != nil {
+			t.Fatalf("failed to take snapshot: %v", err)
+		}
+		if len(snapshot.Heartbeats) != len(puts) {
+			t.Fatalf("expected %d heartbeats, got %d", len(puts), len(snapshot.Heartbeats))
+		}
+		first := snapshot.Heartbeats[0].LastUpdatedAt
+		for _, hb := range snapshot.Heartbeats {
+			if !hb.LastUpdatedAt.Equal(first) {
+				t.Fatalf("snapshot mixes writes: %s at %v, %s at %v", snapshot.Heartbeats[0].ID, first, hb.ID, hb.LastUpdatedAt)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriverName is the driver the database is opened with. It is the
+// stock SQLite driver with --busy-timeout applied to every connection.
+const sqliteDriverName = "sqlite3_collector"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(fmt.Sprintf("PRAGMA busy_timeout = %d", cf.BusyTimeout.Milliseconds()), nil)
+			return err
+		},
+	})
+}
+
+// enableWAL switches the database to WAL journal mode, which persists in
+// the file. Readers then no longer block the writer or each other, so the
+// pool keeps several connections: concurrent writes are still serialized by
+// SQLite, but a writer waits up to --busy-timeout for the lock instead of
+// failing with "database is locked". In-memory databases stay in memory
+// mode.
+func enableWAL(db *sql.DB) error {
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode = WAL`).Scan(&mode); err != nil {
+		return fmt.Errorf("failed to enable WAL journal mode: %v", err)
+	}
+	if mode != "wal" {
+		slog.Warn("database does not support WAL journal mode", "journal_mode", mode)
+	}
+	return nil
+}
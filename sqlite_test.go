@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPutsToDistinctIDs(t *testing.T) {
+	const puts = 50
+	setupTest(t)
+	h := internalRouter()
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	failures := make(chan string, puts)
+	for i := range puts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			id := fmt.Sprintf("worker-%02d", i)
+			if w := serve(h, http.MethodPut, "/"+id, `{"metadata":{"n":1}}`); w.Code != http.StatusNoContent {
+				failures <- fmt.Sprintf("%s: %d %s", id, w.Code, w.Body)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Errorf("expected every concurrent PUT to succeed, got %s", failure)
+	}
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM heartbeats`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != puts {
+		t.Fatalf("expected %d rows, got %d", puts, rows)
+	}
+}
+
+func TestBusyTimeoutAppliedToConnections(t *testing.T) {
+	setupTest(t, "--busy-timeout", "1500ms")
+
+	var timeout int64
+	if err := db.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 1500 {
+		t.Fatalf("expected a busy timeout of 1500ms, got %dms", timeout)
+	}
+}
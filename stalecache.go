@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// staleHeader is set on responses served from the stale cache.
+const staleHeader = "X-Heartbeat-Stale"
+
+// staleWarnInterval is how often serving stale heartbeats is logged through
+// an outage. Every stale read is counted in heartbeat_stale_reads_total.
+const staleWarnInterval = time.Minute
+
+// staleCacheStore remembers the last heartbeat successfully read for each id
+// and serves it when the database fails, so checks keep being answered
+// through an outage. Such reads are marked Stale.
+type staleCacheStore struct {
+	Store
+
+	mu         sync.Mutex
+	cache      map[heartbeatKey]storedHeartbeat
+	lastWarned time.Time
+}
+
+func newStaleCacheStore(next Store) *staleCacheStore {
+	return &staleCacheStore{Store: next, cache: map[heartbeatKey]storedHeartbeat{}}
+}
+
+func (s *staleCacheStore) Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error) {
+	hb, err := s.Store.Get(ctx, key)
+	switch {
+	case err == nil:
+		s.mu.Lock()
+		s.cache[key] = hb
+		s.mu.Unlock()
+		return hb, nil
+	case errors.Is(err, ErrNotFound):
+		s.forget(key)
+		return hb, err
+	case errors.Is(err, errCorruptTimestamp), ctx.Err() != nil:
+		// Neither is an outage: the row itself is bad, or the client's
+		// deadline ran out.
+		return hb, err
+	}
+
+	s.mu.Lock()
+	cached, ok := s.cache[key]
+	warn := ok && time.Since(s.lastWarned) >= staleWarnInterval
+	if warn {
+		s.lastWarned = time.Now()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return hb, err
+	}
+	staleReads.Inc()
+	if warn {
+		staleCacheLog.Warn("serving stale heartbeats after a database error", "namespace", key.Namespace, "id", key.ID, "error", err)
+	}
+	cached.Stale = true
+	return cached, nil
+}
+
+func (s *staleCacheStore) Delete(ctx context.Context, key heartbeatKey) error {
+	if err := s.Store.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.forget(key)
+	return nil
+}
+
+func (s *staleCacheStore) forget(key heartbeatKey) {
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// setupStaleCache configures the collector with --stale-cache, wrapping the
+// store as run does.
+func setupStaleCache(t *testing.T) {
+	t.Helper()
+	setupTest(t, "--stale-cache")
+	store = newStaleCacheStore(store)
+}
+
+func TestStaleCacheServesDuringOutage(t *testing.T) {
+	setupStaleCache(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", `{"metadata":{"v":1}}`), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/unread", ""), http.StatusNoContent)
+	fresh := getHeartbeat(t, "worker", "?ttl=1m")
+
+	_ = db.Close()
+
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", "")
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get(staleHeader) != "true" {
+		t.Fatalf("expected the response to be flagged stale, got headers %v", w.Header())
+	}
+	if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Fatalf("expected a stale response not to be cacheable, got headers %v", w.Header())
+	}
+	var stale Heartbeat
+	decodeBody(t, w, &stale)
+	if !stale.LastUpdatedAt.Equal(fresh.LastUpdatedAt) || string(stale.Metadata) != `{"v":1}` {
+		t.Fatalf("expected the last-known-good heartbeat %+v, got %+v", fresh, stale)
+	}
+
+	// Ids never read before the outage have nothing to fall back on.
+	reads := counterValue(t, "heartbeat_stale_reads_total")
+	expectError(t, serve(externalRouter(), http.MethodGet, "/unread?ttl=1m", ""), http.StatusInternalServerError, "internal_error")
+	if got := counterValue(t, "heartbeat_stale_reads_total"); got != reads {
+		t.Fatalf("expected a failed read not to count as stale, got %v after %v", got, reads)
+	}
+}
+
+func TestStaleReadsCountedAndWarnedOnce(t *testing.T) {
+	setupStaleCache(t)
+	var logs bytes.Buffer
+	staleCacheLog = slog.New(slog.NewTextHandler(&logs, nil))
+	t.Cleanup(func() { staleCacheLog = slog.Default() })
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+
+	_ = db.Close()
+
+	before := counterValue(t, "heartbeat_stale_reads_total")
+	for range 5 {
+		expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusOK)
+	}
+	if got := counterValue(t, "heartbeat_stale_reads_total"); got != before+5 {
+		t.Fatalf("expected 5 stale reads to be counted, got %v after %v", got, before)
+	}
+	if warnings := strings.Count(logs.String(), "serving stale heartbeats"); warnings != 1 {
+		t.Fatalf("expected a single warning for the outage, got %d:\n%s", warnings, logs.String())
+	}
+}
+
+func TestStaleCacheNotUsedWhileHealthy(t *testing.T) {
+	setupStaleCache(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	for range 2 {
+		w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", "")
+		expectStatus(t, w, http.StatusOK)
+		if w.Header().Get(staleHeader) != "" {
+			t.Fatal("expected a fresh read not to be flagged stale")
+		}
+	}
+}
+
+func TestStaleCacheForgetsDeletedHeartbeat(t *testing.T) {
+	setupStaleCache(t)
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+	expectStatus(t, serve(h, http.MethodDelete, "/worker", ""), http.StatusNoContent)
+
+	_ = db.Close()
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusInternalServerError, "internal_error")
+}
+
+func TestOutageWithoutStaleCache(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+
+	_ = db.Close()
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", ""), http.StatusInternalServerError, "internal_error")
+}
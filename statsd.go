@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacket keeps each datagram within a typical Ethernet MTU.
+const statsdMaxPacket = 1432
+
+// statsdEmitter pushes the collector's metrics to a statsd server, using
+// DogStatsD tags for labels. Counters are sent as the increase since the
+// previous push.
+type statsdEmitter struct {
+	conn   net.Conn
+	logger *slog.Logger
+	last   map[string]float64
+}
+
+func newStatsdEmitter(addr string, logger *slog.Logger) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open statsd connection: %v", err)
+	}
+	return &statsdEmitter{conn: conn, logger: logger, last: map[string]float64{}}, nil
+}
+
+// Run pushes every interval until ctx is done.
+func (e *statsdEmitter) Run(ctx context.Context, interval time.Duration) error {
+	defer func() {
+		_ = e.conn.Close()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := e.push()
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				e.logger.Error("failed to push statsd metrics", "error", err)
+			}
+			reportJobRun("statsd", err)
+		}
+	}
+}
+
+// push sends one gather of metricsRegistry. Heartbeat ages are taken from
+// the freshness gauges, so the heartbeats are read once per push.
+func (e *statsdEmitter) push() error {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	now := float64(heartbeatNow().UnixNano()) / float64(time.Second)
+
+	var lines []string
+	for _, f := range families {
+		if f.GetName() == "heartbeat_last_updated_timestamp_seconds" {
+			for _, m := range f.GetMetric() {
+				lines = append(lines, statsdLine("heartbeat.age_seconds", now-m.GetGauge().GetValue(), "g",
+					labelTags(m.GetLabel())...))
+			}
+			continue
+		}
+
+		var name string
+		switch f.GetName() {
+		case "heartbeat_put_total":
+			name = "heartbeat.put"
+		case "heartbeat_get_total":
+			name = "heartbeat.get"
+		default:
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			tags := labelTags(m.GetLabel())
+			key := name + "|" + strings.Join(tags, ",")
+			value := m.GetCounter().GetValue()
+			if delta := value - e.last[key]; delta > 0 {
+				lines = append(lines, statsdLine(name, delta, "c", tags...))
+			}
+			e.last[key] = value
+		}
+	}
+
+	return e.send(lines)
+}
+
+// send writes lines in as few datagrams as fit statsdMaxPacket.
+func (e *statsdEmitter) send(lines []string) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := e.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return fmt.Errorf("failed to send statsd metrics: %v", err)
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("failed to send statsd metrics: %v", err)
+	}
+	return nil
+}
+
+func labelTags(labels []*dto.LabelPair) []string {
+	var tags []string
+	for _, l := range labels {
+		tags = append(tags, l.GetName(), l.GetValue())
+	}
+	return tags
+}
+
+// statsdLine formats a metric, tags holding alternating names and values.
+func statsdLine(name string, value float64, kind string, tags ...string) string {
+	line := fmt.Sprintf("%s:%g|%s", name, value, kind)
+	for i := 0; i+1 < len(tags); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "|#"
+		}
+		line += sep + tags[i] + ":" + statsdTagValue.Replace(tags[i+1])
+	}
+	return line
+}
+
+// statsdTagValue replaces the characters that delimit DogStatsD tags.
+var statsdTagValue = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListener is a mock statsd server collecting the lines sent to it.
+type statsdListener struct {
+	conn net.PacketConn
+}
+
+func newStatsdListener(t *testing.T) *statsdListener {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &statsdListener{conn: conn}
+}
+
+// lines returns the lines of the datagrams received until none arrive for a
+// short while.
+func (l *statsdListener) lines(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	buf := make([]byte, 64<<10)
+	for {
+		_ = l.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > statsdMaxPacket {
+			t.Errorf("expected datagrams of at most %d bytes, got %d", statsdMaxPacket, n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func newTestEmitter(t *testing.T, l *statsdListener) *statsdEmitter {
+	t.Helper()
+	e, err := newStatsdEmitter(l.conn.LocalAddr().String(), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = e.conn.Close()
+	})
+	return e
+}
+
+func TestStatsdEmitsHeartbeatAges(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/team/cron", ""), http.StatusNoContent)
+	c.Advance(30 * time.Second)
+
+	l := newStatsdListener(t)
+	if err := newTestEmitter(t, l).push(); err != nil {
+		t.Fatal(err)
+	}
+	lines := l.lines(t)
+	for _, want := range []string{
+		"heartbeat.age_seconds:30|g|#id:worker,namespace:default",
+		"heartbeat.age_seconds:30|g|#id:cron,namespace:team",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("expected %q, got %v", want, lines)
+		}
+	}
+}
+
+func TestStatsdEmitsCounterIncreases(t *testing.T) {
+	setupTest(t)
+	l := newStatsdListener(t)
+	e := newTestEmitter(t, l)
+	// The counters are process-wide, the first push sends what earlier tests
+	// added.
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+	l.lines(t)
+
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	getHeartbeat(t, "worker", "?ttl=1m")
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+	lines := l.lines(t)
+	for _, want := range []string{"heartbeat.put:2|c", "heartbeat.get:1|c|#result:hit"} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("expected %q, got %v", want, lines)
+		}
+	}
+
+	// Counters that didn't move aren't sent again.
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range l.lines(t) {
+		if strings.HasSuffix(strings.SplitN(line, "|#", 2)[0], "|c") {
+			t.Errorf("expected no counters without new requests, got %q", line)
+		}
+	}
+}
+
+func TestStatsdSplitsLargePushes(t *testing.T) {
+	setupTest(t)
+	insertHeartbeats(t, 200)
+
+	l := newStatsdListener(t)
+	if err := newTestEmitter(t, l).push(); err != nil {
+		t.Fatal(err)
+	}
+	ages := 0
+	for _, line := range l.lines(t) {
+		if strings.HasPrefix(line, "heartbeat.age_seconds:") {
+			ages++
+		}
+	}
+	if ages != 200 {
+		t.Fatalf("expected an age for each of 200 heartbeats, got %d", ages)
+	}
+}
+
+func TestStatsdLine(t *testing.T) {
+	if got := statsdLine("heartbeat.put", 3, "c"); got != "heartbeat.put:3|c" {
+		t.Fatalf("unexpected line %q", got)
+	}
+	if got := statsdLine("heartbeat.age_seconds", 1.5, "g", "id", "a,b|c", "namespace", "default"); got != "heartbeat.age_seconds:1.5|g|#id:a_b_c,namespace:default" {
+		t.Fatalf("unexpected line %q", got)
+	}
+}
+
+func TestStatsdIntervalMustBePositive(t *testing.T) {
+	err := runUntilSignal(t, "--statsd-addr", "127.0.0.1:8125", "--statsd-interval", "0")
+	if err == nil || err.Error() != "--statsd-interval must be positive" {
+		t.Fatalf("expected the interval to be rejected, got %v", err)
+	}
+}
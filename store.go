@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for an unknown heartbeat.
+var ErrNotFound = errors.New("heartbeat not found")
+
+// ErrMetadataTooLarge is returned by a Store when merging a metadata patch
+// would grow the metadata past PutOptions.MaxMetadataBytes.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+// Store holds the heartbeats, their history and the settings the handlers
+// and background jobs read and write. The SQLite tables are reached through
+// sqliteStore, an HA deployment can provide another implementation. Only
+// migrations, seeding, readiness pings, pool statistics and WAL maintenance
+// use the database directly.
+type Store interface {
+	// Put records a heartbeat for key at now, creating it if it is new.
+	Put(ctx context.Context, key heartbeatKey, now time.Time, opts PutOptions) error
+	// PutMany records several heartbeats at now, either all of them or none.
+	PutMany(ctx context.Context, now time.Time, puts []HeartbeatPut) error
+	// Get returns ErrNotFound for an unknown key and an error wrapping
+	// errCorruptTimestamp when the stored date cannot be parsed.
+	Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error)
+	// Delete returns ErrNotFound for an unknown key.
+	Delete(ctx context.Context, key heartbeatKey) error
+	// Removed returns the ids in namespace deleted or reaped at or after
+	// since, ordered by id. Removals are kept for listDeltaRetention.
+	Removed(ctx context.Context, namespace string, since time.Time) ([]string, error)
+
+	// List calls fn for a page of the heartbeats in a namespace, ordered by
+	// id, and stops at the first error fn returns. Heartbeats with a
+	// corrupt date are skipped.
+	List(ctx context.Context, q ListQuery, fn func(HeartbeatStatus) error) error
+	// Keys calls fn with the key of every heartbeat.
+	Keys(ctx context.Context, fn func(heartbeatKey)) error
+	// Snapshot reads every heartbeat as of a single point in time.
+	Snapshot(ctx context.Context) (Snapshot, error)
+	// Expired returns the ids in namespace last updated before cutoff,
+	// ordered by id.
+	Expired(ctx context.Context, namespace string, cutoff time.Time) ([]string, error)
+	// CountGroup counts the heartbeats in namespace whose id starts with
+	// prefix, and those of them last updated before cutoff or with a corrupt
+	// date.
+	CountGroup(ctx context.Context, namespace, prefix string, cutoff time.Time) (total, expired int64, err error)
+	// CountAlive counts the heartbeats with a stored ttl, or with fallback
+	// when it is not 0, and those of them still within it at now.
+	CountAlive(ctx context.Context, fallback time.Duration, now time.Time) (total, alive int64, err error)
+	// History returns up to limit arrivals of key, most recent first.
+	History(ctx context.Context, key heartbeatKey, limit int) ([]time.Time, error)
+	// Arrivals calls fn with the arrivals of key received at or after since,
+	// oldest first.
+	Arrivals(ctx context.Context, key heartbeatKey, since time.Time, fn func(time.Time) error) error
+
+	// SetIntervals stores interval as the ttl of every heartbeat in
+	// namespace whose id starts with prefix and returns how many changed.
+	SetIntervals(ctx context.Context, namespace, prefix string, interval time.Duration) (int64, error)
+	// Mute suppresses notifications for key until the given time. It
+	// returns ErrNotFound for an unknown key.
+	Mute(ctx context.Context, key heartbeatKey, until time.Time) error
+	// MetadataLimit returns the metadata limit override of key, false when
+	// none is set.
+	MetadataLimit(ctx context.Context, key heartbeatKey) (int64, bool, error)
+	// SetMetadataLimit overrides the metadata limit of key, a maxBytes of 0
+	// removes the override.
+	SetMetadataLimit(ctx context.Context, key heartbeatKey, maxBytes int64) error
+	// Banner returns the current banner, false when none is set.
+	Banner(ctx context.Context) (Banner, bool, error)
+	// SetBanner stores message as the banner, an empty message clears it.
+	SetBanner(ctx context.Context, message string, now time.Time) error
+
+	// Stale returns every heartbeat past its stored ttl at now.
+	Stale(ctx context.Context, now time.Time) ([]heartbeatKey, error)
+	// ExpiredUnnotified returns the heartbeats past their stored ttl at now
+	// that were neither notified about nor are muted.
+	ExpiredUnnotified(ctx context.Context, now time.Time) ([]expiredUnnotified, error)
+	// QueueWebhook adds d to the webhook delivery queue, due at now, and
+	// records the expiry notification of each of expired at now, unless it
+	// was updated since its stamp was read, all in one transaction.
+	QueueWebhook(ctx context.Context, d webhookDelivery, expired []expiredUnnotified, now time.Time) error
+	// DueWebhooks returns the queued deliveries due at now, oldest first,
+	// leaving out those dead-lettered.
+	DueWebhooks(ctx context.Context, now time.Time) ([]webhookDelivery, error)
+	// CompleteWebhook removes a delivered delivery from the queue.
+	CompleteWebhook(ctx context.Context, id int64) error
+	// RetryWebhook stores the attempts and last error of d and makes it due
+	// again at next.
+	RetryWebhook(ctx context.Context, d webhookDelivery, next time.Time) error
+	// DeadLetterWebhook stores the attempts and last error of d and keeps it
+	// from being due again.
+	DeadLetterWebhook(ctx context.Context, d webhookDelivery, now time.Time) error
+	// ReapExpired deletes the heartbeats whose stored ttl ran out more than
+	// grace before now, along with their history. Heartbeats created less
+	// than newGrace before now are kept.
+	ReapExpired(ctx context.Context, grace, newGrace time.Duration, now time.Time) (int64, error)
+	// TrimHistory deletes the arrivals received before cutoff.
+	TrimHistory(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// PutOptions are the optional parts of a heartbeat write. Null values leave
+// what is stored untouched.
+type PutOptions struct {
+	// InitialTTL is stored only when the heartbeat is created.
+	InitialTTL sql.NullInt64
+	// TTL replaces the stored ttl.
+	TTL      sql.NullInt64
+	AlertURL sql.NullString
+	Metadata sql.NullString
+	// MetadataPatch is merged into the stored metadata as a JSON merge patch
+	// (RFC 7396) instead of replacing it, a new heartbeat starts from an
+	// empty object. The merged metadata may be at most MaxMetadataBytes.
+	MetadataPatch    sql.NullString
+	MaxMetadataBytes int64
+	// SLATarget is the availability in percent /{id}/sla holds the
+	// heartbeat to.
+	SLATarget sql.NullFloat64
+	// Method is always stored, a null value clears it.
+	Method sql.NullString
+}
+
+// HeartbeatPut is a single write of a PutMany.
+type HeartbeatPut struct {
+	Key  heartbeatKey
+	Opts PutOptions
+}
+
+// store is the Store used by the handlers.
+var store Store
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db}
+}
+
+func (s *sqliteStore) Put(ctx context.Context, key heartbeatKey, now time.Time, opts PutOptions) error {
+	defer recordDBTime(ctx, time.Now())
+	if !opts.MetadataPatch.Valid {
+		return putHeartbeat(ctx, s.db, key, now, opts)
+	}
+
+	// A merge too large for the limit is only known once it is written, so
+	// it has to be undone.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := putHeartbeat(ctx, tx, key, now, opts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) PutMany(ctx context.Context, now time.Time, puts []HeartbeatPut) error {
+	defer recordDBTime(ctx, time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, p := range puts {
+		if err := putHeartbeat(ctx, tx, p.Key, now, p.Opts); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// putHeartbeat is a single upsert, so concurrent first reports of an id
+// can't both insert: one creates the row and sets created_at, the others only
+// refresh last_updated_at. A pending row is created by its first report.
+// A metadata patch is merged by SQLite's json_patch, which implements RFC
+// 7396, and is rejected with ErrMetadataTooLarge after the fact, so db must
+// be a transaction for one. The arrival is then appended to heartbeat_events.
+func putHeartbeat(ctx context.Context, db execer, key heartbeatKey, now time.Time, opts PutOptions) error {
+	stamp := now.Format(storedTimeFormat)
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO heartbeats (namespace, id, last_updated_at, ttl_seconds, alert_url, last_method, metadata, created_at, sla_target)
+        VALUES (?, ?, ?, ?, ?, ?, COALESCE(?, json_patch('{}', ?)), ?, ?)
+        ON CONFLICT(namespace, id) DO UPDATE SET
+            last_updated_at = excluded.last_updated_at,
+            ttl_seconds = COALESCE(?, CASE WHEN heartbeats.pending THEN excluded.ttl_seconds ELSE heartbeats.ttl_seconds END),
+            alert_url = COALESCE(excluded.alert_url, heartbeats.alert_url),
+            sla_target = COALESCE(excluded.sla_target, heartbeats.sla_target),
+            last_method = excluded.last_method,
+            metadata = CASE
+                WHEN ? IS NULL THEN COALESCE(excluded.metadata, heartbeats.metadata)
+                ELSE json_patch(COALESCE(heartbeats.metadata, '{}'), ?)
+            END,
+            created_at = CASE WHEN heartbeats.pending THEN excluded.created_at ELSE heartbeats.created_at END,
+            expiry_notified_at = NULL,
+            pending = 0;
+    `, key.Namespace, key.ID, stamp, opts.InitialTTL, opts.AlertURL, opts.Method, opts.Metadata, opts.MetadataPatch, stamp,
+		opts.SLATarget, opts.TTL, opts.MetadataPatch, opts.MetadataPatch)
+	if err != nil {
+		return err
+	}
+	if opts.MetadataPatch.Valid {
+		var size int64
+		if err := db.QueryRowContext(ctx, `
+            SELECT length(CAST(metadata AS BLOB)) FROM heartbeats WHERE namespace = ? AND id = ?
+        `, key.Namespace, key.ID).Scan(&size); err != nil {
+			return fmt.Errorf("failed to measure merged metadata: %v", err)
+		}
+		if size > opts.MaxMetadataBytes {
+			return ErrMetadataTooLarge
+		}
+	}
+	if cf.RegisterParents {
+		if err := registerParents(ctx, db, key, stamp); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO heartbeat_events (namespace, id, received_at) VALUES (?, ?, ?)
+    `, key.Namespace, key.ID, stamp)
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat event: %v", err)
+	}
+	return nil
+}
+
+// Delete removes a heartbeat and its history in one transaction, leaving a
+// tombstone for list deltas.
+func (s *sqliteStore) Delete(ctx context.Context, key heartbeatKey) error {
+	defer recordDBTime(ctx, time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := recordTombstone(ctx, tx, key, heartbeatNow()); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM heartbeats WHERE namespace = ? AND id = ?`, key.Namespace, key.ID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count deleted heartbeats: %v", err)
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, `
+        DELETE FROM heartbeat_events WHERE namespace = ? AND id = ? `+idCollate(),
+		key.Namespace, key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete heartbeat events: %v", err)
+	}
+	return tx.Commit()
+}
+
+// storedHeartbeat is a heartbeat row as held in the database.
+type storedHeartbeat struct {
+	Namespace     string
+	ID            string
+	LastUpdatedAt time.Time
+	TTL           sql.NullInt64
+	Method        sql.NullString
+	// Metadata is the JSON object last attached by the publisher.
+	Metadata sql.NullString
+	// CreatedAt is zero for heartbeats created before it was recorded.
+	CreatedAt time.Time
+	// MutedUntil is zero unless alerts were muted, it may lie in the past.
+	MutedUntil time.Time
+	SLATarget  sql.NullFloat64
+	// Pending is set for a parent registered by --register-parents that
+	// hasn't reported itself yet. Only Get, List and Keys return such rows.
+	Pending bool
+	// Stale is set when the heartbeat was served from the stale cache
+	// because the database could not be read.
+	Stale bool
+}
+
+// Get reads a single heartbeat. Dates in a legacy format are repaired in
+// place.
+func (s *sqliteStore) Get(ctx context.Context, key heartbeatKey) (storedHeartbeat, error) {
+	var (
+		lastUpdatedAtStr string
+		createdAtStr     sql.NullString
+		mutedUntilStr    sql.NullString
+		hb               = storedHeartbeat{Namespace: key.Namespace, ID: key.ID}
+	)
+	// last_updated_at is read as text, the driver would otherwise turn any
+	// value it cannot parse into the zero time and hide the corruption.
+	defer recordDBTime(ctx, time.Now())
+	err := s.db.QueryRowContext(ctx, `
+        SELECT CAST(last_updated_at AS TEXT), ttl_seconds, last_method, metadata, CAST(created_at AS TEXT),
+            CAST(muted_until AS TEXT), pending, sla_target
+        FROM heartbeats WHERE namespace = ? AND id = ?
+    `, key.Namespace, key.ID).Scan(&lastUpdatedAtStr, &hb.TTL, &hb.Method, &hb.Metadata, &createdAtStr, &mutedUntilStr, &hb.Pending, &hb.SLATarget)
+	if err == sql.ErrNoRows {
+		return storedHeartbeat{}, ErrNotFound
+	}
+	if err != nil {
+		return storedHeartbeat{}, err
+	}
+
+	lastUpdatedAt, legacy, err := parseStoredTime(lastUpdatedAtStr)
+	if err != nil {
+		slog.Error("heartbeat has a corrupt last updated at date", "namespace", key.Namespace, "id", key.ID, "value", lastUpdatedAtStr)
+		return storedHeartbeat{}, err
+	}
+	if legacy {
+		slog.Warn("repairing heartbeat stored in a legacy date format", "namespace", key.Namespace, "id", key.ID, "value", lastUpdatedAtStr)
+		s.repairStoredTime(ctx, key, lastUpdatedAtStr, lastUpdatedAt)
+	}
+	// A date in the future was written before the clock moved backwards.
+	// Left alone it would keep the heartbeat alive until the clock catches
+	// up, so it is reset to now and expires one ttl from here.
+	if now := heartbeatNow(); lastUpdatedAt.Sub(now) > clockJumpTolerance {
+		slog.Warn("heartbeat was last updated in the future, the clock may have moved backwards", "namespace", key.Namespace, "id", key.ID, "value", lastUpdatedAtStr)
+		lastUpdatedAt = now
+		s.repairStoredTime(ctx, key, lastUpdatedAtStr, lastUpdatedAt)
+	}
+	hb.LastUpdatedAt = lastUpdatedAt
+
+	if createdAtStr.Valid {
+		if createdAt, _, err := parseStoredTime(createdAtStr.String); err == nil {
+			hb.CreatedAt = createdAt
+		}
+	}
+	if mutedUntilStr.Valid {
+		if mutedUntil, _, err := parseStoredTime(mutedUntilStr.String); err == nil {
+			hb.MutedUntil = mutedUntil
+		}
+	}
+
+	return hb, nil
+}
+
+// repairStoredTime rewrites a last_updated_at value that can't be used as
+// stored. The update is skipped if the row changed since it was read.
+func (s *sqliteStore) repairStoredTime(ctx context.Context, key heartbeatKey, oldValue string, t time.Time) {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE heartbeats SET last_updated_at = ? WHERE namespace = ? AND id = ? AND last_updated_at = ?
+    `, t.Format(storedTimeFormat), key.Namespace, key.ID, oldValue)
+	if err != nil {
+		slog.Error("failed to repair heartbeat date", "namespace", key.Namespace, "id", key.ID, "error", err)
+	}
+}
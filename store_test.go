@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storeBackends builds each Store implementation over a fresh database or
+// directory. The wrappers must behave exactly like the sqliteStore they wrap,
+// and fsStore like sqliteStore.
+var storeBackends = map[string]func(t *testing.T) Store{
+	"sqlite": func(t *testing.T) Store {
+		return newSQLiteStore(db)
+	},
+	"bloom": func(t *testing.T) Store {
+		s, err := newBloomStore(context.Background(), newSQLiteStore(db), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"stale-cache": func(t *testing.T) Store {
+		return newStaleCacheStore(newSQLiteStore(db))
+	},
+	"fs": func(t *testing.T) Store {
+		s, err := newFSStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+}
+
+// testStores runs fn as a subtest against every Store implementation.
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	for name, newStore := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			setupTest(t)
+			s := newStore(t)
+			store = s
+			fn(t, s)
+		})
+	}
+}
+
+// storeTestBase is a time in the past that the suite records heartbeats
+// relative to, so none of them are dated in the future.
+func storeTestBase() time.Time {
+	return time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+}
+
+var (
+	workerKey = heartbeatKey{Namespace: defaultNamespace, ID: "worker"}
+	teamKey   = heartbeatKey{Namespace: "team", ID: "worker"}
+)
+
+// mustPut records key at now with opts.
+func mustPut(t *testing.T, s Store, key heartbeatKey, now time.Time, opts PutOptions) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, now, opts); err != nil {
+		t.Fatalf("failed to put %v: %v", key, err)
+	}
+}
+
+// mustGet reads key.
+func mustGet(t *testing.T, s Store, key heartbeatKey) storedHeartbeat {
+	t.Helper()
+	hb, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("failed to get %v: %v", key, err)
+	}
+	return hb
+}
+
+func seconds(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: true}
+}
+
+func text(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+func TestStorePutGet(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		mustPut(t, s, workerKey, base, PutOptions{
+			InitialTTL: seconds(60),
+			AlertURL:   text("https://alerts.example.com/worker"),
+			Metadata:   text(`{"region":"eu-west-1"}`),
+			Method:     text("PUT"),
+		})
+
+		hb := mustGet(t, s, workerKey)
+		if !hb.LastUpdatedAt.Equal(base) || !hb.CreatedAt.Equal(base) || hb.TTL != seconds(60) {
+			t.Fatalf("unexpected heartbeat %+v", hb)
+		}
+		if hb.Metadata != text(`{"region":"eu-west-1"}`) || hb.Method != text("PUT") || hb.Pending || hb.Stale {
+			t.Fatalf("unexpected heartbeat %+v", hb)
+		}
+
+		// Null options leave what is stored, except the method.
+		later := base.Add(time.Minute)
+		mustPut(t, s, workerKey, later, PutOptions{InitialTTL: seconds(300)})
+		hb = mustGet(t, s, workerKey)
+		if !hb.LastUpdatedAt.Equal(later) || !hb.CreatedAt.Equal(base) || hb.TTL != seconds(60) {
+			t.Fatalf("unexpected heartbeat after an update %+v", hb)
+		}
+		if hb.Metadata != text(`{"region":"eu-west-1"}`) || hb.Method.Valid {
+			t.Fatalf("unexpected heartbeat after an update %+v", hb)
+		}
+
+		mustPut(t, s, workerKey, later, PutOptions{TTL: seconds(120)})
+		if hb := mustGet(t, s, workerKey); hb.TTL != seconds(120) {
+			t.Fatalf("expected the ttl to be replaced, got %+v", hb.TTL)
+		}
+
+		mustPut(t, s, teamKey, later, PutOptions{})
+		if hb := mustGet(t, s, teamKey); hb.Namespace != "team" || hb.TTL.Valid {
+			t.Fatalf("unexpected heartbeat in another namespace %+v", hb)
+		}
+	})
+}
+
+func TestStoreGetMissing(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		if _, err := s.Get(context.Background(), workerKey); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		mustPut(t, s, teamKey, storeTestBase(), PutOptions{})
+		if _, err := s.Get(context.Background(), workerKey); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound for the same id in another namespace, got %v", err)
+		}
+	})
+}
+
+func TestStoreDelete(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		mustPut(t, s, workerKey, storeTestBase(), PutOptions{})
+		mustGet(t, s, workerKey)
+
+		if err := s.Delete(ctx, workerKey); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, workerKey); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound after a delete, got %v", err)
+		}
+		if history, err := s.History(ctx, workerKey, 10); err != nil || len(history) != 0 {
+			t.Fatalf("expected the history to be deleted, got %v, %v", history, err)
+		}
+		if err := s.Delete(ctx, workerKey); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound deleting a missing heartbeat, got %v", err)
+		}
+	})
+}
+
+func TestStorePutMany(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		err := s.PutMany(context.Background(), base, []HeartbeatPut{
+			{Key: workerKey, Opts: PutOptions{InitialTTL: seconds(60)}},
+			{Key: teamKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hb := mustGet(t, s, workerKey); !hb.LastUpdatedAt.Equal(base) || hb.TTL != seconds(60) {
+			t.Fatalf("unexpected heartbeat %+v", hb)
+		}
+		if hb := mustGet(t, s, teamKey); !hb.LastUpdatedAt.Equal(base) {
+			t.Fatalf("unexpected heartbeat %+v", hb)
+		}
+	})
+}
+
+func TestStoreList(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		for i, id := range []string{"c", "a", "b"} {
+			mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: id}, base.Add(time.Duration(i)*time.Minute), PutOptions{})
+		}
+		mustPut(t, s, teamKey, base, PutOptions{})
+
+		list := func(q ListQuery) (ids []string, expired []bool) {
+			t.Helper()
+			err := s.List(context.Background(), q, func(hb HeartbeatStatus) error {
+				ids = append(ids, hb.ID)
+				expired = append(expired, hb.Expired)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids, expired
+		}
+
+		cutoff := base.Add(30 * time.Second)
+		ids, expired := list(ListQuery{Namespace: defaultNamespace, Cutoff: cutoff, Limit: 10})
+		if !slices.Equal(ids, []string{"a", "b", "c"}) || !slices.Equal(expired, []bool{false, false, true}) {
+			t.Fatalf("unexpected list %v %v", ids, expired)
+		}
+		if ids, _ := list(ListQuery{Namespace: defaultNamespace, Cutoff: cutoff, Status: "live", Limit: 1, Offset: 1}); !slices.Equal(ids, []string{"b"}) {
+			t.Fatalf("unexpected page of live heartbeats %v", ids)
+		}
+		if ids, _ := list(ListQuery{Namespace: defaultNamespace, Cutoff: cutoff, Status: "expired", Limit: 10}); !slices.Equal(ids, []string{"c"}) {
+			t.Fatalf("unexpected expired heartbeats %v", ids)
+		}
+		if ids, _ := list(ListQuery{Namespace: defaultNamespace, Cutoff: cutoff, Prefixes: []string{"a", "c", "cc"}, Limit: 10}); !slices.Equal(ids, []string{"a", "c"}) {
+			t.Fatalf("expected the heartbeats under any of the prefixes, got %v", ids)
+		}
+		changed := ListQuery{Namespace: defaultNamespace, Cutoff: cutoff, ChangedSince: base.Add(90 * time.Second), ExpiredAfter: base, Limit: 10}
+		if ids, _ := list(changed); !slices.Equal(ids, []string{"b", "c"}) {
+			t.Fatalf("expected the written and the expired heartbeats, got %v", ids)
+		}
+		changed.ExpiredAfter = base.Add(time.Second)
+		if ids, _ := list(changed); !slices.Equal(ids, []string{"b"}) {
+			t.Fatalf("expected a heartbeat expired before ExpiredAfter to be left out, got %v", ids)
+		}
+	})
+}
+
+func TestStoreRemoved(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		useFakeClock(t, storeTestBase().Add(time.Hour))
+		base := storeTestBase()
+		mustPut(t, s, workerKey, base, PutOptions{})
+		mustPut(t, s, teamKey, base, PutOptions{InitialTTL: seconds(60)})
+		if err := s.Delete(ctx, workerKey); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ReapExpired(ctx, 0, 0, heartbeatNow()); err != nil {
+			t.Fatal(err)
+		}
+
+		if ids, err := s.Removed(ctx, defaultNamespace, heartbeatNow()); err != nil || !slices.Equal(ids, []string{"worker"}) {
+			t.Fatalf("expected the deleted heartbeat, got %v, %v", ids, err)
+		}
+		if ids, err := s.Removed(ctx, "team", heartbeatNow()); err != nil || !slices.Equal(ids, []string{"worker"}) {
+			t.Fatalf("expected the reaped heartbeat, got %v, %v", ids, err)
+		}
+		if ids, err := s.Removed(ctx, defaultNamespace, heartbeatNow().Add(time.Second)); err != nil || len(ids) != 0 {
+			t.Fatalf("expected nothing removed since, got %v, %v", ids, err)
+		}
+
+		// Removals older than the retention are forgotten by the next one.
+		mustPut(t, s, workerKey, heartbeatNow(), PutOptions{})
+		useFakeClock(t, heartbeatNow().Add(listDeltaRetention+time.Second))
+		if err := s.Delete(ctx, workerKey); err != nil {
+			t.Fatal(err)
+		}
+		if ids, err := s.Removed(ctx, "team", base); err != nil || len(ids) != 0 {
+			t.Fatalf("expected the old removal to be forgotten, got %v, %v", ids, err)
+		}
+	})
+}
+
+func TestStoreKeysAndSnapshot(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		mustPut(t, s, workerKey, base, PutOptions{})
+		mustPut(t, s, teamKey, base, PutOptions{})
+
+		keys := map[heartbeatKey]bool{}
+		if err := s.Keys(ctx, func(key heartbeatKey) { keys[key] = true }); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || !keys[workerKey] || !keys[teamKey] {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+
+		snapshot, err := s.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.Heartbeats) != 2 || snapshot.TakenAt.IsZero() {
+			t.Fatalf("unexpected snapshot %+v", snapshot)
+		}
+		for _, hb := range snapshot.Heartbeats {
+			if !hb.LastUpdatedAt.Equal(base) {
+				t.Fatalf("unexpected heartbeat in the snapshot %+v", hb)
+			}
+		}
+	})
+}
+
+func TestStoreExpiredAndCounts(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "web.old"}, base, PutOptions{InitialTTL: seconds(60)})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "web.new"}, base.Add(time.Hour-time.Second), PutOptions{InitialTTL: seconds(600)})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "batch"}, base, PutOptions{})
+
+		cutoff := base.Add(time.Minute)
+		expired, err := s.Expired(ctx, defaultNamespace, cutoff)
+		if err != nil || !slices.Equal(expired, []string{"batch", "web.old"}) {
+			t.Fatalf("unexpected expired ids %v, %v", expired, err)
+		}
+
+		total, expiredCount, err := s.CountGroup(ctx, defaultNamespace, "web.", cutoff)
+		if err != nil || total != 2 || expiredCount != 1 {
+			t.Fatalf("unexpected group counts %d, %d, %v", total, expiredCount, err)
+		}
+
+		now := base.Add(time.Hour)
+		total, alive, err := s.CountAlive(ctx, 0, now)
+		if err != nil || total != 2 || alive != 1 {
+			t.Fatalf("unexpected alive counts without a fallback %d, %d, %v", total, alive, err)
+		}
+		total, alive, err = s.CountAlive(ctx, 2*time.Hour, now)
+		if err != nil || total != 3 || alive != 2 {
+			t.Fatalf("unexpected alive counts with a fallback %d, %d, %v", total, alive, err)
+		}
+
+		stale, err := s.Stale(ctx, now)
+		if err != nil || !slices.Equal(stale, []heartbeatKey{{Namespace: defaultNamespace, ID: "web.old"}}) {
+			t.Fatalf("unexpected stale heartbeats %v, %v", stale, err)
+		}
+	})
+}
+
+func TestStoreHistory(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		for i := range 3 {
+			mustPut(t, s, workerKey, base.Add(time.Duration(i)*time.Minute), PutOptions{})
+		}
+
+		history, err := s.History(ctx, workerKey, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 || !history[0].Equal(base.Add(2*time.Minute)) || !history[1].Equal(base.Add(time.Minute)) {
+			t.Fatalf("expected the two most recent arrivals first, got %v", history)
+		}
+
+		trimmed, err := s.TrimHistory(ctx, base.Add(90*time.Second))
+		if err != nil || trimmed != 2 {
+			t.Fatalf("expected 2 arrivals to be trimmed, got %d, %v", trimmed, err)
+		}
+		if history, _ := s.History(ctx, workerKey, 10); len(history) != 1 {
+			t.Fatalf("expected a single arrival left, got %v", history)
+		}
+	})
+}
+
+func TestStoreArrivals(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		for i := range 4 {
+			mustPut(t, s, workerKey, base.Add(time.Duration(i)*time.Minute), PutOptions{})
+		}
+		mustPut(t, s, teamKey, base.Add(2*time.Minute), PutOptions{})
+
+		var arrivals []time.Time
+		if err := s.Arrivals(ctx, workerKey, base.Add(time.Minute), func(at time.Time) error {
+			arrivals = append(arrivals, at)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := []time.Time{base.Add(time.Minute), base.Add(2 * time.Minute), base.Add(3 * time.Minute)}
+		if !slices.EqualFunc(arrivals, want, time.Time.Equal) {
+			t.Fatalf("expected the arrivals since the cutoff oldest first, got %v", arrivals)
+		}
+
+		stop := errors.New("stop")
+		if err := s.Arrivals(ctx, workerKey, base, func(time.Time) error { return stop }); !errors.Is(err, stop) {
+			t.Fatalf("expected the callback's error to be returned, got %v", err)
+		}
+	})
+}
+
+func TestStoreSetIntervals(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "web.api"}, base, PutOptions{})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "batch"}, base, PutOptions{})
+
+		updated, err := s.SetIntervals(context.Background(), defaultNamespace, "web.", 30*time.Second)
+		if err != nil || updated != 1 {
+			t.Fatalf("expected 1 heartbeat to be updated, got %d, %v", updated, err)
+		}
+		if hb := mustGet(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "web.api"}); hb.TTL != seconds(30) {
+			t.Fatalf("expected the interval to be stored, got %+v", hb.TTL)
+		}
+	})
+}
+
+func TestStoreMute(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		until := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+		if err := s.Mute(ctx, workerKey, until); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound muting a missing heartbeat, got %v", err)
+		}
+
+		mustPut(t, s, workerKey, storeTestBase(), PutOptions{})
+		if err := s.Mute(ctx, workerKey, until); err != nil {
+			t.Fatal(err)
+		}
+		if hb := mustGet(t, s, workerKey); !hb.MutedUntil.Equal(until) {
+			t.Fatalf("expected the heartbeat to be muted until %v, got %v", until, hb.MutedUntil)
+		}
+	})
+}
+
+func TestStoreMetadataLimit(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if _, ok, err := s.MetadataLimit(ctx, workerKey); err != nil || ok {
+			t.Fatalf("expected no override, got %v, %v", ok, err)
+		}
+
+		if err := s.SetMetadataLimit(ctx, workerKey, 10); err != nil {
+			t.Fatal(err)
+		}
+		if limit, ok, err := s.MetadataLimit(ctx, workerKey); err != nil || !ok || limit != 10 {
+			t.Fatalf("expected an override of 10, got %d, %v, %v", limit, ok, err)
+		}
+
+		if err := s.SetMetadataLimit(ctx, workerKey, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := s.MetadataLimit(ctx, workerKey); err != nil || ok {
+			t.Fatalf("expected the override to be removed, got %v, %v", ok, err)
+		}
+	})
+}
+
+func TestStoreBanner(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if _, ok, err := s.Banner(ctx); err != nil || ok {
+			t.Fatalf("expected no banner, got %v, %v", ok, err)
+		}
+
+		now := storeTestBase()
+		if err := s.SetBanner(ctx, "maintenance", now); err != nil {
+			t.Fatal(err)
+		}
+		if banner, ok, err := s.Banner(ctx); err != nil || !ok || banner.Message != "maintenance" || !banner.UpdatedAt.Equal(now) {
+			t.Fatalf("unexpected banner %+v, %v, %v", banner, ok, err)
+		}
+
+		if err := s.SetBanner(ctx, "", now); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := s.Banner(ctx); err != nil || ok {
+			t.Fatalf("expected the banner to be cleared, got %v, %v", ok, err)
+		}
+	})
+}
+
+func TestStoreNotifications(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		mustPut(t, s, workerKey, base, PutOptions{InitialTTL: seconds(60), AlertURL: text("https://alerts.example.com/worker")})
+		mustPut(t, s, teamKey, base, PutOptions{InitialTTL: seconds(60)})
+		now := base.Add(time.Hour)
+
+		expired, err := s.ExpiredUnnotified(ctx, now)
+		if err != nil || len(expired) != 2 {
+			t.Fatalf("expected 2 unnotified heartbeats, got %+v, %v", expired, err)
+		}
+		e := expired[0]
+		if e.notification.ID != "worker" || e.url != "https://alerts.example.com/worker" || !e.notification.ExpiredAt.Equal(base.Add(time.Minute)) {
+			t.Fatalf("unexpected unnotified heartbeat %+v", e)
+		}
+
+		if err := s.QueueWebhook(ctx, webhookDelivery{url: e.url, payload: []byte(`{}`)}, expired[:1], now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Mute(ctx, teamKey, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if expired, err := s.ExpiredUnnotified(ctx, now); err != nil || len(expired) != 0 {
+			t.Fatalf("expected notified and muted heartbeats to be left out, got %+v, %v", expired, err)
+		}
+
+		// Once the mute runs out the heartbeat is due again, but a report
+		// arriving after its stamp was read keeps it from being recorded.
+		later := now.Add(2 * time.Hour)
+		due, err := s.ExpiredUnnotified(ctx, later)
+		if err != nil || len(due) != 1 || due[0].notification.Namespace != "team" {
+			t.Fatalf("expected the muted heartbeat once the mute ran out, got %+v, %v", due, err)
+		}
+		mustPut(t, s, teamKey, base.Add(time.Minute), PutOptions{})
+		if err := s.QueueWebhook(ctx, webhookDelivery{url: "https://alerts.example.com", payload: []byte(`{}`)}, due, later); err != nil {
+			t.Fatal(err)
+		}
+		if expired, _ := s.ExpiredUnnotified(ctx, later); len(expired) != 1 {
+			t.Fatalf("expected a heartbeat updated since the stamp to stay unnotified, got %+v", expired)
+		}
+	})
+}
+
+func TestStoreWebhookQueue(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		now := storeTestBase()
+		for _, key := range []heartbeatKey{workerKey, teamKey} {
+			d := webhookDelivery{url: "https://alerts.example.com/" + key.ID, payload: []byte(`{"id":"` + key.ID + `"}`), heartbeats: []heartbeatKey{key}}
+			if err := s.QueueWebhook(ctx, d, nil, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		due, err := s.DueWebhooks(ctx, now)
+		if err != nil || len(due) != 2 {
+			t.Fatalf("expected both deliveries to be due, got %+v, %v", due, err)
+		}
+		worker, team := due[0], due[1]
+		if worker.url != "https://alerts.example.com/worker" || string(worker.payload) != `{"id":"worker"}` || len(worker.heartbeats) != 1 || worker.heartbeats[0] != workerKey || worker.attempts != 0 {
+			t.Fatalf("unexpected delivery %+v", worker)
+		}
+
+		worker.attempts, worker.lastError = 1, "webhook responded with 502 Bad Gateway"
+		if err := s.RetryWebhook(ctx, worker, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		team.attempts, team.lastError = 3, "connection refused"
+		if err := s.DeadLetterWebhook(ctx, team, now); err != nil {
+			t.Fatal(err)
+		}
+		if due, err := s.DueWebhooks(ctx, now); err != nil || len(due) != 0 {
+			t.Fatalf("expected nothing due before the retry, got %+v, %v", due, err)
+		}
+		due, err = s.DueWebhooks(ctx, now.Add(time.Hour))
+		if err != nil || len(due) != 1 || due[0].id != worker.id || due[0].attempts != 1 || due[0].lastError != worker.lastError {
+			t.Fatalf("expected only the retried delivery to come due, got %+v, %v", due, err)
+		}
+
+		if err := s.CompleteWebhook(ctx, worker.id); err != nil {
+			t.Fatal(err)
+		}
+		if due, err := s.DueWebhooks(ctx, now.Add(time.Hour)); err != nil || len(due) != 0 {
+			t.Fatalf("expected the delivered delivery to leave the queue, got %+v, %v", due, err)
+		}
+	})
+}
+
+func TestStoreReapExpired(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		mustPut(t, s, workerKey, base, PutOptions{InitialTTL: seconds(60)})
+		mustPut(t, s, teamKey, base.Add(30*time.Minute), PutOptions{InitialTTL: seconds(60)})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "no-ttl"}, base, PutOptions{})
+
+		reaped, err := s.ReapExpired(ctx, 10*time.Minute, 0, base.Add(time.Hour))
+		if err != nil || reaped != 2 {
+			t.Fatalf("expected 2 heartbeats to be reaped, got %d, %v", reaped, err)
+		}
+		if _, err := s.Get(ctx, workerKey); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected the reaped heartbeat to be gone, got %v", err)
+		}
+		mustGet(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "no-ttl"})
+
+		reaped, err = s.ReapExpired(ctx, 10*time.Minute, 0, base.Add(time.Hour))
+		if err != nil || reaped != 0 {
+			t.Fatalf("expected nothing left to reap, got %d, %v", reaped, err)
+		}
+	})
+}
+
+func TestStoreReapExpiredNewGrace(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		base := storeTestBase()
+		// old was created an hour before it went quiet, new only reported
+		// once, both are stale by now.
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "old"}, base, PutOptions{InitialTTL: seconds(60)})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "old"}, base.Add(time.Hour), PutOptions{})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "new"}, base.Add(time.Hour), PutOptions{InitialTTL: seconds(60)})
+
+		reaped, err := s.ReapExpired(ctx, time.Minute, 2*time.Hour, base.Add(150*time.Minute))
+		if err != nil || reaped != 1 {
+			t.Fatalf("expected only the old heartbeat to be reaped, got %d, %v", reaped, err)
+		}
+		if _, err := s.Get(ctx, heartbeatKey{Namespace: defaultNamespace, ID: "old"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected the old heartbeat to be gone, got %v", err)
+		}
+		mustGet(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "new"})
+
+		reaped, err = s.ReapExpired(ctx, time.Minute, 2*time.Hour, base.Add(5*time.Hour))
+		if err != nil || reaped != 1 {
+			t.Fatalf("expected the new heartbeat to be reaped once its grace ran out, got %d, %v", reaped, err)
+		}
+	})
+}
+
+func TestStoreMetadataPatch(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		patch := func(at time.Time, doc string, maxBytes int64) error {
+			return s.Put(context.Background(), workerKey, at, PutOptions{
+				MetadataPatch:    text(doc),
+				MaxMetadataBytes: maxBytes,
+			})
+		}
+
+		// A new heartbeat starts from an empty object.
+		if err := patch(base, `{"a":1,"b":{"c":2,"x":"<&>"}}`, 100); err != nil {
+			t.Fatal(err)
+		}
+		if hb := mustGet(t, s, workerKey); hb.Metadata != text(`{"a":1,"b":{"c":2,"x":"<&>"}}`) {
+			t.Fatalf("expected the patch as the metadata of a new heartbeat, got %+v", hb.Metadata)
+		}
+
+		if err := patch(base.Add(time.Minute), `{"b":{"c":null,"d":3},"e":"x"}`, 100); err != nil {
+			t.Fatal(err)
+		}
+		// SQLite appends new keys, fsStore sorts them.
+		if hb := mustGet(t, s, workerKey); hb.Metadata != text(`{"a":1,"b":{"x":"<&>","d":3},"e":"x"}`) &&
+			hb.Metadata != text(`{"a":1,"b":{"d":3,"x":"<&>"},"e":"x"}`) {
+			t.Fatalf("expected the patch to be merged, got %+v", hb.Metadata)
+		}
+
+		if err := patch(base.Add(2*time.Minute), `{"big":"xxxxxxxxxxxxxxxxxxxx"}`, 40); !errors.Is(err, ErrMetadataTooLarge) {
+			t.Fatalf("expected ErrMetadataTooLarge, got %v", err)
+		}
+		hb := mustGet(t, s, workerKey)
+		if !hb.LastUpdatedAt.Equal(base.Add(time.Minute)) || len(hb.Metadata.String) > 40 {
+			t.Fatalf("expected a rejected patch to leave the heartbeat untouched, got %+v", hb)
+		}
+		if history, err := s.History(context.Background(), workerKey, 10); err != nil || len(history) != 2 {
+			t.Fatalf("expected a rejected patch to record no arrival, got %v, %v", history, err)
+		}
+	})
+}
+
+func TestStoreSLATarget(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		target := sql.NullFloat64{Float64: 99.9, Valid: true}
+		mustPut(t, s, workerKey, base, PutOptions{SLATarget: target})
+		mustPut(t, s, workerKey, base.Add(time.Minute), PutOptions{})
+		if hb := mustGet(t, s, workerKey); hb.SLATarget != target {
+			t.Fatalf("expected the sla target to be kept, got %+v", hb.SLATarget)
+		}
+	})
+}
+
+func TestStoreListHasMeta(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		base := storeTestBase()
+		for id, metadata := range map[string]string{
+			"a": `{"labels":{"region":"eu"}}`,
+			"b": `{"labels":{"region":null}}`,
+			"c": `{"labels":"eu"}`,
+		} {
+			mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: id}, base, PutOptions{Metadata: text(metadata)})
+		}
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "d"}, base, PutOptions{})
+
+		for key, want := range map[string][]string{
+			"labels":        {"a", "b", "c"},
+			"labels.region": {"a"},
+			"region":        nil,
+		} {
+			var ids []string
+			err := s.List(context.Background(), ListQuery{Namespace: defaultNamespace, Cutoff: base, HasMeta: key, Limit: 10}, func(hb HeartbeatStatus) error {
+				ids = append(ids, hb.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids, want) {
+				t.Errorf("%s: expected %v, got %v", key, want, ids)
+			}
+		}
+	})
+}
+
+func TestStoreRegisterParents(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		cf.RegisterParents = true
+		base := storeTestBase()
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "team.svc.inst"}, base, PutOptions{InitialTTL: seconds(60)})
+
+		parent := heartbeatKey{Namespace: defaultNamespace, ID: "team.svc"}
+		if hb := mustGet(t, s, parent); !hb.Pending || hb.TTL.Valid {
+			t.Fatalf("expected a pending parent without a ttl, got %+v", hb)
+		}
+		snapshot, err := s.Snapshot(context.Background())
+		if err != nil || len(snapshot.Heartbeats) != 1 {
+			t.Fatalf("expected pending parents to be left out of snapshots, got %+v, %v", snapshot, err)
+		}
+
+		reported := base.Add(time.Minute)
+		mustPut(t, s, parent, reported, PutOptions{InitialTTL: seconds(120)})
+		if hb := mustGet(t, s, parent); hb.Pending || hb.TTL != seconds(120) || !hb.CreatedAt.Equal(reported) {
+			t.Fatalf("expected the parent to be created by its first report, got %+v", hb)
+		}
+	})
+}
+
+func TestStoreNocase(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		if err := applyIDCollation(db, idCollationNocase); err != nil {
+			t.Fatal(err)
+		}
+		cf.IDCollation = idCollationNocase
+		ctx := context.Background()
+		base := storeTestBase()
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "Worker"}, base, PutOptions{InitialTTL: seconds(60)})
+		mustPut(t, s, heartbeatKey{Namespace: defaultNamespace, ID: "WORKER"}, base.Add(time.Minute), PutOptions{})
+
+		if hb := mustGet(t, s, workerKey); hb.TTL != seconds(60) || !hb.LastUpdatedAt.Equal(base.Add(time.Minute)) {
+			t.Fatalf("expected ids differing in case to be the same heartbeat, got %+v", hb)
+		}
+		if history, err := s.History(ctx, workerKey, 10); err != nil || len(history) != 2 {
+			t.Fatalf("expected the history of both reports, got %v, %v", history, err)
+		}
+		var keys []heartbeatKey
+		if err := s.Keys(ctx, func(key heartbeatKey) { keys = append(keys, key) }); err != nil || len(keys) != 1 {
+			t.Fatalf("expected a single key, got %v, %v", keys, err)
+		}
+		if updated, err := s.SetIntervals(ctx, defaultNamespace, "WORK", time.Minute); err != nil || updated != 1 {
+			t.Fatalf("expected the prefix to match case-insensitively, got %d, %v", updated, err)
+		}
+		if err := s.Delete(ctx, workerKey); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, heartbeatKey{Namespace: defaultNamespace, ID: "Worker"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected the heartbeat to be deleted, got %v", err)
+		}
+	})
+}
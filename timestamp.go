@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// storedTimeFormat is the format heartbeats are written with. Parsing it also
+// accepts the whole-second values written before sub-second precision was
+// kept.
+const storedTimeFormat = time.RFC3339Nano
+
+// legacyTimeFormats are formats that have ended up in the heartbeats table
+// through older writers or manual edits. Values in these formats are still
+// meaningful and can be rewritten in storedTimeFormat.
+var legacyTimeFormats = []string{
+	time.DateTime,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// truncateTimestamp drops the components of a heartbeat timestamp below
+// --timestamp-precision before it is stored.
+func truncateTimestamp(t time.Time) time.Time {
+	return t.Truncate(cf.TimestampPrecision)
+}
+
+// errCorruptTimestamp is returned by parseStoredTime when a value does not
+// match any known format.
+var errCorruptTimestamp = errors.New("corrupt timestamp")
+
+// parseStoredTime parses a last_updated_at value read from the database.
+// legacy reports whether the value was in one of the legacyTimeFormats and
+// should be repaired.
+func parseStoredTime(value string) (t time.Time, legacy bool, err error) {
+	if t, err := time.Parse(storedTimeFormat, value); err == nil {
+		return t, false, nil
+	}
+
+	for _, format := range legacyTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.UTC(), true, nil
+		}
+	}
+
+	return time.Time{}, false, fmt.Errorf("%w: %q", errCorruptTimestamp, value)
+}
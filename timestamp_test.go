@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseStoredTime(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value  string
+		legacy bool
+	}{
+		{"2024-01-02T03:04:05Z", false},
+		{"2024-01-02T03:04:05.000000000Z", false},
+		{"2024-01-02 03:04:05", true},
+		{"2024-01-02 03:04:05 +0000 UTC", true},
+		{"Tue, 02 Jan 2024 03:04:05 +0000", true},
+		{"Tue, 02 Jan 2024 03:04:05 UTC", true},
+	}
+	for _, tt := range tests {
+		got, legacy, err := parseStoredTime(tt.value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(want) || legacy != tt.legacy {
+			t.Errorf("%q: got %v legacy=%v, want %v legacy=%v", tt.value, got, legacy, want, tt.legacy)
+		}
+	}
+}
+
+func TestParseStoredTimeCorrupt(t *testing.T) {
+	for _, value := range []string{"", "yesterday", "2024-13-45T99:00:00Z"} {
+		if _, _, err := parseStoredTime(value); !errors.Is(err, errCorruptTimestamp) {
+			t.Errorf("%q: expected errCorruptTimestamp, got %v", value, err)
+		}
+	}
+}
+
+func TestGetRepairsLegacyTimestamp(t *testing.T) {
+	setupTest(t)
+	stamp := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	insertHeartbeat(t, "legacy", stamp.Format(time.DateTime), sql.NullInt64{})
+
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/legacy?ttl=5m", ""), http.StatusOK)
+	if got, want := storedLastUpdatedAt(t, "legacy"), stamp.Format(storedTimeFormat); got != want {
+		t.Fatalf("expected the legacy date to be rewritten as %q, got %q", want, got)
+	}
+}
+
+func TestGetCorruptTimestamp(t *testing.T) {
+	setupTest(t)
+	insertHeartbeat(t, "corrupt", "not a date", sql.NullInt64{})
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/corrupt?ttl=5m", ""), http.StatusInternalServerError, "corrupt_timestamp")
+	if got := storedLastUpdatedAt(t, "corrupt"); got != "not a date" {
+		t.Fatalf("expected a corrupt date to be left alone, got %q", got)
+	}
+}
+
+func TestTimestampPrecision(t *testing.T) {
+	reportedAt := time.Date(2026, 3, 1, 12, 34, 56, 789123456, time.UTC)
+	for _, tc := range []struct {
+		precision string
+		want      time.Time
+	}{
+		{"0s", reportedAt},
+		{"1ms", time.Date(2026, 3, 1, 12, 34, 56, 789000000, time.UTC)},
+		{"1s", time.Date(2026, 3, 1, 12, 34, 56, 0, time.UTC)},
+		{"1m", time.Date(2026, 3, 1, 12, 34, 0, 0, time.UTC)},
+	} {
+		setupTest(t, "--timestamp-precision", tc.precision)
+		useFakeClock(t, reportedAt)
+		h := internalRouter()
+		expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+		expectStatus(t, serve(h, http.MethodPost, "/batch", `[{"id":"batched"}]`), http.StatusNoContent)
+
+		for _, id := range []string{"worker", "batched"} {
+			stored, _, err := parseStoredTime(storedLastUpdatedAt(t, id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.Equal(tc.want) {
+				t.Errorf("precision %s: expected %s to be stored as %v, got %v", tc.precision, id, tc.want, stored)
+			}
+		}
+	}
+}
+
+func TestQuickSuccessionTimestampsDiffer(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	first := storedLastUpdatedAt(t, "worker")
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	second := storedLastUpdatedAt(t, "worker")
+	if first == second {
+		t.Fatalf("expected heartbeats in the same second to be told apart, both stored %q", first)
+	}
+
+	firstAt, _, err := parseStoredTime(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondAt, _, err := parseStoredTime(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secondAt.After(firstAt) {
+		t.Fatalf("expected %q to be stored after %q", second, first)
+	}
+}
+
+func TestGetPreservesNanoseconds(t *testing.T) {
+	setupTest(t)
+	reportedAt := time.Date(2026, 3, 1, 12, 34, 56, 789123456, time.UTC)
+	useFakeClock(t, reportedAt)
+
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=1m", "")
+	expectStatus(t, w, http.StatusOK)
+	var raw struct {
+		LastUpdatedAt string `json:"last_updated_at"`
+	}
+	decodeBody(t, w, &raw)
+	if raw.LastUpdatedAt != "2026-03-01T12:34:56.789123456Z" {
+		t.Fatalf("expected nanosecond precision in the response, got %q", raw.LastUpdatedAt)
+	}
+}
+
+func TestGetWholeSecondTimestamp(t *testing.T) {
+	setupTest(t)
+	stamp := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	insertHeartbeat(t, "worker", stamp.Format(time.RFC3339), sql.NullInt64{})
+
+	if hb := getHeartbeat(t, "worker", "?ttl=5m"); !hb.LastUpdatedAt.Equal(stamp) {
+		t.Fatalf("expected the whole-second date %v to load, got %v", stamp, hb.LastUpdatedAt)
+	}
+}
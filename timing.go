@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type serverTimingKey struct{}
+
+// serverTiming accumulates the time a request spends in each phase.
+type serverTiming struct {
+	start time.Time
+
+	mu sync.Mutex
+	db time.Duration
+}
+
+// recordDBTime adds the time since start to the request's db phase.
+func recordDBTime(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(serverTimingKey{}).(*serverTiming); ok {
+		t.mu.Lock()
+		t.db += time.Since(start)
+		t.mu.Unlock()
+	}
+}
+
+func (t *serverTiming) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("db;dur=%.3f, total;dur=%.3f", durationMillis(t.db), durationMillis(time.Since(t.start)))
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timingResponseWriter sets the Server-Timing header just before the
+// response headers are written.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (w *timingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timing.header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withServerTiming reports how long each request spent in the database and
+// in total through a Server-Timing header.
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &serverTiming{start: time.Now()}
+		ctx := context.WithValue(r.Context(), serverTimingKey{}, timing)
+		next.ServeHTTP(&timingResponseWriter{ResponseWriter: w, timing: timing}, r.WithContext(ctx))
+	})
+}
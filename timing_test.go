@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseServerTiming parses a Server-Timing header into durations by metric
+// name.
+func parseServerTiming(t *testing.T, header string) map[string]float64 {
+	t.Helper()
+	metrics := map[string]float64{}
+	for _, metric := range strings.Split(header, ",") {
+		name, params, ok := strings.Cut(strings.TrimSpace(metric), ";")
+		dur, found := strings.CutPrefix(params, "dur=")
+		if !ok || !found {
+			t.Fatalf("invalid Server-Timing metric %q in %q", metric, header)
+		}
+		d, err := strconv.ParseFloat(dur, 64)
+		if err != nil || d < 0 {
+			t.Fatalf("invalid Server-Timing duration %q in %q", dur, header)
+		}
+		metrics[name] = d
+	}
+	return metrics
+}
+
+func TestServerTiming(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	h := withServerTiming(externalRouter())
+
+	for _, target := range []string{"/worker?ttl=1m", "/missing?ttl=1m", "/?ttl=1m"} {
+		w := serve(h, http.MethodGet, target, "")
+		header := w.Header().Get("Server-Timing")
+		if header == "" {
+			t.Fatalf("GET %s: expected a Server-Timing header", target)
+		}
+		metrics := parseServerTiming(t, header)
+		db, hasDB := metrics["db"]
+		total, hasTotal := metrics["total"]
+		if !hasDB || !hasTotal {
+			t.Fatalf("GET %s: expected db and total metrics, got %q", target, header)
+		}
+		if db > total {
+			t.Fatalf("GET %s: expected db time within the total, got %q", target, header)
+		}
+	}
+}
+
+func TestServerTimingOnNoContent(t *testing.T) {
+	setupTest(t)
+
+	w := serve(withServerTiming(internalRouter()), http.MethodPut, "/worker", "")
+	expectStatus(t, w, http.StatusNoContent)
+	parseServerTiming(t, w.Header().Get("Server-Timing"))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// validTLSConfig checks that --tls-cert and --tls-key are given together, and
+// that a client CA is only given along with them.
+func validTLSConfig(cert, key, clientCA string) error {
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+	if clientCA != "" && cert == "" {
+		return fmt.Errorf("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+	return nil
+}
+
+func tlsEnabled() bool {
+	return cf.TLSCert != ""
+}
+
+// listenAndServe serves srv over HTTPS when TLS is configured and over plain
+// HTTP otherwise.
+func listenAndServe(srv *http.Server) error {
+	if tlsEnabled() {
+		return srv.ListenAndServeTLS(cf.TLSCert, cf.TLSKey)
+	}
+	return srv.ListenAndServe()
+}
+
+// clientCAs holds the pool client certificates are verified against, swapped
+// on SIGHUP.
+var clientCAs atomic.Pointer[x509.CertPool]
+
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// newInternalTLSConfig asks internal server clients for a certificate when
+// --tls-client-ca is set, verified against the current clientCAs. The config
+// is assembled per handshake as ClientCAs can't be replaced once the server
+// is listening. Connections without a certificate are still accepted, so
+// probes work, requireClientCert rejects their other requests.
+func newInternalTLSConfig() (*tls.Config, error) {
+	if cf.TLSClientCA == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cf.TLSCert, cf.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	base := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientCAs = clientCAs.Load()
+			return config, nil
+		},
+	}, nil
+}
+
+// requireClientCert rejects requests over connections without a verified
+// client certificate while --tls-client-ca is set, except GETs of the
+// probePaths.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cf.TLSClientCA == "" || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0) ||
+			(r.Method == http.MethodGet && probePaths[r.URL.Path]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeJSONError(w, http.StatusUnauthorized, "client_certificate_required", "a client certificate from --tls-client-ca is required")
+	})
+}
+
+// runClientCAReloader reloads --tls-client-ca on every SIGHUP until ctx is
+// done. A bundle that fails to load is logged and the previous one is kept.
+func runClientCAReloader(ctx context.Context, logger *slog.Logger) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			pool, err := loadClientCAs(cf.TLSClientCA)
+			if err != nil {
+				logger.Error("failed to reload client CA bundle, keeping the previous one", "error", err)
+				continue
+			}
+			clientCAs.Store(pool)
+			logger.Info("reloaded client CA bundle", "path", cf.TLSClientCA)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// path is the PEM file of the CA certificate.
+	path string
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{}
+	ca.cert, ca.key = issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	ca.path = filepath.Join(t.TempDir(), name+".pem")
+	writePEM(t, ca.path, "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue writes a certificate for name signed by ca and its key, returning
+// their paths. Server certificates are valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, name string, server bool) (certPath, keyPath string) {
+	t.Helper()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	cert, key := issueCert(t, template, ca.cert, ca.key)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", cert.Raw)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+// issueCert signs template with parentKey, or self-signs it when parent is
+// nil.
+func issueCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template.SerialNumber = big.NewInt(testSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidTLSConfig(t *testing.T) {
+	tests := []struct {
+		cert, key, clientCA string
+		valid               bool
+	}{
+		{"", "", "", true},
+		{"cert.pem", "key.pem", "", true},
+		{"cert.pem", "key.pem", "ca.pem", true},
+		{"cert.pem", "", "", false},
+		{"", "key.pem", "", false},
+		{"", "", "ca.pem", false},
+		{"cert.pem", "", "ca.pem", false},
+	}
+	for _, tt := range tests {
+		err := validTLSConfig(tt.cert, tt.key, tt.clientCA)
+		if (err == nil) != tt.valid {
+			t.Errorf("cert %q key %q client ca %q: expected valid=%v, got %v", tt.cert, tt.key, tt.clientCA, tt.valid, err)
+		}
+	}
+}
+
+func TestTLSFlagsFailFast(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "server", true)
+
+	if err := runUntilSignal(t, "--tls-cert", cert); err == nil || err.Error() != "--tls-cert and --tls-key must be set together" {
+		t.Fatalf("expected a lone --tls-cert to be rejected, got %v", err)
+	}
+	if err := runUntilSignal(t, "--tls-key", key); err == nil || err.Error() != "--tls-cert and --tls-key must be set together" {
+		t.Fatalf("expected a lone --tls-key to be rejected, got %v", err)
+	}
+}
+
+func TestShutdownUnderTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "server", true)
+
+	if err := runUntilSignal(t, "--tls-cert", cert, "--tls-key", key); err != nil {
+		t.Fatalf("expected a clean shutdown under TLS, got %v", err)
+	}
+}
+
+// startMTLSServer serves the internal router over TLS as run does with
+// --tls-client-ca set, returning its URL and a pool trusting its certificate.
+func startMTLSServer(t *testing.T, clientCA string) (string, *x509.CertPool) {
+	t.Helper()
+	serverCA := newTestCA(t, "server-ca")
+	cert, key := serverCA.issue(t, "server", true)
+	setupTest(t, "--tls-cert", cert, "--tls-key", key, "--tls-client-ca", clientCA)
+
+	pool, err := loadClientCAs(cf.TLSClientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs.Store(pool)
+	t.Cleanup(func() {
+		clientCAs.Store(nil)
+	})
+	config, err := newInternalTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: requireClientCert(internalRouter()), TLSConfig: config}
+	go func() {
+		_ = server.ServeTLS(ln, cf.TLSCert, cf.TLSKey)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	return "https://" + ln.Addr().String(), roots
+}
+
+// mtlsRequest sends a request over a new connection, presenting the client
+// certificate at certPath unless it is empty. It returns the response status,
+// or 0 when the handshake was refused.
+func mtlsRequest(t *testing.T, roots *x509.CertPool, method, url, certPath, keyPath string) int {
+	t.Helper()
+	config := &tls.Config{RootCAs: roots}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	oldCA := newTestCA(t, "client-ca")
+	url, roots := startMTLSServer(t, oldCA.path)
+	cert, key := oldCA.issue(t, "client", false)
+	strangerCert, strangerKey := newTestCA(t, "stranger-ca").issue(t, "stranger", false)
+
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", cert, key); status != http.StatusNoContent {
+		t.Fatalf("expected a trusted client certificate to be accepted, got %d", status)
+	}
+	// The server only asks for certificates from the CAs it trusts, so an
+	// untrusted one isn't even presented.
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", strangerCert, strangerKey); status != http.StatusUnauthorized {
+		t.Fatalf("expected an untrusted client certificate to be rejected with 401, got %d", status)
+	}
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", "", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected a request without a client certificate to be rejected with 401, got %d", status)
+	}
+	if status := mtlsRequest(t, roots, http.MethodGet, url+"/healthz", "", ""); status != http.StatusOK {
+		t.Fatalf("expected probes to need no client certificate, got %d", status)
+	}
+}
+
+func TestClientCASwappedOnSIGHUP(t *testing.T) {
+	oldCA := newTestCA(t, "client-ca")
+	newCA := newTestCA(t, "new-client-ca")
+	url, roots := startMTLSServer(t, oldCA.path)
+	oldCert, oldKey := oldCA.issue(t, "client", false)
+	newCert, newKey := newCA.issue(t, "client", false)
+
+	// With a handler of its own registered the test binary survives a SIGHUP
+	// that arrives before the reloader has registered its listener.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGHUP)
+	defer signal.Stop(ignored)
+	var logs logRecorder
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runClientCAReloader(ctx, logs.logger())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// reload signals SIGHUP until msg is logged, as the first may arrive
+	// before the reloader listens.
+	reload := func(msg string) {
+		t.Helper()
+		self, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs.mu.Lock()
+		logs.records = nil
+		logs.mu.Unlock()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if err := self.Signal(syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+			logs.mu.Lock()
+			logged := slices.ContainsFunc(logs.records, func(record map[string]any) bool { return record["msg"] == msg })
+			logs.mu.Unlock()
+			if logged {
+				return
+			}
+		}
+		t.Fatalf("expected %q to be logged", msg)
+	}
+
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", newCert, newKey); status != http.StatusUnauthorized {
+		t.Fatalf("expected the new CA not to be trusted yet, got %d", status)
+	}
+
+	writePEM(t, oldCA.path, "CERTIFICATE", newCA.cert.Raw)
+	reload("reloaded client CA bundle")
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", newCert, newKey); status != http.StatusNoContent {
+		t.Fatalf("expected a certificate from the swapped-in CA to be accepted, got %d", status)
+	}
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", oldCert, oldKey); status != http.StatusUnauthorized {
+		t.Fatalf("expected the swapped-out CA not to be trusted, got %d", status)
+	}
+
+	// A broken bundle keeps the previous one.
+	if err := os.WriteFile(oldCA.path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload("failed to reload client CA bundle, keeping the previous one")
+	if status := mtlsRequest(t, roots, http.MethodPut, url+"/worker", newCert, newKey); status != http.StatusNoContent {
+		t.Fatalf("expected the previous CA to be kept, got %d", status)
+	}
+}
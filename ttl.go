@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ttlUnitAliases maps the unit spellings accepted in a ttl to the unit
+// time.ParseDuration understands. Days are not supported by ParseDuration and
+// are expanded separately.
+var ttlUnitAliases = map[string]string{
+	"ns": "ns", "nsec": "ns", "nanosecond": "ns", "nanoseconds": "ns",
+	"us": "us", "µs": "us", "usec": "us", "microsecond": "us", "microseconds": "us",
+	"ms": "ms", "msec": "ms", "millisecond": "ms", "milliseconds": "ms",
+	"s": "s", "sec": "s", "secs": "s", "second": "s", "seconds": "s",
+	"m": "m", "min": "m", "mins": "m", "minute": "m", "minutes": "m",
+	"h": "h", "hr": "h", "hrs": "h", "hour": "h", "hours": "h",
+	"d": "d", "day": "d", "days": "d",
+}
+
+var ttlComponent = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*([^0-9.\s]+)`)
+
+// parseTTL parses a ttl supplied by a client. Unless strict is set, unit
+// casing is ignored, a trailing dot is dropped and the aliases in
+// ttlUnitAliases are accepted, so "30S", "30sec" and "1d" all work. In strict
+// mode only the time.ParseDuration syntax is accepted.
+func parseTTL(value string, strict bool) (time.Duration, error) {
+	if strict {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return d, nil
+	}
+
+	rest := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), ".")
+	if rest == "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var (
+		normalized strings.Builder
+		days       time.Duration
+	)
+	for rest != "" {
+		m := ttlComponent.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		unit, ok := ttlUnitAliases[m[2]]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit %q in duration %q", m[2], value)
+		}
+		if unit == "d" {
+			d, err := time.ParseDuration(m[1] + "h")
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			days += d * 24
+		} else {
+			normalized.WriteString(m[1] + unit)
+		}
+		rest = strings.TrimSpace(rest[len(m[0]):])
+	}
+
+	if normalized.Len() == 0 {
+		return days, nil
+	}
+	d, err := time.ParseDuration(normalized.String())
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return days + d, nil
+}
+
+// How a check whose ttl resolves to zero is answered, see --zero-ttl.
+const (
+	zeroTTLReject = "reject"
+	zeroTTLExpire = "expire"
+)
+
+func validZeroTTLMode(mode string) error {
+	switch mode {
+	case zeroTTLReject, zeroTTLExpire:
+		return nil
+	}
+	return fmt.Errorf("invalid zero ttl mode %q, expected %s or %s", mode, zeroTTLReject, zeroTTLExpire)
+}
+
+// clampTTL raises ttl to the configured minimum.
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl < cf.MinTTL {
+		return cf.MinTTL
+	}
+	return ttl
+}
+
+// Names of the external endpoints a missing ttl can fall back to --default-ttl on.
+const (
+	ttlEndpointHeartbeat = "heartbeat"
+	ttlEndpointList      = "list"
+	ttlEndpointExpired   = "expired"
+	ttlEndpointGroup     = "group"
+)
+
+// defaultTTLEndpoints holds the parsed --default-ttl-endpoints.
+var defaultTTLEndpoints map[string]bool
+
+func parseDefaultTTLEndpoints(values []string) (map[string]bool, error) {
+	endpoints := map[string]bool{}
+	for _, v := range values {
+		switch v {
+		case ttlEndpointHeartbeat, ttlEndpointList, ttlEndpointExpired, ttlEndpointGroup:
+			endpoints[v] = true
+		default:
+			return nil, fmt.Errorf("invalid default ttl endpoint %q, expected %s, %s, %s or %s", v, ttlEndpointHeartbeat, ttlEndpointList, ttlEndpointExpired, ttlEndpointGroup)
+		}
+	}
+	if len(endpoints) > 0 && cf.DefaultTTL <= 0 {
+		return nil, fmt.Errorf("--default-ttl-endpoints requires --default-ttl")
+	}
+	return endpoints, nil
+}
+
+// globalDefaultTTL returns --default-ttl when endpoint is configured to fall
+// back to it on a missing ttl. Other endpoints answer such requests with 400.
+func globalDefaultTTL(endpoint string) (time.Duration, bool) {
+	if cf.DefaultTTL <= 0 || !defaultTTLEndpoints[endpoint] {
+		return 0, false
+	}
+	return cf.DefaultTTL, true
+}
+
+// prefixTTL is a default ttl for ids matching a pattern. Patterns ending in
+// "*" match by prefix, anything else must match the id exactly.
+type prefixTTL struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// prefixTTLs holds the parsed --prefix-ttl mappings.
+var prefixTTLs []prefixTTL
+
+// parsePrefixTTLs parses mappings of the form "batch.*=1h".
+func parsePrefixTTLs(values []string) ([]prefixTTL, error) {
+	var parsed []prefixTTL
+	for _, v := range values {
+		pattern, ttl, ok := strings.Cut(v, "=")
+		if !ok || pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			return nil, fmt.Errorf("invalid prefix ttl %q, expected pattern=duration", v)
+		}
+		d, err := parseTTL(ttl, cf.StrictTTLUnits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix ttl %q: %v", v, err)
+		}
+		parsed = append(parsed, prefixTTL{pattern: normalizeID(pattern), ttl: d})
+	}
+	return parsed, nil
+}
+
+// defaultTTLFor returns the ttl of the most specific mapping matching hbID.
+// An exact match wins over any prefix, and a longer prefix over a shorter one.
+// Patterns are matched under the configured id collation.
+func defaultTTLFor(hbID string) (time.Duration, bool) {
+	var (
+		best    time.Duration
+		bestLen = -1
+	)
+	hbID = foldID(hbID)
+	for _, p := range prefixTTLs {
+		prefix, isPrefix := strings.CutSuffix(foldID(p.pattern), "*")
+		switch {
+		case !isPrefix && prefix == hbID:
+			return p.ttl, true
+		case isPrefix && strings.HasPrefix(hbID, prefix) && len(prefix) > bestLen:
+			best, bestLen = p.ttl, len(prefix)
+		}
+	}
+	return best, bestLen >= 0
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTTLUnitVariants(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"30S", 30 * time.Second},
+		{"30s.", 30 * time.Second},
+		{"30sec", 30 * time.Second},
+		{"30 seconds", 30 * time.Second},
+		{"5M", 5 * time.Minute},
+		{"5mins", 5 * time.Minute},
+		{"2Hr", 2 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"1 Day 2h", 26 * time.Hour},
+		{"1.5h", 90 * time.Minute},
+		{"250MS", 250 * time.Millisecond},
+		{" 1m30s ", 90 * time.Second},
+	}
+	for _, tt := range tests {
+		got, err := parseTTL(tt.value, false)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseTTLInvalid(t *testing.T) {
+	for _, value := range []string{"", ".", "30", "30x", "s30", "1w", "1d-2h"} {
+		if _, err := parseTTL(value, false); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParseTTLStrict(t *testing.T) {
+	if d, err := parseTTL("1m30s", true); err != nil || d != 90*time.Second {
+		t.Fatalf("expected 1m30s to parse in strict mode, got %v, %v", d, err)
+	}
+	for _, value := range []string{"30S", "30sec", "1d", "30s."} {
+		if _, err := parseTTL(value, true); err == nil {
+			t.Errorf("%q: expected an error in strict mode", value)
+		}
+	}
+}
+
+func TestGetAcceptsTTLUnitVariants(t *testing.T) {
+	setupTest(t)
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	for _, ttl := range []string{"5M", "5min", "1Day", "300SEC."} {
+		expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl="+ttl, ""), http.StatusOK)
+	}
+}
+
+func TestGetStrictTTLUnits(t *testing.T) {
+	setupTest(t, "--strict-ttl-units")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=5m", ""), http.StatusOK)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=5min", ""), http.StatusBadRequest, "invalid_ttl")
+}
+
+func TestPrefixTTL(t *testing.T) {
+	setupTest(t, "--prefix-ttl", "batch.*=1h", "--prefix-ttl", "batch.nightly.*=24h", "--prefix-ttl", "web.api=30s")
+	for _, tc := range []struct {
+		id   string
+		want time.Duration
+		ok   bool
+	}{
+		{"batch.import", time.Hour, true},
+		{"batch.nightly.report", 24 * time.Hour, true},
+		{"web.api", 30 * time.Second, true},
+		{"web.api.v2", 0, false},
+		{"worker", 0, false},
+	} {
+		got, ok := defaultTTLFor(tc.id)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("defaultTTLFor(%q) = %v, %v, want %v, %v", tc.id, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPrefixTTLOnRead(t *testing.T) {
+	setupTest(t, "--prefix-ttl", "batch.*=1h")
+	h := internalRouter()
+	expectStatus(t, serve(h, http.MethodPut, "/batch.import", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	hb := getHeartbeat(t, "batch.import", "")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != time.Hour {
+		t.Fatalf("expected the prefix ttl of 1h, got %v", remaining)
+	}
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusBadRequest, "missing_ttl")
+}
+
+func TestPrefixTTLFallsBackToGlobalDefault(t *testing.T) {
+	setupTest(t, "--prefix-ttl", "batch.*=1h", "--default-ttl", "5m", "--default-ttl-endpoints", "heartbeat")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	hb := getHeartbeat(t, "worker", "")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != 5*time.Minute {
+		t.Fatalf("expected the global default of 5m, got %v", remaining)
+	}
+}
+
+func TestParsePrefixTTLsInvalid(t *testing.T) {
+	setupTest(t)
+	for _, v := range []string{"batch.*", "=1h", "a*b*=1h", "batch.*=soon"} {
+		if _, err := parsePrefixTTLs([]string{v}); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestMinTTLFloor(t *testing.T) {
+	setupTest(t, "--min-ttl", "30s")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker?ttl=1s", ""), http.StatusNoContent)
+
+	for _, query := range []string{"", "?ttl=1s", "?ttl=0s"} {
+		hb := getHeartbeat(t, "worker", query)
+		if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != 30*time.Second {
+			t.Errorf("GET /worker%s: expected the ttl to be raised to 30s, got %v", query, remaining)
+		}
+	}
+	hb := getHeartbeat(t, "worker", "?ttl=1m")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != time.Minute {
+		t.Fatalf("expected a ttl above the floor to be kept, got %v", remaining)
+	}
+}
+
+func TestMinTTLKeepsShortTTLAlive(t *testing.T) {
+	tenSecondsAgo := time.Now().Add(-10 * time.Second).UTC().Format(storedTimeFormat)
+
+	setupTest(t)
+	insertHeartbeat(t, "worker", tenSecondsAgo, sql.NullInt64{Int64: 1, Valid: true})
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusNotFound, "expired")
+
+	setupTest(t, "--min-ttl", "30s")
+	insertHeartbeat(t, "worker", tenSecondsAgo, sql.NullInt64{Int64: 1, Valid: true})
+	expectStatus(t, serve(externalRouter(), http.MethodGet, "/worker", ""), http.StatusOK)
+}
+
+func TestTTLWindow(t *testing.T) {
+	setupTest(t)
+	c := useFakeClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	c.Advance(time.Second)
+	hb := getHeartbeat(t, "worker", "?ttl=2s")
+	if remaining := hb.ExpiresAt.Sub(hb.LastUpdatedAt); remaining != 2*time.Second {
+		t.Fatalf("expected the heartbeat to expire 2s after it was last updated, got %v", remaining)
+	}
+
+	c.Advance(1500 * time.Millisecond)
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=2s", ""), http.StatusNotFound, "expired")
+}
+
+func TestDefaultTTLEndpointPolicies(t *testing.T) {
+	setupTest(t, "--default-ttl", "5m", "--default-ttl-endpoints", "list,expired")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/web.api", ""), http.StatusNoContent)
+	h := externalRouter()
+
+	// Lenient endpoints fall back to --default-ttl.
+	expectStatus(t, serve(h, http.MethodGet, "/", ""), http.StatusOK)
+	expectStatus(t, serve(h, http.MethodGet, "/expired", ""), http.StatusOK)
+
+	// Strict endpoints still require a ttl.
+	expectError(t, serve(h, http.MethodGet, "/web.api", ""), http.StatusBadRequest, "missing_ttl")
+	expectError(t, serve(h, http.MethodGet, "/groups/web./status", ""), http.StatusBadRequest, "missing_ttl")
+
+	expectStatus(t, serve(h, http.MethodGet, "/web.api?ttl=1m", ""), http.StatusOK)
+	expectStatus(t, serve(h, http.MethodGet, "/groups/web./status?ttl=1m", ""), http.StatusOK)
+}
+
+func TestDefaultTTLEndpointPolicyApplied(t *testing.T) {
+	setupTest(t, "--default-ttl", "5m", "--default-ttl-endpoints", "list")
+	c := useFakeClock(t, time.Now())
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	c.Advance(4 * time.Minute)
+	if list := listHeartbeats(t, ""); len(list) != 1 || list[0].Expired {
+		t.Fatalf("expected the heartbeat to be alive under the 5m default, got %+v", list)
+	}
+	c.Advance(2 * time.Minute)
+	if list := listHeartbeats(t, ""); len(list) != 1 || !list[0].Expired {
+		t.Fatalf("expected the heartbeat to be expired under the 5m default, got %+v", list)
+	}
+}
+
+func TestParseDefaultTTLEndpoints(t *testing.T) {
+	setupTest(t, "--default-ttl", "5m")
+	if _, err := parseDefaultTTLEndpoints([]string{"history"}); err == nil {
+		t.Error("expected an unknown endpoint to be rejected")
+	}
+
+	setupTest(t)
+	if _, err := parseDefaultTTLEndpoints([]string{ttlEndpointList}); err == nil {
+		t.Error("expected endpoints without --default-ttl to be rejected")
+	}
+}
+
+func TestZeroTTLRejected(t *testing.T) {
+	setupTest(t)
+	var logs logRecorder
+	defaultLog := httpLog
+	httpLog = logs.logger()
+	t.Cleanup(func() {
+		httpLog = defaultLog
+	})
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+	insertHeartbeat(t, "zero", time.Now().Format(storedTimeFormat), sql.NullInt64{Int64: 0, Valid: true})
+
+	w := serve(externalRouter(), http.MethodGet, "/worker?ttl=0s", "")
+	expectError(t, w, http.StatusUnprocessableEntity, "zero_ttl")
+	record := logs.waitFor(t, "ttl resolves to zero, the heartbeat can never be alive")
+	if record["level"] != "WARN" || record["id"] != "worker" || record["source"] != "query" {
+		t.Fatalf("expected a warning naming the heartbeat and ttl source, got %v", record)
+	}
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/zero", ""), http.StatusUnprocessableEntity, "zero_ttl")
+}
+
+func TestZeroTTLExpire(t *testing.T) {
+	setupTest(t, "--zero-ttl", "expire")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	expectError(t, serve(externalRouter(), http.MethodGet, "/worker?ttl=0s", ""), http.StatusNotFound, "expired")
+}
+
+func TestZeroTTLRaisedByMinTTL(t *testing.T) {
+	setupTest(t, "--min-ttl", "30s")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	getHeartbeat(t, "worker", "?ttl=0s")
+}
+
+func TestInvalidZeroTTLMode(t *testing.T) {
+	if err := validZeroTTLMode("flap"); err == nil {
+		t.Fatal("expected an unknown zero ttl mode to be rejected")
+	}
+	for _, mode := range []string{zeroTTLReject, zeroTTLExpire} {
+		if err := validZeroTTLMode(mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ExpiryNotification is the payload POSTed when a heartbeat expires.
+type ExpiryNotification struct {
+	Namespace     string    `json:"namespace"`
+	ID            string    `json:"id"`
+	LastUpdatedAt time.Time `json:"last_updated_at"`
+	ExpiredAt     time.Time `json:"expired_at"`
+}
+
+// ExpiryDigest is the payload POSTed with --alert-digest, holding every
+// heartbeat for a URL that expired since the last check.
+type ExpiryDigest struct {
+	Expired []ExpiryNotification `json:"expired"`
+}
+
+var notifyMu sync.Mutex
+
+// expiredUnnotified is a heartbeat past its stored ttl that no notification
+// has been delivered for yet. stamp is last_updated_at as stored, url its
+// alert_url or empty.
+type expiredUnnotified struct {
+	notification ExpiryNotification
+	stamp        string
+	url          string
+}
+
+// runExpiryNotifier notifies about heartbeats that crossed their stored ttl
+// every interval until ctx is done.
+func runExpiryNotifier(ctx context.Context, interval time.Duration, client *http.Client, logger *slog.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			notified, err := notifyExpired(ctx, client, logger)
+			if ctx.Err() == nil {
+				reportJobRun("expiry-webhook", err)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("failed to notify about expired heartbeats", "error", err)
+				}
+				continue
+			}
+			if len(notified) > 0 {
+				logger.Info("notified about expired heartbeats", "sent", len(notified))
+			}
+		}
+	}
+}
+
+// notifyExpired queues a notification for each heartbeat that expired since
+// the last run, to its alert_url or else --expiry-webhook-url, skipping
+// heartbeats with neither, then delivers the queued notifications that are
+// due. With --alert-digest the heartbeats sharing a URL are queued as one
+// ExpiryDigest instead. Queuing records the notification in
+// expiry_notified_at, which the next heartbeat for the id clears, so each
+// expiry is notified once. Muted heartbeats are left for the first run after
+// their mute ends. It returns the heartbeats whose notification was delivered.
+func notifyExpired(ctx context.Context, client *http.Client, logger *slog.Logger) ([]heartbeatKey, error) {
+	// Runs are serialized, so a scan racing the notifier can't notify the
+	// same expiry twice.
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	if err := queueExpired(ctx); err != nil {
+		return nil, err
+	}
+	return deliverWebhooks(ctx, client, logger)
+}
+
+// queueExpired adds the notifications for the heartbeats that expired since
+// the last run to the delivery queue.
+func queueExpired(ctx context.Context) error {
+	now := heartbeatNow()
+	expired, err := store.ExpiredUnnotified(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	if !cf.AlertDigest {
+		for _, e := range expired {
+			if url := e.webhookURL(); url != "" {
+				if err := queueWebhook(ctx, url, e.notification, []expiredUnnotified{e}, now); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var (
+		urls  []string
+		byURL = map[string][]expiredUnnotified{}
+	)
+	for _, e := range expired {
+		url := e.webhookURL()
+		if url == "" {
+			continue
+		}
+		if _, ok := byURL[url]; !ok {
+			urls = append(urls, url)
+		}
+		byURL[url] = append(byURL[url], e)
+	}
+	for _, url := range urls {
+		digest := ExpiryDigest{Expired: []ExpiryNotification{}}
+		for _, e := range byURL[url] {
+			digest.Expired = append(digest.Expired, e.notification)
+		}
+		if err := queueWebhook(ctx, url, digest, byURL[url], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueWebhook queues payload, an ExpiryNotification or ExpiryDigest, for
+// url as the notification of expired.
+func queueWebhook(ctx context.Context, url string, payload any, expired []expiredUnnotified, now time.Time) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+	d := webhookDelivery{url: url, payload: body}
+	for _, e := range expired {
+		d.heartbeats = append(d.heartbeats, heartbeatKey{Namespace: e.notification.Namespace, ID: e.notification.ID})
+	}
+	return store.QueueWebhook(ctx, d, expired, now)
+}
+
+// webhookDelivery is a notification waiting in the delivery queue, with the
+// heartbeats whose expiry it notifies and the attempts that failed so far.
+type webhookDelivery struct {
+	id         int64
+	url        string
+	payload    []byte
+	heartbeats []heartbeatKey
+	attempts   int
+	lastError  string
+}
+
+// maxWebhookBackoff caps the wait between two delivery attempts.
+const maxWebhookBackoff = time.Hour
+
+// webhookBackoff returns how long a delivery waits after its attempts-th
+// failed attempt: --webhook-retry-backoff, doubled with every further one.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := cf.WebhookRetryBackoff
+	for range attempts - 1 {
+		if backoff >= maxWebhookBackoff/2 {
+			return maxWebhookBackoff
+		}
+		backoff *= 2
+	}
+	return min(backoff, maxWebhookBackoff)
+}
+
+// deliverWebhooks POSTs every queued notification that is due and returns
+// the heartbeats of those delivered. A delivered notification leaves the
+// queue, a failed one is due again after webhookBackoff, and one that failed
+// --webhook-max-attempts times is dead-lettered: kept in the queue for
+// inspection but never sent again.
+func deliverWebhooks(ctx context.Context, client *http.Client, logger *slog.Logger) ([]heartbeatKey, error) {
+	due, err := store.DueWebhooks(ctx, heartbeatNow())
+	if err != nil {
+		return nil, err
+	}
+
+	notified := []heartbeatKey{}
+	var firstErr error
+	for _, d := range due {
+		postErr := postExpiryWebhook(ctx, client, d.url, d.payload)
+		if postErr == nil {
+			if err := store.CompleteWebhook(ctx, d.id); err != nil {
+				return notified, err
+			}
+			notified = append(notified, d.heartbeats...)
+			continue
+		}
+		if ctx.Err() != nil {
+			// Shutting down isn't the webhook failing, the attempt
+			// doesn't count.
+			return notified, postErr
+		}
+		if firstErr == nil {
+			firstErr = postErr
+		}
+
+		d.attempts++
+		d.lastError = postErr.Error()
+		now := heartbeatNow()
+		if d.attempts >= cf.WebhookMaxAttempts {
+			webhookDeadLetters.Inc()
+			logger.Error("dead-lettering expiry notification", "delivery", d.id, "heartbeats", len(d.heartbeats), "attempts", d.attempts, "error", postErr)
+			err = store.DeadLetterWebhook(ctx, d, now)
+		} else {
+			retryAt := now.Add(webhookBackoff(d.attempts))
+			logger.Warn("failed to deliver expiry notification", "delivery", d.id, "heartbeats", len(d.heartbeats), "attempts", d.attempts, "retry_at", retryAt, "error", postErr)
+			err = store.RetryWebhook(ctx, d, retryAt)
+		}
+		if err != nil {
+			return notified, err
+		}
+	}
+	return notified, firstErr
+}
+
+// webhookURL returns where the expiry of e is notified, empty for nowhere.
+func (e expiredUnnotified) webhookURL() string {
+	if e.url != "" {
+		return e.url
+	}
+	return cf.ExpiryWebhookURL
+}
+
+// QueueWebhook records the notifications on the stored date, which skips
+// heartbeats that arrived since they were read. Their notification is still
+// queued, as it was already composed.
+func (s *sqliteStore) QueueWebhook(ctx context.Context, d webhookDelivery, expired []expiredUnnotified, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	heartbeats, err := json.Marshal(d.heartbeats)
+	if err != nil {
+		return fmt.Errorf("failed to encode notified heartbeats: %v", err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stamp := now.Format(storedTimeFormat)
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO webhook_deliveries (url, payload, heartbeats, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?)
+    `, d.url, string(d.payload), string(heartbeats), stamp, stamp)
+	if err != nil {
+		return fmt.Errorf("failed to queue expiry notification: %v", err)
+	}
+	for _, e := range expired {
+		_, err := tx.ExecContext(ctx, `
+            UPDATE heartbeats SET expiry_notified_at = ?
+            WHERE namespace = ? AND id = ? AND CAST(last_updated_at AS TEXT) = ?
+        `, stamp, e.notification.Namespace, e.notification.ID, e.stamp)
+		if err != nil {
+			return fmt.Errorf("failed to record expiry notification: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) DueWebhooks(ctx context.Context, now time.Time) ([]webhookDelivery, error) {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, url, payload, heartbeats, attempts, COALESCE(last_error, '')
+        FROM webhook_deliveries
+        WHERE dead_lettered_at IS NULL AND julianday(next_attempt_at) <= julianday(?)
+        ORDER BY id
+    `, now.Format(storedTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var due []webhookDelivery
+	for rows.Next() {
+		var (
+			d                   webhookDelivery
+			payload, heartbeats string
+		)
+		if err := rows.Scan(&d.id, &d.url, &payload, &heartbeats, &d.attempts, &d.lastError); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		if err := json.Unmarshal([]byte(heartbeats), &d.heartbeats); err != nil {
+			return nil, fmt.Errorf("failed to decode the heartbeats of webhook delivery %d: %v", d.id, err)
+		}
+		d.payload = []byte(payload)
+		due = append(due, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read webhook deliveries: %v", err)
+	}
+	return due, nil
+}
+
+func (s *sqliteStore) CompleteWebhook(ctx context.Context, id int64) error {
+	defer recordDBTime(ctx, time.Now())
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove delivered webhook: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) RetryWebhook(ctx context.Context, d webhookDelivery, next time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?
+    `, d.attempts, d.lastError, next.Format(storedTimeFormat), d.id)
+	if err != nil {
+		return fmt.Errorf("failed to record failed webhook delivery: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeadLetterWebhook(ctx context.Context, d webhookDelivery, now time.Time) error {
+	defer recordDBTime(ctx, time.Now())
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE webhook_deliveries SET attempts = ?, last_error = ?, dead_lettered_at = ? WHERE id = ?
+    `, d.attempts, d.lastError, now.Format(storedTimeFormat), d.id)
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter webhook delivery: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ExpiredUnnotified(ctx context.Context, now time.Time) ([]expiredUnnotified, error) {
+	defer recordDBTime(ctx, time.Now())
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT namespace, id, CAST(last_updated_at AS TEXT), ttl_seconds, COALESCE(alert_url, '')
+        FROM heartbeats
+        WHERE ttl_seconds IS NOT NULL
+            AND expiry_notified_at IS NULL
+            AND julianday(last_updated_at) + MAX(ttl_seconds, ?2) / 86400.0 < julianday(?1)
+            AND (muted_until IS NULL OR julianday(muted_until) <= julianday(?1))
+        ORDER BY namespace, id
+    `, now.Format(storedTimeFormat), cf.MinTTL.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired heartbeats: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var expired []expiredUnnotified
+	for rows.Next() {
+		var (
+			e          expiredUnnotified
+			ttlSeconds int64
+		)
+		if err := rows.Scan(&e.notification.Namespace, &e.notification.ID, &e.stamp, &ttlSeconds, &e.url); err != nil {
+			return nil, fmt.Errorf("failed to scan heartbeat: %v", err)
+		}
+		lastUpdatedAt, _, err := parseStoredTime(e.stamp)
+		if err != nil {
+			slog.Warn("skipping heartbeat with a corrupt last updated at date in expiry notifications", "namespace", e.notification.Namespace, "id", e.notification.ID, "value", e.stamp)
+			continue
+		}
+		e.notification.LastUpdatedAt = lastUpdatedAt
+		e.notification.ExpiredAt = lastUpdatedAt.Add(clampTTL(time.Duration(ttlSeconds) * time.Second))
+		expired = append(expired, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read heartbeats: %v", err)
+	}
+	return expired, nil
+}
+
+// postExpiryWebhook POSTs body, an encoded ExpiryNotification or
+// ExpiryDigest, to url.
+func postExpiryWebhook(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", redactURLError(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
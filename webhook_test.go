@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is an httptest.Server collecting the expiry notifications
+// POSTed to it.
+type webhookRecorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []ExpiryNotification
+}
+
+func newWebhookRecorder(t *testing.T) *webhookRecorder {
+	t.Helper()
+	rec := &webhookRecorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n ExpiryNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("failed to decode notification: %v", err)
+		}
+		rec.mu.Lock()
+		rec.received = append(rec.received, n)
+		rec.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *webhookRecorder) ids() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	ids := []string{}
+	for _, n := range rec.received {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+// runNotifier runs a single pass of the expiry notifier.
+func runNotifier(t *testing.T) []heartbeatKey {
+	t.Helper()
+	notified, err := notifyExpired(context.Background(), http.DefaultClient, slog.Default())
+	if err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	return notified
+}
+
+// insertExpired writes a heartbeat in the default namespace whose 1m ttl ran
+// out an hour ago.
+func insertExpired(t *testing.T, id string) {
+	t.Helper()
+	insertHeartbeat(t, id, time.Now().UTC().Add(-time.Hour).Format(storedTimeFormat), sql.NullInt64{Int64: 60, Valid: true})
+}
+
+func TestAlertURLOverridesGlobalWebhook(t *testing.T) {
+	global := newWebhookRecorder(t)
+	perID := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", global.URL)
+
+	insertExpired(t, "own")
+	insertExpired(t, "shared")
+	expectStatus(t, serve(internalRouter(), http.MethodPut, "/own?alert_url="+perID.URL, ""), http.StatusNoContent)
+	// Recording the alert_url also refreshed own, expire it again.
+	if _, err := db.Exec(`UPDATE heartbeats SET last_updated_at = ? WHERE id = 'own'`, time.Now().UTC().Add(-time.Hour).Format(storedTimeFormat)); err != nil {
+		t.Fatal(err)
+	}
+
+	runNotifier(t)
+	if ids := perID.ids(); len(ids) != 1 || ids[0] != "own" {
+		t.Fatalf("expected own to be notified at its alert_url, got %v", ids)
+	}
+	if ids := global.ids(); len(ids) != 1 || ids[0] != "shared" {
+		t.Fatalf("expected shared to fall back to --expiry-webhook-url, got %v", ids)
+	}
+}
+
+func TestAlertURLKeptWhenOmitted(t *testing.T) {
+	setupTest(t)
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker?alert_url=https://hooks.example.com/a", ""), http.StatusNoContent)
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+
+	var alertURL sql.NullString
+	if err := db.QueryRow(`SELECT alert_url FROM heartbeats WHERE id = 'worker'`).Scan(&alertURL); err != nil {
+		t.Fatal(err)
+	}
+	if alertURL.String != "https://hooks.example.com/a" {
+		t.Fatalf("expected the alert_url to be kept, got %+v", alertURL)
+	}
+}
+
+func TestInvalidAlertURL(t *testing.T) {
+	setupTest(t)
+
+	for _, v := range []string{"hooks.example.com", "ftp://hooks.example.com", "/relative"} {
+		expectError(t, serve(internalRouter(), http.MethodPut, "/worker?alert_url="+v, ""), http.StatusBadRequest, "invalid_alert_url")
+	}
+}
+
+func TestNoWebhookSkipsHeartbeat(t *testing.T) {
+	setupTest(t)
+	insertExpired(t, "worker")
+
+	if notified := runNotifier(t); len(notified) != 0 {
+		t.Fatalf("expected nothing to be notified without a URL, got %v", notified)
+	}
+}
+
+func TestExpiryNotifiedOnce(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	lastUpdatedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	insertHeartbeat(t, "worker", lastUpdatedAt.Format(storedTimeFormat), sql.NullInt64{Int64: 60, Valid: true})
+
+	for range 3 {
+		runNotifier(t)
+	}
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if len(hook.received) != 1 {
+		t.Fatalf("expected exactly one notification, got %d", len(hook.received))
+	}
+	n := hook.received[0]
+	if n.Namespace != defaultNamespace || n.ID != "worker" || !n.LastUpdatedAt.Equal(lastUpdatedAt) || !n.ExpiredAt.Equal(lastUpdatedAt.Add(time.Minute)) {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+}
+
+func TestExpiryNotifiedAgainAfterRecovery(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	c := useFakeClock(t, time.Now())
+	h := internalRouter()
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker?ttl=1m", ""), http.StatusNoContent)
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 0 {
+		t.Fatalf("expected a live heartbeat not to be notified, got %v", ids)
+	}
+
+	c.Advance(2 * time.Minute)
+	runNotifier(t)
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 1 {
+		t.Fatalf("expected one notification for the first expiry, got %v", ids)
+	}
+
+	expectStatus(t, serve(h, http.MethodPut, "/worker", ""), http.StatusNoContent)
+	runNotifier(t)
+	c.Advance(2 * time.Minute)
+	runNotifier(t)
+	runNotifier(t)
+	if ids := hook.ids(); len(ids) != 2 {
+		t.Fatalf("expected one more notification for the second expiry, got %v", ids)
+	}
+}
+
+// flakyWebhook is an httptest.Server failing the first fail POSTs with
+// 502 and taking the rest.
+type flakyWebhook struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fail     int
+	attempts int
+}
+
+func newFlakyWebhook(t *testing.T, fail int) *flakyWebhook {
+	t.Helper()
+	hook := &flakyWebhook{fail: fail}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		hook.attempts++
+		if hook.attempts <= hook.fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(hook.Close)
+	return hook
+}
+
+func (hook *flakyWebhook) attempted() int {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	return hook.attempts
+}
+
+// failNotifier runs a single pass of the expiry notifier expecting a failed
+// delivery.
+func failNotifier(t *testing.T) {
+	t.Helper()
+	if _, err := notifyExpired(context.Background(), http.DefaultClient, slog.Default()); err == nil {
+		t.Fatal("expected the failed delivery to be reported")
+	}
+}
+
+func TestFailedExpiryNotificationRetried(t *testing.T) {
+	hook := newFlakyWebhook(t, 2)
+	setupTest(t, "--expiry-webhook-url", hook.URL, "--webhook-retry-backoff", "30s")
+	c := useFakeClock(t, time.Now())
+	insertExpired(t, "worker")
+
+	failNotifier(t)
+	if notified := runNotifier(t); len(notified) != 0 || hook.attempted() != 1 {
+		t.Fatalf("expected no retry before the backoff passed, got %v after %d attempts", notified, hook.attempted())
+	}
+	c.Advance(30 * time.Second)
+	failNotifier(t)
+
+	// The backoff doubles after the second failure.
+	c.Advance(30 * time.Second)
+	if notified := runNotifier(t); len(notified) != 0 || hook.attempted() != 2 {
+		t.Fatalf("expected no retry before the doubled backoff passed, got %v after %d attempts", notified, hook.attempted())
+	}
+	c.Advance(30 * time.Second)
+	if notified := runNotifier(t); len(notified) != 1 || notified[0].ID != "worker" {
+		t.Fatalf("expected the notification to be retried until delivered, got %v", notified)
+	}
+	c.Advance(time.Hour)
+	if notified := runNotifier(t); len(notified) != 0 {
+		t.Fatalf("expected no further notifications once delivered, got %v", notified)
+	}
+	if hook.attempted() != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", hook.attempted())
+	}
+}
+
+func TestFailedExpiryNotificationDeadLettered(t *testing.T) {
+	hook := newFlakyWebhook(t, 100)
+	setupTest(t, "--expiry-webhook-url", hook.URL, "--webhook-max-attempts", "3", "--webhook-retry-backoff", "1s")
+	c := useFakeClock(t, time.Now())
+	insertExpired(t, "worker")
+	before := counterValue(t, "webhook_dead_letters_total")
+
+	for range 3 {
+		failNotifier(t)
+		c.Advance(time.Minute)
+	}
+	for range 3 {
+		runNotifier(t)
+		c.Advance(time.Hour)
+	}
+	if hook.attempted() != 3 {
+		t.Fatalf("expected delivery to stop after 3 attempts, got %d", hook.attempted())
+	}
+	if got := counterValue(t, "webhook_dead_letters_total") - before; got != 1 {
+		t.Fatalf("expected one dead letter to be counted, got %v", got)
+	}
+
+	var (
+		attempts  int
+		lastError string
+		dead      sql.NullString
+	)
+	err := db.QueryRow(`SELECT attempts, last_error, dead_lettered_at FROM webhook_deliveries`).Scan(&attempts, &lastError, &dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || lastError != "webhook responded with 502 Bad Gateway" || !dead.Valid {
+		t.Fatalf("expected the delivery to be kept as a dead letter, got %d, %q, %+v", attempts, lastError, dead)
+	}
+	// The expiry stays notified, a dead letter isn't queued again.
+	if expired, err := store.ExpiredUnnotified(context.Background(), heartbeatNow()); err != nil || len(expired) != 0 {
+		t.Fatalf("expected the dead-lettered expiry to stay notified, got %+v, %v", expired, err)
+	}
+}
+
+func TestQueuedNotificationSurvivesRestart(t *testing.T) {
+	hook := newFlakyWebhook(t, 1)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	c := useFakeClock(t, time.Now())
+	insertExpired(t, "worker")
+	failNotifier(t)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if db, err = openDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	store = newSQLiteStore(db)
+	c.Advance(time.Minute)
+	if notified := runNotifier(t); len(notified) != 1 || notified[0].ID != "worker" {
+		t.Fatalf("expected the queued notification to be delivered after the restart, got %v", notified)
+	}
+	if hook.attempted() != 2 {
+		t.Fatalf("expected the notification to be retried once, got %d attempts", hook.attempted())
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	cf.WebhookRetryBackoff = 30 * time.Second
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour,
+		50: time.Hour,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("%d attempts: expected %v, got %v", attempts, want, got)
+		}
+	}
+}
+
+func TestWebhookRetryFlagsValidated(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--webhook-max-attempts", "0"}, "--webhook-max-attempts must be positive"},
+		{[]string{"--webhook-retry-backoff", "0s"}, "--webhook-retry-backoff must be positive"},
+	} {
+		err := runUntilSignal(t, tc.args...)
+		if err == nil || err.Error() != tc.want {
+			t.Fatalf("%v: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestSlowWebhookTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+	setupTest(t, "--expiry-webhook-url", hook.URL)
+	insertExpired(t, "worker")
+
+	started := time.Now()
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := notifyExpired(context.Background(), client, slog.Default()); err == nil {
+		t.Fatal("expected the slow webhook to time out")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected the client timeout to bound the delivery, took %v", elapsed)
+	}
+}
+
+// digestRecorder is an httptest.Server collecting the expiry digests POSTed
+// to it, failing the first fail of them.
+type digestRecorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fail     int
+	attempts int
+	received []ExpiryDigest
+}
+
+func newDigestRecorder(t *testing.T, fail int) *digestRecorder {
+	t.Helper()
+	rec := &digestRecorder{fail: fail}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.attempts++
+		if rec.attempts <= rec.fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var d ExpiryDigest
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			t.Errorf("failed to decode digest: %v", err)
+		}
+		rec.received = append(rec.received, d)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// digestIDs returns the ids of each digest received.
+func (rec *digestRecorder) digestIDs() [][]string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	digests := [][]string{}
+	for _, d := range rec.received {
+		ids := []string{}
+		for _, n := range d.Expired {
+			ids = append(ids, n.ID)
+		}
+		digests = append(digests, ids)
+	}
+	return digests
+}
+
+func TestAlertDigest(t *testing.T) {
+	global := newDigestRecorder(t, 0)
+	perID := newDigestRecorder(t, 0)
+	setupTest(t, "--expiry-webhook-url", global.URL, "--alert-digest")
+	for _, id := range []string{"a", "b", "c"} {
+		insertExpired(t, id)
+	}
+	insertExpired(t, "own")
+	if _, err := db.Exec(`UPDATE heartbeats SET alert_url = ? WHERE id = 'own'`, perID.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if notified := runNotifier(t); len(notified) != 4 {
+		t.Fatalf("expected every expired heartbeat to be notified, got %v", notified)
+	}
+	if digests := global.digestIDs(); !slices.EqualFunc(digests, [][]string{{"a", "b", "c"}}, slices.Equal[[]string]) {
+		t.Fatalf("expected one digest of a, b and c at --expiry-webhook-url, got %v", digests)
+	}
+	if digests := perID.digestIDs(); !slices.EqualFunc(digests, [][]string{{"own"}}, slices.Equal[[]string]) {
+		t.Fatalf("expected own in a digest of its own at its alert_url, got %v", digests)
+	}
+
+	if notified := runNotifier(t); len(notified) != 0 {
+		t.Fatalf("expected no further digests once delivered, got %v", notified)
+	}
+	insertExpired(t, "d")
+	runNotifier(t)
+	if digests := global.digestIDs(); len(digests) != 2 || !slices.Equal(digests[1], []string{"d"}) {
+		t.Fatalf("expected the next check to send only the new expiry, got %v", digests)
+	}
+}
+
+func TestFailedAlertDigestRetried(t *testing.T) {
+	hook := newDigestRecorder(t, 1)
+	setupTest(t, "--expiry-webhook-url", hook.URL, "--alert-digest")
+	c := useFakeClock(t, time.Now())
+	insertExpired(t, "a")
+	insertExpired(t, "b")
+
+	failNotifier(t)
+	c.Advance(time.Minute)
+	if notified := runNotifier(t); len(notified) != 2 {
+		t.Fatalf("expected the whole digest to be retried, got %v", notified)
+	}
+	if digests := hook.digestIDs(); !slices.EqualFunc(digests, [][]string{{"a", "b"}}, slices.Equal[[]string]) {
+		t.Fatalf("expected one delivered digest of a and b, got %v", digests)
+	}
+}